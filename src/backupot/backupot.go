@@ -195,7 +195,11 @@ func main() {
                 fmt.Println(err.Error())
                 panic(err.Error())
             }
-            s := server.NewTeapotServer(config)
+            s, err := server.NewTeapotServer(config)
+            if err != nil {
+                fmt.Println(err.Error())
+                panic(err.Error())
+            }
             fmt.Println("Starting server...")
             server.StartServer(s)
         }
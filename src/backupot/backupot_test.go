@@ -41,7 +41,7 @@ func (s *RealSuite) SetUpSuite(c *C) {
     }()
     s.dir = c.MkDir()
     s.config, _ = conf.LoadFromFile("teapot.config")
-    s.server = server.NewTeapotServer(s.config)
+    s.server, _ = server.NewTeapotServer(s.config)
     server.AsyncStartServer(s.server)
 }
 
@@ -56,7 +56,9 @@ func (s *S) SetUpTest(c *C) {
     s.dir = c.MkDir()
     s.filename = s.dir + "/output.txt"
     s.config = conf.LoadTest(s.dir, 0)
-    s.server = server.NewTeapotServer(s.config)
+    var err error
+    s.server, err = server.NewTeapotServer(s.config)
+    c.Assert(err, IsNil)
     server.AsyncStartServer(s.server)
 }
 
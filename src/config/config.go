@@ -67,6 +67,13 @@ func generate() {
     }
     encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
     nodeInfo := conf.GenerateNodeInfo(nodeId, ipPort, encodedPubKey)
+    // Objects are private, peers read our bucket with these credentials.
+    // They should only be allowed to get and list objects of our bucket.
+    nodeInfo.ReadAccessKey = os.Getenv("TEAPOT_READ_ACCESS_KEY")
+    nodeInfo.ReadSecretKey = os.Getenv("TEAPOT_READ_SECRET_KEY")
+    if nodeInfo.ReadAccessKey == "" {
+        fmt.Println("TEAPOT_READ_ACCESS_KEY not set, other nodes will not be able to read your bucket directly.")
+    }
     config := conf.GenerateConfig(nodeInfo, passphrase, auth.AccessKey, auth.SecretKey, encodedPriKey)
     conf.WriteConfigFile(config, "teapot.config")
     conf.WriteNodeInfoFile(nodeInfo, "teapot.pub."+nodeId)
@@ -0,0 +1,459 @@
+package adaptor
+
+import (
+    "container/list"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "hash"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "teapot/utility"
+)
+
+const cachedAdaptorDebug utility.Debug = true
+
+/*
+   Whether the object under key is named after its content, i.e. key is
+   an encoded SHA-256 hash. Only such objects never change and may be
+   cached; e.g. <nodeId>.manifest may not.
+*/
+func isContentAddressed(key string) bool {
+    buf, err := base64.URLEncoding.DecodeString(key)
+    return err == nil && len(buf) == sha256.Size
+}
+
+type CacheStats struct {
+    Hits    int64
+    Misses  int64
+    Objects int
+    Size    int64
+}
+
+type cacheEntry struct {
+    name string
+    size int64
+}
+
+/*
+   A size bounded directory of immutable objects, evicting the least
+   recently used ones. Object k of bucket b is the file <dir>/b/k.
+*/
+type diskCache struct {
+    dir     string
+    limit   int64
+    lock    *sync.Mutex
+    size    int64
+    lru     *list.List
+    entries map[string]*list.Element
+    hits    int64
+    misses  int64
+}
+
+// All adaptors caching in the same directory share one index.
+var diskCaches = make(map[string]*diskCache)
+var diskCachesLock sync.Mutex
+
+func sharedDiskCache(dir string, limit int64) *diskCache {
+    dir = filepath.Clean(dir)
+    diskCachesLock.Lock()
+    defer diskCachesLock.Unlock()
+    if cache, ok := diskCaches[dir]; ok {
+        return cache
+    }
+    cache := newDiskCache(dir, limit)
+    diskCaches[dir] = cache
+    return cache
+}
+
+func newDiskCache(dir string, limit int64) *diskCache {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        cachedAdaptorDebug.Panicf("Unable to create cache directory %v: %v", dir, err)
+    }
+    cache := &diskCache{
+        dir,
+        limit,
+        new(sync.Mutex),
+        0,
+        list.New(),
+        make(map[string]*list.Element),
+        0,
+        0,
+    }
+    cache.load()
+    return cache
+}
+
+// Index what previous runs left, the most recently modified first.
+func (cache *diskCache) load() {
+    infos := make([]os.FileInfo, 0)
+    names := make(map[os.FileInfo]string)
+    filepath.Walk(cache.dir, func(filename string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return nil
+        }
+        if strings.HasPrefix(info.Name(), ".tmp_") {
+            os.Remove(filename)
+            return nil
+        }
+        name, err := filepath.Rel(cache.dir, filename)
+        if err != nil {
+            return nil
+        }
+        infos = append(infos, info)
+        names[info] = name
+        return nil
+    })
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].ModTime().After(infos[j].ModTime())
+    })
+    for _, info := range infos {
+        cache.entries[names[info]] = cache.lru.PushBack(&cacheEntry{names[info], info.Size()})
+        cache.size += info.Size()
+    }
+    cache.evict()
+}
+
+// The file name of an object, or "" if it can't be cached.
+func cacheName(bucketName, key string) string {
+    if !isContentAddressed(key) || bucketName == "" || bucketName == "." || bucketName == ".." || strings.ContainsAny(bucketName, "/\\") {
+        return ""
+    }
+    return bucketName + string(filepath.Separator) + key
+}
+
+// A verified copy of the object, or nil.
+func (cache *diskCache) get(bucketName, key string) []byte {
+    name := cacheName(bucketName, key)
+    if name == "" {
+        return nil
+    }
+    cache.lock.Lock()
+    element, ok := cache.entries[name]
+    if ok {
+        cache.lru.MoveToFront(element)
+    }
+    cache.lock.Unlock()
+    if ok {
+        value, err := ioutil.ReadFile(filepath.Join(cache.dir, name))
+        if err == nil && verify(key, value) {
+            cache.count(true)
+            return value
+        }
+        cachedAdaptorDebug.Debugf("Dropping cached copy of %v: %v", name, err)
+        cache.remove(bucketName, key)
+    }
+    cache.count(false)
+    return nil
+}
+
+/*
+   The cached copy of the object, opened, or nil. Only the SHA-256 of the
+   content is checked, the whole copy is never held in memory.
+*/
+func (cache *diskCache) open(bucketName, key string) *os.File {
+    name := cacheName(bucketName, key)
+    cache.lock.Lock()
+    element, ok := cache.entries[name]
+    if ok {
+        cache.lru.MoveToFront(element)
+    }
+    cache.lock.Unlock()
+    if !ok {
+        cache.count(false)
+        return nil
+    }
+    file, err := os.Open(filepath.Join(cache.dir, name))
+    if err == nil {
+        hash := sha256.New()
+        if _, err = io.Copy(hash, file); err == nil && base64.URLEncoding.EncodeToString(hash.Sum(nil)) != key {
+            err = errors.New("Hash doesn't match.")
+        }
+        if err == nil {
+            _, err = file.Seek(0, 0)
+        }
+        if err != nil {
+            file.Close()
+        }
+    }
+    if err != nil {
+        cachedAdaptorDebug.Debugf("Dropping cached copy of %v: %v", name, err)
+        cache.remove(bucketName, key)
+        cache.count(false)
+        return nil
+    }
+    cache.count(true)
+    return file
+}
+
+/*
+   Wrap rc so that what is read is written to a temporary file as well,
+   which is added to the cache once rc is read to the end and the
+   content matches its hash.
+*/
+func (cache *diskCache) filler(bucketName, key string, rc io.ReadCloser) io.ReadCloser {
+    filename := filepath.Join(cache.dir, cacheName(bucketName, key))
+    if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+        cachedAdaptorDebug.Error(err)
+        return rc
+    }
+    file, err := ioutil.TempFile(filepath.Dir(filename), ".tmp_"+key)
+    if err != nil {
+        cachedAdaptorDebug.Error(err)
+        return rc
+    }
+    return &cacheFiller{rc, cache, bucketName, key, file, sha256.New(), 0}
+}
+
+type cacheFiller struct {
+    io.ReadCloser
+    cache      *diskCache
+    bucketName string
+    key        string
+    // nil once the copy is given up or cached.
+    file *os.File
+    hash hash.Hash
+    size int64
+}
+
+func (filler *cacheFiller) Read(p []byte) (int, error) {
+    n, err := filler.ReadCloser.Read(p)
+    if n > 0 && filler.file != nil {
+        filler.hash.Write(p[:n])
+        filler.size += int64(n)
+        if _, writeErr := filler.file.Write(p[:n]); writeErr != nil || filler.size > filler.cache.limit {
+            filler.discard()
+        }
+    }
+    if err == io.EOF && filler.file != nil {
+        filler.commit()
+    }
+    return n, err
+}
+
+func (filler *cacheFiller) Close() error {
+    if filler.file != nil {
+        filler.discard()
+    }
+    return filler.ReadCloser.Close()
+}
+
+func (filler *cacheFiller) discard() {
+    filler.file.Close()
+    os.Remove(filler.file.Name())
+    filler.file = nil
+}
+
+func (filler *cacheFiller) commit() {
+    if base64.URLEncoding.EncodeToString(filler.hash.Sum(nil)) != filler.key {
+        filler.discard()
+        return
+    }
+    file := filler.file
+    filler.file = nil
+    if err := file.Close(); err != nil {
+        os.Remove(file.Name())
+        cachedAdaptorDebug.Error(err)
+        return
+    }
+    filler.cache.add(filler.bucketName, filler.key, file.Name(), filler.size)
+}
+
+func (cache *diskCache) count(hit bool) {
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    if hit {
+        cache.hits++
+    } else {
+        cache.misses++
+    }
+}
+
+// Keep a verified copy of the object, unless it doesn't fit.
+func (cache *diskCache) put(bucketName, key string, value []byte) {
+    name := cacheName(bucketName, key)
+    if name == "" || int64(len(value)) > cache.limit || !verify(key, value) {
+        return
+    }
+    filename := filepath.Join(cache.dir, name)
+    if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+        cachedAdaptorDebug.Error(err)
+        return
+    }
+    file, err := ioutil.TempFile(filepath.Dir(filename), ".tmp_"+key)
+    if err != nil {
+        cachedAdaptorDebug.Error(err)
+        return
+    }
+    _, err = file.Write(value)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(file.Name())
+        cachedAdaptorDebug.Error(err)
+        return
+    }
+    cache.add(bucketName, key, file.Name(), int64(len(value)))
+}
+
+// Move the complete temporary file tempName into the cache.
+func (cache *diskCache) add(bucketName, key, tempName string, size int64) {
+    name := cacheName(bucketName, key)
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    if err := os.Rename(tempName, filepath.Join(cache.dir, name)); err != nil {
+        os.Remove(tempName)
+        cachedAdaptorDebug.Error(err)
+        return
+    }
+    if element, ok := cache.entries[name]; ok {
+        cache.size -= element.Value.(*cacheEntry).size
+        cache.lru.Remove(element)
+    }
+    cache.entries[name] = cache.lru.PushFront(&cacheEntry{name, size})
+    cache.size += size
+    cache.evict()
+}
+
+func (cache *diskCache) remove(bucketName, key string) {
+    name := cacheName(bucketName, key)
+    if name == "" {
+        return
+    }
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    if element, ok := cache.entries[name]; ok {
+        cache.drop(element)
+    }
+}
+
+// Drop the least recently used objects until the cache fits.
+func (cache *diskCache) evict() {
+    for cache.size > cache.limit && cache.lru.Len() > 0 {
+        cache.drop(cache.lru.Back())
+    }
+}
+
+func (cache *diskCache) drop(element *list.Element) {
+    entry := element.Value.(*cacheEntry)
+    if err := os.Remove(filepath.Join(cache.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+        cachedAdaptorDebug.Error(err)
+    }
+    cache.lru.Remove(element)
+    delete(cache.entries, entry.name)
+    cache.size -= entry.size
+}
+
+func (cache *diskCache) stats() CacheStats {
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    return CacheStats{cache.hits, cache.misses, cache.lru.Len(), cache.size}
+}
+
+/*
+   An adaptor serving reads of content addressed objects from a local
+   disk cache and filling it from the underlying adaptor.
+   Everything else goes straight to the underlying adaptor.
+*/
+type CachedAdaptor struct {
+    Adaptor
+    cache        *diskCache
+    myBucketName string
+}
+
+/*
+   Cache reads of theAdaptor in dir, holding at most limit bytes.
+   Adaptors caching in the same directory share the cache.
+*/
+func NewCachedAdaptor(theAdaptor Adaptor, dir string, limit int64, myBucketName string) *CachedAdaptor {
+    return &CachedAdaptor{theAdaptor, sharedDiskCache(dir, limit), myBucketName}
+}
+
+func (adaptor *CachedAdaptor) GetText(key string) (string, error) {
+    return adaptor.GetTextFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *CachedAdaptor) GetBinary(key string) ([]byte, error) {
+    return adaptor.GetBinaryFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *CachedAdaptor) GetTextFrom(path, key string) (string, error) {
+    value, err := adaptor.GetBinaryFrom(path, key)
+    if err != nil {
+        return "", err
+    }
+    return string(value), nil
+}
+
+func (adaptor *CachedAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    if value := adaptor.cache.get(path, key); value != nil {
+        return value, nil
+    }
+    value, err := adaptor.Adaptor.GetBinaryFrom(path, key)
+    if err != nil {
+        return nil, err
+    }
+    adaptor.cache.put(path, key, value)
+    return value, nil
+}
+
+func (adaptor *CachedAdaptor) GetReader(key string) (io.ReadCloser, error) {
+    return adaptor.GetReaderFrom(adaptor.myBucketName, key)
+}
+
+/*
+   Stream content addressed objects, which may be too large to be held
+   in memory. A cached copy is checked against its hash before it is
+   handed out, and a fetched copy is cached as it is read.
+*/
+func (adaptor *CachedAdaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
+    if cacheName(path, key) == "" {
+        return adaptor.Adaptor.GetReaderFrom(path, key)
+    }
+    if file := adaptor.cache.open(path, key); file != nil {
+        return file, nil
+    }
+    rc, err := adaptor.Adaptor.GetReaderFrom(path, key)
+    if err != nil {
+        return nil, err
+    }
+    return adaptor.cache.filler(path, key, rc), nil
+}
+
+func (adaptor *CachedAdaptor) PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    return adaptor.PutMultipartTo(adaptor.myBucketName, key, r, uploadId, started)
+}
+
+// Nothing is cached on upload, only on download.
+func (adaptor *CachedAdaptor) PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    if multipart, ok := adaptor.Adaptor.(MultipartAdaptor); ok {
+        return multipart.PutMultipartTo(path, key, r, uploadId, started)
+    }
+    length, err := r.Seek(0, 2)
+    if err == nil {
+        _, err = r.Seek(0, 0)
+    }
+    if err != nil {
+        return cachedAdaptorDebug.Error(err)
+    }
+    return adaptor.Adaptor.PutReaderTo(path, key, r, length, "binary/octet-stream")
+}
+
+func (adaptor *CachedAdaptor) Delete(key string) error {
+    return adaptor.DeleteFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *CachedAdaptor) DeleteFrom(path, key string) error {
+    adaptor.cache.remove(path, key)
+    return adaptor.Adaptor.DeleteFrom(path, key)
+}
+
+func (adaptor *CachedAdaptor) Stats() CacheStats {
+    return adaptor.cache.stats()
+}
@@ -0,0 +1,126 @@
+package adaptor
+
+import (
+    "bytes"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "os"
+    "path/filepath"
+    "sync"
+    "teapot/utility"
+)
+
+type CachedSuite struct {
+    dir string
+}
+
+var _ = Suite(&CachedSuite{})
+
+func (s *CachedSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    RegisterVerifier(func(key string, value []byte) bool {
+        return !isContentAddressed(key) || utility.GetHashOfBytesAndEncode(value) == key
+    })
+}
+
+func (s *CachedSuite) TearDownTest(c *C) {
+    RegisterVerifier(func(key string, value []byte) bool {
+        return true
+    })
+}
+
+func (s *CachedSuite) TestReadThrough(c *C) {
+    fsAdaptor := NewFSAdaptor(s.dir+"/remote", testBucket)
+    broken := &brokenAdaptor{fsAdaptor, new(sync.Mutex), false}
+    cached := NewCachedAdaptor(broken, s.dir+"/cache", 1<<20, testBucket)
+    value := []byte("an immutable value")
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(cached.PutBinary(key, value), IsNil)
+    c.Assert(cached.PutText("node.latestUpdate", "1"), IsNil)
+
+    got, err := cached.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, value)
+    // Served from the cache while remote storage is down.
+    broken.setBroken(true)
+    got, err = cached.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, value)
+    _, err = cached.GetText("node.latestUpdate")
+    c.Assert(err, NotNil)
+    stats := cached.Stats()
+    c.Assert(stats.Hits, Equals, int64(1))
+    c.Assert(stats.Objects, Equals, 1)
+
+    // A corrupted copy is dropped and fetched again.
+    c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "cache", testBucket, key), []byte("garbage"), 0600), IsNil)
+    broken.setBroken(false)
+    got, err = cached.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, value)
+
+    c.Assert(cached.Delete(key), IsNil)
+    _, err = os.Stat(filepath.Join(s.dir, "cache", testBucket, key))
+    c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CachedSuite) TestEviction(c *C) {
+    fsAdaptor := NewFSAdaptor(s.dir+"/remote", testBucket)
+    cached := NewCachedAdaptor(fsAdaptor, s.dir+"/cache", 100, testBucket)
+    keys := make([]string, 3)
+    for i := range keys {
+        value := make([]byte, 40)
+        value[0] = byte(i)
+        keys[i] = utility.GetHashOfBytesAndEncode(value)
+        c.Assert(cached.PutBinary(keys[i], value), IsNil)
+        _, err := cached.GetBinary(keys[i])
+        c.Assert(err, IsNil)
+    }
+    stats := cached.Stats()
+    c.Assert(stats.Objects, Equals, 2)
+    c.Assert(stats.Size, Equals, int64(80))
+    _, err := os.Stat(filepath.Join(s.dir, "cache", testBucket, keys[0]))
+    c.Assert(os.IsNotExist(err), Equals, true)
+
+    // Another adaptor on the same directory shares the cache.
+    other := NewCachedAdaptor(fsAdaptor, s.dir+"/cache", 100, testBucket)
+    _, err = other.GetBinary(keys[2])
+    c.Assert(err, IsNil)
+    c.Assert(other.Stats().Hits, Equals, int64(1))
+}
+
+func (s *CachedSuite) TestStreaming(c *C) {
+    fsAdaptor := NewFSAdaptor(s.dir+"/remote", testBucket)
+    broken := &brokenAdaptor{fsAdaptor, new(sync.Mutex), false}
+    cached := NewCachedAdaptor(broken, s.dir+"/cache", 1<<20, testBucket)
+    value := []byte("a value streamed through the cache")
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(PutFile(cached, key, bytes.NewReader(value), int64(len(value)), "", nil), IsNil)
+
+    rc, err := cached.GetReader(key)
+    c.Assert(err, IsNil)
+    got, err := ioutil.ReadAll(rc)
+    c.Assert(err, IsNil)
+    c.Assert(rc.Close(), IsNil)
+    c.Assert(got, DeepEquals, value)
+    c.Assert(cached.Stats().Objects, Equals, 1)
+
+    c.Assert(fsAdaptor.Delete(key), IsNil)
+    rc, err = cached.GetReader(key)
+    c.Assert(err, IsNil)
+    got, err = ioutil.ReadAll(rc)
+    c.Assert(err, IsNil)
+    rc.Close()
+    c.Assert(got, DeepEquals, value)
+    c.Assert(cached.Stats().Hits, Equals, int64(1))
+
+    // A copy read only in part is not cached.
+    other := []byte("another value")
+    otherKey := utility.GetHashOfBytesAndEncode(other)
+    c.Assert(fsAdaptor.PutBinary(otherKey, other), IsNil)
+    rc, err = cached.GetReader(otherKey)
+    c.Assert(err, IsNil)
+    rc.Read(make([]byte, 3))
+    rc.Close()
+    c.Assert(cached.Stats().Objects, Equals, 1)
+}
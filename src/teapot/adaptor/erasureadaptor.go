@@ -0,0 +1,709 @@
+package adaptor
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "teapot/conf"
+    "teapot/utility"
+)
+
+const erasureAdaptorDebug utility.Debug = true
+
+// Every shard starts with the size of the whole object.
+const shardHeaderSize = 8
+
+// Bytes of every shard encoded at a time when storing an object.
+const stripeSize = 1 << 20
+
+/*
+   An adaptor cutting every object into data and parity shards with a
+   Reed-Solomon code, so that any dataShards of them rebuild it.
+   Shard i of bucket b is stored as bucket "b-i" of store i mod len(stores),
+   under the key of the object. Losing a store is survived as long as it
+   holds at most parityShards shards.
+*/
+type ErasureAdaptor struct {
+    stores       []Adaptor
+    codec        *utility.ReedSolomon
+    myBucketName string
+}
+
+func NewErasureAdaptor(stores []Adaptor, dataShards, parityShards int, myBucketName string) (*ErasureAdaptor, error) {
+    if len(stores) == 0 {
+        return nil, erasureAdaptorDebug.Error(errors.New("No shard store."))
+    }
+    codec, err := utility.NewReedSolomon(dataShards, parityShards)
+    if err != nil {
+        return nil, erasureAdaptorDebug.Error(err)
+    }
+    return &ErasureAdaptor{stores, codec, myBucketName}, nil
+}
+
+/*
+   The adaptor values should be stored with: theAdaptor itself, unless
+   ValueShards asks for erasure coding.
+*/
+func NewValueAdaptor(config *conf.Config, myBucketName string, theAdaptor Adaptor) (Adaptor, error) {
+    if len(config.ValueShards) == 0 {
+        return theAdaptor, nil
+    }
+    stores := make([]Adaptor, 0, len(config.ValueShards))
+    for _, spec := range config.ValueShards {
+        store, err := NewFromSpec(config, spec, myBucketName)
+        if err != nil {
+            return nil, erasureAdaptorDebug.Error(err)
+        }
+        stores = append(stores, store)
+    }
+    erasureAdaptor, err := NewErasureAdaptor(stores, config.ErasureDataShards, config.ErasureParityShards, myBucketName)
+    if err != nil {
+        return nil, err
+    }
+    return withCache(config, erasureAdaptor, myBucketName), nil
+}
+
+func (adaptor *ErasureAdaptor) store(i int) Adaptor {
+    return adaptor.stores[i%len(adaptor.stores)]
+}
+
+func shardBucket(path string, i int) string {
+    return path + "-" + strconv.Itoa(i)
+}
+
+func (adaptor *ErasureAdaptor) PutText(key, value string) error {
+    return adaptor.PutTextTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *ErasureAdaptor) PutBinary(key string, value []byte) error {
+    return adaptor.PutBinaryTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *ErasureAdaptor) PutTextTo(path, key, value string) error {
+    return adaptor.PutBinaryTo(path, key, []byte(value))
+}
+
+func (adaptor *ErasureAdaptor) PutBinaryTo(path, key string, value []byte) error {
+    return adaptor.putShards(path, key, bytes.NewReader(value), int64(len(value)), nil)
+}
+
+func (adaptor *ErasureAdaptor) PutReader(key string, r io.Reader, length int64, contType string) error {
+    return adaptor.PutReaderTo(adaptor.myBucketName, key, r, length, contType)
+}
+
+// Every shard reads the content at its own pace, so it is spooled first.
+func (adaptor *ErasureAdaptor) PutReaderTo(path, key string, r io.Reader, length int64, contType string) error {
+    file, err := spool(r, length)
+    if err != nil {
+        return erasureAdaptorDebug.Error(err)
+    }
+    defer dropSpool(file)
+    return adaptor.putShards(path, key, file, length, nil)
+}
+
+func (adaptor *ErasureAdaptor) PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    return adaptor.PutMultipartTo(adaptor.myBucketName, key, r, uploadId, started)
+}
+
+// Shards larger than MultipartThreshold are uploaded in parts if their store can.
+func (adaptor *ErasureAdaptor) PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    length, err := r.Seek(0, 2)
+    if err != nil {
+        return erasureAdaptorDebug.Error(err)
+    }
+    return adaptor.putShards(path, key, r, length, newUploadIdSet(uploadId, started))
+}
+
+/*
+   Store all shards at once, each encoded from r as its store reads it.
+   The write fails unless every shard is stored, so that the caller
+   retries while the object is not fully redundant yet.
+*/
+func (adaptor *ErasureAdaptor) putShards(path, key string, r io.ReaderAt, length int64, uploads *uploadIdSet) error {
+    total := adaptor.codec.TotalShards()
+    errs := make(chan error, total)
+    for i := 0; i < total; i++ {
+        go func(i int) {
+            shard := newShardReader(adaptor.codec, r, length, i)
+            store := adaptor.store(i)
+            if multipart, ok := store.(MultipartAdaptor); ok && uploads != nil && shard.Size() > MultipartThreshold {
+                errs <- multipart.PutMultipartTo(shardBucket(path, i), key, shard, uploads.get(i), uploads.starter(i))
+                return
+            }
+            errs <- store.PutReaderTo(shardBucket(path, i), key, shard, shard.Size(), "binary/octet-stream")
+        }(i)
+    }
+    var lastErr error
+    for i := 0; i < total; i++ {
+        if err := <-errs; err != nil {
+            lastErr = err
+        }
+    }
+    if lastErr != nil {
+        return erasureAdaptorDebug.Error(lastErr)
+    }
+    return nil
+}
+
+/*
+   Shard index of the length bytes of r, header included, as stored by
+   putShards. It is encoded stripeSize bytes at a time as it is read, the
+   same bytes ReedSolomon.Split and Encode give for the whole object.
+   Read by one upload at a time.
+*/
+type shardReader struct {
+    codec     *utility.ReedSolomon
+    r         io.ReaderAt
+    length    int64
+    index     int
+    shardSize int64
+    // The stripe encoded last.
+    stripe      []byte
+    stripeStart int64
+}
+
+// Size of every shard of an object of length bytes, header left out.
+func shardSizeOf(length int64, dataShards int) int64 {
+    shardSize := (length + int64(dataShards) - 1) / int64(dataShards)
+    if shardSize == 0 {
+        shardSize = 1
+    }
+    return shardSize
+}
+
+func newShardReader(codec *utility.ReedSolomon, r io.ReaderAt, length int64, index int) *io.SectionReader {
+    shardSize := shardSizeOf(length, codec.DataShards())
+    sr := &shardReader{codec, r, length, index, shardSize, nil, -1}
+    return io.NewSectionReader(sr, 0, shardHeaderSize+shardSize)
+}
+
+func (sr *shardReader) ReadAt(p []byte, off int64) (int, error) {
+    n := 0
+    for n < len(p) && off < shardHeaderSize+sr.shardSize {
+        var piece []byte
+        if off < shardHeaderSize {
+            header := make([]byte, shardHeaderSize)
+            binary.BigEndian.PutUint64(header, uint64(sr.length))
+            piece = header[off:]
+        } else {
+            position := off - shardHeaderSize
+            start := position / stripeSize * stripeSize
+            if err := sr.encode(start); err != nil {
+                return n, err
+            }
+            piece = sr.stripe[position-start:]
+        }
+        copied := copy(p[n:], piece)
+        n += copied
+        off += int64(copied)
+    }
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// Encode the stripe of the shard from offset start.
+func (sr *shardReader) encode(start int64) error {
+    if sr.stripeStart == start {
+        return nil
+    }
+    size := sr.shardSize - start
+    if size > stripeSize {
+        size = stripeSize
+    }
+    if sr.index < sr.codec.DataShards() {
+        data, err := sr.readData(sr.index, start, size)
+        if err != nil {
+            return err
+        }
+        sr.stripe, sr.stripeStart = data, start
+        return nil
+    }
+    shards := make([][]byte, sr.codec.TotalShards())
+    for i := range shards {
+        if i < sr.codec.DataShards() {
+            data, err := sr.readData(i, start, size)
+            if err != nil {
+                return err
+            }
+            shards[i] = data
+        } else {
+            shards[i] = make([]byte, size)
+        }
+    }
+    if err := sr.codec.Encode(shards); err != nil {
+        return err
+    }
+    sr.stripe, sr.stripeStart = shards[sr.index], start
+    return nil
+}
+
+// size bytes of data shard i from offset start, zero padded past the end.
+func (sr *shardReader) readData(i int, start, size int64) ([]byte, error) {
+    data := make([]byte, size)
+    from := int64(i)*sr.shardSize + start
+    if from >= sr.length {
+        return data, nil
+    }
+    available := sr.length - from
+    if available > size {
+        available = size
+    }
+    if n, err := sr.r.ReadAt(data[:available], from); int64(n) < available {
+        if err == nil {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return data, nil
+}
+
+func (adaptor *ErasureAdaptor) GetText(key string) (string, error) {
+    return adaptor.GetTextFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ErasureAdaptor) GetBinary(key string) ([]byte, error) {
+    return adaptor.GetBinaryFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ErasureAdaptor) GetTextFrom(path, key string) (string, error) {
+    value, err := adaptor.GetBinaryFrom(path, key)
+    if err != nil {
+        return "", err
+    }
+    return string(value), nil
+}
+
+type shardResult struct {
+    index   int
+    payload []byte
+    err     error
+}
+
+/*
+   Fetch all shards, rebuild the object from those that agree on its
+   size and verify it. If the result is corrupted, leave out one shard
+   at a time in case a single shard is to blame.
+*/
+func (adaptor *ErasureAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    total := adaptor.codec.TotalShards()
+    results := make(chan shardResult, total)
+    for i := 0; i < total; i++ {
+        go func(i int) {
+            payload, err := adaptor.store(i).GetBinaryFrom(shardBucket(path, i), key)
+            results <- shardResult{i, payload, err}
+        }(i)
+    }
+    payloads := make([][]byte, total)
+    var lastErr error
+    for i := 0; i < total; i++ {
+        result := <-results
+        if result.err == nil && len(result.payload) < shardHeaderSize {
+            result.err = newError(Permanent, errors.New(fmt.Sprintf("Shard %v of %v is too short.", result.index, key)))
+        }
+        if result.err != nil {
+            if lastErr == nil || Classify(result.err) != NotFound {
+                lastErr = result.err
+            }
+            continue
+        }
+        payloads[result.index] = result.payload
+    }
+    size, shards := adaptor.consistentShards(payloads)
+    present := 0
+    for _, shard := range shards {
+        if shard != nil {
+            present++
+        }
+    }
+    if present < adaptor.codec.DataShards() {
+        if lastErr == nil {
+            lastErr = newError(Permanent, errors.New("Too few consistent shards."))
+        }
+        return nil, erasureAdaptorDebug.Error(newError(Classify(lastErr), errors.New(fmt.Sprintf("Only %v shards of %v are available: %v", present, key, lastErr))))
+    }
+    if value, err := adaptor.decode(shards, size, -1); err == nil && verify(key, value) {
+        return value, nil
+    }
+    if present > adaptor.codec.DataShards() {
+        for i := range shards {
+            if shards[i] == nil {
+                continue
+            }
+            if value, err := adaptor.decode(shards, size, i); err == nil && verify(key, value) {
+                erasureAdaptorDebug.Debugf("Shard %v of %v is corrupted.", i, key)
+                return value, nil
+            }
+        }
+    }
+    return nil, erasureAdaptorDebug.Error(newError(Permanent, errors.New(fmt.Sprintf("Unable to rebuild a verified copy of %v.", key))))
+}
+
+/*
+   Strip the headers and keep the shards agreeing with the most common
+   object size, the others are treated as missing.
+*/
+func (adaptor *ErasureAdaptor) consistentShards(payloads [][]byte) (int, [][]byte) {
+    votes := make(map[uint64]int)
+    var size uint64
+    for _, payload := range payloads {
+        if payload == nil {
+            continue
+        }
+        s := binary.BigEndian.Uint64(payload)
+        votes[s]++
+        if votes[s] > votes[size] || (votes[s] == votes[size] && s < size) {
+            size = s
+        }
+    }
+    shards := make([][]byte, len(payloads))
+    shardSize := -1
+    for i, payload := range payloads {
+        if payload == nil || binary.BigEndian.Uint64(payload) != size {
+            continue
+        }
+        shard := payload[shardHeaderSize:]
+        if shardSize == -1 {
+            shardSize = len(shard)
+        }
+        if len(shard) == shardSize {
+            shards[i] = shard
+        }
+    }
+    return int(size), shards
+}
+
+// Rebuild the object without touching shards, leaving out shard skip.
+func (adaptor *ErasureAdaptor) decode(shards [][]byte, size int, skip int) ([]byte, error) {
+    work := make([][]byte, len(shards))
+    copy(work, shards)
+    if skip >= 0 {
+        work[skip] = nil
+    }
+    if err := adaptor.codec.Reconstruct(work); err != nil {
+        return nil, err
+    }
+    return adaptor.codec.Join(work, size)
+}
+
+func (adaptor *ErasureAdaptor) GetReader(key string) (io.ReadCloser, error) {
+    return adaptor.GetReaderFrom(adaptor.myBucketName, key)
+}
+
+/*
+   Stream the object one data shard after the other, checked as it is
+   read. A data shard that cannot be read is rebuilt a stripe at a time
+   from others. A corrupted shard fails the read at its end, GetBinaryFrom
+   rebuilds around it.
+*/
+func (adaptor *ErasureAdaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
+    var lastErr error
+    for i := 0; i < adaptor.codec.TotalShards(); i++ {
+        rc, size, err := adaptor.openShard(path, key, i)
+        if err != nil {
+            if lastErr == nil || Classify(err) != NotFound {
+                lastErr = err
+            }
+            continue
+        }
+        stream := &shardStream{adaptor, path, key, size, shardSizeOf(size, adaptor.codec.DataShards()), 0, nil}
+        if i == 0 {
+            stream.current = &exactReader{rc, stream.part(0)}
+        } else {
+            rc.Close()
+            stream.index = -1
+        }
+        return newVerifyingReader(key, stream, nil), nil
+    }
+    return nil, erasureAdaptorDebug.Error(lastErr)
+}
+
+// Shard i of key, read past its header, and the object size it tells.
+func (adaptor *ErasureAdaptor) openShard(path, key string, i int) (io.ReadCloser, int64, error) {
+    rc, err := adaptor.store(i).GetReaderFrom(shardBucket(path, i), key)
+    if err != nil {
+        return nil, 0, err
+    }
+    header := make([]byte, shardHeaderSize)
+    if _, err := io.ReadFull(rc, header); err != nil {
+        rc.Close()
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            err = newError(Permanent, errors.New(fmt.Sprintf("Shard %v of %v is too short.", i, key)))
+        }
+        return nil, 0, err
+    }
+    return rc, int64(binary.BigEndian.Uint64(header)), nil
+}
+
+/*
+   The object read from its data shards in order, current reading data
+   shard index. Past the data shards, or past the end of the object, it
+   is at its end.
+*/
+type shardStream struct {
+    adaptor   *ErasureAdaptor
+    path      string
+    key       string
+    size      int64
+    shardSize int64
+    index     int
+    current   io.ReadCloser
+}
+
+// Bytes of the object held by data shard i, the padding left out.
+func (stream *shardStream) part(i int) int64 {
+    part := stream.size - int64(i)*stream.shardSize
+    if part > stream.shardSize {
+        part = stream.shardSize
+    }
+    if part < 0 {
+        part = 0
+    }
+    return part
+}
+
+func (stream *shardStream) Read(p []byte) (int, error) {
+    for {
+        if stream.current == nil {
+            if stream.index+1 >= stream.adaptor.codec.DataShards() || stream.part(stream.index+1) == 0 {
+                return 0, io.EOF
+            }
+            stream.index++
+            current, err := stream.open(stream.index)
+            if err != nil {
+                return 0, err
+            }
+            stream.current = current
+        }
+        n, err := stream.current.Read(p)
+        if err == io.EOF {
+            stream.current.Close()
+            stream.current = nil
+            if n == 0 {
+                continue
+            }
+            err = nil
+        }
+        return n, err
+    }
+}
+
+func (stream *shardStream) Close() error {
+    if stream.current == nil {
+        return nil
+    }
+    err := stream.current.Close()
+    stream.current = nil
+    return err
+}
+
+// Data shard i as stored, or else rebuilt from the others.
+func (stream *shardStream) open(i int) (io.ReadCloser, error) {
+    rc, size, err := stream.adaptor.openShard(stream.path, stream.key, i)
+    if err == nil && size == stream.size {
+        return &exactReader{rc, stream.part(i)}, nil
+    }
+    if err == nil {
+        rc.Close()
+        err = newError(Permanent, errors.New(fmt.Sprintf("Shard %v of %v disagrees on its size.", i, stream.key)))
+    }
+    erasureAdaptorDebug.Debugf("Rebuilding shard %v of %v: %v", i, stream.key, err)
+    return stream.rebuild(i)
+}
+
+/*
+   Open dataShards shards other than i agreeing on the object size, to
+   rebuild shard i from.
+*/
+func (stream *shardStream) rebuild(i int) (io.ReadCloser, error) {
+    codec := stream.adaptor.codec
+    sources := make([]io.ReadCloser, codec.TotalShards())
+    opened := 0
+    var lastErr error = newError(Permanent, errors.New("Too few consistent shards."))
+    for j := 0; j < codec.TotalShards() && opened < codec.DataShards(); j++ {
+        if j == i {
+            continue
+        }
+        rc, size, err := stream.adaptor.openShard(stream.path, stream.key, j)
+        if err == nil && size != stream.size {
+            rc.Close()
+            continue
+        }
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        sources[j] = rc
+        opened++
+    }
+    rebuilt := &rebuiltShard{codec, sources, i, stream.shardSize, 0, nil}
+    if opened < codec.DataShards() {
+        rebuilt.Close()
+        return nil, erasureAdaptorDebug.Error(newError(Classify(lastErr), errors.New(fmt.Sprintf("Unable to rebuild shard %v of %v: %v", i, stream.key, lastErr))))
+    }
+    return &exactReader{rebuilt, stream.part(i)}, nil
+}
+
+/*
+   Shard index rebuilt a stripe at a time from the shards read by
+   sources, nil for those not read.
+*/
+type rebuiltShard struct {
+    codec     *utility.ReedSolomon
+    sources   []io.ReadCloser
+    index     int
+    shardSize int64
+    // Offset in the shard of what stripe does not hold.
+    offset int64
+    stripe []byte
+}
+
+func (rebuilt *rebuiltShard) Read(p []byte) (int, error) {
+    if len(rebuilt.stripe) == 0 {
+        if rebuilt.offset >= rebuilt.shardSize {
+            return 0, io.EOF
+        }
+        size := rebuilt.shardSize - rebuilt.offset
+        if size > stripeSize {
+            size = stripeSize
+        }
+        shards := make([][]byte, rebuilt.codec.TotalShards())
+        for j, source := range rebuilt.sources {
+            if source == nil {
+                continue
+            }
+            shards[j] = make([]byte, size)
+            if _, err := io.ReadFull(source, shards[j]); err != nil {
+                return 0, err
+            }
+        }
+        if err := rebuilt.codec.Reconstruct(shards); err != nil {
+            return 0, err
+        }
+        rebuilt.stripe = shards[rebuilt.index]
+        rebuilt.offset += size
+    }
+    n := copy(p, rebuilt.stripe)
+    rebuilt.stripe = rebuilt.stripe[n:]
+    return n, nil
+}
+
+func (rebuilt *rebuiltShard) Close() error {
+    var lastErr error
+    for _, source := range rebuilt.sources {
+        if source != nil {
+            if err := source.Close(); err != nil {
+                lastErr = err
+            }
+        }
+    }
+    return lastErr
+}
+
+// Exactly remaining bytes of rc, an error if it ends sooner.
+type exactReader struct {
+    io.ReadCloser
+    remaining int64
+}
+
+func (reader *exactReader) Read(p []byte) (int, error) {
+    if reader.remaining <= 0 {
+        return 0, io.EOF
+    }
+    if int64(len(p)) > reader.remaining {
+        p = p[:reader.remaining]
+    }
+    n, err := reader.ReadCloser.Read(p)
+    reader.remaining -= int64(n)
+    if err == io.EOF && reader.remaining > 0 {
+        err = io.ErrUnexpectedEOF
+    } else if err == io.EOF {
+        err = nil
+    }
+    return n, err
+}
+
+func (adaptor *ErasureAdaptor) Delete(key string) error {
+    return adaptor.DeleteFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ErasureAdaptor) DeleteFrom(path, key string) error {
+    var lastErr error
+    for i := 0; i < adaptor.codec.TotalShards(); i++ {
+        if err := adaptor.store(i).DeleteFrom(shardBucket(path, i), key); err != nil {
+            lastErr = err
+        }
+    }
+    if lastErr != nil {
+        return erasureAdaptorDebug.Error(lastErr)
+    }
+    return nil
+}
+
+func (adaptor *ErasureAdaptor) Head(key string) (*ObjectInfo, error) {
+    return adaptor.HeadFrom(adaptor.myBucketName, key)
+}
+
+/*
+   The object exists if enough shards do. Its size is read from the
+   header of a shard, the ETag is unknown without rebuilding it.
+*/
+func (adaptor *ErasureAdaptor) HeadFrom(path, key string) (*ObjectInfo, error) {
+    present := 0
+    var lastErr error = ErrNotFound
+    var size int64 = -1
+    for i := 0; i < adaptor.codec.TotalShards() && present < adaptor.codec.DataShards(); i++ {
+        _, err := adaptor.store(i).HeadFrom(shardBucket(path, i), key)
+        if err != nil {
+            if err != ErrNotFound {
+                lastErr = err
+            }
+            continue
+        }
+        present++
+        if size < 0 {
+            if rc, shardSize, err := adaptor.openShard(path, key, i); err == nil {
+                rc.Close()
+                size = shardSize
+            }
+        }
+    }
+    if present < adaptor.codec.DataShards() {
+        return nil, lastErr
+    }
+    if size < 0 {
+        return nil, erasureAdaptorDebug.Error(newError(Transient, errors.New("Unable to read the size of "+key)))
+    }
+    return &ObjectInfo{key, size, ""}, nil
+}
+
+func (adaptor *ErasureAdaptor) List(prefix, marker string, max int) (*ListResult, error) {
+    return adaptor.ListFrom(adaptor.myBucketName, prefix, marker, max)
+}
+
+/*
+   Merge the listings of the first parityShards+1 shard buckets: an object
+   missing from all of them could not be rebuilt anyway. Sizes and ETags
+   are those of the shards.
+*/
+func (adaptor *ErasureAdaptor) ListFrom(path, prefix, marker string, max int) (*ListResult, error) {
+    count := adaptor.codec.TotalShards() - adaptor.codec.DataShards() + 1
+    results := make([]*ListResult, 0, count)
+    var lastErr error
+    for i := 0; i < count; i++ {
+        result, err := adaptor.store(i).ListFrom(shardBucket(path, i), prefix, marker, max)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        results = append(results, result)
+    }
+    if len(results) == 0 {
+        return nil, erasureAdaptorDebug.Error(lastErr)
+    }
+    return mergeListings(results, max), nil
+}
@@ -0,0 +1,164 @@
+package adaptor
+
+import (
+    "bytes"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "strconv"
+    "sync"
+    "teapot/utility"
+)
+
+type ErasureSuite struct {
+    dir string
+}
+
+var _ = Suite(&ErasureSuite{})
+
+func (s *ErasureSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    RegisterVerifier(func(key string, value []byte) bool {
+        return utility.GetHashOfBytesAndEncode(value) == key
+    })
+}
+
+func (s *ErasureSuite) TearDownTest(c *C) {
+    RegisterVerifier(func(key string, value []byte) bool {
+        return true
+    })
+}
+
+func (s *ErasureSuite) newStores(n int) ([]*FSAdaptor, []*brokenAdaptor, []Adaptor) {
+    fsAdaptors := make([]*FSAdaptor, n)
+    brokenAdaptors := make([]*brokenAdaptor, n)
+    adaptors := make([]Adaptor, n)
+    for i := 0; i < n; i++ {
+        fsAdaptors[i] = NewFSAdaptor(s.dir+"/store"+strconv.Itoa(i), testBucket)
+        brokenAdaptors[i] = &brokenAdaptor{fsAdaptors[i], new(sync.Mutex), false}
+        adaptors[i] = brokenAdaptors[i]
+    }
+    return fsAdaptors, brokenAdaptors, adaptors
+}
+
+func (s *ErasureSuite) TestLostStore(c *C) {
+    fsAdaptors, brokenAdaptors, adaptors := s.newStores(3)
+    erasure, err := NewErasureAdaptor(adaptors, 4, 2, testBucket)
+    c.Assert(err, IsNil)
+    value := []byte("a value which does not fit into a single shard")
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(erasure.PutBinary(key, value), IsNil)
+    // Every store holds two shards, none holds the whole value.
+    _, err = fsAdaptors[0].GetBinaryFrom(testBucket, key)
+    c.Assert(err, NotNil)
+    shard, err := fsAdaptors[0].GetBinaryFrom(shardBucket(testBucket, 3), key)
+    c.Assert(err, IsNil)
+    c.Assert(len(shard) < len(value), Equals, true)
+
+    brokenAdaptors[1].setBroken(true)
+    got, err := erasure.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, value)
+    info, err := erasure.Head(key)
+    c.Assert(err, IsNil)
+    c.Assert(info.Size, Equals, int64(len(value)))
+    result, err := erasure.List("", "", 0)
+    c.Assert(err, IsNil)
+    c.Assert(len(result.Objects), Equals, 1)
+    c.Assert(result.Objects[0].Key, Equals, key)
+
+    // Writes need every shard.
+    c.Assert(erasure.PutBinary("other", value), NotNil)
+    brokenAdaptors[2].setBroken(true)
+    _, err = erasure.GetBinary(key)
+    c.Assert(err, NotNil)
+}
+
+// Values larger than a stripe are encoded as they are uploaded, to the same shards.
+func (s *ErasureSuite) TestStripes(c *C) {
+    fsAdaptors, _, adaptors := s.newStores(3)
+    erasure, err := NewErasureAdaptor(adaptors, 4, 2, testBucket)
+    c.Assert(err, IsNil)
+    value := make([]byte, 5*stripeSize+3)
+    for i := range value {
+        value[i] = byte(i * 7 % 251)
+    }
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(erasure.PutReader(key, bytes.NewReader(value), int64(len(value)), "binary/octet-stream"), IsNil)
+    shards := erasure.codec.Split(value)
+    c.Assert(erasure.codec.Encode(shards), IsNil)
+    for i, shard := range shards {
+        payload, err := fsAdaptors[i%3].GetBinaryFrom(shardBucket(testBucket, i), key)
+        c.Assert(err, IsNil)
+        c.Assert(bytes.Equal(payload[shardHeaderSize:], shard), Equals, true)
+    }
+    got, err := erasure.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(bytes.Equal(got, value), Equals, true)
+
+    c.Assert(erasure.Delete(key), IsNil)
+    c.Assert(erasure.PutMultipart(key, bytes.NewReader(value), "", func(string) error { return nil }), IsNil)
+    got, err = erasure.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(bytes.Equal(got, value), Equals, true)
+}
+
+// Reads are streamed a shard at a time, lost shards rebuilt a stripe at a time.
+func (s *ErasureSuite) TestStreamedRead(c *C) {
+    fsAdaptors, brokenAdaptors, adaptors := s.newStores(3)
+    for i := range adaptors {
+        adaptors[i] = &streamOnlyAdaptor{adaptors[i]}
+    }
+    erasure, err := NewErasureAdaptor(adaptors, 4, 2, testBucket)
+    c.Assert(err, IsNil)
+    value := make([]byte, 5*stripeSize+3)
+    for i := range value {
+        value[i] = byte(i * 7 % 251)
+    }
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(erasure.PutReader(key, bytes.NewReader(value), int64(len(value)), "binary/octet-stream"), IsNil)
+    read := func() ([]byte, error) {
+        rc, err := erasure.GetReader(key)
+        if err != nil {
+            return nil, err
+        }
+        defer rc.Close()
+        return ioutil.ReadAll(rc)
+    }
+    got, err := read()
+    c.Assert(err, IsNil)
+    c.Assert(bytes.Equal(got, value), Equals, true)
+
+    // Shards 0 and 3 are gone with the first store.
+    brokenAdaptors[0].setBroken(true)
+    got, err = read()
+    c.Assert(err, IsNil)
+    c.Assert(bytes.Equal(got, value), Equals, true)
+    brokenAdaptors[0].setBroken(false)
+
+    shard, err := fsAdaptors[1].GetBinaryFrom(shardBucket(testBucket, 1), key)
+    c.Assert(err, IsNil)
+    shard[shardHeaderSize+stripeSize+1] ^= 0xff
+    c.Assert(fsAdaptors[1].PutBinaryTo(shardBucket(testBucket, 1), key, shard), IsNil)
+    _, err = read()
+    c.Assert(err, ErrorMatches, "Read a corrupted copy of .*")
+}
+
+func (s *ErasureSuite) TestCorruptedShard(c *C) {
+    fsAdaptors, _, adaptors := s.newStores(3)
+    erasure, err := NewErasureAdaptor(adaptors, 2, 1, testBucket)
+    c.Assert(err, IsNil)
+    value := []byte("some value to be corrupted")
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(erasure.PutBinary(key, value), IsNil)
+    shard, err := fsAdaptors[0].GetBinaryFrom(shardBucket(testBucket, 0), key)
+    c.Assert(err, IsNil)
+    shard[shardHeaderSize] ^= 0xff
+    c.Assert(fsAdaptors[0].PutBinaryTo(shardBucket(testBucket, 0), key, shard), IsNil)
+    got, err := erasure.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, value)
+
+    c.Assert(erasure.Delete(key), IsNil)
+    _, err = erasure.Head(key)
+    c.Assert(err, Equals, ErrNotFound)
+}
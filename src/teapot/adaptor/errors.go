@@ -0,0 +1,102 @@
+package adaptor
+
+import (
+    "launchpad.net/goamz/s3"
+    "os"
+    "teapot/utility"
+)
+
+const errorsDebug utility.Debug = true
+
+/*
+   How a failed storage request should be handled by the caller.
+   Transient failures may succeed when retried, the others won't
+   until somebody fixes the data, the credentials or the configuration.
+*/
+type ErrorKind int
+
+const (
+    Transient ErrorKind = iota
+    NotFound
+    Auth
+    Permanent
+)
+
+func (kind ErrorKind) String() string {
+    switch kind {
+    case Transient:
+        return "transient"
+    case NotFound:
+        return "not found"
+    case Auth:
+        return "auth"
+    case Permanent:
+        return "permanent"
+    }
+    return "unknown"
+}
+
+/*
+   An error whose kind is already known by the adaptor.
+*/
+type Error struct {
+    Kind ErrorKind
+    Err  error
+}
+
+func (err *Error) Error() string {
+    return err.Err.Error()
+}
+
+func newError(kind ErrorKind, err error) *Error {
+    return &Error{kind, err}
+}
+
+/*
+   Tell what kind of failure err is.
+   Errors we know nothing about, e.g. network errors, are transient.
+*/
+func Classify(err error) ErrorKind {
+    if err == ErrNotFound {
+        return NotFound
+    }
+    switch e := err.(type) {
+    case *Error:
+        return e.Kind
+    case *s3.Error:
+        return classifyS3Error(e)
+    case *os.PathError:
+        if os.IsNotExist(e) {
+            return NotFound
+        }
+        if os.IsPermission(e) {
+            return Auth
+        }
+    }
+    return Transient
+}
+
+func classifyS3Error(err *s3.Error) ErrorKind {
+    switch err.Code {
+    case "NoSuchKey", "NoSuchBucket":
+        return NotFound
+    case "InvalidAccessKeyId", "SignatureDoesNotMatch", "AccessDenied",
+        "AccountProblem", "ExpiredToken", "InvalidToken", "InvalidSecurity":
+        return Auth
+    case "RequestTimeout", "SlowDown", "InternalError", "ServiceUnavailable",
+        "RequestTimeTooSkewed", "OperationAborted":
+        return Transient
+    }
+    switch {
+    case err.StatusCode == 401 || err.StatusCode == 403:
+        return Auth
+    case err.StatusCode == 404:
+        return NotFound
+    case err.StatusCode >= 500 || err.StatusCode == 0:
+        return Transient
+    case err.StatusCode >= 400:
+        return Permanent
+    }
+    errorsDebug.Debugf("Unknown S3 error %v: %v", err.Code, err.Message)
+    return Transient
+}
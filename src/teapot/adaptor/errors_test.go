@@ -0,0 +1,30 @@
+package adaptor
+
+import (
+    "errors"
+    "launchpad.net/goamz/s3"
+    . "launchpad.net/gocheck"
+)
+
+type ErrorsSuite struct{}
+
+var _ = Suite(&ErrorsSuite{})
+
+func (s *ErrorsSuite) TestClassify(c *C) {
+    c.Assert(Classify(ErrNotFound), Equals, NotFound)
+    c.Assert(Classify(errors.New("connection refused")), Equals, Transient)
+    c.Assert(Classify(&Error{Permanent, errors.New("bad")}), Equals, Permanent)
+    c.Assert(Classify(&s3.Error{StatusCode: 403, Code: "InvalidAccessKeyId"}), Equals, Auth)
+    c.Assert(Classify(&s3.Error{StatusCode: 404, Code: "NoSuchKey"}), Equals, NotFound)
+    c.Assert(Classify(&s3.Error{StatusCode: 503, Code: "SlowDown"}), Equals, Transient)
+    c.Assert(Classify(&s3.Error{StatusCode: 400, Code: "InvalidBucketName"}), Equals, Permanent)
+    c.Assert(Classify(&s3.Error{StatusCode: 500}), Equals, Transient)
+}
+
+func (s *ErrorsSuite) TestClassifyFS(c *C) {
+    adaptor := NewFSAdaptor(c.MkDir(), testBucket)
+    _, err := adaptor.GetText("missing")
+    c.Assert(Classify(err), Equals, NotFound)
+    err = adaptor.PutText("../escape", testTextValue)
+    c.Assert(Classify(err), Equals, Permanent)
+}
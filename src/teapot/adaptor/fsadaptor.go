@@ -0,0 +1,283 @@
+package adaptor
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/hex"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    path_ "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "teapot/conf"
+    "teapot/utility"
+)
+
+const fsadaptorDebug utility.Debug = true
+
+/*
+   An adaptor backed by a local (or network mounted) directory.
+   Every bucket is a sub directory of rootDir and every key is a file
+   in that sub directory.
+   Writes go to a temporary file which is renamed into place, so a
+   reader never observes a partially written object.
+*/
+type FSAdaptor struct {
+    rootDir      string
+    myBucketName string
+}
+
+func NewFSAdaptor(rootDir, myBucketName string) *FSAdaptor {
+    rootDir = path_.Clean(rootDir)
+    if err := os.MkdirAll(rootDir, 0700); err != nil {
+        fsadaptorDebug.Panicf("Unable to create storage directory %v: %v", rootDir, err)
+    }
+    return &FSAdaptor{
+        rootDir,
+        myBucketName,
+    }
+}
+
+// Build a directory backed adaptor rooted at StorageDir.
+func newFSAdaptorFromConfig(config *conf.Config, myBucketName string) (Adaptor, error) {
+    if config.StorageDir == "" {
+        return nil, fsadaptorDebug.Error(errors.New("Storage directory not set up yet."))
+    }
+    return NewFSAdaptor(config.StorageDir, myBucketName), nil
+}
+
+func (adaptor *FSAdaptor) PutText(key, value string) error {
+    return adaptor.PutTextTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *FSAdaptor) PutBinary(key string, value []byte) error {
+    return adaptor.PutBinaryTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *FSAdaptor) PutTextTo(path, key, value string) error {
+    return adaptor.PutBinaryTo(path, key, []byte(value))
+}
+
+func (adaptor *FSAdaptor) PutBinaryTo(path, key string, value []byte) error {
+    return adaptor.PutReaderTo(path, key, bytes.NewReader(value), int64(len(value)), "binary/octet-stream")
+}
+
+func (adaptor *FSAdaptor) GetText(key string) (string, error) {
+    return adaptor.GetTextFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *FSAdaptor) GetBinary(key string) ([]byte, error) {
+    return adaptor.GetBinaryFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *FSAdaptor) GetTextFrom(path, key string) (string, error) {
+    buf, err := adaptor.GetBinaryFrom(path, key)
+    if err != nil {
+        return "", err
+    }
+    return string(buf), nil
+}
+
+func (adaptor *FSAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    rc, err := adaptor.GetReaderFrom(path, key)
+    if err != nil {
+        return nil, err
+    }
+    defer rc.Close()
+    buf, err := ioutil.ReadAll(rc)
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    return buf, nil
+}
+
+func (adaptor *FSAdaptor) PutReader(key string, r io.Reader, length int64, contType string) error {
+    return adaptor.PutReaderTo(adaptor.myBucketName, key, r, length, contType)
+}
+
+func (adaptor *FSAdaptor) GetReader(key string) (io.ReadCloser, error) {
+    return adaptor.GetReaderFrom(adaptor.myBucketName, key)
+}
+
+// The content type is not stored, every object is just a plain file.
+func (adaptor *FSAdaptor) PutReaderTo(path, key string, r io.Reader, length int64, contType string) error {
+    filename, err := adaptor.objectPath(path, key)
+    if err != nil {
+        return fsadaptorDebug.Error(err)
+    }
+    dir := filepath.Dir(filename)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fsadaptorDebug.Error(err)
+    }
+    file, err := ioutil.TempFile(dir, ".tmp_"+filepath.Base(filename))
+    if err != nil {
+        return fsadaptorDebug.Error(err)
+    }
+    n, err := io.Copy(file, r)
+    if err == nil && n != length {
+        err = errors.New("Object length mismatch: " + key)
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(file.Name(), filename)
+    }
+    if err != nil {
+        os.Remove(file.Name())
+        return fsadaptorDebug.Error(err)
+    }
+    return nil
+}
+
+func (adaptor *FSAdaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
+    filename, err := adaptor.objectPath(path, key)
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    return file, nil
+}
+
+func (adaptor *FSAdaptor) Delete(key string) error {
+    return adaptor.DeleteFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *FSAdaptor) DeleteFrom(path, key string) error {
+    filename, err := adaptor.objectPath(path, key)
+    if err != nil {
+        return fsadaptorDebug.Error(err)
+    }
+    if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+        return fsadaptorDebug.Error(err)
+    }
+    return nil
+}
+
+func (adaptor *FSAdaptor) Head(key string) (*ObjectInfo, error) {
+    return adaptor.HeadFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *FSAdaptor) HeadFrom(path, key string) (*ObjectInfo, error) {
+    filename, err := adaptor.objectPath(path, key)
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    stat, err := os.Stat(filename)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, ErrNotFound
+        }
+        return nil, fsadaptorDebug.Error(err)
+    }
+    if stat.IsDir() {
+        return nil, ErrNotFound
+    }
+    etag, err := fileETag(filename)
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    return &ObjectInfo{key, stat.Size(), etag}, nil
+}
+
+func (adaptor *FSAdaptor) List(prefix, marker string, max int) (*ListResult, error) {
+    return adaptor.ListFrom(adaptor.myBucketName, prefix, marker, max)
+}
+
+/*
+   Walk the bucket directory and return keys in the same order S3 does.
+   Computing the ETag reads every listed file, so keep pages small
+   when the objects are big.
+*/
+func (adaptor *FSAdaptor) ListFrom(path, prefix, marker string, max int) (*ListResult, error) {
+    if max <= 0 {
+        max = DefaultListSize
+    }
+    bucketDir := filepath.Join(adaptor.rootDir, path)
+    if _, err := adaptor.objectPath(path, "key"); err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    keys := make([]string, 0)
+    err := filepath.Walk(bucketDir, func(filename string, info os.FileInfo, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil
+            }
+            return err
+        }
+        if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp_") {
+            return nil
+        }
+        relative, err := filepath.Rel(bucketDir, filename)
+        if err != nil {
+            return err
+        }
+        key := filepath.ToSlash(relative)
+        if strings.HasPrefix(key, prefix) && key > marker {
+            keys = append(keys, key)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, fsadaptorDebug.Error(err)
+    }
+    sort.Strings(keys)
+    result := ListResult{make([]ObjectInfo, 0), "", false}
+    if len(keys) > max {
+        keys = keys[:max]
+        result.Truncated = true
+        result.NextMarker = keys[max-1]
+    }
+    for _, key := range keys {
+        info, err := adaptor.HeadFrom(path, key)
+        if err != nil {
+            if err == ErrNotFound {
+                // Deleted while listing.
+                continue
+            }
+            return nil, err
+        }
+        result.Objects = append(result.Objects, *info)
+    }
+    return &result, nil
+}
+
+func fileETag(filename string) (string, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    hasher := md5.New()
+    if _, err := io.Copy(hasher, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+   Map a bucket and a key to a file name under rootDir.
+   Reject anything that would escape the bucket directory.
+*/
+func (adaptor *FSAdaptor) objectPath(bucketName, key string) (string, error) {
+    if bucketName == "" || strings.ContainsAny(bucketName, "/\\") || bucketName == "." || bucketName == ".." {
+        return "", newError(Permanent, errors.New("Invalid bucket name: "+bucketName))
+    }
+    cleaned := path_.Clean("/" + key)
+    if key == "" || cleaned == "/" || cleaned[1:] != key {
+        return "", newError(Permanent, errors.New("Invalid key: "+key))
+    }
+    if strings.HasPrefix(path_.Base(key), ".tmp_") {
+        return "", newError(Permanent, errors.New("Invalid key: "+key))
+    }
+    return filepath.Join(adaptor.rootDir, bucketName, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,130 @@
+package adaptor
+
+import (
+    "bytes"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+)
+
+type FSSuite struct {
+    dir string
+}
+
+var _ = Suite(&FSSuite{})
+
+func (s *FSSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *FSSuite) TestText(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    err := adaptor.PutText(testKey, testTextValue)
+    c.Assert(err, IsNil)
+    textValue, err := adaptor.GetText(testKey)
+    c.Assert(err, IsNil)
+    c.Assert(textValue, Equals, testTextValue)
+}
+
+func (s *FSSuite) TestBinary(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    err := adaptor.PutBinary(testKey, testBinaryValue)
+    c.Assert(err, IsNil)
+    binaryValue, err := adaptor.GetBinary(testKey)
+    c.Assert(err, IsNil)
+    c.Assert(binaryValue, DeepEquals, testBinaryValue)
+    // Overwrite the existing object.
+    err = adaptor.PutBinary(testKey, []byte("another value"))
+    c.Assert(err, IsNil)
+    binaryValue, err = adaptor.GetBinary(testKey)
+    c.Assert(err, IsNil)
+    c.Assert(string(binaryValue), Equals, "another value")
+}
+
+func (s *FSSuite) TestReader(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    err := adaptor.PutReader(testKey, bytes.NewReader(testBinaryValue), int64(len(testBinaryValue)), "binary/octet-stream")
+    c.Assert(err, IsNil)
+    rc, err := adaptor.GetReader(testKey)
+    c.Assert(err, IsNil)
+    defer rc.Close()
+    buf, err := ioutil.ReadAll(rc)
+    c.Assert(err, IsNil)
+    c.Assert(buf, DeepEquals, testBinaryValue)
+    // A short reader must not leave a truncated object behind.
+    err = adaptor.PutReader("short_key", bytes.NewReader(testBinaryValue), int64(len(testBinaryValue))+1, "binary/octet-stream")
+    c.Assert(err, NotNil)
+    _, err = adaptor.GetBinary("short_key")
+    c.Assert(err, NotNil)
+}
+
+func (s *FSSuite) TestOtherBucket(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    other := NewFSAdaptor(s.dir, "other_bucket")
+    err := other.PutText(testKey, testTextValue)
+    c.Assert(err, IsNil)
+    textValue, err := adaptor.GetTextFrom("other_bucket", testKey)
+    c.Assert(err, IsNil)
+    c.Assert(textValue, Equals, testTextValue)
+    _, err = adaptor.GetText(testKey)
+    c.Assert(err, NotNil)
+}
+
+func (s *FSSuite) TestInvalidKey(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    c.Assert(adaptor.PutText("../escape", testTextValue), NotNil)
+    c.Assert(adaptor.PutTextTo("..", testKey, testTextValue), NotNil)
+    c.Assert(adaptor.PutTextTo("a/b", testKey, testTextValue), NotNil)
+    c.Assert(adaptor.PutText("", testTextValue), NotNil)
+}
+
+func (s *FSSuite) TestDeleteAndHead(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    _, err := adaptor.Head(testKey)
+    c.Assert(err, Equals, ErrNotFound)
+    c.Assert(adaptor.PutBinary(testKey, testBinaryValue), IsNil)
+    info, err := adaptor.Head(testKey)
+    c.Assert(err, IsNil)
+    c.Assert(info.Key, Equals, testKey)
+    c.Assert(info.Size, Equals, int64(len(testBinaryValue)))
+    // MD5 of "hello, world"
+    c.Assert(info.ETag, Equals, "e4d7f1b4ed2e42d15898f4b27b019da4")
+    exists, err := Exists(adaptor, testBucket, testKey)
+    c.Assert(err, IsNil)
+    c.Assert(exists, Equals, true)
+    c.Assert(adaptor.Delete(testKey), IsNil)
+    exists, err = Exists(adaptor, testBucket, testKey)
+    c.Assert(err, IsNil)
+    c.Assert(exists, Equals, false)
+    // Deleting twice is fine.
+    c.Assert(adaptor.Delete(testKey), IsNil)
+}
+
+func (s *FSSuite) TestList(c *C) {
+    adaptor := NewFSAdaptor(s.dir, testBucket)
+    result, err := adaptor.List("", "", 0)
+    c.Assert(err, IsNil)
+    c.Assert(len(result.Objects), Equals, 0)
+    for _, key := range []string{"b", "a", "node.latestUpdate", "c", "dir/d"} {
+        c.Assert(adaptor.PutText(key, key), IsNil)
+    }
+    result, err = adaptor.List("", "", 2)
+    c.Assert(err, IsNil)
+    c.Assert(result.Truncated, Equals, true)
+    c.Assert(len(result.Objects), Equals, 2)
+    c.Assert(result.Objects[0].Key, Equals, "a")
+    c.Assert(result.Objects[1].Key, Equals, "b")
+    result, err = adaptor.List("", result.NextMarker, 2)
+    c.Assert(err, IsNil)
+    c.Assert(result.Truncated, Equals, true)
+    c.Assert(result.Objects[0].Key, Equals, "c")
+    c.Assert(result.Objects[1].Key, Equals, "dir/d")
+    result, err = adaptor.List("", result.NextMarker, 2)
+    c.Assert(err, IsNil)
+    c.Assert(result.Truncated, Equals, false)
+    c.Assert(len(result.Objects), Equals, 1)
+    c.Assert(result.Objects[0].Key, Equals, "node.latestUpdate")
+    objects, err := ListAllFrom(adaptor, testBucket, "node.")
+    c.Assert(err, IsNil)
+    c.Assert(len(objects), Equals, 1)
+    c.Assert(objects[0].Size, Equals, int64(len("node.latestUpdate")))
+}
@@ -0,0 +1,104 @@
+package adaptor
+
+import (
+    "errors"
+    "sort"
+    "strings"
+    "sync"
+    "teapot/conf"
+    "teapot/utility"
+)
+
+const registryDebug utility.Debug = true
+
+/*
+   A Factory builds a new adaptor whose own bucket is myBucketName.
+   Every call must return a fresh instance so that several nodes in the
+   same process never share credentials or buckets.
+*/
+type Factory func(config *conf.Config, myBucketName string) (Adaptor, error)
+
+var factories = make(map[string]Factory)
+var factoriesLock sync.Mutex
+
+// Make a storage backend available under the given name.
+// Registering a name twice replaces the previous factory.
+func Register(name string, factory Factory) {
+    factoriesLock.Lock()
+    defer factoriesLock.Unlock()
+    factories[name] = factory
+}
+
+// Names of all registered backends, sorted.
+func Backends() []string {
+    factoriesLock.Lock()
+    defer factoriesLock.Unlock()
+    names := make([]string, 0, len(factories))
+    for name := range factories {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Create an adaptor of the named backend.
+func NewByName(name string, config *conf.Config, myBucketName string) (Adaptor, error) {
+    factoriesLock.Lock()
+    factory, ok := factories[name]
+    factoriesLock.Unlock()
+    if !ok {
+        return nil, registryDebug.Error(errors.New("Unknown storage backend: " + name))
+    }
+    return factory(config, myBucketName)
+}
+
+// Create an adaptor of the backend chosen by StorageBackend in the configuration.
+func New(config *conf.Config, myBucketName string) (Adaptor, error) {
+    name := config.StorageBackend
+    if name == "" {
+        name = conf.S3Backend
+    }
+    theAdaptor, err := NewByName(name, config, myBucketName)
+    if err != nil {
+        return nil, err
+    }
+    return withCache(config, theAdaptor, myBucketName), nil
+}
+
+// Put the disk cache in front of theAdaptor if CacheDir is set.
+func withCache(config *conf.Config, theAdaptor Adaptor, myBucketName string) Adaptor {
+    if config.CacheDir == "" {
+        return theAdaptor
+    }
+    return NewCachedAdaptor(theAdaptor, config.CacheDir, config.CacheSize, myBucketName)
+}
+
+/*
+   Create an adaptor from a spec like "fs:/mnt/teapot", "s3:us-west-1"
+   or "s3:http://127.0.0.1:9000", see conf.ParseReplica.
+   The rest of the configuration is taken from config.
+*/
+func NewFromSpec(config *conf.Config, spec string, myBucketName string) (Adaptor, error) {
+    backend, argument := conf.ParseReplica(spec)
+    specConfig := *config
+    specConfig.StorageBackend = backend
+    switch backend {
+    case conf.FSBackend:
+        specConfig.StorageDir = argument
+    case conf.S3Backend:
+        if strings.Contains(argument, "://") {
+            specConfig.S3Endpoint = argument
+        } else if argument != "" {
+            specConfig.S3Region = argument
+        }
+    case conf.ReplicatedBackend:
+        return nil, registryDebug.Error(errors.New("Cannot nest replicated storage: " + spec))
+    }
+    return NewByName(backend, &specConfig, myBucketName)
+}
+
+func init() {
+    Register(conf.S3Backend, newS3AdaptorFromConfig)
+    Register(conf.FSBackend, newFSAdaptorFromConfig)
+    Register(conf.ReplicatedBackend, newReplicatedAdaptorFromConfig)
+}
@@ -0,0 +1,60 @@
+package adaptor
+
+import (
+    "errors"
+    . "launchpad.net/gocheck"
+    "teapot/conf"
+)
+
+type RegistrySuite struct {
+    dir string
+}
+
+var _ = Suite(&RegistrySuite{})
+
+func (s *RegistrySuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *RegistrySuite) TestBuiltinBackends(c *C) {
+    names := make(map[string]bool)
+    for _, name := range Backends() {
+        names[name] = true
+    }
+    c.Assert(names[conf.FSBackend], Equals, true)
+    c.Assert(names[conf.S3Backend], Equals, true)
+}
+
+func (s *RegistrySuite) TestNewFromConfig(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    config.StorageBackend = conf.FSBackend
+    config.StorageDir = s.dir + "/storage"
+    adaptor, err := New(config, config.MyBucketName)
+    c.Assert(err, IsNil)
+    _, ok := adaptor.(*FSAdaptor)
+    c.Assert(ok, Equals, true)
+    config.StorageBackend = "no_such_backend"
+    _, err = New(config, config.MyBucketName)
+    c.Assert(err, ErrorMatches, "Unknown storage backend.*")
+}
+
+// Every node gets its own adaptor, even in the same process.
+func (s *RegistrySuite) TestNoSharedInstance(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    adaptor0, err := New(configs[0], configs[0].MyBucketName)
+    c.Assert(err, IsNil)
+    adaptor1, err := New(configs[1], configs[1].MyBucketName)
+    c.Assert(err, IsNil)
+    c.Assert(adaptor0.(*S3Adaptor).myBucketName, Equals, configs[0].MyBucketName)
+    c.Assert(adaptor1.(*S3Adaptor).myBucketName, Equals, configs[1].MyBucketName)
+}
+
+func (s *RegistrySuite) TestRegister(c *C) {
+    Register("broken", func(config *conf.Config, myBucketName string) (Adaptor, error) {
+        return nil, errors.New("broken backend")
+    })
+    config := conf.LoadTest(s.dir, 0)
+    config.StorageBackend = "broken"
+    _, err := New(config, config.MyBucketName)
+    c.Assert(err, ErrorMatches, "broken backend")
+}
@@ -0,0 +1,565 @@
+package adaptor
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "io/ioutil"
+    "os"
+    "sync"
+    "teapot/conf"
+    "teapot/utility"
+    "time"
+)
+
+const replicatedAdaptorDebug utility.Debug = true
+
+const (
+    // Repairs waiting for the background worker; more are dropped.
+    repairQueueSize = 1000
+    // A repair is given up after this many failed attempts.
+    maxRepairAttempts = 10
+    // Consecutive failures before a replica is considered unhealthy.
+    replicaBreakerThreshold = 3
+    replicaBreakerCooldown  = 30 * time.Second
+    // Streamed objects up to this size are held for the verifier.
+    verifyHoldLimit = 1 << 20
+)
+
+/*
+   Tell whether value is really the object stored under key.
+   Most keys are hashes of the content, but only the log knows how a
+   log entry is hashed, so it registers the verifier used by replicated
+   storage.
+*/
+type Verifier func(key string, value []byte) bool
+
+var verifier Verifier = func(key string, value []byte) bool {
+    return true
+}
+var verifierLock sync.Mutex
+
+func RegisterVerifier(v Verifier) {
+    verifierLock.Lock()
+    defer verifierLock.Unlock()
+    verifier = v
+}
+
+func verify(key string, value []byte) bool {
+    verifierLock.Lock()
+    v := verifier
+    verifierLock.Unlock()
+    return v(key, value)
+}
+
+// Whether key is the SHA-256 of the content, as for values.
+func namedAfterContent(key string) bool {
+    buf, err := base64.URLEncoding.DecodeString(key)
+    return err == nil && len(buf) == sha256.Size
+}
+
+/*
+   Check what is read through it against key once read to the end,
+   hashing the content as it goes by, see cacheFiller. Objects not named
+   after their content are held for the verifier while they are small,
+   larger ones are not checked. checked, if any, gets the outcome.
+*/
+type verifyingReader struct {
+    io.ReadCloser
+    key     string
+    hash    hash.Hash
+    held    []byte
+    large   bool
+    checked func(ok bool)
+}
+
+func newVerifyingReader(key string, rc io.ReadCloser, checked func(ok bool)) *verifyingReader {
+    return &verifyingReader{rc, key, sha256.New(), make([]byte, 0), false, checked}
+}
+
+func (reader *verifyingReader) Read(p []byte) (int, error) {
+    n, err := reader.ReadCloser.Read(p)
+    reader.hash.Write(p[:n])
+    if !reader.large {
+        if len(reader.held)+n > verifyHoldLimit {
+            reader.held, reader.large = nil, true
+        } else {
+            reader.held = append(reader.held, p[:n]...)
+        }
+    }
+    if err != io.EOF {
+        return n, err
+    }
+    ok := base64.URLEncoding.EncodeToString(reader.hash.Sum(nil)) == reader.key
+    if !ok && !reader.large {
+        ok = verify(reader.key, reader.held)
+    } else if !ok {
+        ok = !namedAfterContent(reader.key)
+    }
+    if reader.checked != nil {
+        reader.checked(ok)
+        reader.checked = nil
+    }
+    if !ok {
+        return n, newError(Permanent, errors.New(fmt.Sprintf("Read a corrupted copy of %v.", reader.key)))
+    }
+    return n, err
+}
+
+type replica struct {
+    adaptor Adaptor
+    breaker *utility.CircuitBreaker
+}
+
+/*
+   Bring the lagging replicas of one object up to date.
+   If deleted is set, the object is removed from them instead.
+*/
+type repairTask struct {
+    path     string
+    key      string
+    lagging  []int
+    deleted  bool
+    attempts int
+}
+
+/*
+   An adaptor storing every object on several underlying adaptors.
+   A write succeeds once writeQuorum replicas have stored it; the other
+   replicas are repaired in the background. Reads are served by the first
+   healthy replica that returns a verified copy.
+*/
+type ReplicatedAdaptor struct {
+    replicas     []*replica
+    writeQuorum  int
+    myBucketName string
+    repairs      chan *repairTask
+}
+
+func NewReplicatedAdaptor(adaptors []Adaptor, writeQuorum int, myBucketName string) *ReplicatedAdaptor {
+    if writeQuorum < 1 || writeQuorum > len(adaptors) {
+        replicatedAdaptorDebug.Panicf("Invalid write quorum %v of %v replicas.", writeQuorum, len(adaptors))
+    }
+    replicas := make([]*replica, len(adaptors))
+    for i, adaptor := range adaptors {
+        replicas[i] = &replica{
+            adaptor,
+            utility.NewCircuitBreaker(replicaBreakerThreshold, replicaBreakerCooldown),
+        }
+    }
+    adaptor := &ReplicatedAdaptor{
+        replicas,
+        writeQuorum,
+        myBucketName,
+        make(chan *repairTask, repairQueueSize),
+    }
+    go adaptor.repairLoop()
+    return adaptor
+}
+
+// Build every replica listed in Replicas with its own backend.
+func newReplicatedAdaptorFromConfig(config *conf.Config, myBucketName string) (Adaptor, error) {
+    if len(config.Replicas) == 0 {
+        return nil, replicatedAdaptorDebug.Error(errors.New("Replicas not set up yet."))
+    }
+    adaptors := make([]Adaptor, 0, len(config.Replicas))
+    for _, spec := range config.Replicas {
+        adaptor, err := NewFromSpec(config, spec, myBucketName)
+        if err != nil {
+            return nil, replicatedAdaptorDebug.Error(err)
+        }
+        adaptors = append(adaptors, adaptor)
+    }
+    writeQuorum := config.WriteQuorum
+    if writeQuorum == 0 {
+        writeQuorum = len(adaptors)/2 + 1
+    }
+    if writeQuorum > len(adaptors) {
+        return nil, replicatedAdaptorDebug.Error(errors.New("Write quorum is larger than the number of replicas."))
+    }
+    return NewReplicatedAdaptor(adaptors, writeQuorum, myBucketName), nil
+}
+
+func (adaptor *ReplicatedAdaptor) PutText(key, value string) error {
+    return adaptor.PutTextTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *ReplicatedAdaptor) PutBinary(key string, value []byte) error {
+    return adaptor.PutBinaryTo(adaptor.myBucketName, key, value)
+}
+
+func (adaptor *ReplicatedAdaptor) PutTextTo(path, key, value string) error {
+    return adaptor.PutBinaryTo(path, key, []byte(value))
+}
+
+func (adaptor *ReplicatedAdaptor) PutBinaryTo(path, key string, value []byte) error {
+    return adaptor.PutReaderTo(path, key, bytes.NewReader(value), int64(len(value)), "binary/octet-stream")
+}
+
+func (adaptor *ReplicatedAdaptor) PutReader(key string, r io.Reader, length int64, contType string) error {
+    return adaptor.PutReaderTo(adaptor.myBucketName, key, r, length, contType)
+}
+
+/*
+   The content is spooled to a temporary file, every replica reads its
+   own section of it. The file goes once the last replica is done.
+*/
+func (adaptor *ReplicatedAdaptor) PutReaderTo(path, key string, r io.Reader, length int64, contType string) error {
+    file, err := spool(r, length)
+    if err != nil {
+        return replicatedAdaptorDebug.Error(err)
+    }
+    return adaptor.write(path, key, false, func(i int, replica Adaptor) error {
+        return replica.PutReaderTo(path, key, io.NewSectionReader(file, 0, length), length, contType)
+    }, func() {
+        dropSpool(file)
+    })
+}
+
+func (adaptor *ReplicatedAdaptor) PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    return adaptor.PutMultipartTo(adaptor.myBucketName, key, r, uploadId, started)
+}
+
+/*
+   Replicas uploading in parts do so, the others get the object in one
+   request. uploadId holds the upload of every replica. r belongs to the
+   caller, so this waits for every replica instead of a quorum.
+*/
+func (adaptor *ReplicatedAdaptor) PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    length, err := r.Seek(0, 2)
+    if err != nil {
+        return replicatedAdaptorDebug.Error(err)
+    }
+    uploads := newUploadIdSet(uploadId, started)
+    finished := make(chan bool)
+    err = adaptor.write(path, key, false, func(i int, replica Adaptor) error {
+        section := io.NewSectionReader(r, 0, length)
+        if multipart, ok := replica.(MultipartAdaptor); ok {
+            return multipart.PutMultipartTo(path, key, section, uploads.get(i), uploads.starter(i))
+        }
+        return replica.PutReaderTo(path, key, section, length, "binary/octet-stream")
+    }, func() {
+        close(finished)
+    })
+    <-finished
+    return err
+}
+
+func (adaptor *ReplicatedAdaptor) Delete(key string) error {
+    return adaptor.DeleteFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ReplicatedAdaptor) DeleteFrom(path, key string) error {
+    return adaptor.write(path, key, true, func(i int, replica Adaptor) error {
+        return replica.DeleteFrom(path, key)
+    }, nil)
+}
+
+type writeResult struct {
+    index int
+    err   error
+}
+
+/*
+   Run op on every replica at once and return when writeQuorum of them
+   succeeded or that became impossible. The remaining results are
+   collected in the background and failed replicas are repaired.
+   done, if any, is called once every replica is done.
+*/
+func (adaptor *ReplicatedAdaptor) write(path, key string, deleted bool, op func(i int, replica Adaptor) error, done func()) error {
+    results := make(chan writeResult, len(adaptor.replicas))
+    for i, r := range adaptor.replicas {
+        if !r.breaker.Allow() {
+            results <- writeResult{i, newError(Transient, errors.New("Replica is unhealthy."))}
+            continue
+        }
+        go func(i int, r *replica) {
+            err := op(i, r.adaptor)
+            adaptor.record(r, err)
+            results <- writeResult{i, err}
+        }(i, r)
+    }
+    successes, failures := 0, 0
+    lagging := make([]int, 0)
+    var lastErr error
+    for successes < adaptor.writeQuorum && failures <= len(adaptor.replicas)-adaptor.writeQuorum {
+        result := <-results
+        if result.err == nil {
+            successes++
+        } else {
+            failures++
+            lagging = append(lagging, result.index)
+            lastErr = result.err
+        }
+    }
+    remaining := len(adaptor.replicas) - successes - failures
+    reached := successes >= adaptor.writeQuorum
+    go func() {
+        for ; remaining > 0; remaining-- {
+            if result := <-results; result.err != nil {
+                lagging = append(lagging, result.index)
+            }
+        }
+        if done != nil {
+            done()
+        }
+        // Without a quorum the caller retries the whole write.
+        if reached && len(lagging) > 0 {
+            adaptor.repair(&repairTask{path, key, lagging, deleted, 0})
+        }
+    }()
+    if !reached {
+        return replicatedAdaptorDebug.Error(newError(Classify(lastErr), errors.New(fmt.Sprintf("Write quorum not reached for %v: %v", key, lastErr))))
+    }
+    return nil
+}
+
+// Only failures of the replica itself count against its health.
+func (adaptor *ReplicatedAdaptor) record(r *replica, err error) {
+    if err == nil {
+        r.breaker.Success()
+        return
+    }
+    switch Classify(err) {
+    case Transient, Auth:
+        r.breaker.Failure()
+    }
+}
+
+func (adaptor *ReplicatedAdaptor) GetText(key string) (string, error) {
+    return adaptor.GetTextFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ReplicatedAdaptor) GetBinary(key string) ([]byte, error) {
+    return adaptor.GetBinaryFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ReplicatedAdaptor) GetTextFrom(path, key string) (string, error) {
+    value, err := adaptor.GetBinaryFrom(path, key)
+    if err != nil {
+        return "", err
+    }
+    return string(value), nil
+}
+
+/*
+   Try the healthy replicas in order until one returns a copy that
+   passes verification. Replicas that missed it are repaired.
+*/
+func (adaptor *ReplicatedAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    lagging := make([]int, 0)
+    var lastErr error
+    for i, r := range adaptor.replicas {
+        if !r.breaker.Allow() {
+            continue
+        }
+        value, err := r.adaptor.GetBinaryFrom(path, key)
+        adaptor.record(r, err)
+        if err == nil && !verify(key, value) {
+            err = newError(Permanent, errors.New(fmt.Sprintf("Replica %v returned a corrupted copy of %v.", i, key)))
+        }
+        if err != nil {
+            replicatedAdaptorDebug.Error(err)
+            lagging = append(lagging, i)
+            lastErr = err
+            continue
+        }
+        if len(lagging) > 0 {
+            adaptor.repair(&repairTask{path, key, lagging, false, 0})
+        }
+        return value, nil
+    }
+    if lastErr == nil {
+        lastErr = newError(Transient, errors.New("No healthy replica."))
+    }
+    return nil, lastErr
+}
+
+func (adaptor *ReplicatedAdaptor) GetReader(key string) (io.ReadCloser, error) {
+    return adaptor.GetReaderFrom(adaptor.myBucketName, key)
+}
+
+/*
+   Stream the object from the first healthy replica that has it, checked
+   as it is read. A corrupted copy fails the read at its end, the caller
+   retries. Replicas that missed the object or corrupted it are repaired.
+*/
+func (adaptor *ReplicatedAdaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
+    lagging := make([]int, 0)
+    var lastErr error
+    for i, r := range adaptor.replicas {
+        if !r.breaker.Allow() {
+            continue
+        }
+        rc, err := r.adaptor.GetReaderFrom(path, key)
+        adaptor.record(r, err)
+        if err != nil {
+            replicatedAdaptorDebug.Error(err)
+            lagging = append(lagging, i)
+            lastErr = err
+            continue
+        }
+        serving := i
+        return newVerifyingReader(key, rc, func(ok bool) {
+            if !ok {
+                replicatedAdaptorDebug.Debugf("Replica %v returned a corrupted copy of %v.", serving, key)
+                lagging = append(lagging, serving)
+            }
+            if len(lagging) > 0 {
+                adaptor.repair(&repairTask{path, key, lagging, false, 0})
+            }
+        }), nil
+    }
+    if lastErr == nil {
+        lastErr = newError(Transient, errors.New("No healthy replica."))
+    }
+    return nil, lastErr
+}
+
+func (adaptor *ReplicatedAdaptor) Head(key string) (*ObjectInfo, error) {
+    return adaptor.HeadFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *ReplicatedAdaptor) HeadFrom(path, key string) (*ObjectInfo, error) {
+    var lastErr error
+    for _, r := range adaptor.replicas {
+        if !r.breaker.Allow() {
+            continue
+        }
+        info, err := r.adaptor.HeadFrom(path, key)
+        adaptor.record(r, err)
+        if err == nil {
+            return info, nil
+        }
+        if lastErr == nil || err != ErrNotFound {
+            lastErr = err
+        }
+    }
+    if lastErr == nil {
+        lastErr = newError(Transient, errors.New("No healthy replica."))
+    }
+    return nil, lastErr
+}
+
+func (adaptor *ReplicatedAdaptor) List(prefix, marker string, max int) (*ListResult, error) {
+    return adaptor.ListFrom(adaptor.myBucketName, prefix, marker, max)
+}
+
+/*
+   Merge the listings of all healthy replicas, so an object stored by
+   any quorum shows up.
+*/
+func (adaptor *ReplicatedAdaptor) ListFrom(path, prefix, marker string, max int) (*ListResult, error) {
+    results := make([]*ListResult, 0, len(adaptor.replicas))
+    var lastErr error
+    for _, r := range adaptor.replicas {
+        if !r.breaker.Allow() {
+            continue
+        }
+        result, err := r.adaptor.ListFrom(path, prefix, marker, max)
+        adaptor.record(r, err)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        results = append(results, result)
+    }
+    if len(results) == 0 {
+        if lastErr == nil {
+            lastErr = newError(Transient, errors.New("No healthy replica."))
+        }
+        return nil, replicatedAdaptorDebug.Error(lastErr)
+    }
+    return mergeListings(results, max), nil
+}
+
+// Queue a repair, drop it if the queue is full.
+func (adaptor *ReplicatedAdaptor) repair(task *repairTask) {
+    select {
+    case adaptor.repairs <- task:
+    default:
+        replicatedAdaptorDebug.Debugf("Repair queue full, dropped repair of %v/%v.", task.path, task.key)
+    }
+}
+
+func (adaptor *ReplicatedAdaptor) repairLoop() {
+    backoff := utility.NewBackoff(time.Second, time.Minute)
+    for task := range adaptor.repairs {
+        if err := adaptor.doRepair(task); err != nil {
+            replicatedAdaptorDebug.Error(err)
+            task.attempts++
+            if task.attempts < maxRepairAttempts {
+                time.Sleep(backoff.Next())
+                adaptor.repair(task)
+            }
+            continue
+        }
+        backoff.Reset()
+    }
+}
+
+func (adaptor *ReplicatedAdaptor) doRepair(task *repairTask) error {
+    replicatedAdaptorDebug.Debugf("Repairing %v/%v on replicas %v.", task.path, task.key, task.lagging)
+    var file *os.File
+    var length int64
+    if !task.deleted {
+        var err error
+        if file, length, err = adaptor.goodCopy(task); err != nil {
+            return err
+        }
+        defer dropSpool(file)
+    }
+    stillLagging := make([]int, 0)
+    var lastErr error
+    for _, i := range task.lagging {
+        var err error
+        if task.deleted {
+            err = adaptor.replicas[i].adaptor.DeleteFrom(task.path, task.key)
+        } else {
+            err = adaptor.replicas[i].adaptor.PutReaderTo(task.path, task.key, io.NewSectionReader(file, 0, length), length, "binary/octet-stream")
+        }
+        adaptor.record(adaptor.replicas[i], err)
+        if err != nil {
+            stillLagging = append(stillLagging, i)
+            lastErr = err
+        }
+    }
+    task.lagging = stillLagging
+    return lastErr
+}
+
+// A verified copy from a replica which is not lagging, spooled to a temporary file.
+func (adaptor *ReplicatedAdaptor) goodCopy(task *repairTask) (*os.File, int64, error) {
+    isLagging := make(map[int]bool)
+    for _, i := range task.lagging {
+        isLagging[i] = true
+    }
+    var lastErr error = ErrNotFound
+    for i, r := range adaptor.replicas {
+        if isLagging[i] {
+            continue
+        }
+        rc, err := r.adaptor.GetReaderFrom(task.path, task.key)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        file, err := ioutil.TempFile("", "teapot-spool")
+        if err != nil {
+            rc.Close()
+            return nil, 0, err
+        }
+        length, err := io.Copy(file, newVerifyingReader(task.key, rc, nil))
+        rc.Close()
+        if err == nil {
+            return file, length, nil
+        }
+        dropSpool(file)
+        lastErr = err
+    }
+    return nil, 0, lastErr
+}
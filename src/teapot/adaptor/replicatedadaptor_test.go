@@ -0,0 +1,277 @@
+package adaptor
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "io/ioutil"
+    . "launchpad.net/gocheck"
+    "strconv"
+    "sync"
+    "teapot/conf"
+    "teapot/utility"
+    "time"
+)
+
+type ReplicatedSuite struct {
+    dir string
+}
+
+var _ = Suite(&ReplicatedSuite{})
+
+// A replica which can be switched off.
+type brokenAdaptor struct {
+    Adaptor
+    lock   *sync.Mutex
+    broken bool
+}
+
+func (a *brokenAdaptor) setBroken(broken bool) {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    a.broken = broken
+}
+
+func (a *brokenAdaptor) isBroken() bool {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    return a.broken
+}
+
+func (a *brokenAdaptor) PutReaderTo(path, key string, r io.Reader, length int64, contType string) error {
+    if a.isBroken() {
+        return errors.New("replica down")
+    }
+    return a.Adaptor.PutReaderTo(path, key, r, length, contType)
+}
+
+func (a *brokenAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    if a.isBroken() {
+        return nil, errors.New("replica down")
+    }
+    return a.Adaptor.GetBinaryFrom(path, key)
+}
+
+func (a *brokenAdaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
+    if a.isBroken() {
+        return nil, errors.New("replica down")
+    }
+    return a.Adaptor.GetReaderFrom(path, key)
+}
+
+// Refuses to read objects whole, so reads have to stream.
+type streamOnlyAdaptor struct {
+    Adaptor
+}
+
+func (a *streamOnlyAdaptor) GetBinaryFrom(path, key string) ([]byte, error) {
+    return nil, errors.New("read whole")
+}
+
+// A replica uploading in parts, every upload gets an id.
+type multipartAdaptor struct {
+    Adaptor
+}
+
+func (a *multipartAdaptor) PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    return a.PutMultipartTo(testBucket, key, r, uploadId, started)
+}
+
+func (a *multipartAdaptor) PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    if uploadId == "" {
+        if err := started("upload-" + key); err != nil {
+            return err
+        }
+    }
+    length, err := r.Seek(0, 2)
+    if err != nil {
+        return err
+    }
+    if _, err := r.Seek(0, 0); err != nil {
+        return err
+    }
+    return a.Adaptor.PutReaderTo(path, key, r, length, "binary/octet-stream")
+}
+
+func (s *ReplicatedSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    RegisterVerifier(func(key string, value []byte) bool {
+        return utility.GetHashOfBytesAndEncode(value) == key
+    })
+}
+
+func (s *ReplicatedSuite) TearDownTest(c *C) {
+    RegisterVerifier(func(key string, value []byte) bool {
+        return true
+    })
+}
+
+func (s *ReplicatedSuite) newReplicas(n int) ([]*FSAdaptor, []*brokenAdaptor, []Adaptor) {
+    fsAdaptors := make([]*FSAdaptor, n)
+    brokenAdaptors := make([]*brokenAdaptor, n)
+    adaptors := make([]Adaptor, n)
+    for i := 0; i < n; i++ {
+        fsAdaptors[i] = NewFSAdaptor(s.dir+"/replica"+strconv.Itoa(i), testBucket)
+        brokenAdaptors[i] = &brokenAdaptor{fsAdaptors[i], new(sync.Mutex), false}
+        adaptors[i] = brokenAdaptors[i]
+    }
+    return fsAdaptors, brokenAdaptors, adaptors
+}
+
+func waitForKey(c *C, adaptor Adaptor, key string) {
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+        if _, err := adaptor.Head(key); err == nil {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Fatalf("%v was not repaired.", key)
+}
+
+func (s *ReplicatedSuite) TestWriteQuorum(c *C) {
+    fsAdaptors, brokenAdaptors, adaptors := s.newReplicas(3)
+    adaptor := NewReplicatedAdaptor(adaptors, 2, testBucket)
+    key := utility.GetHashOfBytesAndEncode(testBinaryValue)
+    brokenAdaptors[2].setBroken(true)
+    c.Assert(adaptor.PutBinary(key, testBinaryValue), IsNil)
+    brokenAdaptors[1].setBroken(true)
+    c.Assert(adaptor.PutBinary("other", testBinaryValue), NotNil)
+    // The lagging replica catches up once it is back.
+    brokenAdaptors[1].setBroken(false)
+    brokenAdaptors[2].setBroken(false)
+    waitForKey(c, fsAdaptors[2], key)
+    value, err := fsAdaptors[2].GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(value, DeepEquals, testBinaryValue)
+}
+
+func (s *ReplicatedSuite) TestMultipart(c *C) {
+    fsAdaptors, _, adaptors := s.newReplicas(2)
+    adaptors[0] = &multipartAdaptor{adaptors[0]}
+    adaptor := NewReplicatedAdaptor(adaptors, 1, testBucket)
+    key := utility.GetHashOfBytesAndEncode(testBinaryValue)
+    uploadId := ""
+    started := func(id string) error {
+        uploadId = id
+        return nil
+    }
+    c.Assert(PutFile(adaptor, key, bytes.NewReader(testBinaryValue), int64(len(testBinaryValue)), "", started), IsNil)
+    c.Assert(adaptor.PutMultipart(key, bytes.NewReader(testBinaryValue), "", started), IsNil)
+    // Every replica has it once the call returns.
+    for _, fsAdaptor := range fsAdaptors {
+        value, err := fsAdaptor.GetBinary(key)
+        c.Assert(err, IsNil)
+        c.Assert(value, DeepEquals, testBinaryValue)
+    }
+    uploads := newUploadIdSet(uploadId, nil)
+    c.Assert(uploads.get(0), Equals, "upload-"+key)
+    c.Assert(uploads.get(1), Equals, "")
+}
+
+func (s *ReplicatedSuite) TestVerifiedRead(c *C) {
+    fsAdaptors, brokenAdaptors, adaptors := s.newReplicas(3)
+    adaptor := NewReplicatedAdaptor(adaptors, 3, testBucket)
+    key := utility.GetHashOfBytesAndEncode(testBinaryValue)
+    c.Assert(adaptor.PutBinary(key, testBinaryValue), IsNil)
+    // A tampered copy is skipped and then repaired.
+    c.Assert(fsAdaptors[0].PutBinary(key, []byte("tampered")), IsNil)
+    brokenAdaptors[1].setBroken(true)
+    value, err := adaptor.GetBinary(key)
+    c.Assert(err, IsNil)
+    c.Assert(value, DeepEquals, testBinaryValue)
+    for i := 0; i < 500; i++ {
+        if value, _ = fsAdaptors[0].GetBinary(key); string(value) != "tampered" {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(value, DeepEquals, testBinaryValue)
+    // Nothing good left.
+    c.Assert(fsAdaptors[0].PutBinary(key, []byte("tampered")), IsNil)
+    c.Assert(fsAdaptors[2].PutBinary(key, []byte("tampered")), IsNil)
+    _, err = adaptor.GetBinary(key)
+    c.Assert(err, NotNil)
+}
+
+// Reads are streamed and checked at their end.
+func (s *ReplicatedSuite) TestStreamedRead(c *C) {
+    fsAdaptors, brokenAdaptors, adaptors := s.newReplicas(2)
+    for i := range adaptors {
+        adaptors[i] = &streamOnlyAdaptor{adaptors[i]}
+    }
+    adaptor := NewReplicatedAdaptor(adaptors, 2, testBucket)
+    value := make([]byte, 3*verifyHoldLimit+5)
+    for i := range value {
+        value[i] = byte(i * 7 % 251)
+    }
+    key := utility.GetHashOfBytesAndEncode(value)
+    c.Assert(fsAdaptors[0].PutBinary(key, value), IsNil)
+    c.Assert(fsAdaptors[1].PutBinary(key, value), IsNil)
+    rc, err := adaptor.GetReader(key)
+    c.Assert(err, IsNil)
+    got, err := ioutil.ReadAll(rc)
+    c.Assert(err, IsNil)
+    c.Assert(rc.Close(), IsNil)
+    c.Assert(bytes.Equal(got, value), Equals, true)
+
+    // A corrupted copy fails the read, and is repaired from the other replica.
+    tampered := append([]byte{}, value...)
+    tampered[len(tampered)-1] ^= 0xff
+    c.Assert(fsAdaptors[0].PutBinary(key, tampered), IsNil)
+    rc, err = adaptor.GetReader(key)
+    c.Assert(err, IsNil)
+    _, err = ioutil.ReadAll(rc)
+    c.Assert(err, ErrorMatches, "Read a corrupted copy of .*")
+    rc.Close()
+    for i := 0; i < 500; i++ {
+        if got, _ = fsAdaptors[0].GetBinary(key); bytes.Equal(got, value) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(bytes.Equal(got, value), Equals, true)
+
+    brokenAdaptors[0].setBroken(true)
+    rc, err = adaptor.GetReader(key)
+    c.Assert(err, IsNil)
+    got, err = ioutil.ReadAll(rc)
+    c.Assert(err, IsNil)
+    rc.Close()
+    c.Assert(bytes.Equal(got, value), Equals, true)
+}
+
+func (s *ReplicatedSuite) TestMergedList(c *C) {
+    fsAdaptors, _, adaptors := s.newReplicas(2)
+    adaptor := NewReplicatedAdaptor(adaptors, 1, testBucket)
+    c.Assert(fsAdaptors[0].PutText("a", "a"), IsNil)
+    c.Assert(fsAdaptors[1].PutText("b", "b"), IsNil)
+    c.Assert(fsAdaptors[0].PutText("c", "c"), IsNil)
+    c.Assert(fsAdaptors[1].PutText("c", "c"), IsNil)
+    result, err := adaptor.List("", "", 2)
+    c.Assert(err, IsNil)
+    c.Assert(len(result.Objects), Equals, 2)
+    c.Assert(result.Objects[0].Key, Equals, "a")
+    c.Assert(result.Objects[1].Key, Equals, "b")
+    c.Assert(result.Truncated, Equals, true)
+    result, err = adaptor.List("", result.NextMarker, 2)
+    c.Assert(err, IsNil)
+    c.Assert(len(result.Objects), Equals, 1)
+    c.Assert(result.Objects[0].Key, Equals, "c")
+    c.Assert(result.Truncated, Equals, false)
+}
+
+func (s *ReplicatedSuite) TestFromConfig(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    config.StorageBackend = conf.ReplicatedBackend
+    config.Replicas = []string{"fs:" + s.dir + "/a", "fs:" + s.dir + "/b"}
+    adaptor, err := New(config, config.MyBucketName)
+    c.Assert(err, IsNil)
+    c.Assert(adaptor.(*ReplicatedAdaptor).writeQuorum, Equals, 2)
+    c.Assert(adaptor.PutText(testKey, testTextValue), IsNil)
+    textValue, err := NewFSAdaptor(s.dir+"/b", config.MyBucketName).GetText(testKey)
+    c.Assert(err, IsNil)
+    c.Assert(textValue, Equals, testTextValue)
+    config.Replicas = []string{"replicated:x"}
+    _, err = New(config, config.MyBucketName)
+    c.Assert(err, NotNil)
+}
@@ -3,24 +3,42 @@ package adaptor
 //package main
 
 import (
+    "errors"
     "io"
     "launchpad.net/goamz/aws"
     "launchpad.net/goamz/s3"
+    "net/url"
+    "strings"
     "sync"
+    "teapot/conf"
     "teapot/utility"
+    "time"
 )
 
 const s3adaptorDebug utility.Debug = true
 
+// Bucket addressing styles understood by NewS3Region.
+const (
+    PathStyle        = conf.S3PathStyle
+    VirtualHostStyle = conf.S3VirtualHostStyle
+)
+
+// Objects are never readable by anonymous users.
+// Peers read other buckets with read only credentials, see SetReadAuth.
+const objectACL = s3.Private
+
+// Size of the parts of a multipart upload; S3 allows 10000 parts.
+const s3PartSize = 64 << 20
+
 type S3Adaptor struct {
     s3Adaptor    *s3.S3
     myBucketName string
     allBuckets   map[string]*s3.Bucket
+    bucketLock   *sync.Mutex
+    // Credentials used to read buckets of other nodes.
+    readAuth map[string]*aws.Auth
 }
 
-var adaptor *S3Adaptor
-var once sync.Once
-
 func EnvAuth() (aws.Auth, error) {
     return aws.EnvAuth()
 }
@@ -29,33 +47,108 @@ func NewAuth(accessKey, secretKey string) *aws.Auth {
     return &aws.Auth{accessKey, secretKey}
 }
 
-// make it once
-func GetAdaptor(auth *aws.Auth, myBucketName string) *S3Adaptor {
-    if adaptor == nil {
-        once.Do(func() {
-            s3Adaptor := s3.New(*auth, aws.USEast)
-            allBuckets := make(map[string]*s3.Bucket)
-            adaptor = &S3Adaptor{
-                s3Adaptor,
-                myBucketName,
-                allBuckets,
-            }
-            myBucket := adaptor.s3Adaptor.Bucket(myBucketName)
-            adaptor.allBuckets[myBucketName] = myBucket
-        })
+/*
+   Build the region to talk to.
+   regionName picks one of the AWS regions, us-east-1 by default.
+   endpoint overrides the S3 endpoint for S3 compatible services such as
+   MinIO or Ceph RGW, in which case regionName is only used as a name.
+   addressing is either "path" (http://endpoint/bucket/key) or
+   "virtual" (http://bucket.endpoint/key); empty keeps the region default.
+*/
+func NewS3Region(endpoint, regionName, addressing string) (aws.Region, error) {
+    region := aws.USEast
+    if regionName != "" {
+        if knownRegion, ok := aws.Regions[regionName]; ok {
+            region = knownRegion
+        } else if endpoint == "" {
+            return region, s3adaptorDebug.Error(errors.New("Unknown S3 region: " + regionName))
+        } else {
+            region.Name = regionName
+        }
+    }
+    if endpoint != "" {
+        if _, err := url.Parse(endpoint); err != nil {
+            return region, s3adaptorDebug.Error(err)
+        }
+        region.S3Endpoint = strings.TrimRight(endpoint, "/")
+        region.S3BucketEndpoint = ""
+        region.S3LocationConstraint = false
     }
+    switch addressing {
+    case "":
+    case PathStyle:
+        region.S3BucketEndpoint = ""
+    case VirtualHostStyle:
+        endpointURL, err := url.Parse(region.S3Endpoint)
+        if err != nil {
+            return region, s3adaptorDebug.Error(err)
+        }
+        region.S3BucketEndpoint = endpointURL.Scheme + "://${bucket}." + endpointURL.Host
+    default:
+        return region, s3adaptorDebug.Error(errors.New("Unknown S3 addressing style: " + addressing))
+    }
+    return region, nil
+}
+
+func NewS3Adaptor(auth *aws.Auth, region aws.Region, myBucketName string) *S3Adaptor {
+    s3Adaptor := s3.New(*auth, region)
+    adaptor := &S3Adaptor{
+        s3Adaptor,
+        myBucketName,
+        make(map[string]*s3.Bucket),
+        new(sync.Mutex),
+        make(map[string]*aws.Auth),
+    }
+    adaptor.allBuckets[myBucketName] = s3Adaptor.Bucket(myBucketName)
     return adaptor
 }
 
+// Build an S3 adaptor out of the S3 settings in the configuration.
+func newS3AdaptorFromConfig(config *conf.Config, myBucketName string) (Adaptor, error) {
+    region, err := NewS3Region(config.S3Endpoint, config.S3Region, config.S3Addressing)
+    if err != nil {
+        return nil, s3adaptorDebug.Error(err)
+    }
+    auth := NewAuth(config.AWSAccessKey, config.AWSSecretKey)
+    adaptor := NewS3Adaptor(auth, region, myBucketName)
+    for nodeId, credential := range config.NodeReadCredentials {
+        if bucketName, ok := config.NodeBucketMap[nodeId]; ok && bucketName != myBucketName {
+            readAuth := NewAuth(credential.AccessKey, credential.SecretKey)
+            adaptor.SetReadAuth(bucketName, readAuth)
+            // The same credentials read the peer's value shards.
+            for i := 0; i < config.ErasureDataShards+config.ErasureParityShards; i++ {
+                adaptor.SetReadAuth(shardBucket(bucketName, i), readAuth)
+            }
+        }
+    }
+    return adaptor, nil
+}
+
+/*
+   Use the given credentials for every request to bucketName.
+   These are the scoped read credentials a peer hands out in its node info.
+*/
+func (adaptor *S3Adaptor) SetReadAuth(bucketName string, auth *aws.Auth) {
+    adaptor.bucketLock.Lock()
+    defer adaptor.bucketLock.Unlock()
+    adaptor.readAuth[bucketName] = auth
+    delete(adaptor.allBuckets, bucketName)
+}
+
+// A URL granting read access to a single object until expires.
+func (adaptor *S3Adaptor) SignedURL(path, key string, expires time.Time) string {
+    return adaptor.getBucket(path).SignedURL(key, expires)
+}
+
 func (adaptor *S3Adaptor) PutTextTo(path, key, text string) error {
     bucket := adaptor.getBucket(path)
-    err := bucket.Put(key, []byte(text), "text/plain", s3.PublicRead)
+    err := bucket.Put(key, []byte(text), "text/plain", objectACL)
     if err != nil {
         s3adaptorDebug.Error(err)
         s3Err, _ := err.(*s3.Error)
         if s3Err != nil && s3Err.Code == "NoSuchBucket" {
-            bucket.PutBucket(s3.BucketOwnerFull)
-            err = bucket.Put(key, []byte(text), "text/plain", s3.PublicRead)
+            bucket.PutBucket(s3.Private)
+            err = bucket.Put(key, []byte(text), "text/plain", objectACL)
             if err != nil {
                 return s3adaptorDebug.Error(err)
             }
@@ -73,13 +166,13 @@ func (adaptor *S3Adaptor) PutText(key, value string) error {
 // Handle errors such as bucket not exist
 func (adaptor *S3Adaptor) PutBinaryTo(path, key string, value []byte) error {
     bucket := adaptor.getBucket(path)
-    err := bucket.Put(key, value, "binary/octet-stream", s3.PublicRead)
+    err := bucket.Put(key, value, "binary/octet-stream", objectACL)
     if err != nil {
         s3adaptorDebug.Error(err)
         s3Err, _ := err.(*s3.Error)
         if s3Err != nil && s3Err.Code == "NoSuchBucket" {
-            bucket.PutBucket(s3.BucketOwnerFull)
-            err = bucket.Put(key, value, "binary/octet-stream", s3.PublicRead)
+            bucket.PutBucket(s3.Private)
+            err = bucket.Put(key, value, "binary/octet-stream", objectACL)
             if err != nil {
                 return s3adaptorDebug.Error(err)
             }
@@ -117,9 +210,15 @@ func (adaptor *S3Adaptor) GetBinary(key string) ([]byte, error) {
 }
 
 func (adaptor *S3Adaptor) getBucket(bucketName string) *s3.Bucket {
+    adaptor.bucketLock.Lock()
+    defer adaptor.bucketLock.Unlock()
     bucket := adaptor.allBuckets[bucketName]
     if bucket == nil {
-        bucket = adaptor.s3Adaptor.Bucket(bucketName)
+        if auth, ok := adaptor.readAuth[bucketName]; ok {
+            bucket = s3.New(*auth, adaptor.s3Adaptor.Region).Bucket(bucketName)
+        } else {
+            bucket = adaptor.s3Adaptor.Bucket(bucketName)
+        }
         adaptor.allBuckets[bucketName] = bucket
     }
     return bucket
@@ -135,12 +234,12 @@ func (adaptor *S3Adaptor) GetReader(key string) (io.ReadCloser, error) {
 
 func (adaptor *S3Adaptor) PutReaderTo(path, key string, r io.Reader, length int64, contType string) error {
     bucket := adaptor.getBucket(path)
-    err := bucket.PutReader(key, r, length, contType, s3.PublicRead)
+    err := bucket.PutReader(key, r, length, contType, objectACL)
     if err != nil {
         s3Err, _ := err.(*s3.Error)
         if s3Err != nil && s3Err.Code == "NoSuchBucket" {
-            bucket.PutBucket(s3.BucketOwnerFull)
-            err = bucket.PutReader(key, r, length, contType, s3.PublicRead)
+            bucket.PutBucket(s3.Private)
+            err = bucket.PutReader(key, r, length, contType, objectACL)
             if err != nil {
                 return s3adaptorDebug.Error(err)
             }
@@ -151,7 +250,123 @@ func (adaptor *S3Adaptor) PutReaderTo(path, key string, r io.Reader, length int6
     return nil
 }
 
+func (adaptor *S3Adaptor) PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    return adaptor.PutMultipartTo(adaptor.myBucketName, key, r, uploadId, started)
+}
+
+/*
+   Upload r in parts of s3PartSize. Parts of a resumed upload which
+   match the content are not sent again. An upload which S3 forgot,
+   e.g. it was aborted by a lifecycle rule, is started over.
+*/
+func (adaptor *S3Adaptor) PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error {
+    bucket := adaptor.getBucket(path)
+    for {
+        var multi *s3.Multi
+        if uploadId != "" {
+            multi = &s3.Multi{Bucket: bucket, Key: key, UploadId: uploadId}
+        } else {
+            var err error
+            if multi, err = adaptor.initMulti(bucket, key); err != nil {
+                return s3adaptorDebug.Error(err)
+            }
+            if err := started(multi.UploadId); err != nil {
+                multi.Abort()
+                return s3adaptorDebug.Error(err)
+            }
+        }
+        parts, err := multi.PutAll(r, s3PartSize)
+        if err == nil {
+            err = multi.Complete(parts)
+        }
+        if err == nil {
+            return nil
+        }
+        if s3Err, _ := err.(*s3.Error); s3Err != nil && s3Err.Code == "NoSuchUpload" && uploadId != "" {
+            s3adaptorDebug.Debugf("Upload %v of %v is gone, starting over.", uploadId, key)
+            uploadId = ""
+            if err := started(""); err != nil {
+                return s3adaptorDebug.Error(err)
+            }
+            continue
+        }
+        return s3adaptorDebug.Error(err)
+    }
+}
+
+func (adaptor *S3Adaptor) initMulti(bucket *s3.Bucket, key string) (*s3.Multi, error) {
+    multi, err := bucket.InitMulti(key, "binary/octet-stream", objectACL)
+    if s3Err, _ := err.(*s3.Error); s3Err != nil && s3Err.Code == "NoSuchBucket" {
+        bucket.PutBucket(s3.Private)
+        multi, err = bucket.InitMulti(key, "binary/octet-stream", objectACL)
+    }
+    return multi, err
+}
+
 func (adaptor *S3Adaptor) GetReaderFrom(path, key string) (io.ReadCloser, error) {
     bucket := adaptor.getBucket(path)
     return bucket.GetReader(key)
 }
+
+func (adaptor *S3Adaptor) Delete(key string) error {
+    return adaptor.DeleteFrom(adaptor.myBucketName, key)
+}
+
+func (adaptor *S3Adaptor) DeleteFrom(path, key string) error {
+    bucket := adaptor.getBucket(path)
+    if err := bucket.Del(key); err != nil {
+        s3Err, _ := err.(*s3.Error)
+        if s3Err != nil && (s3Err.Code == "NoSuchKey" || s3Err.Code == "NoSuchBucket") {
+            return nil
+        }
+        return s3adaptorDebug.Error(err)
+    }
+    return nil
+}
+
+func (adaptor *S3Adaptor) Head(key string) (*ObjectInfo, error) {
+    return adaptor.HeadFrom(adaptor.myBucketName, key)
+}
+
+// The key itself is the first key in a listing prefixed by the key.
+func (adaptor *S3Adaptor) HeadFrom(path, key string) (*ObjectInfo, error) {
+    result, err := adaptor.ListFrom(path, key, "", 1)
+    if err != nil {
+        return nil, err
+    }
+    if len(result.Objects) == 0 || result.Objects[0].Key != key {
+        return nil, ErrNotFound
+    }
+    return &result.Objects[0], nil
+}
+
+func (adaptor *S3Adaptor) List(prefix, marker string, max int) (*ListResult, error) {
+    return adaptor.ListFrom(adaptor.myBucketName, prefix, marker, max)
+}
+
+func (adaptor *S3Adaptor) ListFrom(path, prefix, marker string, max int) (*ListResult, error) {
+    if max <= 0 {
+        max = DefaultListSize
+    }
+    bucket := adaptor.getBucket(path)
+    resp, err := bucket.List(prefix, "", marker, max)
+    if err != nil {
+        s3Err, _ := err.(*s3.Error)
+        if s3Err != nil && s3Err.Code == "NoSuchBucket" {
+            return &ListResult{make([]ObjectInfo, 0), "", false}, nil
+        }
+        return nil, s3adaptorDebug.Error(err)
+    }
+    result := ListResult{
+        make([]ObjectInfo, 0, len(resp.Contents)),
+        "",
+        resp.IsTruncated,
+    }
+    for _, key := range resp.Contents {
+        result.Objects = append(result.Objects, ObjectInfo{key.Key, key.Size, strings.Trim(key.ETag, "\"")})
+    }
+    if result.Truncated && len(result.Objects) > 0 {
+        result.NextMarker = result.Objects[len(result.Objects)-1].Key
+    }
+    return &result, nil
+}
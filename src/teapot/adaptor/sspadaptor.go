@@ -1,6 +1,41 @@
 package adaptor
 
-import "io"
+import (
+    "errors"
+    "io"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+)
+
+// Returned by Head when the object does not exist.
+var ErrNotFound = errors.New("Object not found.")
+
+// Default page size of List when max is not positive.
+const DefaultListSize = 1000
+
+/*
+   Metadata of a stored object.
+   ETag is the hex encoded MD5 of the content, without quotes.
+*/
+type ObjectInfo struct {
+    Key  string
+    Size int64
+    ETag string
+}
+
+/*
+   One page of a listing, sorted by key.
+   If Truncated is set, pass NextMarker as marker to get the next page.
+*/
+type ListResult struct {
+    Objects    []ObjectInfo
+    NextMarker string
+    Truncated  bool
+}
 
 type Adaptor interface {
     //    SetMyBucket(bucketName string)
@@ -16,4 +51,191 @@ type Adaptor interface {
     GetReader(key string) (rc io.ReadCloser, err error)
     PutReaderTo(path, key string, r io.Reader, length int64, contType string) error
     GetReaderFrom(path, key string) (rc io.ReadCloser, err error)
+    // Deleting an object that doesn't exist is not an error.
+    Delete(key string) error
+    DeleteFrom(path, key string) error
+    // Return ErrNotFound if the object doesn't exist.
+    Head(key string) (*ObjectInfo, error)
+    HeadFrom(path, key string) (*ObjectInfo, error)
+    // List keys starting with prefix and greater than marker, at most max of them.
+    List(prefix, marker string, max int) (*ListResult, error)
+    ListFrom(path, prefix, marker string, max int) (*ListResult, error)
+}
+
+type ReaderAtSeeker interface {
+    io.ReaderAt
+    io.ReadSeeker
+}
+
+/*
+   Implemented by adaptors which upload large objects in parts.
+   started is told the id of the upload before any part is sent; passing
+   that id as uploadId after a failure resumes the upload and keeps the
+   parts sent already. It is told "" once the id is no longer valid.
+*/
+type MultipartAdaptor interface {
+    PutMultipart(key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error
+    PutMultipartTo(path, key string, r ReaderAtSeeker, uploadId string, started func(uploadId string) error) error
+}
+
+// Objects larger than this are uploaded in parts if the adaptor can.
+const MultipartThreshold = 64 << 20
+
+/*
+   Upload the length bytes of r, in parts if the object is large and
+   the adaptor supports it, see MultipartAdaptor. Otherwise r is streamed
+   in one request.
+*/
+func PutFile(adaptor Adaptor, key string, r ReaderAtSeeker, length int64, uploadId string, started func(uploadId string) error) error {
+    if multipart, ok := adaptor.(MultipartAdaptor); ok && length > MultipartThreshold {
+        return multipart.PutMultipart(key, r, uploadId, started)
+    }
+    if _, err := r.Seek(0, 0); err != nil {
+        return err
+    }
+    return adaptor.PutReader(key, r, length, "binary/octet-stream")
+}
+
+/*
+   Copy the length bytes of r to a temporary file, for adaptors which
+   read an object more than once without holding it in memory.
+   Release the file with dropSpool.
+*/
+func spool(r io.Reader, length int64) (*os.File, error) {
+    file, err := ioutil.TempFile("", "teapot-spool")
+    if err != nil {
+        return nil, err
+    }
+    if _, err := io.CopyN(file, r, length); err != nil {
+        dropSpool(file)
+        return nil, err
+    }
+    return file, nil
+}
+
+func dropSpool(file *os.File) {
+    file.Close()
+    os.Remove(file.Name())
+}
+
+/*
+   The uploads of one object to several stores, kept in a single upload
+   id for the caller, see MultipartAdaptor.
+*/
+type uploadIdSet struct {
+    lock    *sync.Mutex
+    ids     map[int]string
+    started func(uploadId string) error
+}
+
+func newUploadIdSet(uploadId string, started func(uploadId string) error) *uploadIdSet {
+    ids := make(map[int]string)
+    if values, err := url.ParseQuery(uploadId); err == nil {
+        for key, value := range values {
+            if i, err := strconv.Atoi(key); err == nil && len(value) > 0 {
+                ids[i] = value[0]
+            }
+        }
+    }
+    return &uploadIdSet{new(sync.Mutex), ids, started}
+}
+
+func (set *uploadIdSet) get(i int) string {
+    set.lock.Lock()
+    defer set.lock.Unlock()
+    return set.ids[i]
+}
+
+// The started callback of the upload to store i.
+func (set *uploadIdSet) starter(i int) func(uploadId string) error {
+    return func(uploadId string) error {
+        set.lock.Lock()
+        defer set.lock.Unlock()
+        if uploadId == "" {
+            delete(set.ids, i)
+        } else {
+            set.ids[i] = uploadId
+        }
+        values := url.Values{}
+        for i, id := range set.ids {
+            values.Set(strconv.Itoa(i), id)
+        }
+        return set.started(values.Encode())
+    }
+}
+
+// Check whether an object exists.
+func Exists(adaptor Adaptor, path, key string) (bool, error) {
+    if _, err := adaptor.HeadFrom(path, key); err != nil {
+        if err == ErrNotFound {
+            return false, nil
+        }
+        return false, err
+    }
+    return true, nil
+}
+
+// Walk through every page of a listing and return all objects with the prefix.
+func ListAllFrom(adaptor Adaptor, path, prefix string) ([]ObjectInfo, error) {
+    objects := make([]ObjectInfo, 0)
+    marker := ""
+    for {
+        result, err := adaptor.ListFrom(path, prefix, marker, DefaultListSize)
+        if err != nil {
+            return nil, err
+        }
+        objects = append(objects, result.Objects...)
+        if !result.Truncated {
+            return objects, nil
+        }
+        marker = result.NextMarker
+    }
+}
+
+/*
+   Merge pages listed from several stores with the same prefix and marker.
+   The metadata of the first page listing a key wins. Keys after the end
+   of a truncated page are left for the next page, since that store may
+   not have listed them yet.
+*/
+func mergeListings(results []*ListResult, max int) *ListResult {
+    if max <= 0 {
+        max = DefaultListSize
+    }
+    objects := make(map[string]ObjectInfo)
+    limit := ""
+    truncated := false
+    for _, result := range results {
+        for _, object := range result.Objects {
+            if _, ok := objects[object.Key]; !ok {
+                objects[object.Key] = object
+            }
+        }
+        if result.Truncated && len(result.Objects) > 0 {
+            last := result.Objects[len(result.Objects)-1].Key
+            if !truncated || last < limit {
+                limit = last
+            }
+            truncated = true
+        }
+    }
+    keys := make([]string, 0, len(objects))
+    for key := range objects {
+        if !truncated || key <= limit {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    if len(keys) > max {
+        keys = keys[:max]
+        truncated = true
+    }
+    merged := ListResult{make([]ObjectInfo, 0, len(keys)), "", truncated}
+    for _, key := range keys {
+        merged.Objects = append(merged.Objects, objects[key])
+    }
+    if truncated && len(keys) > 0 {
+        merged.NextMarker = keys[len(keys)-1]
+    }
+    return &merged
 }
@@ -12,19 +12,39 @@ import (
     "io/ioutil"
     "math/rand"
     "os"
+    "regexp"
     "strconv"
+    "strings"
     "teapot/utility"
     "time"
 )
 
 const confDebug utility.Debug = true
 
+// Names of the storage backends that can be chosen by StorageBackend.
+const (
+    S3Backend         = "s3"
+    FSBackend         = "fs"
+    ReplicatedBackend = "replicated"
+)
+
+// Size of the local object cache unless CacheSize says otherwise, 1GB.
+const defaultCacheSize = 1 << 30
+
+// Bucket addressing styles that can be chosen by S3Addressing.
+const (
+    S3PathStyle        = "path"
+    S3VirtualHostStyle = "virtual"
+)
+
 type Configuration struct {
     Property      map[string]string
     NodeBucketMap map[string]string
     NodeIpMap     map[string]string
     PublicKeys    map[string]string
     PrivateKey    string
+    // Optional, read only credentials for other nodes' buckets.
+    NodeReadCredentials map[string]ReadCredential
 }
 
 type NodeInfo struct {
@@ -32,6 +52,15 @@ type NodeInfo struct {
     NodeBucket string
     NodeIPPort string
     PublicKey  string
+    // Credentials which can read, and only read, NodeBucket.
+    // Objects are private, so peers need them to read the bucket directly.
+    ReadAccessKey string
+    ReadSecretKey string
+}
+
+type ReadCredential struct {
+    AccessKey string
+    SecretKey string
 }
 
 type Config struct {
@@ -49,10 +78,45 @@ type Config struct {
     AWSAccessKey string
     AWSSecretKey string
 
-    NodeBucketMap map[string]string
-    NodeIpMap     map[string]string
-    PrivateKey    *rsa.PrivateKey
-    PublicKeys    map[string]*rsa.PublicKey
+    // Where log entries and values are stored remotely.
+    // StorageDir is only used by the fs backend.
+    StorageBackend string
+    StorageDir     string
+
+    // Optional settings of S3 compatible storage.
+    // Empty values keep the Amazon S3 defaults.
+    S3Endpoint   string
+    S3Region     string
+    S3Addressing string
+
+    // Used by the replicated backend only.
+    // Every replica is "backend:argument", see ParseReplica.
+    Replicas    []string
+    WriteQuorum int
+
+    // Optional erasure coding of values, log entries are not affected.
+    // Every value is cut into ErasureDataShards shards plus
+    // ErasureParityShards parity shards, which are spread over
+    // ValueShards round robin. Every shard store is "backend:argument".
+    ValueShards         []string
+    ErasureDataShards   int
+    ErasureParityShards int
+
+    // Optional local cache of objects read from remote storage.
+    // CacheSize is in bytes.
+    CacheDir  string
+    CacheSize int64
+
+    // Optional owner/directory prefixes, "<nodeId>" or
+    // "<nodeId>/<directory>", whose values are replicated. Values of
+    // other directories are left remotely. Empty means all of them.
+    Subscriptions []string
+
+    NodeBucketMap       map[string]string
+    NodeIpMap           map[string]string
+    NodeReadCredentials map[string]ReadCredential
+    PrivateKey          *rsa.PrivateKey
+    PublicKeys          map[string]*rsa.PublicKey
 }
 
 func LoadFromFile(filename string) (*Config, error) {
@@ -70,8 +134,23 @@ func LoadFromFile(filename string) (*Config, error) {
     var awsAccessKey string
     var awsSecretKey string
 
+    var storageBackend string
+    var storageDir string
+    var s3Endpoint string
+    var s3Region string
+    var s3Addressing string
+    var replicas []string
+    var writeQuorum int
+    var valueShards []string
+    var erasureDataShards int
+    var erasureParityShards int
+    var cacheDir string
+    var cacheSize int64
+    var subscriptions []string
+
     var nodeBucketMap map[string]string
     var nodeIpMap map[string]string
+    var nodeReadCredentials map[string]ReadCredential
     var privateKey *rsa.PrivateKey
     var publicKeys map[string]*rsa.PublicKey
 
@@ -132,13 +211,115 @@ func LoadFromFile(filename string) (*Config, error) {
             aesKey = _aesKey
         }
     }
+    // Storage backend is optional, S3 is used by default.
+    if _storageBackend, ok := config.Property["StorageBackend"]; !ok {
+        storageBackend = S3Backend
+    } else {
+        storageBackend = _storageBackend
+    }
+    // Backends are looked up in the adaptor registry, so only check what is known here.
+    storageDir = config.Property["StorageDir"]
+    if storageBackend == FSBackend && storageDir == "" {
+        confDebug.Panicf("Storage directory not set up yet.\n")
+    }
+    s3Endpoint = config.Property["S3Endpoint"]
+    s3Region = config.Property["S3Region"]
+    s3Addressing = config.Property["S3Addressing"]
+    if s3Addressing != "" && s3Addressing != S3PathStyle && s3Addressing != S3VirtualHostStyle {
+        confDebug.Panicf("S3 addressing should be either path or virtual.\n")
+    }
+    usesS3 := storageBackend == S3Backend
+    if storageBackend == ReplicatedBackend {
+        if config.Property["Replicas"] == "" {
+            confDebug.Panicf("Replicas not set up yet.\n")
+        }
+        replicas = strings.Split(config.Property["Replicas"], ",")
+        for i, replica := range replicas {
+            replicas[i] = strings.TrimSpace(replica)
+            backend, argument := ParseReplica(replicas[i])
+            if backend == FSBackend && argument == "" {
+                confDebug.Panicf("Storage directory of replica %v not set up yet.\n", i)
+            }
+            if backend == S3Backend {
+                usesS3 = true
+            }
+        }
+        // A majority by default.
+        writeQuorum = len(replicas)/2 + 1
+        if _writeQuorum, ok := config.Property["WriteQuorum"]; ok {
+            if n, err := strconv.Atoi(_writeQuorum); err != nil || n < 1 || n > len(replicas) {
+                confDebug.Panicf("Write quorum should be between 1 and the number of replicas.\n")
+            } else {
+                writeQuorum = n
+            }
+        }
+    }
+    if config.Property["ValueShards"] != "" {
+        valueShards = strings.Split(config.Property["ValueShards"], ",")
+        for i, store := range valueShards {
+            valueShards[i] = strings.TrimSpace(store)
+            backend, argument := ParseReplica(valueShards[i])
+            if backend == FSBackend && argument == "" {
+                confDebug.Panicf("Storage directory of value shard store %v not set up yet.\n", i)
+            }
+            if backend == S3Backend {
+                usesS3 = true
+            }
+        }
+        // 4+2 survives the loss of one of three stores.
+        erasureDataShards = 4
+        erasureParityShards = 2
+        if _dataShards, ok := config.Property["ErasureDataShards"]; ok {
+            if n, err := strconv.Atoi(_dataShards); err != nil || n < 1 {
+                confDebug.Panicf("Erasure data shards should be a positive number.\n")
+            } else {
+                erasureDataShards = n
+            }
+        }
+        if _parityShards, ok := config.Property["ErasureParityShards"]; ok {
+            if n, err := strconv.Atoi(_parityShards); err != nil || n < 0 {
+                confDebug.Panicf("Erasure parity shards should not be negative.\n")
+            } else {
+                erasureParityShards = n
+            }
+        }
+        if erasureDataShards+erasureParityShards > 256 {
+            confDebug.Panicf("Erasure coding supports at most 256 shards.\n")
+        }
+    }
+    // The cache size is given in megabytes.
+    cacheDir = config.Property["CacheDir"]
+    if cacheDir != "" {
+        cacheSize = defaultCacheSize
+        if _cacheSize, ok := config.Property["CacheSize"]; ok {
+            if n, err := strconv.ParseInt(_cacheSize, 10, 64); err != nil || n < 1 {
+                confDebug.Panicf("Cache size should be a positive number of megabytes.\n")
+            } else {
+                cacheSize = n << 20
+            }
+        }
+    }
+    if config.Property["Subscriptions"] != "" {
+        subscriptions = strings.Split(config.Property["Subscriptions"], ",")
+        for i, prefix := range subscriptions {
+            subscriptions[i] = strings.Trim(strings.TrimSpace(prefix), "/")
+            if matched, _ := regexp.MatchString("^"+utility.KeyNamePattern+"(/"+utility.KeyNamePattern+")?$", subscriptions[i]); !matched {
+                confDebug.Panicf("Subscription %v should be <nodeId> or <nodeId>/<directory>.\n", prefix)
+            }
+        }
+    }
+    // AWS keys are only mandatory when the data goes to S3.
     if _awsAccessKey, ok := config.Property["AWSAccessKey"]; !ok {
-        confDebug.Panicf("Amazon AWS access key not set up yet.\n")
+        if usesS3 {
+            confDebug.Panicf("Amazon AWS access key not set up yet.\n")
+        }
     } else {
         awsAccessKey = _awsAccessKey
     }
     if _awsSecretKey, ok := config.Property["AWSSecretKey"]; !ok {
-        confDebug.Panicf("Amazon AWS secret key not set up yet.\n")
+        if usesS3 {
+            confDebug.Panicf("Amazon AWS secret key not set up yet.\n")
+        }
     } else {
         awsSecretKey = _awsSecretKey
     }
@@ -168,6 +349,10 @@ func LoadFromFile(filename string) (*Config, error) {
     }
     nodeBucketMap = config.NodeBucketMap
     nodeIpMap = config.NodeIpMap
+    nodeReadCredentials = config.NodeReadCredentials
+    if nodeReadCredentials == nil {
+        nodeReadCredentials = make(map[string]ReadCredential)
+    }
     conf := Config{
         logPath,
         journalPath,
@@ -183,14 +368,41 @@ func LoadFromFile(filename string) (*Config, error) {
         awsAccessKey,
         awsSecretKey,
 
+        storageBackend,
+        storageDir,
+        s3Endpoint,
+        s3Region,
+        s3Addressing,
+        replicas,
+        writeQuorum,
+        valueShards,
+        erasureDataShards,
+        erasureParityShards,
+        cacheDir,
+        cacheSize,
+        subscriptions,
+
         nodeBucketMap,
         nodeIpMap,
+        nodeReadCredentials,
         privateKey,
         publicKeys,
     }
     return &conf, nil
 }
 
+/*
+   Split a replica into its backend and argument, e.g. "fs:/mnt/teapot"
+   or "s3:us-west-1". The argument of an s3 replica is either a region
+   name or an endpoint URL.
+*/
+func ParseReplica(replica string) (backend, argument string) {
+    if i := strings.Index(replica, ":"); i >= 0 {
+        return replica[:i], replica[i+1:]
+    }
+    return replica, ""
+}
+
 func LoadTest(dir string, i int) *Config {
     // TODO randomize this information.
     tempDir, err := ioutil.TempDir(dir, "temp")
@@ -213,6 +425,7 @@ func LoadTest(dir string, i int) *Config {
 
     nodeBucketMap := make(map[string]string)
     nodeIpMap := make(map[string]string)
+    nodeReadCredentials := make(map[string]ReadCredential)
     privateKey, err := rsa.GenerateKey(Reader, 1024)
     if err != nil {
         panic(err.Error())
@@ -238,8 +451,23 @@ func LoadTest(dir string, i int) *Config {
         aWSAccessKey,
         aWSSecretKey,
 
+        S3Backend,
+        "",
+        "",
+        "",
+        "",
+        nil,
+        0,
+        nil,
+        0,
+        0,
+        "",
+        0,
+        nil,
+
         nodeBucketMap,
         nodeIpMap,
+        nodeReadCredentials,
         privateKey,
         publicKeys,
     }
@@ -346,6 +574,7 @@ func GenerateConfig(nodeInfo NodeInfo, passphrase, awsAccessKey, awsSecretKey, p
         nodeIpMap,
         publicKeys,
         privateKey,
+        make(map[string]ReadCredential),
     }
     return config
 }
@@ -362,6 +591,8 @@ func GenerateNodeInfo(nodeId, ipPort, encodedPubKey string) NodeInfo {
         bucketName,
         ipPort,
         encodedPubKey,
+        "",
+        "",
     }
 }
 
@@ -369,6 +600,12 @@ func AddNodeInfo(config Configuration, nodeInfo NodeInfo) Configuration {
     config.NodeBucketMap[nodeInfo.NodeId] = nodeInfo.NodeBucket
     config.NodeIpMap[nodeInfo.NodeId] = nodeInfo.NodeIPPort
     config.PublicKeys[nodeInfo.NodeId] = nodeInfo.PublicKey
+    if nodeInfo.ReadAccessKey != "" {
+        if config.NodeReadCredentials == nil {
+            config.NodeReadCredentials = make(map[string]ReadCredential)
+        }
+        config.NodeReadCredentials[nodeInfo.NodeId] = ReadCredential{nodeInfo.ReadAccessKey, nodeInfo.ReadSecretKey}
+    }
     return config
 }
 
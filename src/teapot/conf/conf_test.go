@@ -38,3 +38,146 @@ func (s *S) TestConfig(c *C) {
 
     c.Assert(config.AESKey, DeepEquals, utility.KeyFromPassphrase("abcd"))
 }
+
+func (s *S) TestFSBackendConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node2", "127.0.0.1:12347", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "", "", encodedPriKey)
+    delete(configuration.Property, "AWSAccessKey")
+    delete(configuration.Property, "AWSSecretKey")
+    configuration.Property["StorageBackend"] = FSBackend
+    configuration.Property["StorageDir"] = s.dir + "/storage"
+    WriteConfigFile(configuration, s.dir+"/teapot.fs.config")
+    config, err := LoadFromFile(s.dir + "/teapot.fs.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.StorageBackend, Equals, FSBackend)
+    c.Assert(config.StorageDir, Equals, s.dir+"/storage")
+    c.Assert(config.AWSAccessKey, Equals, "")
+}
+
+func (s *S) TestS3CompatibleConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node3", "127.0.0.1:12348", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    configuration.Property["S3Endpoint"] = "http://127.0.0.1:9000"
+    configuration.Property["S3Region"] = "local"
+    configuration.Property["S3Addressing"] = "path"
+    WriteConfigFile(configuration, s.dir+"/teapot.s3.config")
+    config, err := LoadFromFile(s.dir + "/teapot.s3.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.StorageBackend, Equals, S3Backend)
+    c.Assert(config.S3Endpoint, Equals, "http://127.0.0.1:9000")
+    c.Assert(config.S3Region, Equals, "local")
+    c.Assert(config.S3Addressing, Equals, "path")
+}
+
+func (s *S) TestReadCredentials(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node4", "127.0.0.1:12349", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    _, peerPubKey := utility.GenerateKeyPairAndEncode()
+    peerInfo := GenerateNodeInfo("test_peer", "127.0.0.1:12350", peerPubKey)
+    peerInfo.ReadAccessKey = "peer_read_access_key"
+    peerInfo.ReadSecretKey = "peer_read_secret_key"
+    WriteNodeInfoFile(peerInfo, s.dir+"/teapot.pub.test_peer")
+    configuration = AddNodeInfo(configuration, ReadNodeInfoFile(s.dir+"/teapot.pub.test_peer"))
+    WriteConfigFile(configuration, s.dir+"/teapot.read.config")
+    config, err := LoadFromFile(s.dir + "/teapot.read.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.NodeReadCredentials["test_peer"], Equals, ReadCredential{"peer_read_access_key", "peer_read_secret_key"})
+    _, ok := config.NodeReadCredentials["test_node4"]
+    c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestReplicatedConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node5", "127.0.0.1:12351", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    configuration.Property["StorageBackend"] = ReplicatedBackend
+    configuration.Property["Replicas"] = "s3:us-west-1, s3:http://127.0.0.1:9000,fs:/mnt/teapot"
+    WriteConfigFile(configuration, s.dir+"/teapot.replicated.config")
+    config, err := LoadFromFile(s.dir + "/teapot.replicated.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.Replicas, DeepEquals, []string{"s3:us-west-1", "s3:http://127.0.0.1:9000", "fs:/mnt/teapot"})
+    c.Assert(config.WriteQuorum, Equals, 2)
+    backend, argument := ParseReplica(config.Replicas[1])
+    c.Assert(backend, Equals, S3Backend)
+    c.Assert(argument, Equals, "http://127.0.0.1:9000")
+
+    configuration.Property["WriteQuorum"] = "4"
+    WriteConfigFile(configuration, s.dir+"/teapot.replicated.config")
+    c.Assert(func() { LoadFromFile(s.dir + "/teapot.replicated.config") }, PanicMatches, "Write quorum(.|\n)*")
+}
+
+func (s *S) TestErasureConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node6", "127.0.0.1:12352", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    configuration.Property["ValueShards"] = "fs:/mnt/a, fs:/mnt/b,s3:us-west-1"
+    WriteConfigFile(configuration, s.dir+"/teapot.erasure.config")
+    config, err := LoadFromFile(s.dir + "/teapot.erasure.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.ValueShards, DeepEquals, []string{"fs:/mnt/a", "fs:/mnt/b", "s3:us-west-1"})
+    c.Assert(config.ErasureDataShards, Equals, 4)
+    c.Assert(config.ErasureParityShards, Equals, 2)
+
+    configuration.Property["ErasureDataShards"] = "0"
+    WriteConfigFile(configuration, s.dir+"/teapot.erasure.config")
+    c.Assert(func() { LoadFromFile(s.dir + "/teapot.erasure.config") }, PanicMatches, "Erasure data shards(.|\n)*")
+}
+
+func (s *S) TestCacheConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node7", "127.0.0.1:12353", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    configuration.Property["CacheDir"] = s.dir + "/cache"
+    WriteConfigFile(configuration, s.dir+"/teapot.cache.config")
+    config, err := LoadFromFile(s.dir + "/teapot.cache.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.CacheSize, Equals, int64(1<<30))
+
+    configuration.Property["CacheSize"] = "16"
+    WriteConfigFile(configuration, s.dir+"/teapot.cache.config")
+    config, err = LoadFromFile(s.dir + "/teapot.cache.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.CacheSize, Equals, int64(16<<20))
+}
+
+func (s *S) TestSubscriptionsConfig(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node8", "127.0.0.1:12354", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    WriteConfigFile(configuration, s.dir+"/teapot.subscriptions.config")
+    config, err := LoadFromFile(s.dir + "/teapot.subscriptions.config")
+    c.Assert(err, IsNil)
+    c.Assert(len(config.Subscriptions), Equals, 0)
+
+    configuration.Property["Subscriptions"] = "alice/docs, bob/"
+    WriteConfigFile(configuration, s.dir+"/teapot.subscriptions.config")
+    config, err = LoadFromFile(s.dir + "/teapot.subscriptions.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.Subscriptions, DeepEquals, []string{"alice/docs", "bob"})
+
+    configuration.Property["Subscriptions"] = "alice/docs/old"
+    WriteConfigFile(configuration, s.dir+"/teapot.subscriptions.config")
+    c.Assert(func() { LoadFromFile(s.dir + "/teapot.subscriptions.config") }, PanicMatches, "Subscription (.|\n)*")
+}
+
+// Subscriptions name node ids and directories as keys do, see utility.KeyNamePattern.
+func (s *S) TestSubscriptionNames(c *C) {
+    encodedPriKey, encodedPubKey := utility.GenerateKeyPairAndEncode()
+    nodeInfo := GenerateNodeInfo("test_node9", "127.0.0.1:12355", encodedPubKey)
+    configuration := GenerateConfig(nodeInfo, "abcd", "test_aws_access_key", "test_aws_secret_key", encodedPriKey)
+    configuration.Property["Subscriptions"] = "node_1/my_docs,Bob2/Docs_2019"
+    WriteConfigFile(configuration, s.dir+"/teapot.names.config")
+    config, err := LoadFromFile(s.dir + "/teapot.names.config")
+    c.Assert(err, IsNil)
+    c.Assert(config.Subscriptions, DeepEquals, []string{"node_1/my_docs", "Bob2/Docs_2019"})
+
+    // Directories of keys take neither, a subscription to them would never match.
+    for _, subscription := range []string{"alice/docs-old", "alice/docs.old", "alice-2"} {
+        configuration.Property["Subscriptions"] = subscription
+        WriteConfigFile(configuration, s.dir+"/teapot.names.config")
+        c.Assert(func() { LoadFromFile(s.dir + "/teapot.names.config") }, PanicMatches, "Subscription (.|\n)*")
+    }
+}
@@ -39,6 +39,44 @@ func (log *Log) canWrite(nodeId NodeID, key Key, dvv versionVector) bool {
     return false
 }
 
+// Whether nodeId was given the read key of key by the mode in effect at dvv.
+func (log *Log) canRead(nodeId NodeID, key Key, dvv versionVector) bool {
+    owner, directory, _, err := splitKey(key)
+    if err != nil {
+        acDebug.Debugf("%v", err.Error())
+        return false
+    }
+    if owner == nodeId {
+        return true
+    }
+    fullDVV := make(versionVector)
+    fullDVV = buildFullDvv(log, dvv, fullDVV)
+    versionOfOwner := fullDVV[owner]
+    length := len(log.memLog.ReadKeyInfo[owner][directory])
+    if length > 0 {
+        index := sort.Search(length, func(i int) bool {
+            return log.memLog.ReadKeyInfo[owner][directory][i].AcceptStamp > versionOfOwner.AcceptStamp
+        })
+        if index > 0 {
+            info := log.memLog.ReadKeyInfo[owner][directory][index-1]
+            return info.Readers[nodeId] || info.Writers[nodeId]
+        }
+    }
+    return false
+}
+
+// The update that wrote the value.
+func (log *Log) updateOfValue(encodedHashOfValue EncodedHash) *LogEntry {
+    return log.updatesOfValues[encodedHashOfValue]
+}
+
+// Index the update logEntry by its value, other entries are left out.
+func (log *Log) indexValue(logEntry *LogEntry) {
+    if update, ok := logEntry.Message.(*Update); ok {
+        log.updatesOfValues[update.HashOfValue] = logEntry
+    }
+}
+
 // This accept stamp is supposed to be the accept stamp of the dependent update from the owner.
 func (log *Log) getReadKey(key Key, dvv versionVector) SecretKey {
     owner, directory, _, err := splitKey(key)
@@ -147,6 +147,28 @@ func (s *ACSuite) TestChangeMode(c *C) {
     c.Assert(value, DeepEquals, []byte("world4"))
 }
 
+func (s *ACSuite) TestCanRead(c *C) {
+    log := s.logs[0]
+    updates := make([]*LogEntry, 0)
+    for i := 0; i < 2; i++ {
+        if i == 1 {
+            // Let node 1 read from now on.
+            c.Assert(log.Commit(log.NewLogEntry(s.newChangeMode(log, 1, -1))), IsNil)
+        }
+        update := log.NewUpdate(Key(fmt.Sprintf("%v/hello/%v", log.memLog.MyNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        logEntry := log.NewLogEntry(update)
+        c.Assert(log.Commit(logEntry), IsNil)
+        c.Assert(log.GetUpdateOfValue(update.HashOfValue), Equals, logEntry)
+        updates = append(updates, logEntry)
+    }
+    c.Assert(log.GetUpdateOfValue("no_such_value"), IsNil)
+    for i, logEntry := range updates {
+        c.Assert(log.CanRead(s.logs[0].memLog.MyNodeId, logEntry), Equals, true)
+        c.Assert(log.CanRead(s.logs[1].memLog.MyNodeId, logEntry), Equals, i == 1)
+        c.Assert(log.CanRead(s.logs[2].memLog.MyNodeId, logEntry), Equals, false)
+    }
+}
+
 func (s *ACSuite) TestRevoke(c *C) {
     // 0 grants 1 write access first and then revoke it.
     // 1 ignores the second revocation, all updates from A should be able to commit.
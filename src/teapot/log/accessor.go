@@ -1,6 +1,7 @@
 package log
 
 import (
+    "sort"
     "teapot/utility"
 )
 
@@ -49,3 +50,66 @@ func (log *Log) getEntryAfter(virtualNodeId NodeID, versionInfo versionInfo) (in
     }
     return -1, nil
 }
+
+/*
+   Entries of every branch after since, each after the entries it
+   depends on. Dependencies not after since are taken to be known.
+*/
+func (log *Log) entriesSince(since map[NodeID]VersionInfo, max int) ([]*LogEntry, bool) {
+    pending := make(map[NodeID][]*LogEntry)
+    missing := make(map[EncodedHash]bool)
+    nodeIds := make([]string, 0)
+    for nodeId, logEntries := range log.memLog.SequentialLog {
+        i := 0
+        if known, ok := since[nodeId]; ok {
+            i = sort.Search(len(logEntries), func(i int) bool {
+                return logEntries[i].AcceptStamp > known.AcceptStamp
+            })
+        }
+        if i == len(logEntries) {
+            continue
+        }
+        pending[nodeId] = logEntries[i:]
+        for _, logEntry := range logEntries[i:] {
+            missing[logEntry.encodedHash()] = true
+        }
+        nodeIds = append(nodeIds, string(nodeId))
+    }
+    sort.Strings(nodeIds)
+    results := make([]*LogEntry, 0)
+    for len(pending) > 0 {
+        if len(results) >= max {
+            return results, true
+        }
+        progress := false
+        for _, id := range nodeIds {
+            nodeId := NodeID(id)
+            logEntries, ok := pending[nodeId]
+            if !ok || !log.dependenciesSent(logEntries[0], missing) {
+                continue
+            }
+            results = append(results, logEntries[0])
+            delete(missing, logEntries[0].encodedHash())
+            if len(logEntries) == 1 {
+                delete(pending, nodeId)
+            } else {
+                pending[nodeId] = logEntries[1:]
+            }
+            progress = true
+            break
+        }
+        if !progress {
+            accessorDebug.Panicf("Should not happen: entries depend on each other.")
+        }
+    }
+    return results, false
+}
+
+func (log *Log) dependenciesSent(logEntry *LogEntry, missing map[EncodedHash]bool) bool {
+    for _, versionInfo := range logEntry.DVV {
+        if missing[versionInfo.HashOfUpdate] {
+            return false
+        }
+    }
+    return true
+}
@@ -75,3 +75,37 @@ func (s *AccessorSuite) TestGetIthEntry(c *C) {
         }
     }
 }
+
+func (s *AccessorSuite) TestGetEntriesSince(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 3)
+    logs := make([]*Log, 3)
+    for i := range logs {
+        logs[i] = newTestableLog(configs[i])
+    }
+    // logs[0] interleaves its own entries with those of logs[1].
+    for i := 0; i < 5; i++ {
+        for _, log := range logs[:2] {
+            update := log.NewUpdate(Key(string(log.memLog.MyNodeId)+"/dir/"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+            logEntry := log.NewLogEntry(update)
+            c.Assert(log.Commit(logEntry), IsNil)
+            if log != logs[0] {
+                c.Assert(logs[0].Commit(logEntry), IsNil)
+            }
+        }
+    }
+    // logs[2] catches up two entries at a time, committing in the order given.
+    pages := 0
+    for more := true; more; pages++ {
+        var logEntries []*LogEntry
+        logEntries, more = logs[0].GetEntriesSince(logs[2].GetVersionVector(), 2)
+        c.Assert(len(logEntries) <= 2, Equals, true)
+        for _, logEntry := range logEntries {
+            c.Assert(logs[2].Commit(logEntry), IsNil)
+        }
+    }
+    c.Assert(pages, Equals, 5)
+    c.Assert(logs[2].GetVersionVector(), DeepEquals, logs[0].GetVersionVector())
+    logEntries, more := logs[0].GetEntriesSince(logs[2].GetVersionVector(), 2)
+    c.Assert(len(logEntries), Equals, 0)
+    c.Assert(more, Equals, false)
+}
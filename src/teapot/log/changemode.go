@@ -28,30 +28,34 @@ func (changeMode *ChangeMode) handle(log *Log, logEntry *LogEntry) error {
     for nodeId := range changeMode.Writers {
         writers[nodeId] = true
     }
+    readers := make(map[NodeID]bool)
+    for nodeId := range changeMode.Readers {
+        readers[nodeId] = true
+    }
     //log.memLog.Modes[logEntry.NodeId][changeMode.Directory] = append(log.memLog.Modes[logEntry.NodeId][changeMode.Directory], logEntry)
     //changeModeDebug.Debugf("Mode info: %+v", log.memLog.Modes)
     // If I am among the writers
     if key, ok := changeMode.Writers[log.memLog.MyNodeId]; ok {
         // store the key in both writekeyinfo and readkeyinfo
         if myKey, err := extractKey(key, log.memLog.PrivateKey, changeMode.ROQ); err == nil {
-            log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers})
-            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers})
+            log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers, readers})
+            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers, readers})
         } else {
-            log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers})
-            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers})
+            log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers, readers})
+            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers, readers})
         }
         // If I am among the readers
     } else {
         // set writekeyinfo to nil
-        log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers})
+        log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers, readers})
         if key, ok := changeMode.Readers[log.memLog.MyNodeId]; ok {
             if myKey, err := extractKey(key, log.memLog.PrivateKey, changeMode.ROQ); err == nil {
-                log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers})
+                log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{myKey, logEntry.AcceptStamp, writers, readers})
             } else {
-                log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers})
+                log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers, readers})
             }
         } else {
-            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers})
+            log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory] = append(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory], keyInfo{nil, logEntry.AcceptStamp, writers, readers})
         }
     }
     if len(log.memLog.ReadKeyInfo[logEntry.NodeId][changeMode.Directory]) != len(log.memLog.WriteKeyInfo[logEntry.NodeId][changeMode.Directory]) {
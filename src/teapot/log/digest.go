@@ -0,0 +1,207 @@
+package log
+
+import (
+    "bytes"
+    "math"
+    "sort"
+    "teapot/utility"
+)
+
+const digestDebug utility.Debug = true
+
+// Entries of a branch are summed up per range of this many accept stamps, the leaves of its tree.
+const DigestRangeWidth Timestamp = 64
+
+// Every range above the leaves is cut into this many ranges of the level below.
+const DigestFanout = 16
+
+// Ranges of higher levels would not fit a Timestamp.
+const DigestMaxLevel = 14
+
+/*
+   Sums up the entries of a branch in a range of accept stamps. Two logs
+   holding the same entries in a range have the same digest of it, values
+   are compared apart.
+*/
+type RangeDigest struct {
+    Count int
+    Hash  EncodedHash
+}
+
+/*
+   The top of the tree of a branch: the digests of the ranges of the
+   lowest level holding its entries in at most DigestFanout ranges, by
+   range start. The leaves are level 0.
+*/
+type DigestTop struct {
+    Level   int
+    Digests map[Timestamp]RangeDigest
+}
+
+// The width of the ranges of level.
+func DigestWidth(level int) Timestamp {
+    width := DigestRangeWidth
+    for i := 0; i < level; i++ {
+        width *= DigestFanout
+    }
+    return width
+}
+
+// The start of the range of level acceptStamp falls in.
+func DigestRangeOf(acceptStamp Timestamp, level int) Timestamp {
+    return acceptStamp - acceptStamp%DigestWidth(level)
+}
+
+// The entries of logEntries with accept stamps in [from, to).
+func entriesBetween(logEntries []*LogEntry, from, to Timestamp) []*LogEntry {
+    i := sort.Search(len(logEntries), func(i int) bool {
+        return logEntries[i].AcceptStamp >= from
+    })
+    j := sort.Search(len(logEntries), func(j int) bool {
+        return logEntries[j].AcceptStamp >= to
+    })
+    if j < i {
+        return logEntries[:0]
+    }
+    return logEntries[i:j]
+}
+
+func digestOf(logEntries []*LogEntry) RangeDigest {
+    var buf bytes.Buffer
+    for _, logEntry := range logEntries {
+        buf.WriteString(string(logEntry.encodedHash()) + "\n")
+    }
+    return RangeDigest{len(logEntries), EncodedHash(utility.GetHashOfBytesAndEncode(buf.Bytes()))}
+}
+
+/*
+   The accept stamp of the oldest entry held of each branch. Entries
+   before it may have been collected.
+*/
+func (log *Log) GetHorizon() map[NodeID]Timestamp {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    horizon := make(map[NodeID]Timestamp)
+    for nodeId, logEntries := range log.memLog.SequentialLog {
+        if len(logEntries) > 0 {
+            horizon[nodeId] = logEntries[0].AcceptStamp
+        }
+    }
+    return horizon
+}
+
+/*
+   The top of the tree of every branch, see DigestTop. Entries before
+   floors of their branch are left out.
+*/
+func (log *Log) GetDigests(floors map[NodeID]Timestamp) map[NodeID]DigestTop {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    tops := make(map[NodeID]DigestTop)
+    for nodeId, logEntries := range log.memLog.SequentialLog {
+        logEntries = entriesBetween(logEntries, floors[nodeId], Timestamp(math.MaxInt64))
+        if len(logEntries) == 0 {
+            continue
+        }
+        first, last := logEntries[0].AcceptStamp, logEntries[len(logEntries)-1].AcceptStamp
+        level := 0
+        for level < DigestMaxLevel && (DigestRangeOf(last, level)-DigestRangeOf(first, level))/DigestWidth(level) >= DigestFanout {
+            level++
+        }
+        top := DigestTop{level, make(map[Timestamp]RangeDigest)}
+        for i := 0; i < len(logEntries); {
+            start := DigestRangeOf(logEntries[i].AcceptStamp, level)
+            j := i
+            for j < len(logEntries) && DigestRangeOf(logEntries[j].AcceptStamp, level) == start {
+                j++
+            }
+            top.Digests[start] = digestOf(logEntries[i:j])
+            i = j
+        }
+        tops[nodeId] = top
+    }
+    return tops
+}
+
+/*
+   The digest of the range of level of the branch starting at start.
+   Entries before floor are left out.
+*/
+func (log *Log) GetDigest(nodeId NodeID, level int, start, floor Timestamp) RangeDigest {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    if level < 0 || level > DigestMaxLevel {
+        return RangeDigest{}
+    }
+    return digestOf(log.entriesInRange(nodeId, level, start, floor))
+}
+
+/*
+   The digests of the ranges one level below the range of level of the
+   branch starting at start, by range start. Empty ranges and entries
+   before floor are left out.
+*/
+func (log *Log) GetChildDigests(nodeId NodeID, level int, start, floor Timestamp) map[Timestamp]RangeDigest {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    digests := make(map[Timestamp]RangeDigest)
+    if level < 1 || level > DigestMaxLevel {
+        return digests
+    }
+    logEntries := log.entriesInRange(nodeId, level, start, floor)
+    for i := 0; i < len(logEntries); {
+        child := DigestRangeOf(logEntries[i].AcceptStamp, level-1)
+        j := i
+        for j < len(logEntries) && DigestRangeOf(logEntries[j].AcceptStamp, level-1) == child {
+            j++
+        }
+        digests[child] = digestOf(logEntries[i:j])
+        i = j
+    }
+    return digests
+}
+
+// The entries of the range of level starting at start, from floor on.
+func (log *Log) entriesInRange(nodeId NodeID, level int, start, floor Timestamp) []*LogEntry {
+    from := DigestRangeOf(start, level)
+    to := from + DigestWidth(level)
+    if floor > from {
+        from = floor
+    }
+    return entriesBetween(log.memLog.SequentialLog[nodeId], from, to)
+}
+
+/*
+   The entries of the branch with accept stamps in the leaf range
+   starting at start, leaving out those before floor.
+*/
+func (log *Log) GetEntriesInRange(nodeId NodeID, start, floor Timestamp) []*LogEntry {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    logEntries := log.entriesInRange(nodeId, 0, start, floor)
+    results := make([]*LogEntry, len(logEntries))
+    copy(results, logEntries)
+    digestDebug.Debugf("%v entries of %v from %v", len(results), nodeId, start)
+    return results
+}
+
+// The updates whose value is not held locally.
+func (log *Log) GetUpdatesWithoutValue() []*LogEntry {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    results := make([]*LogEntry, 0)
+    for encodedHashOfValue, logEntry := range log.updatesOfValues {
+        if !log.HasValue(encodedHashOfValue) {
+            results = append(results, logEntry)
+        }
+    }
+    return results
+}
+
+// Whether the value is held locally.
+func (log *Log) HasValue(encodedHashOfValue EncodedHash) bool {
+    log.valuesLock.RLock()
+    defer log.valuesLock.RUnlock()
+    _, ok := log.memLog.Values[encodedHashOfValue]
+    return ok
+}
@@ -0,0 +1,103 @@
+package log
+
+import (
+    "bytes"
+    "encoding/gob"
+    . "launchpad.net/gocheck"
+    "strconv"
+    "teapot/conf"
+)
+
+type DigestSuite struct {
+    dir string
+}
+
+var _ = Suite(&DigestSuite{})
+
+func (s *DigestSuite) SetUpSuite(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *DigestSuite) TestDigests(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logs := []*Log{newTestableLog(configs[0]), newTestableLog(configs[1])}
+    writer := logs[0].memLog.MyNodeId
+    n := int(DigestRangeWidth) + 36
+    for i := 0; i < n; i++ {
+        update := logs[0].NewUpdate(Key(string(writer)+"/dir/"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+        logEntry := logs[0].NewLogEntry(update)
+        c.Assert(logs[0].Commit(logEntry), IsNil)
+        // logs[1] gets the first range, without the values.
+        if DigestRangeOf(logEntry.AcceptStamp, 0) == 0 {
+            c.Assert(logs[1].Commit(logEntry), IsNil)
+        }
+    }
+    floors := logs[1].GetHorizon()
+    c.Assert(floors[writer], Equals, Timestamp(1))
+    mine, theirs := logs[1].GetDigests(floors), logs[0].GetDigests(floors)
+    c.Assert(mine[writer].Level, Equals, 0)
+    c.Assert(theirs[writer].Level, Equals, 0)
+    c.Assert(len(mine[writer].Digests), Equals, 1)
+    c.Assert(len(theirs[writer].Digests), Equals, 2)
+    // The first range matches, missing values aside.
+    c.Assert(mine[writer].Digests[0], Equals, theirs[writer].Digests[0])
+    c.Assert(logs[0].GetDigest(writer, 0, DigestRangeWidth, floors[writer]), Equals, theirs[writer].Digests[DigestRangeWidth])
+    c.Assert(len(logs[0].GetEntriesInRange(writer, DigestRangeWidth, floors[writer])), Equals, n-int(DigestRangeWidth)+1)
+    c.Assert(len(logs[1].GetUpdatesWithoutValue()), Equals, int(DigestRangeWidth)-1)
+    for _, logEntry := range logs[1].GetEntriesInRange(writer, 0, floors[writer]) {
+        update := logEntry.Message.(*Update)
+        value, err := logs[0].GetValue(update.HashOfValue)
+        c.Assert(err, IsNil)
+        c.Assert(logs[1].WriteValue(update.HashOfValue, value), IsNil)
+    }
+    c.Assert(len(logs[1].GetUpdatesWithoutValue()), Equals, 0)
+    // Entries before the floor are left out.
+    floors[writer] = 10
+    c.Assert(logs[0].GetDigests(floors)[writer].Digests[0].Count, Equals, int(DigestRangeWidth)-10)
+    c.Assert(len(logs[0].GetEntriesInRange(writer, 0, floors[writer])), Equals, int(DigestRangeWidth)-10)
+}
+
+// The tops stay as small as the log grows, what is below is asked for range by range.
+func (s *DigestSuite) TestDigestTree(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 1)
+    theLog := newTestableLog(configs[0])
+    writer := theLog.memLog.MyNodeId
+    size := func() int {
+        var buf bytes.Buffer
+        c.Assert(gob.NewEncoder(&buf).Encode(theLog.GetDigests(nil)), IsNil)
+        return buf.Len()
+    }
+    n := 2*DigestFanout*int(DigestRangeWidth) + 100
+    sizes := make([]int, 0)
+    for i := 0; i < n; i++ {
+        update := theLog.NewUpdate(Key(string(writer)+"/dir/"+strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+        c.Assert(theLog.Commit(theLog.NewLogEntry(update)), IsNil)
+        if i == 100 || i == n-1 {
+            sizes = append(sizes, size())
+        }
+    }
+    top := theLog.GetDigests(nil)[writer]
+    c.Assert(top.Level, Equals, 1)
+    c.Assert(len(top.Digests), Equals, 3)
+    // Twenty times the entries, hardly a larger top.
+    c.Assert(sizes[1] < 2*sizes[0], Equals, true)
+    c.Assert(sizes[1] < 2048, Equals, true)
+
+    // The children add up to their parent.
+    count := 0
+    for start, digest := range top.Digests {
+        c.Assert(theLog.GetDigest(writer, 1, start, 0), Equals, digest)
+        children := theLog.GetChildDigests(writer, 1, start, 0)
+        c.Assert(len(children) <= DigestFanout, Equals, true)
+        sum := 0
+        for child, childDigest := range children {
+            c.Assert(DigestRangeOf(child, 1), Equals, start)
+            c.Assert(len(theLog.GetEntriesInRange(writer, child, 0)), Equals, childDigest.Count)
+            sum += childDigest.Count
+        }
+        c.Assert(sum, Equals, digest.Count)
+        count += sum
+    }
+    c.Assert(count, Equals, n)
+    c.Assert(len(theLog.GetChildDigests(writer, 0, 0, 0)), Equals, 0)
+}
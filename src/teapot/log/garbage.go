@@ -0,0 +1,252 @@
+package log
+
+import (
+    "bytes"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "teapot/utility"
+    "time"
+)
+
+const garbageDebug utility.Debug = true
+
+// How often the collector checks whether garbage is still waiting to be synced.
+const garbagePollInterval = 10 * time.Second
+
+// The list is rewritten after this many deletions.
+const garbageBatch = 100
+
+/*
+   Log entries and values left over by GC, waiting to be deleted from
+   ValueDir and from remote storage.
+   The list is written to its file before anything is deleted, so that
+   deleting resumes after a crash; deleting an object twice is harmless.
+   The garbage of a GC is prepared before the log is rewritten and only
+   deleted once it is released.
+   The file holds "Entry:<hash>" and "Value:<hash>" lines, and
+   "Prepared:<hash of CDL>:Entry:<hash>" and so on for prepared garbage.
+*/
+type garbageList struct {
+    path    string
+    lock    *sync.Mutex
+    found   *sync.Cond
+    entries map[EncodedHash]bool
+    values  map[EncodedHash]bool
+    // By hash of CDL.
+    prepared map[EncodedHash]*garbageSet
+}
+
+type garbageSet struct {
+    entries []EncodedHash
+    values  []EncodedHash
+}
+
+func newGarbageList(path string) *garbageList {
+    lock := new(sync.Mutex)
+    gl := &garbageList{
+        path,
+        lock,
+        sync.NewCond(lock),
+        make(map[EncodedHash]bool),
+        make(map[EncodedHash]bool),
+        make(map[EncodedHash]*garbageSet),
+    }
+    if !existFile(path) {
+        return gl
+    }
+    iterator := newJournalIterator(path)
+    if iterator == nil {
+        return gl
+    }
+    for {
+        line, err := iterator.NextJournalEntry()
+        if err != nil {
+            garbageDebug.Error(err)
+            break
+        }
+        if line == "" {
+            break
+        }
+        if strings.HasPrefix(line, "Prepared:") {
+            parts := strings.SplitN(line, ":", 4)
+            if len(parts) != 4 {
+                garbageDebug.Debugf("Malformed garbage: %v", line)
+                continue
+            }
+            set := gl.preparedSet(EncodedHash(parts[1]))
+            if parts[2] == "Entry" {
+                set.entries = append(set.entries, EncodedHash(parts[3]))
+            } else {
+                set.values = append(set.values, EncodedHash(parts[3]))
+            }
+        } else if strings.HasPrefix(line, "Entry:") {
+            gl.entries[EncodedHash(strings.TrimPrefix(line, "Entry:"))] = true
+        } else if strings.HasPrefix(line, "Value:") {
+            gl.values[EncodedHash(strings.TrimPrefix(line, "Value:"))] = true
+        }
+    }
+    return gl
+}
+
+// Add to the list, which is on disk once add returns without error.
+func (gl *garbageList) add(entries, values []EncodedHash) error {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    for _, encodedHash := range entries {
+        gl.entries[encodedHash] = true
+    }
+    for _, encodedHash := range values {
+        gl.values[encodedHash] = true
+    }
+    if err := gl.save(); err != nil {
+        return garbageDebug.Error(err)
+    }
+    gl.found.Broadcast()
+    return nil
+}
+
+func (gl *garbageList) preparedSet(encodedHashOfCDL EncodedHash) *garbageSet {
+    set, ok := gl.prepared[encodedHashOfCDL]
+    if !ok {
+        set = &garbageSet{make([]EncodedHash, 0), make([]EncodedHash, 0)}
+        gl.prepared[encodedHashOfCDL] = set
+    }
+    return set
+}
+
+// Keep the garbage of the GC of a CDL, on disk once prepare returns without error.
+func (gl *garbageList) prepare(encodedHashOfCDL EncodedHash, entries, values []EncodedHash) error {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    gl.prepared[encodedHashOfCDL] = &garbageSet{entries, values}
+    if err := gl.save(); err != nil {
+        return garbageDebug.Error(err)
+    }
+    return nil
+}
+
+func (gl *garbageList) isPrepared(encodedHashOfCDL EncodedHash) bool {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    _, ok := gl.prepared[encodedHashOfCDL]
+    return ok
+}
+
+// Hand the garbage of the GC of a CDL over for deletion.
+func (gl *garbageList) release(encodedHashOfCDL EncodedHash) error {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    set, ok := gl.prepared[encodedHashOfCDL]
+    if !ok {
+        return nil
+    }
+    delete(gl.prepared, encodedHashOfCDL)
+    for _, encodedHash := range set.entries {
+        gl.entries[encodedHash] = true
+    }
+    for _, encodedHash := range set.values {
+        gl.values[encodedHash] = true
+    }
+    if err := gl.save(); err != nil {
+        return garbageDebug.Error(err)
+    }
+    gl.found.Broadcast()
+    return nil
+}
+
+// Forget the garbage of a GC which did not rewrite the log.
+func (gl *garbageList) drop(encodedHashOfCDL EncodedHash) error {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    delete(gl.prepared, encodedHashOfCDL)
+    return gl.save()
+}
+
+// The garbage prepared and not released yet, by hash of CDL.
+func (gl *garbageList) preparedGC() map[EncodedHash]garbageSet {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    prepared := make(map[EncodedHash]garbageSet)
+    for encodedHashOfCDL, set := range gl.prepared {
+        prepared[encodedHashOfCDL] = *set
+    }
+    return prepared
+}
+
+// Wait for garbage and return all of it.
+func (gl *garbageList) wait() (entries, values []EncodedHash) {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    for len(gl.entries) == 0 && len(gl.values) == 0 {
+        gl.found.Wait()
+    }
+    return sortedHashes(gl.entries), sortedHashes(gl.values)
+}
+
+// Remove deleted objects from the list.
+func (gl *garbageList) done(entries, values []EncodedHash) error {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    for _, encodedHash := range entries {
+        delete(gl.entries, encodedHash)
+    }
+    for _, encodedHash := range values {
+        delete(gl.values, encodedHash)
+    }
+    return gl.save()
+}
+
+func (gl *garbageList) isGarbage(encodedHash EncodedHash) bool {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    return gl.entries[encodedHash] || gl.values[encodedHash]
+}
+
+func (gl *garbageList) size() int {
+    gl.lock.Lock()
+    defer gl.lock.Unlock()
+    return len(gl.entries) + len(gl.values)
+}
+
+func (gl *garbageList) save() error {
+    if len(gl.entries) == 0 && len(gl.values) == 0 && len(gl.prepared) == 0 {
+        if err := os.Remove(gl.path); err != nil && !os.IsNotExist(err) {
+            return garbageDebug.Error(err)
+        }
+        return nil
+    }
+    var buf bytes.Buffer
+    for _, encodedHash := range sortedHashes(gl.entries) {
+        buf.WriteString("Entry:" + string(encodedHash) + "\n")
+    }
+    for _, encodedHash := range sortedHashes(gl.values) {
+        buf.WriteString("Value:" + string(encodedHash) + "\n")
+    }
+    for encodedHashOfCDL, set := range gl.prepared {
+        for _, encodedHash := range set.entries {
+            buf.WriteString("Prepared:" + string(encodedHashOfCDL) + ":Entry:" + string(encodedHash) + "\n")
+        }
+        for _, encodedHash := range set.values {
+            buf.WriteString("Prepared:" + string(encodedHashOfCDL) + ":Value:" + string(encodedHash) + "\n")
+        }
+    }
+    if err := writeFile(gl.path, buf.Bytes()); err != nil {
+        return garbageDebug.Error(err)
+    }
+    return nil
+}
+
+func sortedHashes(set map[EncodedHash]bool) []EncodedHash {
+    hashes := make([]string, 0, len(set))
+    for encodedHash := range set {
+        hashes = append(hashes, string(encodedHash))
+    }
+    sort.Strings(hashes)
+    result := make([]EncodedHash, len(hashes))
+    for i, encodedHash := range hashes {
+        result[i] = EncodedHash(encodedHash)
+    }
+    return result
+}
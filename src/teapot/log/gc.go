@@ -27,21 +27,29 @@ func (log *Log) performGC(cdl *cDL) error {
     // Replay logs before the cut in CDL to get a checkpoint of the system.
     // Store everything in the checkpoint into stable storage
     // Backup
-    if err := log.takeSnapshot(cdl); err != nil {
-        return logDebug.Error(err)
-    }
-
-    // Do the real Garbage collection.
-    if err := log.garbageCollectValue(cdl); err != nil {
+    garbageValues, err := log.takeSnapshot(cdl)
+    if err != nil {
         return logDebug.Error(err)
     }
     // needs to replace current log with new log.
-    newLog := NewLog(log.conf)
-    if newLog == nil {
+    // Keep the remote storage, its outbox and worker carry on.
+    newLog := newLog(log.conf, log.theAdaptor)
+    newLog.rs = log.rs
+    if err := newLog.rebuild(); err != nil {
         return logDebug.Error(errors.New("Failed to create log after GC."))
     }
+    // So are the locks, readers may be waiting on them.
+    newLog.commitLock, newLog.gcMutex, newLog.valuesLock = log.commitLock, log.gcMutex, log.valuesLock
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    log.valuesLock.Lock()
+    defer log.valuesLock.Unlock()
     *log = *newLog
     delete(log.memLog.LocalCDLs, cdl.encodedHash())
+    for _, encodedHash := range garbageValues {
+        delete(log.memLog.Values, encodedHash)
+        delete(log.updatesOfValues, encodedHash)
+    }
     return nil
 }
 
@@ -65,23 +73,31 @@ func (log *Log) proposeCut() versionVector {
     return validCut
 }
 
-func (log *Log) takeSnapshot(cdl *cDL) error {
+/*
+   Replay the log up to the cut into a new snapshot and rewrite the log
+   with what is left. The garbage is prepared before and handed to remote
+   storage for deletion after. Return the values to be deleted.
+*/
+func (log *Log) takeSnapshot(cdl *cDL) ([]EncodedHash, error) {
     gcDebug.Debugf("Waiting for lock.")
     log.commitLock.Lock()
     defer log.commitLock.Unlock()
     gcDebug.Debugf("Lock acquired.")
-    tempLog := newLog(log.conf)
+    tempLog := newLog(log.conf, log.theAdaptor)
     tempDir, err := ioutil.TempDir("/tmp/", "temp_log")
     if err != nil {
-        return gcDebug.Error(err)
+        return nil, gcDebug.Error(err)
     }
     tempLs := newLogStorage(tempDir + "/log.txt")
+    collected := make([]*LogEntry, 0)
+    // Values of the entries left in the log.
+    live := make(map[EncodedHash]bool)
     if tempLs == nil {
-        return gcDebug.Error(errors.New("Fail to create log storage"))
+        return nil, gcDebug.Error(errors.New("Fail to create log storage"))
     }
     // First recover from latest snapshot
     if err := tempLog.recoverSnapshot(); err != nil {
-        return gcDebug.Error(err)
+        return nil, gcDebug.Error(err)
     }
     // Iterate over log to replay until the CDL
     iterator := newLogIterator(log.conf.LogPath)
@@ -89,7 +105,7 @@ func (log *Log) takeSnapshot(cdl *cDL) error {
         for {
             logEntry, err := iterator.NextLogEntry()
             if err != nil {
-                return gcDebug.Error(err)
+                return nil, gcDebug.Error(err)
             }
             if logEntry == nil {
                 break
@@ -97,19 +113,23 @@ func (log *Log) takeSnapshot(cdl *cDL) error {
             encodedHashOfLogEntry := logEntry.encodedHash()
             if cdl.ToBeDeleted[log.memLog.EntryNodeMap[encodedHashOfLogEntry]].AcceptStamp >= logEntry.AcceptStamp {
                 if err := tempLog.check(logEntry); err != nil {
-                    return gcDebug.Error(err)
+                    return nil, gcDebug.Error(err)
                 }
                 tempLog.updateMemoryState(logEntry)
+                collected = append(collected, logEntry)
             } else {
                 // write to a new log file.
                 if err := tempLs.Append(logEntry); err != nil {
-                    return gcDebug.Error(err)
+                    return nil, gcDebug.Error(err)
+                }
+                if update, ok := logEntry.Message.(*Update); ok {
+                    live[update.HashOfValue] = true
                 }
             }
         }
         //gcDebug.Debugf("memLog after replay: %+v", tempLog.memLog)
     } else {
-        return gcDebug.Error(errors.New("Cannot read and replay log."))
+        return nil, gcDebug.Error(errors.New("Cannot read and replay log."))
     }
     // perform "GC" on memLog
     log.memLog.LogIndexedByHash = make(logIndexedByHash)
@@ -130,10 +150,14 @@ func (log *Log) takeSnapshot(cdl *cDL) error {
     }
     // TODO more GC on memLog
     gcDebug.Debugf("memLog after clean: %+v", tempLog.memLog)
+    garbageValues, err := log.garbageCollectValue(cdl, collected, tempLog.memLog, live)
+    if err != nil {
+        return nil, gcDebug.Error(err)
+    }
 
     // persist the snapshot
     if snapshotPath, err := log.sm.NewSnapshot(tempLog.memLog); err != nil {
-        return gcDebug.Error(err)
+        return nil, gcDebug.Error(err)
     } else {
         gcDebug.Debugf("Snapshot persisted at: %v", snapshotPath)
         lastSnapshot, err := log.sm.GetLastSnapshotFolder()
@@ -141,12 +165,63 @@ func (log *Log) takeSnapshot(cdl *cDL) error {
     }
     // rename the new log file to log.
     if err := os.Rename(tempLs.logFilePath, log.conf.LogPath); err != nil {
-        return gcDebug.Error(err)
+        return nil, gcDebug.Error(err)
     }
-    return nil
+    if err := log.rs.CollectGarbage(cdl.encodedHash()); err != nil {
+        return nil, gcDebug.Error(err)
+    }
+    return garbageValues, nil
 }
 
-// TODO remove unnecessary values.
-func (log *Log) garbageCollectValue(cdl *cDL) error {
-    return nil
+/*
+   Prepare what the snapshot makes unnecessary for deletion by remote
+   storage: the collected log entries, except the last one of every node
+   which the snapshot keeps, and their values unless a snapshot or the
+   rest of the log, whose values are live, still refers to them. Every
+   snapshot is kept, so are its values. Return the values to be deleted.
+*/
+func (log *Log) garbageCollectValue(cdl *cDL, collected []*LogEntry, snapshot *logInMemory, live map[EncodedHash]bool) ([]EncodedHash, error) {
+    kept := make(map[EncodedHash]bool)
+    folders, err := log.sm.GetAllSnapshotFolders()
+    if err != nil {
+        return nil, gcDebug.Error(err)
+    }
+    memLogs := []*logInMemory{snapshot}
+    for _, folder := range folders {
+        memLog, err := log.sm.ReadSnapshot(folder)
+        if err != nil {
+            return nil, gcDebug.Error(err)
+        }
+        memLogs = append(memLogs, memLog)
+    }
+    for _, memLog := range memLogs {
+        for _, updates := range memLog.Checkpoint {
+            for _, logEntry := range updates {
+                if update, ok := logEntry.Message.(*Update); ok {
+                    live[update.HashOfValue] = true
+                }
+            }
+        }
+    }
+    for _, logEntries := range snapshot.SequentialLog {
+        for _, logEntry := range logEntries {
+            kept[logEntry.encodedHash()] = true
+        }
+    }
+    entries := make([]EncodedHash, 0, len(collected))
+    values := make([]EncodedHash, 0)
+    for _, logEntry := range collected {
+        if update, ok := logEntry.Message.(*Update); ok && !live[update.HashOfValue] {
+            live[update.HashOfValue] = true
+            values = append(values, update.HashOfValue)
+        }
+        if encodedHash := logEntry.encodedHash(); !kept[encodedHash] {
+            entries = append(entries, encodedHash)
+        }
+    }
+    gcDebug.Debugf("Garbage of %v: %v log entries, %v values.", cdl.encodedHash(), len(entries), len(values))
+    if err := log.rs.PrepareGarbage(cdl.encodedHash(), entries, values); err != nil {
+        return nil, gcDebug.Error(err)
+    }
+    return values, nil
 }
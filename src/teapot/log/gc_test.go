@@ -26,9 +26,11 @@ func (s *GCSuite) TestGCWithRestart(c *C) {
     for i, config := range configs {
         logs[i] = NewLog(config)
     }
+    updates := make([]*LogEntry, 0)
     for i := 0; i < 3; i++ {
         update := logs[0].NewUpdate(Key(fmt.Sprintf("%v/hello/%v", logs[0].memLog.MyNodeId, i%s.n)), []byte(fmt.Sprintf("world%v", i)))
         logEntry := logs[0].NewLogEntry(update)
+        updates = append(updates, logEntry)
         c.Assert(logs[0].Commit(logEntry), IsNil)
         c.Assert(logs[1].Commit(logEntry), IsNil)
         c.Assert(logs[2].Commit(logEntry), IsNil)
@@ -94,6 +96,10 @@ func (s *GCSuite) TestGCWithRestart(c *C) {
     logs[0] = NewLog(configs[0])
     // TODO fix this
     //c.Assert(len(logs[0].memLog.LocalCDLs), Equals, 0)
+    // Updates folded into the snapshot are still found by their value.
+    for _, logEntry := range updates {
+        c.Assert(logs[0].GetUpdateOfValue(logEntry.Message.(*Update).HashOfValue), DeepEquals, logEntry)
+    }
 }
 
 func (s *GCSuite) TestGCWithAccessControl(c *C) {
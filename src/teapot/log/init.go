@@ -2,10 +2,13 @@ package log
 
 import (
     "bytes"
+    "crypto/sha256"
     "crypto/x509"
+    "encoding/base64"
     "errors"
     "os"
     "strings"
+    "teapot/adaptor"
     "teapot/utility"
 )
 
@@ -51,6 +54,16 @@ func (log *Log) recoverSnapshot() error {
     } else {
         log.memLog = newLogInMemory(log.conf)
     }
+    for _, logEntries := range log.memLog.SequentialLog {
+        for _, logEntry := range logEntries {
+            log.indexValue(logEntry)
+        }
+    }
+    for _, updates := range log.memLog.Checkpoint {
+        for _, logEntry := range updates {
+            log.indexValue(logEntry)
+        }
+    }
     initDebug.Debugf("memLog after recovery from snapshot: %+v", log.memLog)
     return nil
 }
@@ -92,6 +105,7 @@ func (log *Log) replayLog() error {
     journalIterator := newJournalIterator(log.conf.JournalPath)
     noNeedReply := make(map[EncodedHash]bool)
     noNeedSync := make(map[EncodedHash]bool)
+    collected := make(map[EncodedHash]bool)
     if journalIterator != nil {
         for {
             line, err := journalIterator.NextJournalEntry()
@@ -110,12 +124,19 @@ func (log *Log) replayLog() error {
                 noNeedSync[EncodedHash(parts[1])] = true
             case "Reply":
                 noNeedReply[EncodedHash(parts[1])] = true
+            case "GC":
+                // What is left to delete is in the garbage list.
+                collected[EncodedHash(parts[1])] = true
             default:
                 return initDebug.Error(errors.New("Unknown journal type. " + line))
             }
         }
     }
     initDebug.Debugf("noNeedReply: %v", noNeedReply)
+    // Entries queued by the previous run are synced first, in their order.
+    if err := log.rs.Recover(noNeedSync); err != nil {
+        return initDebug.Error(err)
+    }
     iterator := newLogIterator(log.conf.LogPath)
     if iterator != nil {
         for {
@@ -143,6 +164,12 @@ func (log *Log) replayLog() error {
             }
         }
     }
+    if err := log.rs.RecoverGarbage(collected, func(encodedHash EncodedHash) bool {
+        _, ok := log.memLog.LogIndexedByHash[encodedHash]
+        return ok
+    }); err != nil {
+        return initDebug.Error(err)
+    }
     valueDir, err := os.Open(log.conf.ValueDir)
     if err != nil {
         return initDebug.Error(err)
@@ -152,7 +179,14 @@ func (log *Log) replayLog() error {
         return initDebug.Error(err)
     }
     for _, value := range values {
-        log.memLog.Values[EncodedHash(value)] = true
+        if strings.HasPrefix(value, ".tmp_") {
+            // Left by an interrupted download.
+            os.Remove(log.conf.ValueDir + "/" + value)
+            continue
+        }
+        if !log.rs.IsGarbage(EncodedHash(value)) {
+            log.memLog.Values[EncodedHash(value)] = true
+        }
     }
     return nil
 }
@@ -169,6 +203,23 @@ func registerTypes() {
     utility.Register(&cDL{})
 }
 
+/*
+   Check an object read from replicated storage. Values are named after
+   the hash of their content, log entries after the hash of the entry.
+*/
+func verifyStoredObject(key string, value []byte) bool {
+    if utility.GetHashOfBytesAndEncode(value) == key {
+        return true
+    }
+    if logEntry, err := deserializeLogEntry(value); err == nil && string(logEntry.encodedHash()) == key {
+        return true
+    }
+    // Not named after its content, e.g. <nodeId>.manifest
+    buf, err := base64.URLEncoding.DecodeString(key)
+    return err != nil || len(buf) != sha256.Size
+}
+
 func init() {
     registerTypes()
+    adaptor.RegisterVerifier(verifyStoredObject)
 }
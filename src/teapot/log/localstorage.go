@@ -5,7 +5,9 @@ import (
       "teapot/conf"
       "time"*/
     "bufio"
+    "crypto/sha256"
     "encoding/base64"
+    "errors"
     "io"
     "io/ioutil"
     "os"
@@ -37,6 +39,7 @@ type iJournalIterator interface {
 
 type iValueManager interface {
     WriteValue(encodedHash EncodedHash, value []byte) error
+    WriteValueFrom(encodedHash EncodedHash, r io.Reader) error
     ReadValue(encodedHash EncodedHash) ([]byte, error)
 }
 
@@ -182,6 +185,59 @@ func (vm *valueManager) WriteValue(encodedHash EncodedHash, value []byte) error
     return nil
 }
 
+/*
+   Stream a value into place without holding it in memory.
+   The value is only kept if it matches its hash.
+*/
+func (vm *valueManager) WriteValueFrom(encodedHash EncodedHash, r io.Reader) error {
+    file, err := ioutil.TempFile(vm.valueDir, ".tmp_"+string(encodedHash))
+    if err != nil {
+        return localStorageDebug.Error(err)
+    }
+    hash := sha256.New()
+    _, err = io.Copy(io.MultiWriter(file, hash), r)
+    if err == nil && base64.URLEncoding.EncodeToString(hash.Sum(nil)) != string(encodedHash) {
+        err = errors.New("Hash doesn't match.")
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Rename(file.Name(), vm.valueDir+"/"+string(encodedHash))
+    }
+    if err != nil {
+        os.Remove(file.Name())
+        return localStorageDebug.Error(err)
+    }
+    return nil
+}
+
+// Deleting a value which doesn't exist is not an error.
+func (vm *valueManager) DeleteValue(encodedHash EncodedHash) error {
+    if err := os.Remove(vm.valueDir + "/" + string(encodedHash)); err != nil && !os.IsNotExist(err) {
+        return localStorageDebug.Error(err)
+    }
+    return nil
+}
+
+// Whether the value file is there.
+func (vm *valueManager) HasValue(encodedHash EncodedHash) bool {
+    _, err := os.Stat(vm.valueDir + "/" + string(encodedHash))
+    return err == nil
+}
+
+// The value file, for streaming it to remote storage.
+func (vm *valueManager) OpenValue(encodedHash EncodedHash) (*os.File, error) {
+    file, err := os.Open(vm.valueDir + "/" + string(encodedHash))
+    if err != nil {
+        return nil, localStorageDebug.Error(err)
+    }
+    return file, nil
+}
+
 // add integrity check.
 func (vm *valueManager) ReadValue(encodedHash EncodedHash) ([]byte, error) {
     buf, err := ioutil.ReadFile(vm.valueDir + "/" + string(encodedHash))
@@ -4,6 +4,7 @@ import (
     "io/ioutil"
     . "launchpad.net/gocheck"
     "os"
+    "strings"
     "teapot/utility"
 )
 
@@ -69,6 +70,73 @@ func (s *StorageSuite) TestValueManager(c *C) {
     os.RemoveAll("temp")
 }
 
+func (s *StorageSuite) TestStreamValue(c *C) {
+    os.Mkdir("temp", 0700)
+    vm := newValueManager("temp")
+    hash := EncodedHash(utility.GetHashOfBytesAndEncode([]byte("hello")))
+    c.Assert(vm.WriteValueFrom(hash, strings.NewReader("world")), ErrorMatches, "Hash doesn't match.")
+    files, err := ioutil.ReadDir("temp")
+    c.Assert(err, IsNil)
+    c.Assert(len(files), Equals, 0)
+    c.Assert(vm.WriteValueFrom(hash, strings.NewReader("hello")), IsNil)
+    file, err := vm.OpenValue(hash)
+    c.Assert(err, IsNil)
+    value, err := ioutil.ReadAll(file)
+    file.Close()
+    c.Assert(err, IsNil)
+    c.Assert(value, DeepEquals, []byte("hello"))
+    os.RemoveAll("temp")
+}
+
+func (s *StorageSuite) TestUploadIds(c *C) {
+    os.Mkdir("temp", 0700)
+    uploads := newUploadIds("temp/uploads.txt")
+    c.Assert(uploads.set("hash1", "upload1"), IsNil)
+    c.Assert(uploads.set("hash2", "upload2"), IsNil)
+    c.Assert(uploads.set("hash1", ""), IsNil)
+    uploads = newUploadIds("temp/uploads.txt")
+    c.Assert(uploads.get("hash1"), Equals, "")
+    c.Assert(uploads.get("hash2"), Equals, "upload2")
+    os.RemoveAll("temp")
+}
+
+func (s *StorageSuite) TestGarbageList(c *C) {
+    os.Mkdir("temp", 0700)
+    garbage := newGarbageList("temp/garbage.txt")
+    c.Assert(garbage.add([]EncodedHash{"entry1", "entry2"}, []EncodedHash{"value1"}), IsNil)
+    garbage = newGarbageList("temp/garbage.txt")
+    c.Assert(garbage.size(), Equals, 3)
+    c.Assert(garbage.isGarbage("entry1"), Equals, true)
+    c.Assert(garbage.isGarbage("value1"), Equals, true)
+    entries, values := garbage.wait()
+    c.Assert(entries, DeepEquals, []EncodedHash{"entry1", "entry2"})
+    c.Assert(values, DeepEquals, []EncodedHash{"value1"})
+    c.Assert(garbage.done(entries, values), IsNil)
+    c.Assert(garbage.isGarbage("entry1"), Equals, false)
+    c.Assert(existFile("temp/garbage.txt"), Equals, false)
+    os.RemoveAll("temp")
+}
+
+func (s *StorageSuite) TestPreparedGarbage(c *C) {
+    os.Mkdir("temp", 0700)
+    garbage := newGarbageList("temp/garbage.txt")
+    c.Assert(garbage.prepare("cdl1", []EncodedHash{"entry1"}, []EncodedHash{"value1"}), IsNil)
+    c.Assert(garbage.prepare("cdl2", []EncodedHash{"entry2"}, nil), IsNil)
+    garbage = newGarbageList("temp/garbage.txt")
+    c.Assert(garbage.size(), Equals, 0)
+    c.Assert(garbage.isPrepared("cdl1"), Equals, true)
+    c.Assert(garbage.isGarbage("value1"), Equals, false)
+    c.Assert(garbage.release("cdl1"), IsNil)
+    c.Assert(garbage.drop("cdl2"), IsNil)
+    garbage = newGarbageList("temp/garbage.txt")
+    c.Assert(garbage.isPrepared("cdl1"), Equals, false)
+    c.Assert(garbage.isPrepared("cdl2"), Equals, false)
+    entries, values := garbage.wait()
+    c.Assert(entries, DeepEquals, []EncodedHash{"entry1"})
+    c.Assert(values, DeepEquals, []EncodedHash{"value1"})
+    os.RemoveAll("temp")
+}
+
 func (s *StorageSuite) TestWriteFile(c *C) {
     os.Mkdir("temp", 0700)
     err := writeFile("temp/a.txt", []byte("hello"))
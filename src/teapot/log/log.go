@@ -7,9 +7,11 @@ import (
     "encoding/base64"
     "errors"
     "fmt"
+    "io"
     "io/ioutil"
     "strings"
     "sync"
+    "teapot/adaptor"
     "teapot/conf"
     "teapot/utility"
     "time"
@@ -29,13 +31,26 @@ type ILog interface {
     LS() []Key
     GetAllVersions() ([]string, error)
     GetValue(encodedHashOfValue EncodedHash) ([]byte, error)
+    GetUpdateOfValue(encodedHashOfValue EncodedHash) *LogEntry
+    CanRead(nodeId NodeID, logEntry *LogEntry) bool
     GetDecryptValue(update *Update, dvv versionVector) ([]byte, error)
     WriteValue(encodedHashOfValue EncodedHash, value []byte) error
+    WriteValueFrom(encodedHashOfValue EncodedHash, r io.Reader) error
     GetLastEntryInfoOfNode(nodeId NodeID) *VersionInfo
     GetEntryByEncodedHash(encodedHash EncodedHash) *LogEntry
     Observed(nodeId NodeID, acceptStamp Timestamp) bool
     HasLogEntry(nodeId NodeID, encodedHash EncodedHash) bool
+    GetVersionVector() map[NodeID]VersionInfo
+    GetEntriesSince(since map[NodeID]VersionInfo, max int) ([]*LogEntry, bool)
+    GetHorizon() map[NodeID]Timestamp
+    GetDigests(floors map[NodeID]Timestamp) map[NodeID]DigestTop
+    GetDigest(nodeId NodeID, level int, start, floor Timestamp) RangeDigest
+    GetChildDigests(nodeId NodeID, level int, start, floor Timestamp) map[Timestamp]RangeDigest
+    GetEntriesInRange(nodeId NodeID, start, floor Timestamp) []*LogEntry
+    GetUpdatesWithoutValue() []*LogEntry
+    HasValue(encodedHashOfValue EncodedHash) bool
     GC() error
+    SyncStatus() SyncStatus
 }
 
 type logInMemory struct {
@@ -116,6 +131,11 @@ type Log struct {
     conf       *conf.Config
     commitLock *sync.Mutex
     gcMutex    *sync.Mutex
+    // Values are written outside of Commit, by log exchange and reads.
+    valuesLock *sync.RWMutex
+    theAdaptor adaptor.Adaptor
+    // The updates in the snapshot and the log, by hash of their value.
+    updatesOfValues map[EncodedHash]*LogEntry
 
     /*
        local and remote storage.
@@ -127,7 +147,14 @@ type Log struct {
     rs  iRemoteStorage
 }
 
+// Health of syncing to remote storage.
+func (log *Log) SyncStatus() SyncStatus {
+    return log.rs.Status()
+}
+
 func (log *Log) LS() []Key {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
     results := make([]Key, 0)
     for key := range log.memLog.Checkpoint {
         results = append(results, key)
@@ -189,9 +216,24 @@ func newLogInMemory(config *conf.Config) *logInMemory {
     }
 }
 
-// TODO call startSyncLog
+/*
+   Create a log whose remote storage is built from the configuration.
+*/
 func NewLog(config *conf.Config) *Log {
-    log := newLog(config)
+    theAdaptor, err := adaptor.New(config, config.MyBucketName)
+    if err != nil {
+        logDebug.Debugf("Failed to create storage adaptor: %v", err)
+        return nil
+    }
+    return NewLogWithAdaptor(config, theAdaptor)
+}
+
+/*
+   Create a log which syncs to the given adaptor.
+   The adaptor is owned by the caller and may be shared with LogEx.
+*/
+func NewLogWithAdaptor(config *conf.Config, theAdaptor adaptor.Adaptor) *Log {
+    log := newLog(config, theAdaptor)
     if err := log.rebuild(); err != nil {
         logDebug.Debugf("Failed to rebuild log: %v", err)
         return nil
@@ -200,18 +242,21 @@ func NewLog(config *conf.Config) *Log {
     return log
 }
 
-func newLog(config *conf.Config) *Log {
+func newLog(config *conf.Config, theAdaptor adaptor.Adaptor) *Log {
     ls := newLogStorage(config.LogPath)
     js := newJournalStorage(config.JournalPath)
     vm := newValueManager(config.ValueDir)
     sm := newSnapshotManager(config.SnapshotDir)
-    rs := newRemoteStorage(config, js, vm)
+    rs := newRemoteStorage(config, js, vm, theAdaptor)
 
     log := Log{
         nil,
         config,
         new(sync.Mutex),
         new(sync.Mutex),
+        new(sync.RWMutex),
+        theAdaptor,
+        make(map[EncodedHash]*LogEntry),
         ls,
         js,
         vm,
@@ -323,7 +368,7 @@ func (log *Log) Commit(logEntry *LogEntry) error {
     if logEntry.AcceptStamp == -1 {
         // My own log entry, no need to check
         if logEntry.NodeId != log.memLog.MyNodeId {
-            return logDebug.Error(errors.New("Should not happen: log entry from other node should have everything filled up."))
+            return logDebug.Error(&InvalidEntry{errors.New("Should not happen: log entry from other node should have everything filled up.")})
         }
         update, ok := logEntry.Message.(*Update)
         if ok {
@@ -360,6 +405,10 @@ func (log *Log) Commit(logEntry *LogEntry) error {
     // Only check and update memory state is necessary in recovery
     // What is the guarantee if exists here?
     log.updateMemoryState(logEntry)
+    // Queue it while holding the lock, so entries are synced in commit order.
+    if log.needSync(logEntry) {
+        log.rs.SyncLogEntry(logEntry)
+    }
     return nil
 }
 
@@ -372,9 +421,6 @@ func (log *Log) Commit(logEntry *LogEntry) error {
 // check the journal to find out things that are already synced and replied.
 // need in recovery
 func (log *Log) AsyncHandle(logEntry *LogEntry) error {
-    if log.needSync(logEntry) {
-        log.rs.SyncLogEntry(logEntry)
-    }
     if log.needReply(logEntry) {
         return logEntry.Message.asyncHandle(log, logEntry)
     }
@@ -390,6 +436,8 @@ func (log *Log) GetAllVersions() ([]string, error) {
 }
 
 func (log *Log) GetCheckpoint(key Key) ([]*LogEntry, error) {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
     if updates, ok := log.memLog.Checkpoint[key]; ok {
         results := make([]*LogEntry, 0)
         for _, update := range updates {
@@ -422,7 +470,34 @@ func (log *Log) GetCheckpointVersion(key Key, version int) ([]*LogEntry, error)
     return nil, logDebug.Error(errors.New("No such key."))
 }
 
+// The update entry that wrote the value, nil if there is none.
+func (log *Log) GetUpdateOfValue(encodedHashOfValue EncodedHash) *LogEntry {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    return log.updateOfValue(encodedHashOfValue)
+}
+
+/*
+   Whether nodeId may read the value of the update logEntry: it wrote it,
+   or is a reader or writer of its directory under the mode the update was
+   written in. The dependencies of logEntry must be in the log.
+*/
+func (log *Log) CanRead(nodeId NodeID, logEntry *LogEntry) bool {
+    update, ok := logEntry.Message.(*Update)
+    if !ok {
+        return false
+    }
+    if logEntry.NodeId == nodeId {
+        return true
+    }
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    return log.canRead(nodeId, update.Key, logEntry.DVV)
+}
+
 func (log *Log) Blocked(nodeId NodeID) bool {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
     if _, ok := log.memLog.BlackList[nodeId]; ok {
         return true
     }
@@ -430,6 +505,8 @@ func (log *Log) Blocked(nodeId NodeID) bool {
 }
 
 func (log *Log) GetLastEntryInfoOfNode(nodeId NodeID) *VersionInfo {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
     _, lastEntry := log.getLastEntryOfNode(nodeId)
     if lastEntry != nil {
         return &VersionInfo{lastEntry.AcceptStamp, lastEntry.encodedHash()}
@@ -439,8 +516,11 @@ func (log *Log) GetLastEntryInfoOfNode(nodeId NodeID) *VersionInfo {
 
 // read the value from disk.
 // Reading values from remote is not done in this component.
+// The value was not fetched, or not replicated here, see conf.Subscriptions.
+var ErrValueNotAvailable = errors.New("This value is not available on this node.")
+
 func (log *Log) GetValue(encodedHashOfValue EncodedHash) ([]byte, error) {
-    if _, ok := log.memLog.Values[encodedHashOfValue]; ok {
+    if log.HasValue(encodedHashOfValue) {
         // read from disk
         value, err := log.vm.ReadValue(encodedHashOfValue)
         if err != nil {
@@ -448,13 +528,26 @@ func (log *Log) GetValue(encodedHashOfValue EncodedHash) ([]byte, error) {
         }
         return value, nil
     }
-    return nil, logDebug.Error(errors.New("This value is not available on this node."))
+    return nil, logDebug.Error(ErrValueNotAvailable)
 }
 
 func (log *Log) WriteValue(encodedHashOfValue EncodedHash, value []byte) error {
     if err := log.vm.WriteValue(encodedHashOfValue, value); err != nil {
         return logDebug.Error(err)
     }
+    log.valuesLock.Lock()
+    defer log.valuesLock.Unlock()
+    log.memLog.Values[encodedHashOfValue] = true
+    return nil
+}
+
+// Like WriteValue, but the value is streamed from r.
+func (log *Log) WriteValueFrom(encodedHashOfValue EncodedHash, r io.Reader) error {
+    if err := log.vm.WriteValueFrom(encodedHashOfValue, r); err != nil {
+        return logDebug.Error(err)
+    }
+    log.valuesLock.Lock()
+    defer log.valuesLock.Unlock()
     log.memLog.Values[encodedHashOfValue] = true
     return nil
 }
@@ -467,6 +560,12 @@ func (log *Log) GetEntryByEncodedHash(encodedHash EncodedHash) *LogEntry {
    return true if the log entry has been observed by this node.
 */
 func (log *Log) Observed(nodeId NodeID, acceptStamp Timestamp) bool {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    return log.observed(nodeId, acceptStamp)
+}
+
+func (log *Log) observed(nodeId NodeID, acceptStamp Timestamp) bool {
     if versionInfo, ok := log.memLog.VersionVector[nodeId]; ok {
         return versionInfo.AcceptStamp >= acceptStamp
     }
@@ -474,6 +573,12 @@ func (log *Log) Observed(nodeId NodeID, acceptStamp Timestamp) bool {
 }
 
 func (log *Log) HasLogEntry(nodeId NodeID, encodedHash EncodedHash) bool {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    return log.hasLogEntry(nodeId, encodedHash)
+}
+
+func (log *Log) hasLogEntry(nodeId NodeID, encodedHash EncodedHash) bool {
     if existingLogEntry, ok := log.memLog.LogIndexedByHash[encodedHash]; ok {
         // do some deeper check
         if existingLogEntry.NodeId == nodeId {
@@ -483,6 +588,28 @@ func (log *Log) HasLogEntry(nodeId NodeID, encodedHash EncodedHash) bool {
     return false
 }
 
+// A copy of the version vector, keyed by virtual node id.
+func (log *Log) GetVersionVector() map[NodeID]VersionInfo {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    results := make(map[NodeID]VersionInfo)
+    for nodeId, versionInfo := range log.memLog.VersionVector {
+        results[nodeId] = VersionInfo(versionInfo)
+    }
+    return results
+}
+
+/*
+   Entries a node whose version vector is since has not observed, in an
+   order they can be committed in. At most max are returned, the bool
+   tells if there are more.
+*/
+func (log *Log) GetEntriesSince(since map[NodeID]VersionInfo, max int) ([]*LogEntry, bool) {
+    log.commitLock.Lock()
+    defer log.commitLock.Unlock()
+    return log.entriesSince(since, max)
+}
+
 /*
    1. Propose faulty set
    2. Collect ack.
@@ -556,7 +683,7 @@ func (log *Log) persist(logEntry *LogEntry) error {
    After the log is committed, it is still possible to be a fork.
 */
 func (log *Log) check(logEntry *LogEntry) error {
-    if log.HasLogEntry(logEntry.NodeId, logEntry.encodedHash()) {
+    if log.hasLogEntry(logEntry.NodeId, logEntry.encodedHash()) {
         return logDebug.Error(errors.New("Already seen this update."))
     }
     // if the issuer is blocked, the log entry should not be committed.
@@ -564,9 +691,17 @@ func (log *Log) check(logEntry *LogEntry) error {
         return logDebug.Error(errors.New("Cannot accept log from node that is blocked."))
     }
 
+    // Entries from others may be malformed.
+    if logEntry.Message == nil {
+        return logDebug.Error(&InvalidEntry{errors.New("Log entry without a message.")})
+    }
+    publicKey, ok := log.memLog.PublicKeys[logEntry.NodeId]
+    if !ok {
+        return logDebug.Error(&InvalidEntry{errors.New(fmt.Sprintf("Log entry of an unknown node (%v).", logEntry.NodeId))})
+    }
     // Check 1 Valid Signature.
-    if err := logEntry.validateSignature(log.memLog.PublicKeys[logEntry.NodeId]); err != nil {
-        return logDebug.Error(err)
+    if err := logEntry.validateSignature(publicKey); err != nil {
+        return logDebug.Error(&InvalidEntry{err})
     }
 
     // Check 3. Check if all updates this update depends on have been seen and check 4.
@@ -580,25 +715,28 @@ func (log *Log) check(logEntry *LogEntry) error {
         } else {
             if dependentNodeId != dependentLogEntry.NodeId {
                 // TODO Write a test case to bypass this check.
-                return logDebug.Error(errors.New("Wrong information. A node claim to depend on A from node B, but A isn't from B."))
+                return logDebug.Error(&InvalidEntry{errors.New("Wrong information. A node claim to depend on A from node B, but A isn't from B.")})
+            }
+            if dependentLogEntry.AcceptStamp >= logEntry.AcceptStamp {
+                return logDebug.Error(&InvalidEntry{errors.New("Log entry depends on an entry that is not older.")})
             }
         }
     }
 
     // Check 5 Check against timestamp exhaust attack.
     if int64(logEntry.AcceptStamp) > 1000*time.Now().Unix() {
-        return logDebug.Error(errors.New("Invalid accept stamp."))
+        return logDebug.Error(&InvalidEntry{errors.New("Invalid accept stamp.")})
     }
     // Check 6 type specific check
     if err := logEntry.Message.check(log, logEntry); err != nil {
-        return logDebug.Error(err)
+        return logDebug.Error(&InvalidEntry{err})
     }
     // Check 2 has to be newer than any existing updates.
     // if version vector says the update is observed,  a fork exists.
     // If the this logEntry doesn't depends on the latest updates from its author, that's a fork.
     _, lastLogEntry := log.getLastEntryOfNode(logEntry.NodeId)
     // a test case exists to capture this case
-    if log.Observed(logEntry.NodeId, logEntry.AcceptStamp) {
+    if log.observed(logEntry.NodeId, logEntry.AcceptStamp) {
         logDebug.Debugf("This is just a heuristic to detect.")
     }
     // An accpet stamp larger than latest update, but still is a fork.
@@ -627,6 +765,7 @@ func (log *Log) updateMemoryState(logEntry *LogEntry) {
     log.memLog.SequentialLog[virtualNodeId] = append(log.memLog.SequentialLog[virtualNodeId], logEntry)
     // Put logEntry into index
     log.memLog.LogIndexedByHash[encodedHashOfLogEntry] = logEntry
+    log.indexValue(logEntry)
     // find the node id by hash of the log entry
     // Update DVV
     currentVersion := versionInfo{
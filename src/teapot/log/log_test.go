@@ -3,6 +3,7 @@ package log
 import (
     "crypto/rsa"
     "fmt"
+    "io"
     . "launchpad.net/gocheck"
     "math/rand"
     "sync"
@@ -53,6 +54,10 @@ func (fs *fakeStorage) WriteValue(encodedHash EncodedHash, value []byte) error {
     return nil
 }
 
+func (fs *fakeStorage) WriteValueFrom(encodedHash EncodedHash, r io.Reader) error {
+    return nil
+}
+
 func (fs *fakeStorage) ReadValue(encodedHash EncodedHash) ([]byte, error) {
     return nil, nil
 }
@@ -76,9 +81,33 @@ func (fs *fakeStorage) ReadSnapshot(folder string) (*logInMemory, error) {
 func (fs *fakeStorage) SyncLogEntry(logEntries *LogEntry) {
 }
 
+func (fs *fakeStorage) Recover(synced map[EncodedHash]bool) error {
+    return nil
+}
+
 func (fs *fakeStorage) StartSyncLog() {
 }
 
+func (fs *fakeStorage) Status() SyncStatus {
+    return SyncStatus{}
+}
+
+func (fs *fakeStorage) PrepareGarbage(encodedHashOfCDL EncodedHash, entries, values []EncodedHash) error {
+    return nil
+}
+
+func (fs *fakeStorage) CollectGarbage(encodedHashOfCDL EncodedHash) error {
+    return nil
+}
+
+func (fs *fakeStorage) RecoverGarbage(collected map[EncodedHash]bool, inLog func(encodedHash EncodedHash) bool) error {
+    return nil
+}
+
+func (fs *fakeStorage) IsGarbage(encodedHash EncodedHash) bool {
+    return false
+}
+
 func (fs *fakeStorage) GetValue(encodedHash EncodedHash) ([]byte, error) {
     return nil, nil
 }
@@ -96,6 +125,9 @@ func newTestableLog(config *conf.Config) *Log {
         config,
         new(sync.Mutex),
         new(sync.Mutex),
+        new(sync.RWMutex),
+        nil,
+        make(map[EncodedHash]*LogEntry),
 
         fs,
         fs,
@@ -215,7 +247,11 @@ func (s *CheckSuite) TestCheckAlreadySeen(c *C) {
     c.Assert(s.logs[1].Commit(logEntries[1]), IsNil)
     c.Assert(s.logs[0].Commit(logEntries[1]), IsNil)
 
-    c.Assert(s.logs[0].Commit(logEntries[1]), ErrorMatches, "Already seen this update.")
+    err := s.logs[0].Commit(logEntries[1])
+    c.Assert(err, ErrorMatches, "Already seen this update.")
+    // Not the fault of the entry.
+    _, invalid := err.(*InvalidEntry)
+    c.Assert(invalid, Equals, false)
 }
 
 func (s *CheckSuite) TestCheckBadSignature(c *C) {
@@ -230,7 +266,15 @@ func (s *CheckSuite) TestCheckBadSignature(c *C) {
     c.Assert(s.logs[1].Commit(logEntries[0]), IsNil)
     c.Assert(s.logs[1].Commit(logEntries[1]), IsNil)
     logEntries[1].Sig = make([]byte, 10, 10)
-    c.Assert(s.logs[0].Commit(logEntries[1]), ErrorMatches, ".*verification error.*")
+    err := s.logs[0].Commit(logEntries[1])
+    c.Assert(err, ErrorMatches, ".*verification error.*")
+    _, invalid := err.(*InvalidEntry)
+    c.Assert(invalid, Equals, true)
+    logEntries[1].Message = nil
+    c.Assert(s.logs[0].Commit(logEntries[1]), ErrorMatches, "Log entry without a message.")
+    stranger := *logEntries[0]
+    stranger.NodeId = "stranger"
+    c.Assert(s.logs[1].Commit(&stranger), ErrorMatches, "Log entry of an unknown node .*")
 }
 
 func (s *CheckSuite) TestCheckHistory(c *C) {
@@ -271,6 +315,12 @@ func (s *CheckSuite) TestCheckTimestamp(c *C) {
     logEntries[2].AcceptStamp = 2147483648000
     logEntries[2].sign(s.logs[2].memLog.PrivateKey)
     c.Assert(s.logs[0].Commit(logEntries[2]), ErrorMatches, "Invalid accept stamp.")
+    // Nor may an entry claim to be older than what it depends on.
+    older := *logEntries[1]
+    older.AcceptStamp = logEntries[0].AcceptStamp
+    older.sign(s.logs[1].memLog.PrivateKey)
+    c.Assert(s.logs[2].Commit(logEntries[0]), IsNil)
+    c.Assert(s.logs[2].Commit(&older), ErrorMatches, "Log entry depends on an entry that is not older.")
 }
 
 func (s *CheckSuite) TestCheckAndJoinFork(c *C) {
@@ -30,6 +30,18 @@ type LogEntry struct {
 
 const logEntryDebug utility.Debug = true
 
+/*
+   Commit refused an entry for what it is, a bad signature or message for
+   instance, rather than for what the log lacks or already has.
+*/
+type InvalidEntry struct {
+    Err error
+}
+
+func (invalid *InvalidEntry) Error() string {
+    return invalid.Err.Error()
+}
+
 // TODO
 func (logEntry *LogEntry) String() string {
     return fmt.Sprintf("LE[%v,%v,DVV{%v},%v]", logEntry.AcceptStamp, logEntry.NodeId, logEntry.DVV, logEntry.Message)
@@ -0,0 +1,194 @@
+package log
+
+import (
+    "crypto/rsa"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sync"
+    "teapot/utility"
+    "time"
+)
+
+const manifestDebug utility.Debug = true
+
+// A manifest lists this many of the latest entries of its node.
+const manifestRecent = 1000
+
+/*
+   What a node has synced to its bucket, stored as "<nodeId>.manifest".
+   It is signed by the node, so the storage provider cannot forge it,
+   and Version grows with every manifest written, so that an older one
+   served again is told apart.
+*/
+type Manifest struct {
+    NodeId  NodeID
+    Version int64
+    // The latest entries of the node, oldest first.
+    Recent []VersionInfo
+    // The CDL the latest snapshot was taken at, "" before the first GC.
+    Snapshot EncodedHash
+    // The packs holding entries of the node, oldest first.
+    Packs []string
+    Sig   signature
+}
+
+func ManifestKey(nodeId NodeID) string {
+    return string(nodeId) + ".manifest"
+}
+
+func (manifest *Manifest) String() string {
+    return fmt.Sprintf("M[%v,%v,%v,%v,%v]", manifest.NodeId, manifest.Version, manifest.Recent, manifest.Snapshot, manifest.Packs)
+}
+
+// The latest entry of the node, nil if it has none.
+func (manifest *Manifest) Latest() *VersionInfo {
+    if len(manifest.Recent) == 0 {
+        return nil
+    }
+    latest := manifest.Recent[len(manifest.Recent)-1]
+    return &latest
+}
+
+func (manifest *Manifest) sign(privateKey *rsa.PrivateKey) error {
+    sig, err := utility.SignBinary([]byte(manifest.String()), privateKey)
+    if err != nil {
+        return manifestDebug.Error(err)
+    }
+    manifest.Sig = sig
+    return nil
+}
+
+/*
+   Decode a manifest read from the bucket of nodeId and check that nodeId
+   signed it.
+*/
+func DecodeManifest(nodeId NodeID, buf []byte, publicKey *rsa.PublicKey) (*Manifest, error) {
+    var manifest Manifest
+    if err := utility.GobDecode(buf, &manifest); err != nil {
+        return nil, manifestDebug.Error(err)
+    }
+    if manifest.NodeId != nodeId {
+        return nil, manifestDebug.Error(errors.New(fmt.Sprintf("Manifest of %v found in the bucket of %v.", manifest.NodeId, nodeId)))
+    }
+    if err := utility.ValidateSignature([]byte(manifest.String()), publicKey, manifest.Sig); err != nil {
+        return nil, manifestDebug.Error(errors.New(fmt.Sprintf("Forged manifest of %v: %v", nodeId, err)))
+    }
+    return &manifest, nil
+}
+
+/*
+   The manifest of this node as last written, kept in a file so that
+   a restart carries on with its entries, packs and version.
+*/
+type manifestWriter struct {
+    path     string
+    lock     *sync.Mutex
+    manifest Manifest
+    // Held while a version is uploaded, so that versions go out in order.
+    writing    *sync.Mutex
+    privateKey *rsa.PrivateKey
+}
+
+func newManifestWriter(path string, nodeId NodeID, privateKey *rsa.PrivateKey) *manifestWriter {
+    mw := &manifestWriter{path, new(sync.Mutex), Manifest{NodeId: nodeId}, new(sync.Mutex), privateKey}
+    if buf, err := ioutil.ReadFile(path); err == nil {
+        if err := utility.GobDecode(buf, &mw.manifest); err != nil {
+            manifestDebug.Error(err)
+        }
+    } else if !os.IsNotExist(err) {
+        manifestDebug.Error(err)
+    }
+    return mw
+}
+
+// Record a pack of entries of this node.
+func (mw *manifestWriter) addPack(packKey string, logEntries []*LogEntry) error {
+    mw.lock.Lock()
+    defer mw.lock.Unlock()
+    known := make(map[EncodedHash]bool)
+    for _, versionInfo := range mw.manifest.Recent {
+        known[versionInfo.HashOfUpdate] = true
+    }
+    for _, logEntry := range logEntries {
+        // A pack written again after a restart repeats entries.
+        if encodedHash := logEntry.encodedHash(); !known[encodedHash] {
+            mw.manifest.Recent = append(mw.manifest.Recent, VersionInfo{logEntry.AcceptStamp, encodedHash})
+        }
+    }
+    if len(mw.manifest.Recent) > manifestRecent {
+        mw.manifest.Recent = append([]VersionInfo(nil), mw.manifest.Recent[len(mw.manifest.Recent)-manifestRecent:]...)
+    }
+    for _, existing := range mw.manifest.Packs {
+        if existing == packKey {
+            return mw.save()
+        }
+    }
+    mw.manifest.Packs = append(mw.manifest.Packs, packKey)
+    return mw.save()
+}
+
+// Forget packs deleted after GC.
+func (mw *manifestWriter) removePacks(packKeys []string) error {
+    mw.lock.Lock()
+    defer mw.lock.Unlock()
+    deleted := make(map[string]bool)
+    for _, packKey := range packKeys {
+        deleted[packKey] = true
+    }
+    packs := make([]string, 0, len(mw.manifest.Packs))
+    for _, packKey := range mw.manifest.Packs {
+        if !deleted[packKey] {
+            packs = append(packs, packKey)
+        }
+    }
+    mw.manifest.Packs = packs
+    return mw.save()
+}
+
+func (mw *manifestWriter) setSnapshot(encodedHashOfCDL EncodedHash) error {
+    mw.lock.Lock()
+    defer mw.lock.Unlock()
+    mw.manifest.Snapshot = encodedHashOfCDL
+    return mw.save()
+}
+
+// Sign a new version and hand it to put.
+func (mw *manifestWriter) write(put func(manifest []byte) error) error {
+    mw.writing.Lock()
+    defer mw.writing.Unlock()
+    manifest, err := mw.next()
+    if err != nil {
+        return err
+    }
+    return put(manifest)
+}
+
+/*
+   A new version of the manifest, signed. The version is the time it is
+   signed at, unless the clock went back.
+*/
+func (mw *manifestWriter) next() ([]byte, error) {
+    mw.lock.Lock()
+    defer mw.lock.Unlock()
+    version := time.Now().UnixNano()
+    if version <= mw.manifest.Version {
+        version = mw.manifest.Version + 1
+    }
+    mw.manifest.Version = version
+    if err := mw.manifest.sign(mw.privateKey); err != nil {
+        return nil, err
+    }
+    if err := mw.save(); err != nil {
+        return nil, err
+    }
+    return utility.GobEncode(&mw.manifest), nil
+}
+
+func (mw *manifestWriter) save() error {
+    if err := writeFile(mw.path, utility.GobEncode(&mw.manifest)); err != nil {
+        return manifestDebug.Error(err)
+    }
+    return nil
+}
@@ -0,0 +1,271 @@
+package log
+
+import (
+    "bytes"
+    "encoding/base64"
+    "errors"
+    "os"
+    "sync"
+    "teapot/utility"
+)
+
+const outboxDebug utility.Debug = true
+
+// At most this many queued entries are kept in memory, the rest on disk.
+const outboxLimit = 10000
+
+/*
+   Log entries waiting to be synced to remote storage, in commit order.
+   An entry is appended to the outbox file, in the same format as the
+   log file, before it is queued, so the queue survives a restart.
+   An entry leaves the queue once its "Sync:" record is in the journal.
+   The file is truncated whenever the queue runs empty, and rewritten
+   without the synced entries at its start once there are limit of them,
+   so it does not grow while the queue never empties.
+   Pushing never waits: while remote storage is down, entries past limit
+   stay in the file only and are read back as the queue drains.
+*/
+type outbox struct {
+    path     string
+    limit    int
+    lock     *sync.Mutex
+    notEmpty *sync.Cond
+    // The head of the queue.
+    entries []*LogEntry
+    pending map[EncodedHash]bool
+    loaded  bool
+    // Entries at the start of the file that are synced already.
+    popped int
+    // Entries after the head, in the file only.
+    spilled int
+}
+
+func newOutbox(path string, limit int) *outbox {
+    lock := new(sync.Mutex)
+    return &outbox{
+        path,
+        limit,
+        lock,
+        sync.NewCond(lock),
+        make([]*LogEntry, 0),
+        make(map[EncodedHash]bool),
+        false,
+        0,
+        0,
+    }
+}
+
+/*
+   Queue the entries left by the previous run, except those
+   already synced according to the journal.
+   Loading more than once is a no-op.
+*/
+func (ob *outbox) load(synced map[EncodedHash]bool) error {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    return ob.doLoad(synced)
+}
+
+func (ob *outbox) doLoad(synced map[EncodedHash]bool) error {
+    if ob.loaded {
+        return nil
+    }
+    ob.loaded = true
+    iterator := newLogIterator(ob.path)
+    if iterator == nil {
+        return nil
+    }
+    left := make([]*LogEntry, 0)
+    for {
+        logEntry, err := iterator.NextLogEntry()
+        if err != nil {
+            // Most likely a torn write at the end, the replay of the
+            // log queues whatever is lost here.
+            outboxDebug.Error(err)
+            iterator.file.Close()
+            break
+        }
+        if logEntry == nil {
+            break
+        }
+        encodedHash := logEntry.encodedHash()
+        if synced[encodedHash] || ob.pending[encodedHash] {
+            continue
+        }
+        left = append(left, logEntry)
+        ob.pending[encodedHash] = true
+    }
+    ob.entries = left
+    if len(left) > ob.limit {
+        ob.entries = left[:ob.limit]
+        ob.spilled = len(left) - ob.limit
+    }
+    // Drop what is synced from the file.
+    var buf bytes.Buffer
+    for _, logEntry := range left {
+        buf.WriteString(base64.URLEncoding.EncodeToString(logEntry.serialize()) + "\n")
+    }
+    if err := writeFile(ob.path, buf.Bytes()); err != nil {
+        return outboxDebug.Error(err)
+    }
+    return nil
+}
+
+/*
+   Queue logEntry unless it is queued already.
+   guarantee: the entry is on disk if no error is returned.
+   Called with the commit lock held, so it must not wait for the worker.
+*/
+func (ob *outbox) push(logEntry *LogEntry) error {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    if err := ob.doLoad(nil); err != nil {
+        return outboxDebug.Error(err)
+    }
+    encodedHash := logEntry.encodedHash()
+    if ob.pending[encodedHash] {
+        return nil
+    }
+    if err := appendToFile(ob.path, []byte(base64.URLEncoding.EncodeToString(logEntry.serialize())+"\n")); err != nil {
+        return outboxDebug.Error(err)
+    }
+    if ob.spilled == 0 && len(ob.entries) < ob.limit {
+        ob.entries = append(ob.entries, logEntry)
+    } else {
+        if ob.spilled == 0 {
+            outboxDebug.Debugf("Outbox full, keeping further entries on disk only.")
+        }
+        ob.spilled++
+    }
+    ob.pending[encodedHash] = true
+    ob.notEmpty.Signal()
+    return nil
+}
+
+// The oldest entry, wait for one if there is none.
+func (ob *outbox) peek() *LogEntry {
+    return ob.peekBatch(1)[0]
+}
+
+// Up to max oldest entries, wait for one if there is none.
+func (ob *outbox) peekBatch(max int) []*LogEntry {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    for len(ob.entries) == 0 {
+        ob.notEmpty.Wait()
+    }
+    if len(ob.entries) < max {
+        max = len(ob.entries)
+    }
+    batch := make([]*LogEntry, max)
+    copy(batch, ob.entries)
+    return batch
+}
+
+// Remove the oldest entry once it is synced.
+func (ob *outbox) pop() error {
+    return ob.popBatch(1)
+}
+
+// Remove the n oldest entries once they are synced.
+func (ob *outbox) popBatch(n int) error {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    if n > len(ob.entries) {
+        n = len(ob.entries)
+    }
+    if n == 0 {
+        return nil
+    }
+    for i := 0; i < n; i++ {
+        delete(ob.pending, ob.entries[i].encodedHash())
+        ob.entries[i] = nil
+    }
+    ob.entries = ob.entries[n:]
+    ob.popped += n
+    if len(ob.entries) == 0 {
+        ob.entries = make([]*LogEntry, 0)
+        if ob.spilled == 0 {
+            ob.popped = 0
+            if err := os.Truncate(ob.path, 0); err != nil && !os.IsNotExist(err) {
+                return outboxDebug.Error(err)
+            }
+            return nil
+        }
+        if err := ob.readSpilled(); err != nil {
+            return err
+        }
+    }
+    if ob.popped >= ob.limit {
+        return ob.compact()
+    }
+    return nil
+}
+
+// Rewrite the file without the synced entries at its start.
+func (ob *outbox) compact() error {
+    iterator := newLogIterator(ob.path)
+    if iterator == nil {
+        return outboxDebug.Error(errors.New("Unable to read the outbox."))
+    }
+    defer iterator.file.Close()
+    var buf bytes.Buffer
+    for i := 0; ; i++ {
+        logEntry, err := iterator.NextLogEntry()
+        if err != nil {
+            return outboxDebug.Error(err)
+        }
+        if logEntry == nil {
+            break
+        }
+        if i >= ob.popped {
+            buf.WriteString(base64.URLEncoding.EncodeToString(logEntry.serialize()) + "\n")
+        }
+    }
+    if err := writeFile(ob.path, buf.Bytes()); err != nil {
+        return outboxDebug.Error(err)
+    }
+    ob.popped = 0
+    return nil
+}
+
+// Read the next entries kept in the file only into the head.
+func (ob *outbox) readSpilled() error {
+    iterator := newLogIterator(ob.path)
+    if iterator == nil {
+        return outboxDebug.Error(errors.New("Unable to read the outbox."))
+    }
+    defer iterator.file.Close()
+    for i := 0; len(ob.entries) < ob.limit && ob.spilled > 0; i++ {
+        logEntry, err := iterator.NextLogEntry()
+        if err != nil {
+            return outboxDebug.Error(err)
+        }
+        if logEntry == nil {
+            return outboxDebug.Error(errors.New("The outbox is shorter than expected."))
+        }
+        if i >= ob.popped {
+            ob.entries = append(ob.entries, logEntry)
+            ob.spilled--
+        }
+    }
+    return nil
+}
+
+func (ob *outbox) depth() int {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    return len(ob.entries) + ob.spilled
+}
+
+// Whether any of the entries is still waiting to be synced.
+func (ob *outbox) anyPending(encodedHashes []EncodedHash) bool {
+    ob.lock.Lock()
+    defer ob.lock.Unlock()
+    for _, encodedHash := range encodedHashes {
+        if ob.pending[encodedHash] {
+            return true
+        }
+    }
+    return false
+}
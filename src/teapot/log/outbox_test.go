@@ -0,0 +1,127 @@
+package log
+
+import (
+    . "launchpad.net/gocheck"
+    "os"
+    "strconv"
+    "teapot/conf"
+    "teapot/utility"
+)
+
+type OutboxSuite struct {
+    dir string
+}
+
+var _ = Suite(&OutboxSuite{})
+
+func (s *OutboxSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *OutboxSuite) newLogEntries(n int) []*LogEntry {
+    config := conf.LoadTest(s.dir, 0)
+    log := newTestableLog(config)
+    logEntries := make([]*LogEntry, n)
+    for i := 0; i < n; i++ {
+        chmod := log.NewChangeMode(Dir("dir"+strconv.Itoa(i)), utility.KeyFromPassphrase("password"), []NodeID{}, []NodeID{log.memLog.MyNodeId})
+        logEntries[i] = log.NewLogEntry(chmod)
+    }
+    return logEntries
+}
+
+func (s *OutboxSuite) TestOrderAndRestart(c *C) {
+    logEntries := s.newLogEntries(3)
+    ob := newOutbox(s.dir+"/outbox.txt", 10)
+    c.Assert(ob.load(nil), IsNil)
+    for _, logEntry := range logEntries {
+        c.Assert(ob.push(logEntry), IsNil)
+    }
+    // Queued twice, kept once.
+    c.Assert(ob.push(logEntries[0]), IsNil)
+    c.Assert(ob.depth(), Equals, 3)
+    c.Assert(ob.peek().encodedHash(), Equals, logEntries[0].encodedHash())
+
+    // The first one got synced before the restart.
+    synced := map[EncodedHash]bool{logEntries[0].encodedHash(): true}
+    ob = newOutbox(s.dir+"/outbox.txt", 10)
+    c.Assert(ob.load(synced), IsNil)
+    c.Assert(ob.depth(), Equals, 2)
+    c.Assert(ob.peek().encodedHash(), Equals, logEntries[1].encodedHash())
+    c.Assert(ob.pop(), IsNil)
+    c.Assert(ob.peek().encodedHash(), Equals, logEntries[2].encodedHash())
+    c.Assert(ob.pop(), IsNil)
+    c.Assert(ob.depth(), Equals, 0)
+    stat, err := os.Stat(s.dir + "/outbox.txt")
+    c.Assert(err, IsNil)
+    c.Assert(stat.Size(), Equals, int64(0))
+}
+
+func (s *OutboxSuite) TestSpillsToDisk(c *C) {
+    logEntries := s.newLogEntries(5)
+    ob := newOutbox(s.dir+"/outbox.txt", 2)
+    c.Assert(ob.load(nil), IsNil)
+    for _, logEntry := range logEntries[:4] {
+        c.Assert(ob.push(logEntry), IsNil)
+    }
+    c.Assert(ob.depth(), Equals, 4)
+    c.Assert(len(ob.peekBatch(10)), Equals, 2)
+    // Only the head is in memory, the rest is read back from the file.
+    c.Assert(ob.popBatch(2), IsNil)
+    batch := ob.peekBatch(10)
+    c.Assert(len(batch), Equals, 2)
+    c.Assert(batch[0].encodedHash(), Equals, logEntries[2].encodedHash())
+    c.Assert(ob.push(logEntries[4]), IsNil)
+    c.Assert(ob.anyPending([]EncodedHash{logEntries[4].encodedHash()}), Equals, true)
+
+    // A restart keeps the order.
+    synced := map[EncodedHash]bool{logEntries[0].encodedHash(): true, logEntries[1].encodedHash(): true}
+    ob = newOutbox(s.dir+"/outbox.txt", 2)
+    c.Assert(ob.load(synced), IsNil)
+    c.Assert(ob.depth(), Equals, 3)
+    for _, logEntry := range logEntries[2:] {
+        c.Assert(ob.peek().encodedHash(), Equals, logEntry.encodedHash())
+        c.Assert(ob.pop(), IsNil)
+    }
+    c.Assert(ob.depth(), Equals, 0)
+}
+
+// A queue that never runs empty does not keep what is synced in its file.
+func (s *OutboxSuite) TestCompaction(c *C) {
+    logEntries := s.newLogEntries(6)
+    ob := newOutbox(s.dir+"/outbox.txt", 2)
+    c.Assert(ob.load(nil), IsNil)
+    inFile := func() int {
+        iterator := newLogIterator(s.dir + "/outbox.txt")
+        c.Assert(iterator, NotNil)
+        defer iterator.file.Close()
+        n := 0
+        for {
+            logEntry, err := iterator.NextLogEntry()
+            c.Assert(err, IsNil)
+            if logEntry == nil {
+                return n
+            }
+            n++
+        }
+    }
+    for _, logEntry := range logEntries[:5] {
+        c.Assert(ob.push(logEntry), IsNil)
+    }
+    c.Assert(ob.pop(), IsNil)
+    c.Assert(inFile(), Equals, 5)
+    c.Assert(ob.pop(), IsNil)
+    c.Assert(inFile(), Equals, 3)
+    c.Assert(ob.push(logEntries[5]), IsNil)
+    c.Assert(ob.popBatch(2), IsNil)
+    c.Assert(inFile(), Equals, 2)
+    c.Assert(ob.depth(), Equals, 2)
+
+    // A restart finds what is left, in order.
+    ob = newOutbox(s.dir+"/outbox.txt", 2)
+    c.Assert(ob.load(nil), IsNil)
+    for _, logEntry := range logEntries[4:] {
+        c.Assert(ob.peek().encodedHash(), Equals, logEntry.encodedHash())
+        c.Assert(ob.pop(), IsNil)
+    }
+    c.Assert(ob.depth(), Equals, 0)
+}
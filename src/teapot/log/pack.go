@@ -0,0 +1,224 @@
+package log
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "teapot/utility"
+)
+
+const packDebug utility.Debug = true
+
+// A pack holds at most this many log entries.
+const packSize = 256
+
+/*
+   Log entries are synced in packs of consecutive entries of one node.
+   Pack "pack.<nodeId>.<first>-<last>" holds the entries in the format of
+   the log file, <first> and <last> being the zero padded accept stamps
+   of its first and last entry. Its index "packindex.<nodeId>.<first>-<last>"
+   lists the hashes of the entries and is written after the pack, so that
+   listing the indexes of a node in order finds its new packs. A pack
+   written again with more entries after a restart sorts after the first
+   one.
+*/
+func PackKey(nodeId NodeID, first, last Timestamp) string {
+    return fmt.Sprintf("pack.%v.%020d-%020d", nodeId, first, last)
+}
+
+// The stamps of the first and last entry of a pack.
+func ParsePackKey(packKey string) (first, last Timestamp, ok bool) {
+    dot := strings.LastIndex(packKey, ".")
+    if dot < 0 {
+        return 0, 0, false
+    }
+    if _, err := fmt.Sscanf(packKey[dot+1:], "%d-%d", &first, &last); err != nil {
+        return 0, 0, false
+    }
+    return first, last, true
+}
+
+func PackIndexPrefix(nodeId NodeID) string {
+    return "packindex." + string(nodeId) + "."
+}
+
+// The pack an index describes.
+func PackKeyOfIndex(indexKey string) string {
+    return "pack." + strings.TrimPrefix(indexKey, "packindex.")
+}
+
+func encodePack(logEntries []*LogEntry) []byte {
+    var buf bytes.Buffer
+    for _, logEntry := range logEntries {
+        buf.WriteString(base64.URLEncoding.EncodeToString(logEntry.serialize()) + "\n")
+    }
+    return buf.Bytes()
+}
+
+func DecodePack(pack []byte) ([]*LogEntry, error) {
+    logEntries := make([]*LogEntry, 0)
+    for _, line := range strings.Split(string(pack), "\n") {
+        if line == "" {
+            continue
+        }
+        buf, err := base64.URLEncoding.DecodeString(line)
+        if err != nil {
+            return nil, packDebug.Error(err)
+        }
+        logEntry, err := deserializeLogEntry(buf)
+        if err != nil {
+            return nil, packDebug.Error(err)
+        }
+        logEntries = append(logEntries, logEntry)
+    }
+    return logEntries, nil
+}
+
+func encodePackIndex(logEntries []*LogEntry) string {
+    hashes := make([]string, len(logEntries))
+    for i, logEntry := range logEntries {
+        hashes[i] = string(logEntry.encodedHash())
+    }
+    return strings.Join(hashes, "\n") + "\n"
+}
+
+func DecodePackIndex(index string) []EncodedHash {
+    hashes := make([]EncodedHash, 0)
+    for _, line := range strings.Split(index, "\n") {
+        if line != "" {
+            hashes = append(hashes, EncodedHash(line))
+        }
+    }
+    return hashes
+}
+
+/*
+   Split entries, in commit order, into packs of consecutive entries of
+   the same node. A new pack starts whenever the node changes, so that
+   the stamps in the key of a pack bound all of its entries.
+*/
+func splitIntoPacks(logEntries []*LogEntry) [][]*LogEntry {
+    packs := make([][]*LogEntry, 0)
+    for i, logEntry := range logEntries {
+        if i == 0 || logEntry.NodeId != logEntries[i-1].NodeId {
+            packs = append(packs, make([]*LogEntry, 0))
+        }
+        packs[len(packs)-1] = append(packs[len(packs)-1], logEntry)
+    }
+    return packs
+}
+
+/*
+   The packs in remote storage and which of their entries are still
+   alive, so that a pack is deleted once GC made all of its entries
+   garbage. The file holds one "<pack key> <hash>,<hash>,..." line per pack.
+*/
+type packList struct {
+    path  string
+    lock  *sync.Mutex
+    packs map[string]map[EncodedHash]bool
+}
+
+func newPackList(path string) *packList {
+    packs := make(map[string]map[EncodedHash]bool)
+    if content, err := ioutil.ReadFile(path); err == nil {
+        for _, line := range strings.Split(string(content), "\n") {
+            fields := strings.Fields(line)
+            if len(fields) != 2 {
+                continue
+            }
+            alive := make(map[EncodedHash]bool)
+            for _, encodedHash := range strings.Split(fields[1], ",") {
+                if encodedHash != "-" {
+                    alive[EncodedHash(encodedHash)] = true
+                }
+            }
+            packs[fields[0]] = alive
+        }
+    } else if !os.IsNotExist(err) {
+        packDebug.Error(err)
+    }
+    return &packList{path, new(sync.Mutex), packs}
+}
+
+// Record a pack before its entries are marked as synced.
+func (pl *packList) add(packKey string, logEntries []*LogEntry) error {
+    pl.lock.Lock()
+    defer pl.lock.Unlock()
+    alive := make(map[EncodedHash]bool)
+    for _, logEntry := range logEntries {
+        alive[logEntry.encodedHash()] = true
+    }
+    pl.packs[packKey] = alive
+    return pl.save()
+}
+
+/*
+   Forget deleted entries, return the packs left without live entries.
+   They stay in the list until removed.
+*/
+func (pl *packList) collect(deleted []EncodedHash) ([]string, error) {
+    pl.lock.Lock()
+    defer pl.lock.Unlock()
+    gone := make(map[EncodedHash]bool)
+    for _, encodedHash := range deleted {
+        gone[encodedHash] = true
+    }
+    empty := make([]string, 0)
+    for packKey, alive := range pl.packs {
+        for encodedHash := range alive {
+            if gone[encodedHash] {
+                delete(alive, encodedHash)
+            }
+        }
+        if len(alive) == 0 {
+            empty = append(empty, packKey)
+        }
+    }
+    sort.Strings(empty)
+    if err := pl.save(); err != nil {
+        return nil, err
+    }
+    return empty, nil
+}
+
+func (pl *packList) remove(packKey string) error {
+    pl.lock.Lock()
+    defer pl.lock.Unlock()
+    delete(pl.packs, packKey)
+    return pl.save()
+}
+
+func (pl *packList) save() error {
+    var buf bytes.Buffer
+    for packKey, alive := range pl.packs {
+        if len(alive) == 0 {
+            // Written as is, it would not be read back.
+            buf.WriteString(packKey + " -\n")
+            continue
+        }
+        buf.WriteString(packKey + " " + strings.Join(hashStrings(sortedHashes(alive)), ",") + "\n")
+    }
+    if err := writeFile(pl.path, buf.Bytes()); err != nil {
+        return packDebug.Error(err)
+    }
+    return nil
+}
+
+func hashStrings(hashes []EncodedHash) []string {
+    result := make([]string, len(hashes))
+    for i, encodedHash := range hashes {
+        result[i] = string(encodedHash)
+    }
+    return result
+}
+
+// The index describing a pack.
+func packIndexKeyOf(packKey string) string {
+    return "packindex." + strings.TrimPrefix(packKey, "pack.")
+}
@@ -3,8 +3,8 @@ package log
 import (
     "errors"
     "fmt"
-    "runtime"
-    "strconv"
+    path_ "path"
+    "sync"
     "teapot/adaptor"
     "teapot/conf"
     "teapot/utility"
@@ -13,41 +13,107 @@ import (
 
 const remoteStorageDebug utility.Debug = true
 
+// Retry policy of the sync worker.
+const (
+    syncBackoffInitial   = time.Second
+    syncBackoffMax       = 5 * time.Minute
+    syncBreakerThreshold = 5
+)
+
 type iRemoteStorage interface {
     SyncLogEntry(logEntry *LogEntry)
     //    GetValue(encodedHash EncodedHash) ([]byte, error)
+    Recover(synced map[EncodedHash]bool) error
     StartSyncLog()
+    Status() SyncStatus
+    PrepareGarbage(encodedHashOfCDL EncodedHash, entries, values []EncodedHash) error
+    CollectGarbage(encodedHashOfCDL EncodedHash) error
+    RecoverGarbage(collected map[EncodedHash]bool, inLog func(encodedHash EncodedHash) bool) error
+    IsGarbage(encodedHash EncodedHash) bool
+}
+
+/*
+   Health of syncing to remote storage.
+   While Breaker is open nothing is uploaded; LastError tells why.
+*/
+type SyncStatus struct {
+    // Log entries waiting to be synced.
+    Pending int
+    // Log entries and values waiting to be deleted after GC.
+    Garbage int
+    // Our updates not synced because their value is gone from ValueDir.
+    Skipped []EncodedHash
+    // Log entries and values remote storage refused for good, see
+    // StartSyncLog.
+    Failed        []EncodedHash
+    Breaker       utility.BreakerState
+    Failures      int
+    LastErrorKind adaptor.ErrorKind
+    LastError     string
+    LastFailure   time.Time
+    LastSuccess   time.Time
 }
 
 type remoteStorage struct {
     myNodeId    NodeID
     theAdaptor  adaptor.Adaptor
-    logToSync   chan *LogEntry
-    valueToSync chan EncodedHash
-    js          *journalStorage
-    vm          *valueManager
+    // Values may be erasure coded, see conf.ValueShards.
+    valueAdaptor adaptor.Adaptor
+    outbox       *outbox
+    uploads      *uploadIds
+    packs        *packList
+    manifest     *manifestWriter
+    garbage      *garbageList
+    valueToSync  chan EncodedHash
+    js           *journalStorage
+    vm           *valueManager
+
+    backoff       *utility.Backoff
+    breaker       *utility.CircuitBreaker
+    statusLock    *sync.Mutex
+    lastErrorKind adaptor.ErrorKind
+    lastError     string
+    lastFailure   time.Time
+    lastSuccess   time.Time
+    skipped       []EncodedHash
+    refused       []EncodedHash
 }
 
 /*
    Create a remoteStorage object.
 */
-func newRemoteStorage(config *conf.Config, js *journalStorage, vm *valueManager) *remoteStorage {
-    auth := adaptor.NewAuth(config.AWSAccessKey, config.AWSSecretKey)
-    theAdaptor := adaptor.GetAdaptor(auth, config.MyBucketName)
+func newRemoteStorage(config *conf.Config, js *journalStorage, vm *valueManager, theAdaptor adaptor.Adaptor) *remoteStorage {
+    valueAdaptor, err := adaptor.NewValueAdaptor(config, config.MyBucketName, theAdaptor)
+    if err != nil {
+        remoteStorageDebug.Panicf("Unable to create value storage. %v", err)
+    }
     return &remoteStorage{
         NodeID(config.MyNodeId),
         theAdaptor,
-        make(chan *LogEntry),
+        valueAdaptor,
+        newOutbox(path_.Join(path_.Dir(config.JournalPath), "outbox.txt"), outboxLimit),
+        newUploadIds(path_.Join(path_.Dir(config.JournalPath), "uploads.txt")),
+        newPackList(path_.Join(path_.Dir(config.JournalPath), "packs.txt")),
+        newManifestWriter(path_.Join(path_.Dir(config.JournalPath), "manifest"), NodeID(config.MyNodeId), config.PrivateKey),
+        newGarbageList(path_.Join(path_.Dir(config.JournalPath), "garbage.txt")),
         make(chan EncodedHash),
         js,
         vm,
+        utility.NewBackoff(syncBackoffInitial, syncBackoffMax),
+        utility.NewCircuitBreaker(syncBreakerThreshold, syncBackoffMax),
+        new(sync.Mutex),
+        adaptor.Transient,
+        "",
+        time.Time{},
+        time.Time{},
+        nil,
+        nil,
     }
 }
 
 /*
-   use go routine to optimize this
-   asynchronously put the update online.
-   fixed synchronization issue with sync value
+   Queue the entry in the outbox, the sync worker puts it online.
+   Never blocks, a full outbox keeps the entry on disk only.
    We cannot accept an update synced without its value being synced.
    guarantee: if a log is synced, the value associated with it (if any)
    is also synced.
@@ -56,9 +122,18 @@ func (rs *remoteStorage) SyncLogEntry(logEntry *LogEntry) {
     encodedHashOfLogEntry := logEntry.encodedHash()
     logDebug.Debugf("Log entry to sync: %v", logEntry)
     logDebug.Debugf("Hash of log entry to sync: %v", encodedHashOfLogEntry)
-    go func() {
-        rs.logToSync <- logEntry
-    }()
+    if err := rs.outbox.push(logEntry); err != nil {
+        // The replay of the log at next startup queues it again.
+        remoteStorageDebug.Error(err)
+    }
+}
+
+/*
+   Pick up the outbox of the previous run.
+   synced holds the hashes with a "Sync:" record in the journal.
+*/
+func (rs *remoteStorage) Recover(synced map[EncodedHash]bool) error {
+    return rs.outbox.load(synced)
 }
 
 /*func (rs *remoteStorage) GetValue(encodedHash EncodedHash) ([]byte, error) {
@@ -66,81 +141,378 @@ func (rs *remoteStorage) SyncLogEntry(logEntry *LogEntry) {
 }*/
 
 /*
-   Send one entry to remote storage
+   Send a pack of entries of one node to remote storage, followed by its
+   index and, for our own entries, a new manifest.
 */
-func (rs *remoteStorage) doSyncLogEntry(encodedHashOfLogEntry EncodedHash, logEntry *LogEntry, logEntryBinary []byte) error {
-    if err := rs.theAdaptor.PutBinary(string(encodedHashOfLogEntry), logEntryBinary); err != nil {
+func (rs *remoteStorage) doSyncPack(logEntries []*LogEntry, pack []byte) error {
+    first, last := logEntries[0], logEntries[len(logEntries)-1]
+    packKey := PackKey(first.NodeId, first.AcceptStamp, last.AcceptStamp)
+    if err := rs.theAdaptor.PutBinary(packKey, pack); err != nil {
         return remoteStorageDebug.Error(err)
     }
-    if logEntry.NodeId == rs.myNodeId {
-        lastUpdateInfo := strconv.FormatInt(int64(logEntry.AcceptStamp), 10) + "," + string(encodedHashOfLogEntry)
-        if err := rs.theAdaptor.PutText(string(rs.myNodeId)+".latestUpdate", lastUpdateInfo); err != nil {
+    if err := rs.packs.add(packKey, logEntries); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    if err := rs.theAdaptor.PutText(packIndexKeyOf(packKey), encodePackIndex(logEntries)); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    if first.NodeId == rs.myNodeId {
+        if err := rs.manifest.addPack(packKey, logEntries); err != nil {
             return remoteStorageDebug.Error(err)
         }
+        if err := rs.writeManifest(); err != nil {
+            return err
+        }
     }
-    if err := rs.js.Write("Sync:" + string(encodedHashOfLogEntry)); err != nil {
-        return remoteStorageDebug.Error(err)
+    for _, logEntry := range logEntries {
+        if err := rs.js.Write("Sync:" + string(logEntry.encodedHash())); err != nil {
+            return remoteStorageDebug.Error(err)
+        }
     }
     return nil
 }
 
 /*
-   send the value to the remote storage
+   Stream the value file to remote storage. Large values are uploaded in
+   parts, and an interrupted upload is resumed on the next attempt.
 */
 func (rs *remoteStorage) doSyncValue(encodedHashOfValue EncodedHash) error {
-    value, err := rs.vm.ReadValue(encodedHashOfValue)
+    file, err := rs.vm.OpenValue(encodedHashOfValue)
     if err != nil {
-        return remoteStorageDebug.Error(errors.New("The specified value doesn't exist: " + string(encodedHashOfValue)))
+        // Retrying won't bring the value back.
+        return remoteStorageDebug.Error(&adaptor.Error{Kind: adaptor.Permanent, Err: errors.New("The specified value doesn't exist: " + string(encodedHashOfValue))})
     }
-    if err := rs.theAdaptor.PutBinary(string(encodedHashOfValue), value); err != nil {
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    started := func(uploadId string) error {
+        return rs.uploads.set(encodedHashOfValue, uploadId)
+    }
+    if err := adaptor.PutFile(rs.valueAdaptor, string(encodedHashOfValue), file, info.Size(), rs.uploads.get(encodedHashOfValue), started); err != nil {
         return remoteStorageDebug.Error(err)
     }
+    if err := rs.uploads.set(encodedHashOfValue, ""); err != nil {
+        remoteStorageDebug.Error(err)
+    }
     if err := rs.js.Write("Sync:" + string(encodedHashOfValue)); err != nil {
         return remoteStorageDebug.Error(err)
     }
     return nil
 }
 
-// TODO exponetial backup.
+/*
+   One worker syncs entries in order, in packs of up to packSize entries.
+   A failed upload is retried until it succeeds, waiting longer after
+   each failure. Failures that won't go away
+   by themselves (bad credentials, rejected requests) open the breaker at
+   once and are not retried: the entries are left unsynced and listed by
+   Status, the replay of the log at next startup queues them again. The
+   worker then goes on with the next entries every syncBackoffMax, and
+   the failure is reported by Status until an upload succeeds again.
+   Our updates whose value is gone from ValueDir are not synced, retrying
+   won't bring the value back; Status lists them.
+   Entries of other nodes are read from the buckets of their writers, so
+   only ours are synced.
+*/
 func (rs *remoteStorage) StartSyncLog() {
     go func() {
         for {
-            logEntry := <-rs.logToSync
-            for {
-                if logEntry == nil {
-                    break
+            logEntries := rs.outbox.peekBatch(packSize)
+            toSync := make([]*LogEntry, 0, len(logEntries))
+            for _, logEntry := range logEntries {
+                if logEntry.NodeId != rs.myNodeId {
+                    if err := rs.js.Write("Sync:" + string(logEntry.encodedHash())); err != nil {
+                        remoteStorageDebug.Error(err)
+                    }
+                    continue
                 }
                 if update, ok := logEntry.Message.(*Update); ok {
+                    if !rs.vm.HasValue(update.HashOfValue) {
+                        rs.skip(logEntry, update.HashOfValue)
+                        continue
+                    }
                     // value must be there before update is synced.
-                    for {
-                        // Sync value
+                    err := rs.retry(func() error {
                         remoteStorageDebug.Debugf("Syncing value: %v", update.HashOfValue)
-                        if err := rs.doSyncValue(update.HashOfValue); err == nil {
-                            break
-                        } else {
-                            if err.Error() == "The AWS Access Key Id you provided does not exist in our records." {
-                                return
-                            }
-                            remoteStorageDebug.Error(err)
-                            runtime.Gosched()
-                            time.Sleep(1000000000)
-                        }
+                        return rs.doSyncValue(update.HashOfValue)
+                    })
+                    if err != nil {
+                        rs.fail(logEntry.encodedHash(), update.HashOfValue)
+                        continue
                     }
                 }
-                logEntryBinary := utility.GobEncode(logEntry)
-                encodedHashOfLogEntry := logEntry.encodedHash()
-                remoteStorageDebug.Debugf("Syncing log: %v", encodedHashOfLogEntry)
-                if err := rs.doSyncLogEntry(encodedHashOfLogEntry, logEntry, logEntryBinary); err == nil {
-                    break
-                } else {
-                    if err.Error() == "The AWS Access Key Id you provided does not exist in our records." {
-                        return
+                toSync = append(toSync, logEntry)
+            }
+            for _, pack := range splitIntoPacks(toSync) {
+                packBinary := encodePack(pack)
+                err := rs.retry(func() error {
+                    remoteStorageDebug.Debugf("Syncing pack of %v log entries of %v", len(pack), pack[0].NodeId)
+                    if err := rs.doSyncPack(pack, packBinary); err != nil {
+                        remoteStorageDebug.Debugf("Syncing pack failed: %v", pack[0].encodedHash())
+                        return err
+                    }
+                    return nil
+                })
+                if err != nil {
+                    for _, logEntry := range pack {
+                        rs.fail(logEntry.encodedHash())
                     }
-                    remoteStorageDebug.Error(errors.New(fmt.Sprintf("Syncing log failed: %v\n%v", encodedHashOfLogEntry, err)))
-                    runtime.Gosched()
-                    time.Sleep(1000000000)
                 }
             }
+            if err := rs.outbox.popBatch(len(logEntries)); err != nil {
+                remoteStorageDebug.Error(err)
+            }
         }
     }()
+    go rs.collectGarbage()
+}
+
+/*
+   Keep the log entries and values the GC of a CDL makes unnecessary,
+   before the log is rewritten. Nothing is deleted until CollectGarbage.
+*/
+func (rs *remoteStorage) PrepareGarbage(encodedHashOfCDL EncodedHash, entries, values []EncodedHash) error {
+    if len(entries) == 0 && len(values) == 0 {
+        return nil
+    }
+    if err := rs.garbage.prepare(encodedHashOfCDL, entries, values); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    return nil
+}
+
+/*
+   Once the log is rewritten, queue the garbage of the GC of a CDL for
+   deletion. The GC is journaled first.
+*/
+func (rs *remoteStorage) CollectGarbage(encodedHashOfCDL EncodedHash) error {
+    if err := rs.manifest.setSnapshot(encodedHashOfCDL); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    if !rs.garbage.isPrepared(encodedHashOfCDL) {
+        return nil
+    }
+    if err := rs.js.Write("GC:" + string(encodedHashOfCDL)); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    if err := rs.garbage.release(encodedHashOfCDL); err != nil {
+        return remoteStorageDebug.Error(err)
+    }
+    return nil
+}
+
+/*
+   Settle the GCs cut off by a restart. collected holds the journaled
+   ones, their garbage is deleted. Otherwise garbage entries still in the
+   log tell that it was not rewritten, and the garbage is kept.
+*/
+func (rs *remoteStorage) RecoverGarbage(collected map[EncodedHash]bool, inLog func(encodedHash EncodedHash) bool) error {
+    for encodedHashOfCDL, set := range rs.garbage.preparedGC() {
+        rewritten := collected[encodedHashOfCDL]
+        if !rewritten && len(set.entries) > 0 {
+            rewritten = true
+            for _, encodedHash := range set.entries {
+                if inLog(encodedHash) {
+                    rewritten = false
+                    break
+                }
+            }
+        }
+        if !rewritten {
+            remoteStorageDebug.Debugf("GC of %v did not complete, keeping its garbage.", encodedHashOfCDL)
+            if err := rs.garbage.drop(encodedHashOfCDL); err != nil {
+                return remoteStorageDebug.Error(err)
+            }
+            continue
+        }
+        if err := rs.CollectGarbage(encodedHashOfCDL); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (rs *remoteStorage) IsGarbage(encodedHash EncodedHash) bool {
+    return rs.garbage.isGarbage(encodedHash)
+}
+
+/*
+   Delete garbage from ValueDir and remote storage, once nothing of it
+   is waiting in the outbox anymore: an entry still to be synced needs
+   its value. What remote storage refuses to delete for good is left
+   there and listed by Status.
+*/
+func (rs *remoteStorage) collectGarbage() {
+    backoff := utility.NewBackoff(syncBackoffInitial, syncBackoffMax)
+    for {
+        entries, values := rs.garbage.wait()
+        if rs.outbox.anyPending(entries) {
+            time.Sleep(garbagePollInterval)
+            continue
+        }
+        deletedValues := make([]EncodedHash, 0, garbageBatch)
+        for _, encodedHash := range values {
+            err := rs.retryWith(backoff, func() error {
+                if err := rs.vm.DeleteValue(encodedHash); err != nil {
+                    return err
+                }
+                return rs.valueAdaptor.Delete(string(encodedHash))
+            })
+            if err != nil {
+                rs.fail(encodedHash)
+            }
+            if deletedValues = append(deletedValues, encodedHash); len(deletedValues) == garbageBatch {
+                rs.doneWithGarbage(nil, deletedValues)
+                deletedValues = deletedValues[:0]
+            }
+        }
+        rs.doneWithGarbage(nil, deletedValues)
+        deletedEntries := make([]EncodedHash, 0, garbageBatch)
+        for _, encodedHash := range entries {
+            if err := rs.retryWith(backoff, func() error {
+                return rs.theAdaptor.Delete(string(encodedHash))
+            }); err != nil {
+                rs.fail(encodedHash)
+            }
+            if deletedEntries = append(deletedEntries, encodedHash); len(deletedEntries) == garbageBatch {
+                rs.doneWithGarbage(deletedEntries, nil)
+                deletedEntries = deletedEntries[:0]
+            }
+        }
+        rs.doneWithGarbage(deletedEntries, nil)
+        rs.deleteEmptyPacks(backoff, entries)
+        // Tell peers about the snapshot and the packs gone.
+        rs.retryWith(backoff, rs.writeManifest)
+        remoteStorageDebug.Debugf("Deleted %v log entries and %v values.", len(entries), len(values))
+    }
+}
+
+// Delete the packs and indexes holding nothing but deleted entries.
+func (rs *remoteStorage) deleteEmptyPacks(backoff *utility.Backoff, deleted []EncodedHash) {
+    empty, err := rs.packs.collect(deleted)
+    if err != nil {
+        remoteStorageDebug.Error(err)
+    }
+    for _, packKey := range empty {
+        // A pack left there only holds deleted entries.
+        rs.retryWith(backoff, func() error {
+            if err := rs.theAdaptor.Delete(packIndexKeyOf(packKey)); err != nil {
+                return err
+            }
+            return rs.theAdaptor.Delete(packKey)
+        })
+        if err := rs.packs.remove(packKey); err != nil {
+            remoteStorageDebug.Error(err)
+        }
+    }
+    if err := rs.manifest.removePacks(empty); err != nil {
+        remoteStorageDebug.Error(err)
+    }
+}
+
+func (rs *remoteStorage) writeManifest() error {
+    return rs.manifest.write(func(manifest []byte) error {
+        if err := rs.theAdaptor.PutBinary(ManifestKey(rs.myNodeId), manifest); err != nil {
+            return remoteStorageDebug.Error(err)
+        }
+        return nil
+    })
+}
+
+func (rs *remoteStorage) doneWithGarbage(entries, values []EncodedHash) {
+    if err := rs.garbage.done(entries, values); err != nil {
+        remoteStorageDebug.Error(err)
+    }
+}
+
+/*
+   Call sync until it succeeds, or fails in a way retrying won't fix,
+   see permanent. The error is returned then.
+*/
+func (rs *remoteStorage) retry(sync func() error) error {
+    return rs.retryWith(rs.backoff, sync)
+}
+
+// Every worker needs its own backoff, the breaker is shared.
+func (rs *remoteStorage) retryWith(backoff *utility.Backoff, sync func() error) error {
+    for {
+        for !rs.breaker.Allow() {
+            time.Sleep(rs.breaker.RetryIn())
+        }
+        err := sync()
+        if err == nil {
+            backoff.Reset()
+            rs.succeeded()
+            return nil
+        }
+        if rs.failed(err) {
+            time.Sleep(backoff.Next())
+        } else if permanent(err) {
+            return err
+        }
+    }
+}
+
+// Bad credentials and rejected requests won't go away by retrying.
+func permanent(err error) bool {
+    kind := adaptor.Classify(err)
+    return kind == adaptor.Auth || kind == adaptor.Permanent
+}
+
+// Record entries and values remote storage refused for good.
+func (rs *remoteStorage) fail(encodedHashes ...EncodedHash) {
+    rs.statusLock.Lock()
+    defer rs.statusLock.Unlock()
+    rs.refused = append(rs.refused, encodedHashes...)
+}
+
+func (rs *remoteStorage) skip(logEntry *LogEntry, encodedHashOfValue EncodedHash) {
+    remoteStorageDebug.Error(errors.New(fmt.Sprintf("Not syncing %v, its value %v doesn't exist.", logEntry.encodedHash(), encodedHashOfValue)))
+    rs.statusLock.Lock()
+    defer rs.statusLock.Unlock()
+    rs.skipped = append(rs.skipped, logEntry.encodedHash())
+}
+
+func (rs *remoteStorage) succeeded() {
+    rs.breaker.Success()
+    rs.statusLock.Lock()
+    defer rs.statusLock.Unlock()
+    rs.lastSuccess = time.Now()
+}
+
+// Record the failure, return whether it is worth retrying soon.
+func (rs *remoteStorage) failed(err error) bool {
+    kind := adaptor.Classify(err)
+    rs.statusLock.Lock()
+    rs.lastErrorKind = kind
+    rs.lastError = err.Error()
+    rs.lastFailure = time.Now()
+    rs.statusLock.Unlock()
+    if permanent(err) {
+        remoteStorageDebug.Error(errors.New(fmt.Sprintf("Remote storage failure (%v), syncing suspended for %v: %v", kind, syncBackoffMax, err)))
+        rs.breaker.Trip()
+        return false
+    }
+    remoteStorageDebug.Error(err)
+    rs.breaker.Failure()
+    return rs.breaker.State() == utility.BreakerClosed
+}
+
+func (rs *remoteStorage) Status() SyncStatus {
+    rs.statusLock.Lock()
+    defer rs.statusLock.Unlock()
+    return SyncStatus{
+        rs.outbox.depth(),
+        rs.garbage.size(),
+        append([]EncodedHash(nil), rs.skipped...),
+        append([]EncodedHash(nil), rs.refused...),
+        rs.breaker.State(),
+        rs.breaker.Failures(),
+        rs.lastErrorKind,
+        rs.lastError,
+        rs.lastFailure,
+        rs.lastSuccess,
+    }
 }
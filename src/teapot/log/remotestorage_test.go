@@ -0,0 +1,262 @@
+package log
+
+import (
+    "errors"
+    "fmt"
+    . "launchpad.net/gocheck"
+    "sync"
+    "teapot/adaptor"
+    "teapot/conf"
+    "teapot/utility"
+    "time"
+)
+
+type RemoteStorageSuite struct {
+    dir string
+}
+
+var _ = Suite(&RemoteStorageSuite{})
+
+// Fails the next failures puts with err.
+type flakyAdaptor struct {
+    adaptor.Adaptor
+    lock     *sync.Mutex
+    failures int
+    err      error
+}
+
+func (a *flakyAdaptor) PutBinary(key string, value []byte) error {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    if a.failures > 0 {
+        a.failures--
+        return a.err
+    }
+    return a.Adaptor.PutBinary(key, value)
+}
+
+func (s *RemoteStorageSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *RemoteStorageSuite) newRemoteStorage(config *conf.Config, theAdaptor adaptor.Adaptor) *remoteStorage {
+    rs := newRemoteStorage(config, newJournalStorage(config.JournalPath), newValueManager(config.ValueDir), theAdaptor)
+    rs.backoff = utility.NewBackoff(time.Millisecond, 10*time.Millisecond)
+    rs.breaker = utility.NewCircuitBreaker(3, 100*time.Millisecond)
+    return rs
+}
+
+func (s *RemoteStorageSuite) newLogEntry(config *conf.Config) *LogEntry {
+    log := newTestableLog(config)
+    chmod := log.NewChangeMode("dir", utility.KeyFromPassphrase("password"), []NodeID{}, []NodeID{log.memLog.MyNodeId})
+    return log.NewLogEntry(chmod)
+}
+
+func waitForObject(c *C, theAdaptor adaptor.Adaptor, key string, timeout time.Duration) {
+    for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+        if _, err := theAdaptor.Head(key); err == nil {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Fatalf("%v was not synced in %v", key, timeout)
+}
+
+// Wait for the worker to be done with everything queued.
+func waitForPending(c *C, rs *remoteStorage) {
+    for i := 0; i < 500 && rs.Status().Pending != 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(rs.Status().Pending, Equals, 0)
+}
+
+func (s *RemoteStorageSuite) TestTransientFailures(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+    flaky := &flakyAdaptor{storage, new(sync.Mutex), 2, errors.New("connection reset by peer")}
+    rs := s.newRemoteStorage(config, flaky)
+    rs.StartSyncLog()
+    logEntry := s.newLogEntry(config)
+    rs.SyncLogEntry(logEntry)
+    waitForObject(c, storage, PackKey(logEntry.NodeId, logEntry.AcceptStamp, logEntry.AcceptStamp), 5*time.Second)
+    waitForPending(c, rs)
+    status := rs.Status()
+    c.Assert(status.Breaker, Equals, utility.BreakerClosed)
+    c.Assert(status.Failures, Equals, 0)
+    c.Assert(status.LastErrorKind, Equals, adaptor.Transient)
+    c.Assert(status.LastError, Equals, "connection reset by peer")
+}
+
+func (s *RemoteStorageSuite) TestAuthFailureOpensBreaker(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+    authErr := &adaptor.Error{Kind: adaptor.Auth, Err: errors.New("The AWS Access Key Id you provided does not exist in our records.")}
+    flaky := &flakyAdaptor{storage, new(sync.Mutex), 1, authErr}
+    rs := s.newRemoteStorage(config, flaky)
+    rs.StartSyncLog()
+    logEntry := s.newLogEntry(config)
+    rs.SyncLogEntry(logEntry)
+    for i := 0; i < 100 && rs.Status().Failures == 0; i++ {
+        time.Sleep(time.Millisecond)
+    }
+    status := rs.Status()
+    c.Assert(status.Breaker, Equals, utility.BreakerOpen)
+    c.Assert(status.LastErrorKind, Equals, adaptor.Auth)
+    // The entry is not retried, the next one is synced once the breaker lets a trial through.
+    waitForPending(c, rs)
+    c.Assert(rs.Status().Failed, DeepEquals, []EncodedHash{logEntry.encodedHash()})
+    next := s.newLogEntry(config)
+    rs.SyncLogEntry(next)
+    waitForObject(c, storage, PackKey(next.NodeId, next.AcceptStamp, next.AcceptStamp), 5*time.Second)
+    // The pack is only part of the trial, its index follows.
+    waitForPending(c, rs)
+    c.Assert(rs.Status().Breaker, Equals, utility.BreakerClosed)
+}
+
+// Commits go on while remote storage is down, past the outbox limit.
+func (s *RemoteStorageSuite) TestCommitWhileOffline(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+    flaky := &flakyAdaptor{storage, new(sync.Mutex), 1000000, errors.New("connection reset by peer")}
+    log := newLog(config, flaky)
+    rs := s.newRemoteStorage(config, flaky)
+    rs.outbox = newOutbox(s.dir+"/outbox.txt", 2)
+    log.rs = rs
+    c.Assert(log.rebuild(), IsNil)
+    rs.StartSyncLog()
+    committed := make(chan error)
+    go func() {
+        for i := 0; i < 5; i++ {
+            chmod := log.NewChangeMode(Dir(fmt.Sprintf("dir%v", i)), utility.KeyFromPassphrase("password"), []NodeID{}, []NodeID{log.memLog.MyNodeId})
+            if err := log.Commit(log.NewLogEntry(chmod)); err != nil {
+                committed <- err
+                return
+            }
+        }
+        committed <- nil
+    }()
+    select {
+    case err := <-committed:
+        c.Assert(err, IsNil)
+    case <-time.After(5 * time.Second):
+        c.Fatalf("Commit blocked on a full outbox.")
+    }
+    c.Assert(rs.Status().Pending, Equals, 5)
+    // Everything is synced once remote storage is back.
+    flaky.lock.Lock()
+    flaky.failures = 0
+    flaky.lock.Unlock()
+    waitForPending(c, rs)
+}
+
+// An update whose value is gone does not hold back the entries after it.
+func (s *RemoteStorageSuite) TestMissingValue(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+    rs := s.newRemoteStorage(config, storage)
+    log := newTestableLog(config)
+    update := log.NewUpdate(Key(config.MyNodeId+"/dir/a"), []byte("world"))
+    lost := log.NewLogEntry(update)
+    c.Assert(log.Commit(lost), IsNil)
+    rs.SyncLogEntry(lost)
+    chmod := log.NewChangeMode("dir", utility.KeyFromPassphrase("password"), []NodeID{}, []NodeID{log.memLog.MyNodeId})
+    logEntry := log.NewLogEntry(chmod)
+    c.Assert(log.Commit(logEntry), IsNil)
+    rs.SyncLogEntry(logEntry)
+    rs.StartSyncLog()
+    waitForPending(c, rs)
+    status := rs.Status()
+    c.Assert(status.Skipped, DeepEquals, []EncodedHash{lost.encodedHash()})
+    c.Assert(status.Breaker, Equals, utility.BreakerClosed)
+    _, err := storage.Head(PackKey(logEntry.NodeId, logEntry.AcceptStamp, logEntry.AcceptStamp))
+    c.Assert(err, IsNil)
+    _, err = storage.Head(string(update.HashOfValue))
+    c.Assert(err, Equals, adaptor.ErrNotFound)
+}
+
+func (s *RemoteStorageSuite) TestPacks(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+    rs := s.newRemoteStorage(config, storage)
+    log := newTestableLog(config)
+    logEntries := make([]*LogEntry, 3)
+    for i := range logEntries {
+        chmod := log.NewChangeMode("dir", utility.KeyFromPassphrase("password"), []NodeID{}, []NodeID{log.memLog.MyNodeId})
+        logEntries[i] = log.NewLogEntry(chmod)
+        c.Assert(log.Commit(logEntries[i]), IsNil)
+        rs.SyncLogEntry(logEntries[i])
+    }
+    // Queued before the worker starts, so they all go in one pack.
+    rs.StartSyncLog()
+    first, last := logEntries[0], logEntries[2]
+    packKey := PackKey(first.NodeId, first.AcceptStamp, last.AcceptStamp)
+    waitForObject(c, storage, packIndexKeyOf(packKey), 5*time.Second)
+    for i := 0; i < 1000 && rs.Status().Pending != 0; i++ {
+        time.Sleep(time.Millisecond)
+    }
+    c.Assert(rs.Status().Pending, Equals, 0)
+    result, err := storage.List(PackIndexPrefix(first.NodeId), "", 0)
+    c.Assert(err, IsNil)
+    c.Assert(len(result.Objects), Equals, 1)
+    c.Assert(PackKeyOfIndex(result.Objects[0].Key), Equals, packKey)
+    index, err := storage.GetText(result.Objects[0].Key)
+    c.Assert(err, IsNil)
+    pack, err := storage.GetBinary(packKey)
+    c.Assert(err, IsNil)
+    packed, err := DecodePack(pack)
+    c.Assert(err, IsNil)
+    c.Assert(len(packed), Equals, 3)
+    for i, encodedHash := range DecodePackIndex(index) {
+        c.Assert(encodedHash, Equals, logEntries[i].encodedHash())
+        c.Assert(packed[i].encodedHash(), Equals, encodedHash)
+    }
+    buf, err := storage.GetBinary(ManifestKey(first.NodeId))
+    c.Assert(err, IsNil)
+    manifest, err := DecodeManifest(first.NodeId, buf, config.PublicKeys[config.MyNodeId])
+    c.Assert(err, IsNil)
+    c.Assert(*manifest.Latest(), Equals, VersionInfo{last.AcceptStamp, last.encodedHash()})
+    c.Assert(manifest.Packs, DeepEquals, []string{packKey})
+    // The pack goes once GC made all of its entries garbage.
+    rs.deleteEmptyPacks(rs.backoff, []EncodedHash{first.encodedHash()})
+    _, err = storage.Head(packKey)
+    c.Assert(err, IsNil)
+    rs.deleteEmptyPacks(rs.backoff, []EncodedHash{logEntries[1].encodedHash(), last.encodedHash()})
+    _, err = storage.Head(packKey)
+    c.Assert(err, Equals, adaptor.ErrNotFound)
+    _, err = storage.Head(packIndexKeyOf(packKey))
+    c.Assert(err, Equals, adaptor.ErrNotFound)
+    c.Assert(rs.manifest.manifest.Packs, DeepEquals, []string{})
+}
+
+func (s *RemoteStorageSuite) TestSplitIntoPacks(c *C) {
+    a1, a2, b1, a3 := &LogEntry{NodeId: "a"}, &LogEntry{NodeId: "a"}, &LogEntry{NodeId: "b"}, &LogEntry{NodeId: "a"}
+    packs := splitIntoPacks([]*LogEntry{a1, a2, b1, a3})
+    c.Assert(packs, DeepEquals, [][]*LogEntry{{a1, a2}, {b1}, {a3}})
+}
+
+func (s *RemoteStorageSuite) TestManifest(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    nodeId := NodeID(config.MyNodeId)
+    mw := newManifestWriter(s.dir+"/manifest", nodeId, config.PrivateKey)
+    logEntry := s.newLogEntry(config)
+    c.Assert(mw.addPack("pack.a", []*LogEntry{logEntry}), IsNil)
+    c.Assert(mw.addPack("pack.a", []*LogEntry{logEntry}), IsNil)
+    var older, newer []byte
+    c.Assert(mw.write(func(manifest []byte) error { older = manifest; return nil }), IsNil)
+    // A restart carries on with the same manifest.
+    mw = newManifestWriter(s.dir+"/manifest", nodeId, config.PrivateKey)
+    c.Assert(mw.write(func(manifest []byte) error { newer = manifest; return nil }), IsNil)
+    first, err := DecodeManifest(nodeId, older, config.PublicKeys[config.MyNodeId])
+    c.Assert(err, IsNil)
+    second, err := DecodeManifest(nodeId, newer, config.PublicKeys[config.MyNodeId])
+    c.Assert(err, IsNil)
+    c.Assert(second.Version > first.Version, Equals, true)
+    c.Assert(second.Recent, DeepEquals, []VersionInfo{{logEntry.AcceptStamp, logEntry.encodedHash()}})
+    c.Assert(second.Packs, DeepEquals, []string{"pack.a"})
+    // Anything changed breaks the signature.
+    second.Packs = nil
+    _, err = DecodeManifest(nodeId, utility.GobEncode(second), config.PublicKeys[config.MyNodeId])
+    c.Assert(err, ErrorMatches, "Forged manifest.*")
+    _, err = DecodeManifest("somebody_else", newer, config.PublicKeys[config.MyNodeId])
+    c.Assert(err, NotNil)
+}
@@ -110,4 +110,5 @@ type keyInfo struct {
     Key         SecretKey
     AcceptStamp Timestamp
     Writers     map[NodeID]bool
+    Readers     map[NodeID]bool
 }
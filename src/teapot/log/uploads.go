@@ -0,0 +1,65 @@
+package log
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+    "teapot/utility"
+)
+
+const uploadsDebug utility.Debug = true
+
+/*
+   Ids of the multipart uploads of values in progress, so that an upload
+   interrupted by a failure or a restart resumes where it stopped.
+   The file holds one "<hash of value> <upload id>" line per upload.
+*/
+type uploadIds struct {
+    path string
+    lock *sync.Mutex
+    ids  map[EncodedHash]string
+}
+
+func newUploadIds(path string) *uploadIds {
+    ids := make(map[EncodedHash]string)
+    if content, err := ioutil.ReadFile(path); err == nil {
+        for _, line := range strings.Split(string(content), "\n") {
+            if fields := strings.Fields(line); len(fields) == 2 {
+                ids[EncodedHash(fields[0])] = fields[1]
+            }
+        }
+    } else if !os.IsNotExist(err) {
+        uploadsDebug.Error(err)
+    }
+    return &uploadIds{path, new(sync.Mutex), ids}
+}
+
+func (u *uploadIds) get(encodedHash EncodedHash) string {
+    u.lock.Lock()
+    defer u.lock.Unlock()
+    return u.ids[encodedHash]
+}
+
+// Remember the upload of a value, forget it if uploadId is "".
+func (u *uploadIds) set(encodedHash EncodedHash, uploadId string) error {
+    u.lock.Lock()
+    defer u.lock.Unlock()
+    if u.ids[encodedHash] == uploadId {
+        return nil
+    }
+    if uploadId == "" {
+        delete(u.ids, encodedHash)
+    } else {
+        u.ids[encodedHash] = uploadId
+    }
+    var buf bytes.Buffer
+    for hash, id := range u.ids {
+        buf.WriteString(string(hash) + " " + id + "\n")
+    }
+    if err := writeFile(u.path, buf.Bytes()); err != nil {
+        return uploadsDebug.Error(err)
+    }
+    return nil
+}
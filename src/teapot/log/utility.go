@@ -18,7 +18,7 @@ func ValidateKey(key Key) error {
     if len(string(key)) > 80 {
         return utilityDebug.Error(errors.New(fmt.Sprintf("The key should not be longer than 80 chars, %v", key)))
     }
-    matched, err := regexp.MatchString("^[[:alnum:]_]+/[[:alnum:]_]+/([[:alnum:]\\._]+/)*[[:alnum:]\\._]+$", string(key))
+    matched, err := regexp.MatchString("^"+utility.KeyNamePattern+"/"+utility.KeyNamePattern+"/([[:alnum:]\\._]+/)*[[:alnum:]\\._]+$", string(key))
     if err != nil {
         return utilityDebug.Error(err)
     } else if !matched {
@@ -0,0 +1,338 @@
+package logex
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "net/rpc"
+    "sort"
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const digestDebug utility.Debug = true
+
+// How often summaries are compared with a peer.
+const digestSyncInterval = 10 * time.Minute
+
+// At most this many missing values are asked for per comparison.
+const digestValuesWanted = 64
+
+// At most this many ranges are descended into per call.
+const digestDescent = 16
+
+/*
+   The top of the tree of digests of each branch, see log.DigestTop.
+   Asked for with the floors of the asking node, so that what it
+   collected is left out.
+*/
+type Digests map[log.NodeID]log.DigestTop
+
+// A range of a level of the tree of a branch, see log.DigestWidth.
+type EntryRange struct {
+    NodeId log.NodeID
+    Level  int
+    Start  log.Timestamp
+}
+
+// Ask for the digests one level below each of Ranges.
+type ChildDigestsRequest struct {
+    Floors map[log.NodeID]log.Timestamp
+    Ranges []EntryRange
+}
+
+// The digests below each range asked for, in the same order.
+type ChildDigests []map[log.Timestamp]log.RangeDigest
+
+/*
+   Ask for the entries in Ranges that are not in Held, with their values
+   under Subscriptions unless it is empty. At most entriesSincePage
+   entries are sent per call.
+*/
+type RangesRequest struct {
+    Floors        map[log.NodeID]log.Timestamp
+    Ranges        []EntryRange
+    Held          map[log.EncodedHash]bool
+    Subscriptions []string
+}
+
+// When summaries are next compared with a peer.
+type digestSync struct {
+    lock     *sync.Mutex
+    lastSync time.Time
+}
+
+// The first comparison is due an interval after now.
+func newDigestSync(now time.Time) *digestSync {
+    return &digestSync{new(sync.Mutex), now}
+}
+
+// Whether a comparison is due, in which case the next one is not.
+func (tracker *digestSync) due(now time.Time) bool {
+    tracker.lock.Lock()
+    defer tracker.lock.Unlock()
+    if now.Sub(tracker.lastSync) < digestSyncInterval {
+        return false
+    }
+    tracker.lastSync = now
+    return true
+}
+
+/*
+   What we hold of ranges and is not in request, in accept stamp order.
+   The first entriesSincePage only, and More tells if there are more.
+*/
+func (logex *LogEx) entriesInRanges(caller log.NodeID, request RangesRequest) EntriesSince {
+    logEntries := make([]*log.LogEntry, 0)
+    for _, entryRange := range request.Ranges {
+        // Entries are only sent by leaf.
+        if entryRange.Level != 0 {
+            continue
+        }
+        for _, logEntry := range logex.theLog.GetEntriesInRange(entryRange.NodeId, entryRange.Start, request.Floors[entryRange.NodeId]) {
+            if !request.Held[logEntry.EncodedHash()] {
+                logEntries = append(logEntries, logEntry)
+            }
+        }
+    }
+    // Entries come after what they depend on in accept stamp order.
+    sort.Sort(byAcceptStamp(logEntries))
+    more := len(logEntries) > entriesSincePage
+    if more {
+        logEntries = logEntries[:entriesSincePage]
+    }
+    values := make(map[log.EncodedHash][]byte)
+    size := 0
+    for _, logEntry := range logEntries {
+        update, ok := logEntry.Message.(*log.Update)
+        if !ok || size >= entriesSinceValueBytes || !subscriptions(request.Subscriptions).covers(update.Key) {
+            continue
+        }
+        if !logex.theLog.HasValue(update.HashOfValue) || !logex.theLog.CanRead(caller, logEntry) {
+            continue
+        }
+        if value, err := logex.theLog.GetValue(update.HashOfValue); err == nil {
+            values[update.HashOfValue] = value
+            size += len(value)
+        }
+    }
+    // Values left out are fetched the usual way.
+    return EntriesSince{logEntries, values, more}
+}
+
+type byAcceptStamp []*log.LogEntry
+
+func (entries byAcceptStamp) Len() int           { return len(entries) }
+func (entries byAcceptStamp) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+func (entries byAcceptStamp) Less(i, j int) bool { return entries[i].AcceptStamp < entries[j].AcceptStamp }
+
+/*
+   Compare the tops of the trees of digests of our log with those of
+   peer, descend into the ranges that differ down to the leaves and fetch
+   exactly what we miss in those, a page at a time. Then ask peer for the
+   values we lack, see fetchMissingValues.
+*/
+func (logex *LogEx) digestAntiEntropy(peer log.NodeID) error {
+    client, err := logex.dialPeer(peer)
+    if err != nil {
+        return logexDebug.Error(err)
+    }
+    defer client.Close()
+    floors := logex.theLog.GetHorizon()
+    var theirs Digests
+    if err := client.Call("LogEx.GetDigests", floors, &theirs); err != nil {
+        return logexDebug.Error(err)
+    }
+    differing := make([]EntryRange, 0)
+    for nodeId, top := range theirs {
+        if top.Level < 0 || top.Level > log.DigestMaxLevel {
+            digestDebug.Debugf("%v sent digests of %v at level %v", peer, nodeId, top.Level)
+            continue
+        }
+        for start, digest := range top.Digests {
+            if logex.theLog.GetDigest(nodeId, top.Level, start, floors[nodeId]) != digest {
+                differing = append(differing, EntryRange{nodeId, top.Level, log.DigestRangeOf(start, top.Level)})
+            }
+        }
+    }
+    ranges, err := logex.differingLeaves(client, floors, differing)
+    if err != nil {
+        return err
+    }
+    if len(ranges) > 0 {
+        digestDebug.Debugf("%v ranges differ from %v", len(ranges), peer)
+    }
+    for more := len(ranges) > 0; more; {
+        request := RangesRequest{floors, ranges, make(map[log.EncodedHash]bool), logex.subscriptions}
+        for _, entryRange := range ranges {
+            for _, logEntry := range logex.theLog.GetEntriesInRange(entryRange.NodeId, entryRange.Start, floors[entryRange.NodeId]) {
+                request.Held[logEntry.EncodedHash()] = true
+            }
+        }
+        var response EntriesSince
+        if err := client.Call("LogEx.GetRanges", request, &response); err != nil {
+            return logexDebug.Error(err)
+        }
+        if err := logex.commitRanges(response); err != nil {
+            return err
+        }
+        // A page we had all of already would come again.
+        more = response.More && len(response.Entries) > 0
+    }
+    logex.fetchMissingValues(client, peer)
+    return nil
+}
+
+/*
+   The leaves below differing whose digests differ from those of peer,
+   asking for the digests of digestDescent ranges at a time.
+*/
+func (logex *LogEx) differingLeaves(client *rpc.Client, floors map[log.NodeID]log.Timestamp, differing []EntryRange) ([]EntryRange, error) {
+    leaves := make([]EntryRange, 0)
+    for len(differing) > 0 {
+        below := make([]EntryRange, 0)
+        for len(differing) > 0 {
+            batch := make([]EntryRange, 0, digestDescent)
+            for len(differing) > 0 && len(batch) < digestDescent {
+                if differing[0].Level == 0 {
+                    leaves = append(leaves, differing[0])
+                } else {
+                    batch = append(batch, differing[0])
+                }
+                differing = differing[1:]
+            }
+            if len(batch) == 0 {
+                continue
+            }
+            var children ChildDigests
+            if err := client.Call("LogEx.GetChildDigests", ChildDigestsRequest{floors, batch}, &children); err != nil {
+                return nil, logexDebug.Error(err)
+            }
+            if len(children) != len(batch) {
+                return nil, digestDebug.Error(errors.New(fmt.Sprintf("Asked for digests below %v ranges, got %v", len(batch), len(children))))
+            }
+            for i, parent := range batch {
+                for start, digest := range children[i] {
+                    // Not below parent.
+                    if log.DigestRangeOf(start, parent.Level) != parent.Start {
+                        continue
+                    }
+                    if logex.theLog.GetDigest(parent.NodeId, parent.Level-1, start, floors[parent.NodeId]) != digest {
+                        below = append(below, EntryRange{parent.NodeId, parent.Level - 1, log.DigestRangeOf(start, parent.Level-1)})
+                    }
+                }
+            }
+        }
+        differing = below
+    }
+    return leaves, nil
+}
+
+/*
+   Ask peer for up to digestValuesWanted values we lack of updates we
+   subscribe to and may read. Values it does not give are asked for again
+   next time.
+*/
+func (logex *LogEx) fetchMissingValues(client *rpc.Client, peer log.NodeID) {
+    wanted := 0
+    for _, logEntry := range logex.theLog.GetUpdatesWithoutValue() {
+        if wanted == digestValuesWanted {
+            break
+        }
+        update := logEntry.Message.(*log.Update)
+        if !logex.subscriptions.covers(update.Key) || !logex.theLog.CanRead(logex.myNodeId, logEntry) {
+            continue
+        }
+        wanted++
+        var value []byte
+        if err := client.Call("LogEx.GetValue", update.HashOfValue, &value); err != nil {
+            digestDebug.Debugf("%v does not give %v: %v", peer, update.HashOfValue, err)
+            continue
+        }
+        // Checked against its hash.
+        if err := logex.theLog.WriteValue(update.HashOfValue, value); err != nil {
+            digestDebug.Error(err)
+        }
+    }
+}
+
+/*
+   Commit the entries of response as their dependencies come in, and keep
+   the values of those we held already. Entries depending on what neither
+   of us had are fetched the usual way.
+*/
+func (logex *LogEx) commitRanges(response EntriesSince) error {
+    pending := make([]*log.LogEntry, 0)
+    for _, logEntry := range response.Entries {
+        if !logex.theLog.HasLogEntry(logEntry.NodeId, logEntry.EncodedHash()) {
+            pending = append(pending, logEntry)
+        }
+    }
+    for len(pending) > 0 {
+        left := make([]*log.LogEntry, 0)
+        for _, logEntry := range pending {
+            if logex.theLog.HasLogEntry(logEntry.NodeId, logEntry.EncodedHash()) {
+                // Fetched along with an entry depending on it.
+                continue
+            }
+            if !logex.dependenciesCommitted(logEntry) {
+                left = append(left, logEntry)
+                continue
+            }
+            var value []byte
+            if update, ok := logEntry.Message.(*log.Update); ok {
+                value = response.Values[update.HashOfValue]
+                delete(response.Values, update.HashOfValue)
+            }
+            if err := logex.commitRemoteEntry(logEntry, value, false); err != nil {
+                return err
+            }
+        }
+        if len(left) == len(pending) {
+            logEntry := left[rand.Intn(len(left))]
+            err := logex.antiEntropy(logEntry.NodeId, log.VersionInfo{logEntry.AcceptStamp, logEntry.EncodedHash()})
+            if err != nil || !logex.theLog.HasLogEntry(logEntry.NodeId, logEntry.EncodedHash()) {
+                return logexDebug.Error(errors.New(fmt.Sprintf("%v entries wait for dependencies: %v", len(left), err)))
+            }
+        }
+        pending = left
+    }
+    // Values of updates we had without them.
+    for encodedHash, value := range response.Values {
+        if err := logex.theLog.WriteValue(encodedHash, value); err != nil {
+            return logexDebug.Error(err)
+        }
+    }
+    return nil
+}
+
+func (logex *LogEx) dependenciesCommitted(logEntry *log.LogEntry) bool {
+    for nodeId, versionInfo := range logEntry.DVV {
+        if !logex.theLog.HasLogEntry(nodeId, versionInfo.HashOfUpdate) {
+            return false
+        }
+    }
+    return true
+}
+
+// Compare summaries with a random peer once in a while.
+func (logex *LogEx) backgroundDigestSync() {
+    if !logex.digests.due(time.Now()) {
+        return
+    }
+    peers := make([]log.NodeID, 0)
+    for nodeId := range logex.nodeIPMap {
+        if nodeId != logex.myNodeId && !logex.theLog.Blocked(nodeId) {
+            peers = append(peers, nodeId)
+        }
+    }
+    if len(peers) == 0 {
+        return
+    }
+    peer := peers[rand.Intn(len(peers))]
+    if err := logex.digestAntiEntropy(peer); err != nil {
+        digestDebug.Debugf("Comparing summaries with %v failed: %v", peer, err)
+    }
+}
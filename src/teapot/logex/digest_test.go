@@ -0,0 +1,94 @@
+package logex
+
+import (
+    "fmt"
+    . "launchpad.net/gocheck"
+    "teapot/log"
+)
+
+type DigestSuite struct {
+    dir string
+}
+
+var _ = Suite(&DigestSuite{})
+
+func (s *DigestSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// Holes in entries and values are found by comparing summaries.
+func (s *DigestSuite) TestDigestAntiEntropy(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    writer, reader := logEx[0], logEx[1]
+    shareHello(c, writer, logEx)
+    c.Assert(reader.theLog.Commit(writer.theLog.GetEntryByEncodedHash(writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId).HashOfUpdate)), IsNil)
+    values := make([]log.EncodedHash, 0)
+    n := int(log.DigestRangeWidth) + 6
+    for i := 0; i < n; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        logEntry := writer.theLog.NewLogEntry(update)
+        c.Assert(writer.theLog.Commit(logEntry), IsNil)
+        values = append(values, update.HashOfValue)
+        // The reader got the first few without their values.
+        if i < 10 {
+            c.Assert(reader.theLog.Commit(logEntry), IsNil)
+        }
+    }
+    c.Assert(reader.digestAntiEntropy(writer.myNodeId), IsNil)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, true)
+    for _, value := range values {
+        c.Assert(reader.theLog.HasValue(value), Equals, true)
+    }
+    floors := reader.theLog.GetHorizon()
+    c.Assert(reader.theLog.GetDigests(floors), DeepEquals, writer.theLog.GetDigests(floors))
+}
+
+// Many missing entries come in pages.
+func (s *DigestSuite) TestRangesInPages(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    writer, reader := logEx[0], logEx[1]
+    shareHello(c, writer, logEx)
+    counting := &countingP2PLogEx{}
+    writer.p2p = counting
+    n := entriesSincePage + 20
+    for i := 0; i < n; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(update)), IsNil)
+    }
+    c.Assert(reader.digestAntiEntropy(writer.myNodeId), IsNil)
+    c.Assert(counting.ranges, Equals, 2)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, true)
+    c.Assert(len(reader.theLog.GetUpdatesWithoutValue()), Equals, 0)
+}
+
+// Only the ranges that differ are descended into, down to the leaves.
+func (s *DigestSuite) TestDigestTree(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    writer, reader := logEx[0], logEx[1]
+    shareHello(c, writer, logEx)
+    counting := &countingP2PLogEx{}
+    writer.p2p = counting
+    c.Assert(reader.theLog.Commit(writer.theLog.GetEntryByEncodedHash(writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId).HashOfUpdate)), IsNil)
+    n := log.DigestFanout*int(log.DigestRangeWidth) + 100
+    for i := 0; i < n; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        logEntry := writer.theLog.NewLogEntry(update)
+        c.Assert(writer.theLog.Commit(logEntry), IsNil)
+        // The reader misses the last few only.
+        if i < n-3 {
+            c.Assert(reader.theLog.Commit(logEntry), IsNil)
+        }
+    }
+    c.Assert(writer.theLog.GetDigests(nil)[writer.myNodeId].Level, Equals, 1)
+    c.Assert(reader.digestAntiEntropy(writer.myNodeId), IsNil)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, true)
+    c.Assert(counting.children, Equals, 1)
+    c.Assert(counting.ranges, Equals, 1)
+    c.Assert(counting.leaves, DeepEquals, []EntryRange{{writer.myNodeId, 0, log.DigestRangeOf(latest.AcceptStamp, 0)}})
+}
@@ -0,0 +1,268 @@
+package logex
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const freshnessDebug utility.Debug = true
+
+// How often buckets are cross-checked with peers.
+const freshnessCheckInterval = time.Minute
+
+// How many peers are asked per check.
+const freshnessFanout = 3
+
+// How long a bucket may lag behind what peers know before it is flagged.
+const freshnessTimeout = 10 * time.Minute
+
+// Kinds of freshness violations.
+const (
+    // The bucket served an older manifest than it did before.
+    RolledBack = "rolled back"
+    // Peers know of newer entries or manifests than the bucket serves.
+    Stale = "stale"
+)
+
+/*
+   The bucket of NodeId serves an older view of the node than known.
+   Entries of a flagged node are fetched over P2P until its bucket is
+   found fresh again.
+*/
+type FreshnessViolation struct {
+    NodeId log.NodeID
+    Kind   string
+    // The newest entry and manifest version known, and who knows them.
+    Known          log.VersionInfo
+    KnownManifest  int64
+    Witness        log.NodeID
+    Served         log.VersionInfo
+    ServedManifest int64
+    Since          time.Time
+    Flagged        bool
+}
+
+func (violation FreshnessViolation) String() string {
+    return fmt.Sprintf("%v of %v since %v: serving %v (manifest %v), %v knows %v (manifest %v)", violation.Kind, violation.NodeId, violation.Since, violation.Served, violation.ServedManifest, violation.Witness, violation.Known, violation.KnownManifest)
+}
+
+type rollbackError struct {
+    nodeId       log.NodeID
+    seen, served int64
+}
+
+func (err *rollbackError) Error() string {
+    return fmt.Sprintf("Manifest of %v rolled back from version %v to %v.", err.nodeId, err.seen, err.served)
+}
+
+/*
+   Buckets found serving an older view of their node. A rollback is
+   flagged at once, a lag only once it outlasts freshnessTimeout: a node
+   may have told peers about entries it is still syncing.
+*/
+type freshnessChecker struct {
+    lock       *sync.Mutex
+    violations map[log.NodeID]*FreshnessViolation
+    lastCheck  time.Time
+}
+
+func newFreshnessChecker() *freshnessChecker {
+    return &freshnessChecker{new(sync.Mutex), make(map[log.NodeID]*FreshnessViolation), time.Time{}}
+}
+
+// Whether a check is due, in which case the next one is not.
+func (checker *freshnessChecker) due(now time.Time) bool {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    if now.Sub(checker.lastCheck) < freshnessCheckInterval {
+        return false
+    }
+    checker.lastCheck = now
+    return true
+}
+
+func (checker *freshnessChecker) rolledBack(nodeId log.NodeID, seen, served int64, now time.Time) {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    violation, ok := checker.violations[nodeId]
+    if !ok || violation.Kind != RolledBack {
+        violation = &FreshnessViolation{NodeId: nodeId, Kind: RolledBack, Since: now}
+        checker.violations[nodeId] = violation
+    }
+    violation.KnownManifest = seen
+    violation.Witness = ""
+    violation.ServedManifest = served
+    if !violation.Flagged {
+        freshnessDebug.Error(errors.New(fmt.Sprintf("Bucket of %v flagged: %v", nodeId, violation)))
+    }
+    violation.Flagged = true
+}
+
+// Record a lag, flag it once it lasts too long.
+func (checker *freshnessChecker) lagging(lag FreshnessViolation, now time.Time) {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    violation, ok := checker.violations[lag.NodeId]
+    if ok && violation.Kind == RolledBack {
+        return
+    }
+    if ok {
+        lag.Since = violation.Since
+        lag.Flagged = violation.Flagged
+    } else {
+        lag.Since = now
+    }
+    lag.Kind = Stale
+    if !lag.Flagged && now.Sub(lag.Since) >= freshnessTimeout {
+        freshnessDebug.Error(errors.New(fmt.Sprintf("Bucket of %v flagged: %v", lag.NodeId, lag)))
+        lag.Flagged = true
+    }
+    checker.violations[lag.NodeId] = &lag
+}
+
+func (checker *freshnessChecker) fresh(nodeId log.NodeID) {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    if violation, ok := checker.violations[nodeId]; ok && violation.Flagged {
+        freshnessDebug.Debugf("Bucket of %v is fresh again.", nodeId)
+    }
+    delete(checker.violations, nodeId)
+}
+
+func (checker *freshnessChecker) flagged(nodeId log.NodeID) bool {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    violation, ok := checker.violations[nodeId]
+    return ok && violation.Flagged
+}
+
+func (checker *freshnessChecker) list() []FreshnessViolation {
+    checker.lock.Lock()
+    defer checker.lock.Unlock()
+    nodeIds := make([]string, 0, len(checker.violations))
+    for nodeId := range checker.violations {
+        nodeIds = append(nodeIds, string(nodeId))
+    }
+    sort.Strings(nodeIds)
+    violations := make([]FreshnessViolation, len(nodeIds))
+    for i, nodeId := range nodeIds {
+        violations[i] = *checker.violations[log.NodeID(nodeId)]
+    }
+    return violations
+}
+
+/*
+   Buckets serving a stale or rolled back view, including lags not
+   flagged yet.
+*/
+func (logex *LogEx) Freshness() []FreshnessViolation {
+    return logex.freshness.list()
+}
+
+/*
+   Up to freshnessFanout peers at random, leaving out those gossip is
+   backing off from.
+*/
+func (logex *LogEx) freshnessPeers(now time.Time) []log.NodeID {
+    candidates := make([]log.NodeID, 0)
+    for peer := range logex.nodeIPMap {
+        if peer != logex.myNodeId && !logex.gossip.backingOff(peer, now) {
+            candidates = append(candidates, peer)
+        }
+    }
+    peers := make([]log.NodeID, 0, freshnessFanout)
+    for i, j := range rand.Perm(len(candidates)) {
+        if i == freshnessFanout {
+            break
+        }
+        peers = append(peers, candidates[j])
+    }
+    return peers
+}
+
+/*
+   Cross-check the manifest in the bucket of every other node with what
+   we and a few peers reachable over P2P know of the node.
+*/
+func (logex *LogEx) checkFreshness() {
+    nodeIds := make([]log.NodeID, 0, len(logex.nodeBucketMap))
+    for nodeId := range logex.nodeBucketMap {
+        if nodeId != logex.myNodeId {
+            nodeIds = append(nodeIds, nodeId)
+        }
+    }
+    known := logex.knownVersions(nodeIds)
+    witness := make(map[log.NodeID]log.NodeID)
+    for nodeId := range known {
+        witness[nodeId] = logex.myNodeId
+    }
+    for _, peer := range logex.freshnessPeers(time.Now()) {
+        versions, err := logex.p2pGetKnownVersions(peer, nodeIds)
+        if err != nil {
+            // An unreachable peer tells nothing.
+            continue
+        }
+        for nodeId, version := range versions {
+            best := known[nodeId]
+            if version.Latest.AcceptStamp > best.Latest.AcceptStamp || version.Manifest > best.Manifest {
+                witness[nodeId] = peer
+            }
+            if version.Latest.AcceptStamp > best.Latest.AcceptStamp {
+                best.Latest = version.Latest
+            }
+            if version.Manifest > best.Manifest {
+                best.Manifest = version.Manifest
+            }
+            known[nodeId] = best
+        }
+    }
+    now := time.Now()
+    for _, nodeId := range nodeIds {
+        if latest := known[nodeId].Latest; latest.HashOfUpdate != "" && !logex.theLog.Observed(nodeId, latest.AcceptStamp) {
+            // A peer has entries of the node we lack.
+            logex.gossip.markNews(nodeId, now)
+        }
+        manifest, err := logex.getManifest(nodeId)
+        if err != nil || manifest == nil {
+            // Rollbacks are flagged by getManifest.
+            continue
+        }
+        var served log.VersionInfo
+        if latest := manifest.Latest(); latest != nil {
+            served = *latest
+        }
+        best := known[nodeId]
+        if best.Latest.AcceptStamp > served.AcceptStamp || best.Manifest > manifest.Version {
+            logex.freshness.lagging(FreshnessViolation{
+                NodeId:         nodeId,
+                Known:          best.Latest,
+                KnownManifest:  best.Manifest,
+                Witness:        witness[nodeId],
+                Served:         served,
+                ServedManifest: manifest.Version,
+            }, now)
+        } else {
+            logex.freshness.fresh(nodeId)
+        }
+    }
+}
+
+// What this node knows of the given nodes.
+func (logex *LogEx) knownVersions(nodeIds []log.NodeID) KnownVersions {
+    versions := make(KnownVersions)
+    for _, nodeId := range nodeIds {
+        var version KnownVersion
+        if latest := logex.theLog.GetLastEntryInfoOfNode(nodeId); latest != nil {
+            version.Latest = *latest
+        }
+        version.Manifest = logex.manifests.version(nodeId)
+        versions[nodeId] = version
+    }
+    return versions
+}
@@ -0,0 +1,166 @@
+package logex
+
+import (
+    "math/rand"
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const gossipDebug utility.Debug = true
+
+// How many peers without known news are picked per round.
+const gossipFanout = 3
+
+// The longest a failing peer is skipped.
+const gossipSkipMax = 30 * time.Minute
+
+type peerState struct {
+    // Grows while the peer has nothing new.
+    interval time.Duration
+    next     time.Time
+    // Failures in a row.
+    failures int
+    // The peer is known to have entries we have not observed.
+    news bool
+}
+
+/*
+   When to gossip with each peer. Every peer backs off on its own while
+   quiet, and is skipped for a while after failing, so that one quiet or
+   unreachable peer does not slow down the others.
+*/
+type gossipScheduler struct {
+    lock        *sync.Mutex
+    peers       map[log.NodeID]*peerState
+    intervalMin time.Duration
+    intervalMax time.Duration
+}
+
+func newGossipScheduler(nodeIds []log.NodeID, intervalMin, intervalMax time.Duration, now time.Time) *gossipScheduler {
+    scheduler := &gossipScheduler{new(sync.Mutex), make(map[log.NodeID]*peerState), intervalMin, intervalMax}
+    for _, nodeId := range nodeIds {
+        scheduler.peers[nodeId] = &peerState{intervalMin, now, 0, false}
+    }
+    return scheduler
+}
+
+func (scheduler *gossipScheduler) setIntervals(intervalMin, intervalMax time.Duration) {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    scheduler.intervalMin = intervalMin
+    scheduler.intervalMax = intervalMax
+    for _, peer := range scheduler.peers {
+        if peer.interval < intervalMin {
+            peer.interval = intervalMin
+        }
+        if peer.interval > intervalMax {
+            peer.interval = intervalMax
+        }
+    }
+}
+
+/*
+   The peers to gossip with now: every due peer known to have news, and
+   up to gossipFanout other due peers at random.
+*/
+func (scheduler *gossipScheduler) pick(now time.Time) []log.NodeID {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    picked := make([]log.NodeID, 0)
+    others := make([]log.NodeID, 0)
+    for nodeId, peer := range scheduler.peers {
+        if peer.next.After(now) {
+            continue
+        }
+        if peer.news {
+            picked = append(picked, nodeId)
+        } else {
+            others = append(others, nodeId)
+        }
+    }
+    for i, j := range rand.Perm(len(others)) {
+        if i == gossipFanout {
+            break
+        }
+        picked = append(picked, others[j])
+    }
+    return picked
+}
+
+// Record how gossiping with nodeId went and schedule the next round.
+func (scheduler *gossipScheduler) done(nodeId log.NodeID, news bool, err error, now time.Time) {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    peer, ok := scheduler.peers[nodeId]
+    if !ok {
+        return
+    }
+    if err != nil {
+        peer.failures++
+        skip := scheduler.intervalMin
+        for i := 1; i < peer.failures && skip < gossipSkipMax; i++ {
+            skip *= 2
+        }
+        if skip > gossipSkipMax {
+            skip = gossipSkipMax
+        }
+        gossipDebug.Debugf("Skipping %v for %v after %v failures", nodeId, skip, peer.failures)
+        peer.next = now.Add(skip)
+        return
+    }
+    peer.failures = 0
+    peer.news = false
+    if news {
+        peer.interval = scheduler.intervalMin
+    } else if peer.interval *= 2; peer.interval > scheduler.intervalMax {
+        peer.interval = scheduler.intervalMax
+    }
+    peer.next = now.Add(peer.interval)
+}
+
+// nodeId is known to have new entries, gossip with it at once.
+func (scheduler *gossipScheduler) markNews(nodeId log.NodeID, now time.Time) {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    if peer, ok := scheduler.peers[nodeId]; ok {
+        peer.news = true
+        peer.failures = 0
+        peer.next = now
+    }
+}
+
+// nodeId failed lately and is skipped until it is due again.
+func (scheduler *gossipScheduler) backingOff(nodeId log.NodeID, now time.Time) bool {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    peer, ok := scheduler.peers[nodeId]
+    return ok && peer.failures > 0 && peer.next.After(now)
+}
+
+// When the next peer is due.
+func (scheduler *gossipScheduler) nextDue() time.Time {
+    scheduler.lock.Lock()
+    defer scheduler.lock.Unlock()
+    var next time.Time
+    for _, peer := range scheduler.peers {
+        if next.IsZero() || peer.next.Before(next) {
+            next = peer.next
+        }
+    }
+    return next
+}
+
+/*
+   Bounds of the interval between two rounds with a quiet peer. Meant to
+   be set before gossip starts.
+*/
+func (logex *LogEx) SetGossipIntervals(intervalMin, intervalMax time.Duration) {
+    logex.gossip.setIntervals(intervalMin, intervalMax)
+}
+
+// When BackgroundGossip has a peer to talk to next.
+func (logex *LogEx) NextGossip() time.Time {
+    return logex.gossip.nextDue()
+}
@@ -0,0 +1,75 @@
+package logex
+
+import (
+    "errors"
+    . "launchpad.net/gocheck"
+    "teapot/log"
+    "time"
+)
+
+type GossipSuite struct{}
+
+var _ = Suite(&GossipSuite{})
+
+func (s *GossipSuite) newScheduler(now time.Time) *gossipScheduler {
+    return newGossipScheduler([]log.NodeID{"a", "b", "c", "d", "e"}, time.Second, 8*time.Second, now)
+}
+
+func (s *GossipSuite) TestFanout(c *C) {
+    now := time.Now()
+    scheduler := s.newScheduler(now)
+    picked := scheduler.pick(now)
+    c.Assert(len(picked), Equals, gossipFanout)
+    seen := make(map[log.NodeID]bool)
+    for _, nodeId := range picked {
+        seen[nodeId] = true
+        scheduler.done(nodeId, false, nil, now)
+    }
+    c.Assert(len(seen), Equals, gossipFanout)
+    // The others are due still.
+    c.Assert(len(scheduler.pick(now)), Equals, 5-gossipFanout)
+    c.Assert(scheduler.nextDue().Equal(now), Equals, true)
+}
+
+func (s *GossipSuite) TestNewsFirst(c *C) {
+    now := time.Now()
+    scheduler := s.newScheduler(now)
+    for _, nodeId := range []log.NodeID{"a", "b", "c", "d", "e"} {
+        scheduler.done(nodeId, false, nil, now)
+    }
+    c.Assert(len(scheduler.pick(now)), Equals, 0)
+    scheduler.markNews("d", now)
+    c.Assert(scheduler.pick(now), DeepEquals, []log.NodeID{"d"})
+    scheduler.done("d", true, nil, now)
+    c.Assert(scheduler.peers["d"].news, Equals, false)
+    c.Assert(scheduler.peers["d"].next, Equals, now.Add(time.Second))
+}
+
+func (s *GossipSuite) TestBackoff(c *C) {
+    now := time.Now()
+    scheduler := s.newScheduler(now)
+    // A quiet peer is asked less and less often.
+    for _, interval := range []time.Duration{2, 4, 8, 8} {
+        scheduler.done("a", false, nil, now)
+        c.Assert(scheduler.peers["a"].interval, Equals, interval*time.Second)
+    }
+    scheduler.done("a", true, nil, now)
+    c.Assert(scheduler.peers["a"].interval, Equals, time.Second)
+    // A failing peer is skipped for longer and longer, without
+    // holding back the others.
+    for _, skip := range []time.Duration{1, 2, 4} {
+        scheduler.done("b", false, errors.New("connection refused"), now)
+        c.Assert(scheduler.peers["b"].next, Equals, now.Add(skip*time.Second))
+    }
+    later := now.Add(3 * time.Second)
+    c.Assert(scheduler.backingOff("b", later), Equals, true)
+    c.Assert(scheduler.backingOff("a", later), Equals, false)
+    for _, nodeId := range scheduler.pick(later) {
+        c.Assert(nodeId, Not(Equals), log.NodeID("b"))
+    }
+    // Hearing from it brings it back.
+    scheduler.markNews("b", later)
+    c.Assert(scheduler.peers["b"].failures, Equals, 0)
+    c.Assert(scheduler.backingOff("b", later), Equals, false)
+    c.Assert(scheduler.pick(later)[0], Equals, log.NodeID("b"))
+}
@@ -1,24 +1,34 @@
 package logex
 
 import (
-    "container/list"
     "encoding/base64"
     "errors"
     "fmt"
     "net"
-    "net/rpc"
+    path_ "path"
     "strconv"
     "strings"
     "teapot/adaptor"
     "teapot/conf"
     "teapot/log"
     "teapot/utility"
+    "time"
 )
 
 const logexDebug utility.Debug = true
 
+// Bounds of the interval between two rounds with a quiet peer.
+const defaultGossipInterval = 10 * time.Second
+const maxGossipInterval = 64 * defaultGossipInterval
+
 type ILogEx interface {
     BackgroundGossip() bool
+    Freshness() []FreshnessViolation
+    NotifyPeers()
+    Notified() <-chan bool
+    SetGossipIntervals(intervalMin, intervalMax time.Duration)
+    NextGossip() time.Time
+    FetchValue(nodeId log.NodeID, encodedHash log.EncodedHash) error
 }
 
 type nodeIPMap map[log.NodeID]string
@@ -31,13 +41,43 @@ type LogEx struct {
     //valueToSync   chan log.EncodedHash
     myNodeId   log.NodeID
     theAdaptor adaptor.Adaptor
-    theLog     log.ILog
-    config     *conf.Config
-    p2p        IP2PLogEx
-    listener   net.Listener
+    // Values may be erasure coded, see conf.ValueShards.
+    valueAdaptor adaptor.Adaptor
+    theLog       log.ILog
+    config       *conf.Config
+    p2p          IP2PLogEx
+    listener     net.Listener
+    packs        *packCache
+    manifests    *manifestTracker
+    freshness    *freshnessChecker
+    // Entries peers told us about.
+    announcements *announcements
+    notifier      *notifier
+    gossip        *gossipScheduler
+    transport     *transport
+    // Bounds how often each peer may ask for values.
+    limiter       *rateLimiter
+    digests       *digestSync
+    // Anti-entropy progress and entries that failed validation.
+    sessions      *sessionStore
+    subscriptions subscriptions
 }
 
+/*
+   Create a LogEx whose storage adaptor is built from the configuration.
+*/
 func NewLogEx(config *conf.Config, theLog log.ILog) *LogEx {
+    theAdaptor, err := adaptor.New(config, config.NodeBucketMap[config.MyNodeId])
+    if err != nil {
+        logexDebug.Panicf("Unable to create storage adaptor. %v", err)
+    }
+    return NewLogExWithAdaptor(config, theLog, theAdaptor)
+}
+
+/*
+   Create a LogEx which reads other nodes' buckets through the given adaptor.
+*/
+func NewLogExWithAdaptor(config *conf.Config, theLog log.ILog, theAdaptor adaptor.Adaptor) *LogEx {
     nodeBucketMap := make(nodeBucketMap)
     for nodeId, bucket := range config.NodeBucketMap {
         nodeBucketMap[log.NodeID(nodeId)] = bucket
@@ -46,8 +86,16 @@ func NewLogEx(config *conf.Config, theLog log.ILog) *LogEx {
     for nodeId, ipPort := range config.NodeIpMap {
         nodeIPMap[log.NodeID(nodeId)] = ipPort
     }
-    auth := adaptor.NewAuth(config.AWSAccessKey, config.AWSSecretKey)
-    theAdaptor := adaptor.GetAdaptor(auth, nodeBucketMap[log.NodeID(config.MyNodeId)])
+    peers := make([]log.NodeID, 0, len(nodeBucketMap))
+    for nodeId := range nodeBucketMap {
+        if nodeId != log.NodeID(config.MyNodeId) {
+            peers = append(peers, nodeId)
+        }
+    }
+    valueAdaptor, err := adaptor.NewValueAdaptor(config, config.NodeBucketMap[config.MyNodeId], theAdaptor)
+    if err != nil {
+        logexDebug.Panicf("Unable to create value storage. %v", err)
+    }
     logex := LogEx{
         nodeBucketMap,
         nodeIPMap,
@@ -55,118 +103,252 @@ func NewLogEx(config *conf.Config, theLog log.ILog) *LogEx {
         //	make(chan log.EncodedHash),
         log.NodeID(config.MyNodeId),
         theAdaptor,
+        valueAdaptor,
         theLog,
         config,
         &p2pLogEx{},
         nil,
+        newPackCache(),
+        newManifestTracker(path_.Join(path_.Dir(config.JournalPath), "manifests")),
+        newFreshnessChecker(),
+        newAnnouncements(),
+        newNotifier(),
+        newGossipScheduler(peers, defaultGossipInterval, maxGossipInterval, time.Now()),
+        nil,
+        newRateLimiter(valueRequestRate, valueRequestBurst),
+        newDigestSync(time.Now()),
+        newSessionStore(path_.Join(path_.Dir(config.JournalPath), "antientropy")),
+        subscriptions(config.Subscriptions),
+    }
+    // Requests of blacklisted nodes are refused.
+    logex.transport, err = newTransport(config, theLog.Blocked)
+    if err != nil {
+        logexDebug.Panicf("Unable to set up p2p transport. %v", err)
     }
     logex.startP2P(config.IPPort)
     return &logex
 }
 
+/*
+   Gossip with the peers that are due, see gossipScheduler. Returns
+   whether any of them had new entries.
+*/
 func (logex *LogEx) BackgroundGossip() bool {
+    if logex.freshness.due(time.Now()) {
+        logex.checkFreshness()
+    }
+    // Finds the holes comparing latest entries misses.
+    logex.backgroundDigestSync()
     flag := false
-    // TODO just choose a random one to communicate.
-    for nodeId := range logex.nodeBucketMap {
+    for _, nodeId := range logex.gossip.pick(time.Now()) {
         // Introduce blacklist mechanism.
         if logex.theLog.Blocked(nodeId) {
+            logex.gossip.done(nodeId, false, nil, time.Now())
             continue
         }
-        latestVersionInfo, err := logex.anyNewLogEntriesOfNode(nodeId)
-        if err != nil {
-            logexDebug.Error(errors.New(fmt.Sprintf("Error when trying to get new updates information: %v", err)))
-        }
-        if latestVersionInfo != nil {
-            flag = true
-            logexDebug.Debugf("New updates from node %v of hash %v and accept stamp %v\n", nodeId, latestVersionInfo.HashOfUpdate, latestVersionInfo.AcceptStamp)
-            if err := logex.antiEntropy(nodeId, *latestVersionInfo); err != nil {
-                logexDebug.Error(errors.New(fmt.Sprintf("Error when trying to fetch log(key: %v, timestamp: %v) from %v.\n%v\n", latestVersionInfo.HashOfUpdate, latestVersionInfo.AcceptStamp, nodeId, err)))
-            }
-        }
+        news, err := logex.gossipWith(nodeId)
+        logex.gossip.done(nodeId, news, err, time.Now())
+        flag = flag || news
     }
     return flag
 }
 
-func (logex *LogEx) antiEntropy(nodeId log.NodeID, versionInfo log.VersionInfo) error {
-    targetLogEntry, err := logex.getEntryByEncodedHashRemotely(nodeId, versionInfo.HashOfUpdate)
+// Fetch the new entries of nodeId, if any. Returns whether there were.
+func (logex *LogEx) gossipWith(nodeId log.NodeID) (bool, error) {
+    latestVersionInfo, err := logex.anyNewLogEntriesOfNode(nodeId)
     if err != nil {
+        logexDebug.Error(errors.New(fmt.Sprintf("Error when trying to get new updates information: %v", err)))
+        return false, err
+    }
+    if latestVersionInfo == nil {
+        return false, nil
+    }
+    logexDebug.Debugf("New updates from node %v of hash %v and accept stamp %v\n", nodeId, latestVersionInfo.HashOfUpdate, latestVersionInfo.AcceptStamp)
+    if err := logex.antiEntropy(nodeId, *latestVersionInfo); err != nil {
+        logexDebug.Error(errors.New(fmt.Sprintf("Error when trying to fetch log(key: %v, timestamp: %v) from %v.\n%v\n", latestVersionInfo.HashOfUpdate, latestVersionInfo.AcceptStamp, nodeId, err)))
+        return true, err
+    }
+    return true, nil
+}
+
+/*
+   Fetch the entry of nodeId described by versionInfo and what it depends
+   on, and commit them. What was fetched is kept in a session, see
+   sessionStore, so that a round that stops resumes where it did. The
+   session is saved once everything is fetched and every
+   sessionCheckpoint entries committed, so a crash loses little of it.
+*/
+func (logex *LogEx) antiEntropy(nodeId log.NodeID, versionInfo log.VersionInfo) error {
+    logex.sessions.begin(nodeId, versionInfo)
+    if err := logex.catchUp(nodeId, versionInfo); err != nil {
+        if err := logex.sessions.suspend(logex.theLog); err != nil {
+            logexDebug.Debugf("Unable to keep the session with %v: %v", nodeId, err)
+        }
         return err
     }
-    /*
-       if logex.theLog.HasLogEntry(targetLogEntry.NodeId, targetLogEntry.EncodedHash()) {
-           logexDebug.Panicf("This update is supposed to be new. %+v\n%+v", logex.myNodeId, targetLogEntry)
-       }*/
-    logEntryStack := list.New()
-    logEntryStack.PushBack(targetLogEntry)
-    // Get all dependency of this log and put them in a stack.
-    // The assumption is we can iterate the stack and simultaneously insert element to it.
-    for e := logEntryStack.Front(); e != nil; e = e.Next() {
-        if logEntry, ok := e.Value.(*log.LogEntry); ok {
-            for nodeId, versionInfo := range logEntry.DVV {
-                if !logex.theLog.HasLogEntry(nodeId, versionInfo.HashOfUpdate) {
-                    newLogEntry, err := logex.getEntryByEncodedHashRemotely(nodeId, versionInfo.HashOfUpdate)
-                    if err != nil {
-                        return logexDebug.Error(err)
-                    }
-                    logexDebug.Debugf("Log entry received: %v", newLogEntry)
-                    if versionInfo.HashOfUpdate != newLogEntry.EncodedHash() {
-                        return logexDebug.Error(errors.New("Bad dependency"))
-                    }
-                    logEntryStack.PushBack(newLogEntry)
-                }
+    return logex.sessions.finish(nodeId)
+}
+
+func (logex *LogEx) catchUp(nodeId log.NodeID, versionInfo log.VersionInfo) error {
+    targetLogEntry := logex.sessions.fetchedEntry(versionInfo.HashOfUpdate)
+    if targetLogEntry == nil {
+        var err error
+        targetLogEntry, err = logex.getEntryFromStorage(nodeId, versionInfo.HashOfUpdate)
+        if err != nil {
+            // P2P mode: ask the node for everything we miss at once.
+            if err := logex.p2pAntiEntropy(nodeId); err != nil {
+                logexDebug.Error(err)
+            }
+            if logex.theLog.HasLogEntry(nodeId, versionInfo.HashOfUpdate) {
+                return nil
             }
-        } else {
-            // should not happen. This means non-logentry is in the stack.
+            // The node may be offline, others may hold what it wrote.
+            if err := logex.relayAntiEntropy(nodeId, versionInfo); err == nil {
+                return nil
+            }
+            // Peers of older versions serve entries one by one.
+            targetLogEntry, err = logex.p2pGetEntryByEncodedHash(nodeId, versionInfo.HashOfUpdate)
+            if err != nil {
+                return err
+            }
+        }
+        if versionInfo.HashOfUpdate != targetLogEntry.EncodedHash() {
+            return logexDebug.Error(errors.New("Bad update"))
         }
+        logex.sessions.fetched(nodeId, targetLogEntry)
     }
-    flags := make(map[log.EncodedHash]bool)
-    // Pop the stack and commit changes one by one
-    for e := logEntryStack.Back(); e != nil; e = e.Prev() {
-        if logEntry, ok := e.Value.(*log.LogEntry); ok {
-            // If the logEntry is an update, needs to make sure that the value is already there.
-            /*     if logex.theLog.HasLogEntry(logEntry.NodeId, logEntry.EncodedHash()) {
-                   logexDebug.Panicf("This update is supposed to be new. %+v\n%+v", logex.myNodeId, logEntry)
-               }*/
-            encodedHash := logEntry.EncodedHash()
-            if _, ok := flags[encodedHash]; !ok {
-                if update, ok := logEntry.Message.(*log.Update); ok {
-                    value, err := logex.getValueRemotely(logEntry.NodeId, update.HashOfValue)
-                    if err != nil {
-                        return logexDebug.Error(err)
-                    }
-                    // persist value locally.
-                    if err := logex.theLog.WriteValue(update.HashOfValue, value); err != nil {
-                        return logexDebug.Error(err)
-                    }
-                }
-                if err := logex.theLog.Commit(logEntry); err != nil {
+    if quarantined, ok := logex.sessions.quarantined(targetLogEntry); ok {
+        return logexDebug.Error(errors.New(fmt.Sprintf("%v of %v is quarantined: %v", versionInfo.HashOfUpdate, nodeId, quarantined.Reason)))
+    }
+    logEntries := []*log.LogEntry{targetLogEntry}
+    // Get all dependencies of this log, the slice grows as we go.
+    for i := 0; i < len(logEntries); i++ {
+        for dependentNodeId, dependentVersionInfo := range logEntries[i].DVV {
+            encodedHash := dependentVersionInfo.HashOfUpdate
+            if logex.theLog.HasLogEntry(dependentNodeId, encodedHash) {
+                continue
+            }
+            newLogEntry := logex.sessions.fetchedEntry(encodedHash)
+            if newLogEntry == nil {
+                var err error
+                newLogEntry, err = logex.getEntryByEncodedHashRemotely(dependentNodeId, encodedHash)
+                if err != nil {
                     return logexDebug.Error(err)
                 }
-                if err := logex.theLog.AsyncHandle(logEntry); err != nil {
-                    logexDebug.Debugf(err.Error())
-                    panic(err.Error())
-                    // TODO retry?
+                logexDebug.Debugf("Log entry received: %v", newLogEntry)
+                if encodedHash != newLogEntry.EncodedHash() {
+                    return logexDebug.Error(errors.New("Bad dependency"))
                 }
-                flags[encodedHash] = true
+                logex.sessions.fetched(nodeId, newLogEntry)
             }
-        } else {
-            logexDebug.Panicf("should not happen. This means non-logentry is in the stack.")
+            logEntries = append(logEntries, newLogEntry)
+        }
+    }
+    logex.checkpoint(nodeId)
+    committed := 0
+    // Commit them in reverse, dependencies first.
+    for i := len(logEntries) - 1; i >= 0; i-- {
+        logEntry := logEntries[i]
+        encodedHash := logEntry.EncodedHash()
+        // Listed more than once, or committed in an earlier round.
+        if logex.theLog.HasLogEntry(logEntry.NodeId, encodedHash) {
+            continue
+        }
+        if err := logex.commitRemoteEntry(logEntry, nil, true); err != nil {
+            return err
+        }
+        logex.sessions.committed(nodeId, encodedHash)
+        if committed++; committed%sessionCheckpoint == 0 {
+            logex.checkpoint(nodeId)
         }
     }
     return nil
 }
 
+// Save the sessions. Failing to is no reason to stop catching up.
+func (logex *LogEx) checkpoint(nodeId log.NodeID) {
+    if err := logex.sessions.save(); err != nil {
+        logexDebug.Debugf("Unable to save the session with %v: %v", nodeId, err)
+    }
+}
+
+/*
+   Persist the value of an update, fetching it unless given, then commit
+   and handle the entry. A value we may not read is only copied from the
+   bucket, and only if tryBucket.
+*/
+func (logex *LogEx) commitRemoteEntry(logEntry *log.LogEntry, value []byte, tryBucket bool) error {
+    if quarantined, ok := logex.sessions.quarantined(logEntry); ok {
+        return logexDebug.Error(errors.New(fmt.Sprintf("%v is quarantined: %v", logEntry.EncodedHash(), quarantined.Reason)))
+    }
+    if update, ok := logEntry.Message.(*log.Update); ok {
+        if !logex.subscriptions.covers(update.Key) {
+            // Not subscribed, so the entry is committed without its value.
+            logexDebug.Debugf("Committing %v without a value we do not subscribe to", logEntry.EncodedHash())
+        } else if value != nil {
+            if err := logex.theLog.WriteValue(update.HashOfValue, value); err != nil {
+                return logexDebug.Error(err)
+            }
+        } else if logex.theLog.CanRead(logex.myNodeId, logEntry) {
+            if err := logex.fetchValueRemotely(logEntry.NodeId, update.HashOfValue); err != nil {
+                return logexDebug.Error(err)
+            }
+        } else if !tryBucket || logex.fetchValueFromStorage(logEntry.NodeId, update.HashOfValue) != nil {
+            // Peers only give values to their readers and writers.
+            logexDebug.Debugf("Committing %v without a value we may not read", logEntry.EncodedHash())
+        }
+    }
+    if err := logex.commitChecked(logEntry); err != nil {
+        return err
+    }
+    if err := logex.theLog.AsyncHandle(logEntry); err != nil {
+        // The entry is committed, only our reaction to it is missing.
+        logexDebug.Error(err)
+    }
+    logex.packs.forget(logEntry.EncodedHash())
+    return nil
+}
+
+// Commit an entry of others, quarantining it if it fails validation.
+func (logex *LogEx) commitChecked(logEntry *log.LogEntry) error {
+    if err := logex.theLog.Commit(logEntry); err != nil {
+        if invalid, ok := err.(*log.InvalidEntry); ok {
+            logex.sessions.quarantine(logEntry, invalid.Error(), time.Now())
+        }
+        return logexDebug.Error(err)
+    }
+    return nil
+}
+
 func (logex *LogEx) getEntryByHashRemotely(nodeId log.NodeID, hash []byte) (*log.LogEntry, error) {
     encodedHash := log.EncodedHash(base64.URLEncoding.EncodeToString(hash))
     return logex.getEntryByEncodedHashRemotely(nodeId, encodedHash)
 }
 
-// has p2p support.
+// Look for the entry in storage first. has p2p support.
 func (logex *LogEx) getEntryByEncodedHashRemotely(nodeId log.NodeID, encodedHash log.EncodedHash) (*log.LogEntry, error) {
+    if logEntry, err := logex.getEntryFromStorage(nodeId, encodedHash); err == nil {
+        return logEntry, nil
+    }
+    // Try to fetch the update in p2p mode.
+    return logex.p2pGetEntryByEncodedHash(nodeId, encodedHash)
+}
+
+/*
+   Look for the entry in the packs of the node first, then as an object
+   of its own as synced before packs.
+*/
+func (logex *LogEx) getEntryFromStorage(nodeId log.NodeID, encodedHash log.EncodedHash) (*log.LogEntry, error) {
     bucketName, ok := logex.nodeBucketMap[nodeId]
     if !ok {
         return nil, logexDebug.Error(errors.New("not sure where to find this node. configuration not complete."))
     }
+    if logEntry, err := logex.getPackedEntry(nodeId, encodedHash); err != nil {
+        logexDebug.Error(err)
+    } else if logEntry != nil {
+        return logEntry, nil
+    }
+    var lastErr error
     for i := 0; i < 3; i++ {
         logEntryBinary, err := logex.theAdaptor.GetBinaryFrom(bucketName, string(encodedHash))
         if err == nil {
@@ -177,31 +359,89 @@ func (logex *LogEx) getEntryByEncodedHashRemotely(nodeId log.NodeID, encodedHash
             }
             return &logEntry, nil
         }
+        lastErr = err
     }
-    // Try to fetch the update in p2p mode.
-    return logex.p2pGetEntryByEncodedHash(nodeId, encodedHash)
+    return nil, lastErr
 }
 
-func (logex *LogEx) getValueRemotely(nodeId log.NodeID, encodedHash log.EncodedHash) ([]byte, error) {
+/*
+   Stream the value from the bucket of nodeId into the local value
+   directory, falling back to asking the node itself, then other peers.
+*/
+func (logex *LogEx) fetchValueRemotely(nodeId log.NodeID, encodedHash log.EncodedHash) error {
+    if err := logex.fetchValueFromStorage(nodeId, encodedHash); err == nil {
+        return nil
+    }
+    value, err := logex.p2pGetValueFromAny(nodeId, encodedHash)
+    if err != nil {
+        return logexDebug.Error(err)
+    }
+    return logex.theLog.WriteValue(encodedHash, value)
+}
+
+/*
+   Fetch a value written by nodeId that is missing locally, for a read.
+   It is checked against its hash before it is kept.
+*/
+func (logex *LogEx) FetchValue(nodeId log.NodeID, encodedHash log.EncodedHash) error {
+    return logex.fetchValueRemotely(nodeId, encodedHash)
+}
+
+// Stream the value from the bucket of nodeId into the local value directory.
+func (logex *LogEx) fetchValueFromStorage(nodeId log.NodeID, encodedHash log.EncodedHash) error {
     bucketName, ok := logex.nodeBucketMap[nodeId]
     if !ok {
-        return nil, logexDebug.Error(errors.New("not sure where to find this node. configuration not complete."))
+        return logexDebug.Error(errors.New("not sure where to find this node. configuration not complete."))
     }
+    var lastErr error
     for i := 0; i < 3; i++ {
-        value, err := logex.theAdaptor.GetBinaryFrom(bucketName, string(encodedHash))
+        rc, err := logex.valueAdaptor.GetReaderFrom(bucketName, string(encodedHash))
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        err = logex.theLog.WriteValueFrom(encodedHash, rc)
+        rc.Close()
         if err == nil {
-            return value, nil
+            return nil
         }
+        lastErr = err
     }
-    return logex.p2pGetValue(nodeId, encodedHash)
+    return lastErr
 }
 
-// support p2p mode.
+/*
+   Learn about new entries of the node from its manifest, and read the
+   packs holding them at once. Nodes without a manifest tell their latest
+   update only. support p2p mode.
+*/
 func (logex *LogEx) anyNewLogEntriesOfNode(nodeId log.NodeID) (*log.VersionInfo, error) {
     bucketName, ok := logex.nodeBucketMap[nodeId]
     if !ok {
         return nil, logexDebug.Error(errors.New("not sure where to find this node. configuration not complete."))
     }
+    if latest, ok := logex.announcements.take(nodeId); ok && !logex.theLog.Observed(nodeId, latest.AcceptStamp) {
+        // The node told us itself, its bucket may not have it yet.
+        return &latest, nil
+    }
+    if logex.freshness.flagged(nodeId) {
+        // The bucket hides what the node wrote lately.
+        return logex.p2pNewLogEntriesOfNode(nodeId)
+    }
+    manifest, err := logex.getManifest(nodeId)
+    if err != nil {
+        // Forged, rolled back or out of reach.
+        logexDebug.Error(err)
+        return logex.p2pNewLogEntriesOfNode(nodeId)
+    }
+    if manifest != nil {
+        latest := manifest.Latest()
+        if latest == nil || logex.theLog.Observed(nodeId, latest.AcceptStamp) {
+            return nil, nil
+        }
+        logex.fetchPacks(nodeId, manifest)
+        return latest, nil
+    }
     for i := 0; i < 3; i++ {
         latestUpdate, err := logex.theAdaptor.GetTextFrom(bucketName, string(nodeId)+".latestUpdate")
         if err == nil {
@@ -225,14 +465,14 @@ func (logex *LogEx) anyNewLogEntriesOfNode(nodeId log.NodeID) (*log.VersionInfo,
     }
 
     // respond in p2p mode
-    return logex.p2pAnyNewLogEntriesOfNode(nodeId)
+    return logex.p2pNewLogEntriesOfNode(nodeId)
 }
 
 // get a log entry in p2p mode.
 func (logex *LogEx) p2pGetEntryByEncodedHash(nodeId log.NodeID, key log.EncodedHash) (*log.LogEntry, error) {
-    client, err := rpc.DialHTTPPath("tcp", logex.nodeIPMap[nodeId], "/"+string(nodeId))
+    client, err := logex.dialPeer(nodeId)
     if err != nil {
-        return nil, nil
+        return nil, err
     }
     defer client.Close()
     var logEntry log.LogEntry
@@ -242,9 +482,51 @@ func (logex *LogEx) p2pGetEntryByEncodedHash(nodeId log.NodeID, key log.EncodedH
     return &logEntry, nil
 }
 
+/*
+   Fetch every entry the peer holds that we have not observed, page by
+   page over one connection, and commit them in the order sent.
+*/
+func (logex *LogEx) p2pAntiEntropy(peer log.NodeID) error {
+    client, err := logex.dialPeer(peer)
+    if err != nil {
+        return logexDebug.Error(err)
+    }
+    defer client.Close()
+    for {
+        var page EntriesSince
+        request := EntriesSinceRequest{logex.theLog.GetVersionVector(), true, logex.subscriptions}
+        if err := client.Call("LogEx.GetEntriesSince", request, &page); err != nil {
+            return logexDebug.Error(err)
+        }
+        committed := 0
+        for _, logEntry := range page.Entries {
+            // Sent again when our branches of a fork are named differently.
+            if logex.theLog.HasLogEntry(logEntry.NodeId, logEntry.EncodedHash()) {
+                continue
+            }
+            var value []byte
+            if update, ok := logEntry.Message.(*log.Update); ok {
+                value = page.Values[update.HashOfValue]
+            }
+            // We only get here when buckets are out of reach, see antiEntropy.
+            if err := logex.commitRemoteEntry(logEntry, value, false); err != nil {
+                return err
+            }
+            committed++
+        }
+        logexDebug.Debugf("Committed %v of %v entries from %v", committed, len(page.Entries), peer)
+        if !page.More {
+            return nil
+        }
+        if committed == 0 {
+            return logexDebug.Error(errors.New(fmt.Sprintf("No new entries from %v, giving up.", peer)))
+        }
+    }
+}
+
 // check if there are new updates in p2p mode.
 func (logex *LogEx) p2pAnyNewLogEntriesOfNode(nodeId log.NodeID) (*log.VersionInfo, error) {
-    client, err := rpc.DialHTTPPath("tcp", logex.nodeIPMap[nodeId], "/"+string(nodeId))
+    client, err := logex.dialPeer(nodeId)
     if err != nil {
         return nil, err
     }
@@ -263,9 +545,23 @@ func (logex *LogEx) p2pAnyNewLogEntriesOfNode(nodeId log.NodeID) (*log.VersionIn
     return nil, nil
 }
 
+// ask a peer what it knows of nodeIds in p2p mode.
+func (logex *LogEx) p2pGetKnownVersions(peer log.NodeID, nodeIds []log.NodeID) (KnownVersions, error) {
+    client, err := logex.dialPeer(peer)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    var response KnownVersions
+    if err := client.Call("LogEx.GetKnownVersions", nodeIds, &response); err != nil {
+        return nil, err
+    }
+    return response, nil
+}
+
 // get value in p2p mode.
 func (logex *LogEx) p2pGetValue(nodeId log.NodeID, key log.EncodedHash) ([]byte, error) {
-    client, err := rpc.DialHTTPPath("tcp", logex.nodeIPMap[nodeId], "/"+string(nodeId))
+    client, err := logex.dialPeer(nodeId)
     if err != nil {
         return nil, err
     }
@@ -4,6 +4,8 @@ import (
     "fmt"
     . "launchpad.net/gocheck"
     "math/rand"
+    "strings"
+    "teapot/adaptor"
     "teapot/conf"
     "teapot/log"
     "teapot/utility"
@@ -78,11 +80,70 @@ func (fp2p *fakeP2PLogEx) GetLastLogEntryInfoOfNode(logEx *LogEx, nodeId log.Nod
     return (&p2p).GetLastLogEntryInfoOfNode(logEx, nodeId, response)
 }
 
-func (fp2p *fakeP2PLogEx) GetValue(logEx *LogEx, key log.EncodedHash, object *[]byte) error {
+func (fp2p *fakeP2PLogEx) GetKnownVersions(logEx *LogEx, nodeIds []log.NodeID, response *KnownVersions) error {
+    p2p := p2pLogEx(*fp2p)
+    return (&p2p).GetKnownVersions(logEx, nodeIds, response)
+}
+
+func (fp2p *fakeP2PLogEx) GetEntriesSince(logEx *LogEx, caller log.NodeID, request EntriesSinceRequest, response *EntriesSince) error {
+    p2p := p2pLogEx(*fp2p)
+    if err := (&p2p).GetEntriesSince(logEx, caller, request, response); err != nil {
+        return err
+    }
+    for encodedHash := range response.Values {
+        response.Values[encodedHash] = []byte("faulty_world")
+    }
+    return nil
+}
+
+func (fp2p *fakeP2PLogEx) Notify(logEx *LogEx, caller log.NodeID, notification Notification, response *bool) error {
+    p2p := p2pLogEx(*fp2p)
+    return (&p2p).Notify(logEx, caller, notification, response)
+}
+
+func (fp2p *fakeP2PLogEx) GetServableVersions(logEx *LogEx, nodeIds []log.NodeID, response *ServableVersions) error {
+    p2p := p2pLogEx(*fp2p)
+    return (&p2p).GetServableVersions(logEx, nodeIds, response)
+}
+
+func (fp2p *fakeP2PLogEx) GetDigests(logEx *LogEx, floors map[log.NodeID]log.Timestamp, response *Digests) error {
+    p2p := p2pLogEx(*fp2p)
+    return (&p2p).GetDigests(logEx, floors, response)
+}
+
+func (fp2p *fakeP2PLogEx) GetChildDigests(logEx *LogEx, request ChildDigestsRequest, response *ChildDigests) error {
+    p2p := p2pLogEx(*fp2p)
+    return (&p2p).GetChildDigests(logEx, request, response)
+}
+
+func (fp2p *fakeP2PLogEx) GetRanges(logEx *LogEx, caller log.NodeID, request RangesRequest, response *EntriesSince) error {
+    p2p := p2pLogEx(*fp2p)
+    if err := (&p2p).GetRanges(logEx, caller, request, response); err != nil {
+        return err
+    }
+    for encodedHash := range response.Values {
+        response.Values[encodedHash] = []byte("faulty_world")
+    }
+    return nil
+}
+
+func (fp2p *fakeP2PLogEx) GetValue(logEx *LogEx, caller log.NodeID, key log.EncodedHash, object *[]byte) error {
     *object = []byte("faulty_world")
     return nil
 }
 
+// Let every other node read the hello directory of logEx.
+func shareHello(c *C, logEx *LogEx, all []*LogEx) {
+    readers := make([]log.NodeID, 0)
+    for _, other := range all {
+        if other != logEx {
+            readers = append(readers, other.myNodeId)
+        }
+    }
+    chmod := logEx.theLog.NewChangeMode("hello", utility.KeyFromPassphrase("password"), readers, []log.NodeID{})
+    c.Assert(logEx.theLog.Commit(logEx.theLog.NewLogEntry(chmod)), IsNil)
+}
+
 func (s *FaultyLogExSuite) SetUpTest(c *C) {
     s.logEx = make([]*LogEx, 0)
     s.logEntries = make([]*log.LogEntry, 0)
@@ -95,6 +156,7 @@ func (s *FaultyLogExSuite) SetUpTest(c *C) {
         s.logEx = append(s.logEx, logEx)
     }
     for _, logEx := range s.logEx {
+        shareHello(c, logEx, s.logEx)
         update := logEx.theLog.NewUpdate(log.Key(string(logEx.myNodeId)+"/hello/0"), []byte("world"))
         logEntry := logEx.theLog.NewLogEntry(update)
         c.Assert(logEx.theLog.Commit(logEntry), IsNil)
@@ -271,3 +333,211 @@ func (s *FaultyLogExSuite) TestTampperedValueChecking(c *C) {
         c.Assert(err, ErrorMatches, "Hash doesn't match.")
     }
 }
+
+type PackSuite struct {
+    dir string
+}
+
+var _ = Suite(&PackSuite{})
+
+func (s *PackSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// Entries are read from the packs in the bucket of their node.
+func (s *PackSuite) TestAntiEntropyFromPacks(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    for i, config := range configs {
+        storage := adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage), storage)
+    }
+    for i := 0; i < 5; i++ {
+        update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", logEx[0].myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(logEx[0].theLog.Commit(logEx[0].theLog.NewLogEntry(update)), IsNil)
+    }
+    for i := 0; i < 500 && logEx[0].theLog.SyncStatus().Pending != 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(logEx[0].theLog.SyncStatus().Pending, Equals, 0)
+    // Nothing but the buckets to read from.
+    logEx[0].stopP2P()
+    defer logEx[1].stopP2P()
+    versionInfo, err := logEx[1].anyNewLogEntriesOfNode(logEx[0].myNodeId)
+    c.Assert(err, IsNil)
+    c.Assert(versionInfo, NotNil)
+    c.Assert(logEx[1].antiEntropy(logEx[0].myNodeId, *versionInfo), IsNil)
+    for i := 0; i < 5; i++ {
+        logEntries, err := logEx[1].theLog.GetCheckpoint(log.Key(fmt.Sprintf("%v/hello/%v", logEx[0].myNodeId, i)))
+        c.Assert(err, IsNil)
+        c.Assert(len(logEntries), Equals, 1)
+        _, err = logEx[1].theLog.GetValue(logEntries[0].Message.(*log.Update).HashOfValue)
+        c.Assert(err, IsNil)
+    }
+    c.Assert(logEx[1].manifests.seen[logEx[0].myNodeId], NotNil)
+    c.Assert(len(logEx[1].packs.entries), Equals, 0)
+}
+
+// An older manifest served again is not believed.
+func (s *PackSuite) TestManifestRollback(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    storage := make([]adaptor.Adaptor, len(configs))
+    for i, config := range configs {
+        storage[i] = adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage[i]), storage[i])
+    }
+    logEx[0].stopP2P()
+    defer logEx[1].stopP2P()
+    manifests := make([][]byte, 0)
+    for i := 0; i < 2; i++ {
+        update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", logEx[0].myNodeId, i)), []byte("world"))
+        c.Assert(logEx[0].theLog.Commit(logEx[0].theLog.NewLogEntry(update)), IsNil)
+        for j := 0; j < 500 && logEx[0].theLog.SyncStatus().Pending != 0; j++ {
+            time.Sleep(10 * time.Millisecond)
+        }
+        manifest, err := storage[0].GetBinary(log.ManifestKey(logEx[0].myNodeId))
+        c.Assert(err, IsNil)
+        manifests = append(manifests, manifest)
+        versionInfo, err := logEx[1].anyNewLogEntriesOfNode(logEx[0].myNodeId)
+        c.Assert(err, IsNil)
+        c.Assert(versionInfo, NotNil)
+    }
+    c.Assert(storage[0].PutBinary(log.ManifestKey(logEx[0].myNodeId), manifests[0]), IsNil)
+    _, err := logEx[1].getManifest(logEx[0].myNodeId)
+    c.Assert(err, ErrorMatches, "Manifest of .* rolled back .*")
+    violations := logEx[1].Freshness()
+    c.Assert(len(violations), Equals, 1)
+    c.Assert(violations[0].Kind, Equals, RolledBack)
+    c.Assert(violations[0].Flagged, Equals, true)
+    // With the node itself out of reach, there is nothing to trust.
+    _, err = logEx[1].anyNewLogEntriesOfNode(logEx[0].myNodeId)
+    c.Assert(err, NotNil)
+}
+
+// The versions seen outlive a restart.
+func (s *PackSuite) TestManifestVersionsPersist(c *C) {
+    tracker := newManifestTracker(s.dir + "/manifests")
+    c.Assert(tracker.update(&log.Manifest{NodeId: "a", Version: 2}), IsNil)
+    tracker = newManifestTracker(s.dir + "/manifests")
+    c.Assert(tracker.version("a"), Equals, int64(2))
+    c.Assert(tracker.get("a"), IsNil)
+    c.Assert(tracker.update(&log.Manifest{NodeId: "a", Version: 1}), ErrorMatches, "Manifest of a rolled back from version 2 to 1.")
+    c.Assert(tracker.update(&log.Manifest{NodeId: "a", Version: 3}), IsNil)
+}
+
+type FreshnessSuite struct {
+    dir string
+}
+
+var _ = Suite(&FreshnessSuite{})
+
+func (s *FreshnessSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// Ignores manifests while frozen, like a provider hiding recent writes.
+type frozenManifestAdaptor struct {
+    adaptor.Adaptor
+    frozen bool
+}
+
+func (a *frozenManifestAdaptor) PutBinary(key string, value []byte) error {
+    if a.frozen && strings.HasSuffix(key, ".manifest") {
+        return nil
+    }
+    return a.Adaptor.PutBinary(key, value)
+}
+
+func (s *FreshnessSuite) TestStaleBucket(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    frozen := &frozenManifestAdaptor{adaptor.NewFSAdaptor(s.dir+"/storage", configs[0].MyBucketName), false}
+    for i, config := range configs {
+        var storage adaptor.Adaptor = adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        if i == 0 {
+            storage = frozen
+        }
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage), storage)
+        defer logEx[i].stopP2P()
+    }
+    nodeId := logEx[0].myNodeId
+    commit := func(i int) *log.LogEntry {
+        update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", nodeId, i)), []byte("world"))
+        logEntry := logEx[0].theLog.NewLogEntry(update)
+        c.Assert(logEx[0].theLog.Commit(logEntry), IsNil)
+        for j := 0; j < 500 && logEx[0].theLog.SyncStatus().Pending != 0; j++ {
+            time.Sleep(10 * time.Millisecond)
+        }
+        return logEntry
+    }
+    served := commit(0)
+    frozen.frozen = true
+    hidden := commit(1)
+    // Learn about the hidden entry from the node itself.
+    versionInfo, err := logEx[1].p2pAnyNewLogEntriesOfNode(nodeId)
+    c.Assert(err, IsNil)
+    c.Assert(logEx[1].antiEntropy(nodeId, *versionInfo), IsNil)
+    logEx[1].checkFreshness()
+    violations := logEx[1].Freshness()
+    c.Assert(len(violations), Equals, 1)
+    c.Assert(violations[0].Kind, Equals, Stale)
+    c.Assert(violations[0].Known.HashOfUpdate, Equals, hidden.EncodedHash())
+    c.Assert(violations[0].Served.HashOfUpdate, Equals, served.EncodedHash())
+    // The node may still be syncing, it takes a while to be flagged.
+    c.Assert(violations[0].Flagged, Equals, false)
+    logEx[1].freshness.violations[nodeId].Since = time.Now().Add(-freshnessTimeout)
+    logEx[1].checkFreshness()
+    c.Assert(logEx[1].freshness.flagged(nodeId), Equals, true)
+    // The bucket catches up.
+    frozen.frozen = false
+    commit(2)
+    logEx[1].checkFreshness()
+    c.Assert(len(logEx[1].Freshness()), Equals, 0)
+}
+
+// A manifest deleted after it was seen is a rollback, not a node that never wrote one.
+func (s *FreshnessSuite) TestDeletedManifest(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    frozen := &frozenManifestAdaptor{adaptor.NewFSAdaptor(s.dir+"/storage", configs[0].MyBucketName), false}
+    for i, config := range configs {
+        var storage adaptor.Adaptor = adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        if i == 0 {
+            storage = frozen
+        }
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage), storage)
+        defer logEx[i].stopP2P()
+    }
+    nodeId := logEx[0].myNodeId
+    commit := func(i int) *log.LogEntry {
+        update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", nodeId, i)), []byte("world"))
+        logEntry := logEx[0].theLog.NewLogEntry(update)
+        c.Assert(logEx[0].theLog.Commit(logEntry), IsNil)
+        for j := 0; j < 500 && logEx[0].theLog.SyncStatus().Pending != 0; j++ {
+            time.Sleep(10 * time.Millisecond)
+        }
+        return logEntry
+    }
+    commit(0)
+    logEx[1].checkFreshness()
+    c.Assert(len(logEx[1].Freshness()), Equals, 0)
+    seen := logEx[1].manifests.version(nodeId)
+    c.Assert(seen > 0, Equals, true)
+
+    frozen.frozen = true
+    c.Assert(frozen.Delete(log.ManifestKey(nodeId)), IsNil)
+    hidden := commit(1)
+    logEx[1].checkFreshness()
+    violations := logEx[1].Freshness()
+    c.Assert(len(violations), Equals, 1)
+    c.Assert(violations[0].Kind, Equals, RolledBack)
+    c.Assert(violations[0].KnownManifest, Equals, seen)
+    c.Assert(violations[0].ServedManifest, Equals, int64(0))
+    c.Assert(violations[0].Flagged, Equals, true)
+    // Entries of the node now come over P2P.
+    versionInfo, err := logEx[1].anyNewLogEntriesOfNode(nodeId)
+    c.Assert(err, IsNil)
+    c.Assert(versionInfo, NotNil)
+    c.Assert(versionInfo.HashOfUpdate, Equals, hidden.EncodedHash())
+}
@@ -0,0 +1,156 @@
+package logex
+
+import (
+    "io/ioutil"
+    "os"
+    path_ "path"
+    "sync"
+    "teapot/adaptor"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const manifestDebug utility.Debug = true
+
+/*
+   The newest manifest seen of every node. The version of each is kept
+   in a file next to the journal, so that a rollback is caught across
+   restarts too.
+*/
+type manifestTracker struct {
+    path     string
+    lock     *sync.Mutex
+    seen     map[log.NodeID]*log.Manifest
+    versions map[log.NodeID]int64
+}
+
+func newManifestTracker(path string) *manifestTracker {
+    tracker := &manifestTracker{path, new(sync.Mutex), make(map[log.NodeID]*log.Manifest), make(map[log.NodeID]int64)}
+    if buf, err := ioutil.ReadFile(path); err == nil {
+        var versions map[log.NodeID]int64
+        if err := utility.GobDecode(buf, &versions); err != nil {
+            manifestDebug.Error(err)
+        } else if versions != nil {
+            tracker.versions = versions
+        }
+    } else if !os.IsNotExist(err) {
+        manifestDebug.Error(err)
+    }
+    return tracker
+}
+
+/*
+   Keep manifest unless it is older than one seen before, which means
+   the storage provider rolled it back.
+*/
+func (tracker *manifestTracker) update(manifest *log.Manifest) error {
+    tracker.lock.Lock()
+    defer tracker.lock.Unlock()
+    version, ok := tracker.versions[manifest.NodeId]
+    if ok && manifest.Version < version {
+        return manifestDebug.Error(&rollbackError{manifest.NodeId, version, manifest.Version})
+    }
+    tracker.seen[manifest.NodeId] = manifest
+    if !ok || manifest.Version > version {
+        tracker.versions[manifest.NodeId] = manifest.Version
+        if err := tracker.save(); err != nil {
+            // Still caught until the next restart.
+            manifestDebug.Error(err)
+        }
+    }
+    return nil
+}
+
+// The newest manifest seen of nodeId, nil if none.
+func (tracker *manifestTracker) get(nodeId log.NodeID) *log.Manifest {
+    tracker.lock.Lock()
+    defer tracker.lock.Unlock()
+    return tracker.seen[nodeId]
+}
+
+// The version of the newest manifest seen of nodeId, 0 if none.
+func (tracker *manifestTracker) version(nodeId log.NodeID) int64 {
+    tracker.lock.Lock()
+    defer tracker.lock.Unlock()
+    return tracker.versions[nodeId]
+}
+
+func (tracker *manifestTracker) save() error {
+    file, err := ioutil.TempFile(path_.Dir(tracker.path), path_.Base(tracker.path))
+    if err != nil {
+        return manifestDebug.Error(err)
+    }
+    if _, err := file.Write(utility.GobEncode(tracker.versions)); err != nil {
+        file.Close()
+        return manifestDebug.Error(err)
+    }
+    if err := file.Close(); err != nil {
+        return manifestDebug.Error(err)
+    }
+    if err := os.Rename(file.Name(), tracker.path); err != nil {
+        return manifestDebug.Error(err)
+    }
+    return nil
+}
+
+/*
+   Read and check the manifest in the bucket of nodeId.
+   Returns nil if the node has not written one, a rollback if one was
+   seen before.
+*/
+func (logex *LogEx) getManifest(nodeId log.NodeID) (*log.Manifest, error) {
+    bucketName := logex.nodeBucketMap[nodeId]
+    var lastErr error
+    for i := 0; i < 3; i++ {
+        buf, err := logex.theAdaptor.GetBinaryFrom(bucketName, log.ManifestKey(nodeId))
+        if err != nil {
+            if adaptor.Classify(err) == adaptor.NotFound {
+                if seen := logex.manifests.version(nodeId); seen > 0 {
+                    // Deleted since, as good as rolled back.
+                    logex.freshness.rolledBack(nodeId, seen, 0, time.Now())
+                    return nil, manifestDebug.Error(&rollbackError{nodeId, seen, 0})
+                }
+                return nil, nil
+            }
+            lastErr = err
+            continue
+        }
+        manifest, err := log.DecodeManifest(nodeId, buf, logex.config.PublicKeys[string(nodeId)])
+        if err != nil {
+            return nil, err
+        }
+        if err := logex.manifests.update(manifest); err != nil {
+            if rollback, ok := err.(*rollbackError); ok {
+                logex.freshness.rolledBack(nodeId, rollback.seen, rollback.served, time.Now())
+            }
+            return nil, err
+        }
+        return manifest, nil
+    }
+    return nil, manifestDebug.Error(lastErr)
+}
+
+/*
+   Read the packs of the manifest holding entries we have not observed,
+   so that their entries are at hand for antiEntropy.
+*/
+func (logex *LogEx) fetchPacks(nodeId log.NodeID, manifest *log.Manifest) {
+    cache := logex.packs
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    fetched := 0
+    for _, packKey := range manifest.Packs {
+        _, last, ok := log.ParsePackKey(packKey)
+        if !ok || logex.theLog.Observed(nodeId, last) {
+            continue
+        }
+        if err := logex.readPack(nodeId, packKey); err != nil {
+            // The entries are looked up one by one then.
+            manifestDebug.Error(err)
+            continue
+        }
+        fetched++
+    }
+    manifestDebug.Debugf("Read %v packs of %v", fetched, nodeId)
+}
@@ -0,0 +1,137 @@
+package logex
+
+import (
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+)
+
+const notifyDebug utility.Debug = true
+
+/*
+   Sent by a node to its peers when it committed an entry, so that they
+   fetch it at once instead of at their next poll.
+*/
+type Notification struct {
+    NodeId log.NodeID
+    Latest log.VersionInfo
+}
+
+/*
+   The latest entry every node told us about and we have not asked for
+   yet. wake is signalled on every new one.
+*/
+type announcements struct {
+    lock   *sync.Mutex
+    latest map[log.NodeID]log.VersionInfo
+    wake   chan bool
+}
+
+func newAnnouncements() *announcements {
+    return &announcements{new(sync.Mutex), make(map[log.NodeID]log.VersionInfo), make(chan bool, 1)}
+}
+
+func (a *announcements) add(notification Notification) {
+    a.lock.Lock()
+    if latest, ok := a.latest[notification.NodeId]; !ok || latest.AcceptStamp < notification.Latest.AcceptStamp {
+        a.latest[notification.NodeId] = notification.Latest
+    }
+    a.lock.Unlock()
+    select {
+    case a.wake <- true:
+    default:
+        // Already awake.
+    }
+}
+
+/*
+   At most one notification is on its way to each peer. Commits made
+   meanwhile are told in one more notification once it is done.
+*/
+type notifier struct {
+    lock *sync.Mutex
+    // Peers being notified, true if they are to be notified again after.
+    busy map[log.NodeID]bool
+}
+
+func newNotifier() *notifier {
+    return &notifier{new(sync.Mutex), make(map[log.NodeID]bool)}
+}
+
+// Whether to start notifying peer, false if it is being notified already.
+func (n *notifier) start(peer log.NodeID) bool {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    if _, ok := n.busy[peer]; ok {
+        n.busy[peer] = true
+        return false
+    }
+    n.busy[peer] = false
+    return true
+}
+
+// Whether to notify peer again, having just done so.
+func (n *notifier) again(peer log.NodeID) bool {
+    n.lock.Lock()
+    defer n.lock.Unlock()
+    if n.busy[peer] {
+        n.busy[peer] = false
+        return true
+    }
+    delete(n.busy, peer)
+    return false
+}
+
+func (a *announcements) take(nodeId log.NodeID) (log.VersionInfo, bool) {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    latest, ok := a.latest[nodeId]
+    delete(a.latest, nodeId)
+    return latest, ok
+}
+
+/*
+   Signalled when a peer told us about a new entry. Gossip should run
+   then rather than wait for its next round.
+*/
+func (logex *LogEx) Notified() <-chan bool {
+    return logex.announcements.wake
+}
+
+/*
+   Tell every peer about our latest entry. Peers out of reach are left
+   alone; they find the entry when they poll. A peer still being told
+   about an earlier entry is told about the latest one after.
+*/
+func (logex *LogEx) NotifyPeers() {
+    if logex.theLog.GetLastEntryInfoOfNode(logex.myNodeId) == nil {
+        return
+    }
+    for peer := range logex.nodeIPMap {
+        if peer != logex.myNodeId && logex.notifier.start(peer) {
+            go func(peer log.NodeID) {
+                for {
+                    latest := logex.theLog.GetLastEntryInfoOfNode(logex.myNodeId)
+                    logex.p2pNotify(peer, Notification{logex.myNodeId, *latest})
+                    if !logex.notifier.again(peer) {
+                        return
+                    }
+                }
+            }(peer)
+        }
+    }
+}
+
+// notify a peer in p2p mode.
+func (logex *LogEx) p2pNotify(peer log.NodeID, notification Notification) error {
+    client, err := logex.dialPeer(peer)
+    if err != nil {
+        return notifyDebug.Error(err)
+    }
+    defer client.Close()
+    var ok bool
+    if err := client.Call("LogEx.Notify", notification, &ok); err != nil {
+        return notifyDebug.Error(err)
+    }
+    return nil
+}
@@ -2,12 +2,13 @@ package logex
 
 import (
     "errors"
+    "fmt"
     "net"
-    "net/http"
     "net/rpc"
     "strings"
     "teapot/log"
     "teapot/utility"
+    "time"
 )
 
 const p2pDebug utility.Debug = true
@@ -15,7 +16,53 @@ const p2pDebug utility.Debug = true
 type IP2PLogEx interface {
     GetEntryByEncodedHash(logEx *LogEx, key log.EncodedHash, logEntry *log.LogEntry) error
     GetLastLogEntryInfoOfNode(logEx *LogEx, nodeId log.NodeID, response *log.VersionInfo) error
-    GetValue(logEx *LogEx, key log.EncodedHash, object *[]byte) error
+    GetValue(logEx *LogEx, caller log.NodeID, key log.EncodedHash, object *[]byte) error
+    GetKnownVersions(logEx *LogEx, nodeIds []log.NodeID, response *KnownVersions) error
+    GetEntriesSince(logEx *LogEx, caller log.NodeID, request EntriesSinceRequest, response *EntriesSince) error
+    Notify(logEx *LogEx, caller log.NodeID, notification Notification, response *bool) error
+    GetServableVersions(logEx *LogEx, nodeIds []log.NodeID, response *ServableVersions) error
+    GetDigests(logEx *LogEx, floors map[log.NodeID]log.Timestamp, response *Digests) error
+    GetChildDigests(logEx *LogEx, request ChildDigestsRequest, response *ChildDigests) error
+    GetRanges(logEx *LogEx, caller log.NodeID, request RangesRequest, response *EntriesSince) error
+}
+
+// At most this many entries are sent per GetEntriesSince call.
+const entriesSincePage = 256
+
+// Values stop being added to a page once it holds this many bytes of them.
+const entriesSinceValueBytes = 16 << 20
+
+/*
+   What a node knows of another: its newest entry, and the version of
+   its newest manifest seen (0 if none).
+*/
+type KnownVersion struct {
+    Latest   log.VersionInfo
+    Manifest int64
+}
+
+type KnownVersions map[log.NodeID]KnownVersion
+
+/*
+   Ask for the entries a node with version vector Since has not observed.
+   The values of updates are sent along if WithValues, only those under
+   Subscriptions unless it is empty, see subscriptions.
+*/
+type EntriesSinceRequest struct {
+    Since         map[log.NodeID]log.VersionInfo
+    WithValues    bool
+    Subscriptions []string
+}
+
+/*
+   A page of entries in an order they can be committed in. Values lacks
+   those the peer does not hold or may not give us. Ask again with the
+   new version vector if More.
+*/
+type EntriesSince struct {
+    Entries []*log.LogEntry
+    Values  map[log.EncodedHash][]byte
+    More    bool
 }
 
 type p2pLogEx struct{}
@@ -24,10 +71,10 @@ type p2pLogEx struct{}
 func (server *p2pLogEx) GetEntryByEncodedHash(logEx *LogEx, key log.EncodedHash, logEntry *log.LogEntry) error {
     p := logEx.theLog.GetEntryByEncodedHash(key)
     p2pDebug.Debugf("Log entry to send: %+v", p)
-    p.CopyTo(logEntry)
-    if logEntry == nil {
+    if p == nil {
         return p2pDebug.Error(errors.New("Teapot: Log entry with the specified hash doesn't exist"))
     }
+    p.CopyTo(logEntry)
     return nil
 }
 
@@ -47,8 +94,15 @@ func (server *p2pLogEx) GetLastLogEntryInfoOfNode(logEx *LogEx, nodeId log.NodeI
     return nil
 }
 
-// Get Value when S3 is down.
-func (server *p2pLogEx) GetValue(logEx *LogEx, key log.EncodedHash, object *[]byte) error {
+// Get Value when S3 is down. Only readers and writers of the value get it.
+func (server *p2pLogEx) GetValue(logEx *LogEx, caller log.NodeID, key log.EncodedHash, object *[]byte) error {
+    if !logEx.limiter.allow(caller, time.Now()) {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: Too many requests from %v", caller)))
+    }
+    logEntry := logEx.theLog.GetUpdateOfValue(key)
+    if logEntry == nil || !logEx.theLog.CanRead(caller, logEntry) {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: %v may not read %v", caller, key)))
+    }
     value, err := logEx.theLog.GetValue(key)
     if err != nil {
         return err
@@ -57,36 +111,199 @@ func (server *p2pLogEx) GetValue(logEx *LogEx, key log.EncodedHash, object *[]by
     return nil
 }
 
+// Used by peers to check that buckets are not stale.
+func (server *p2pLogEx) GetKnownVersions(logEx *LogEx, nodeIds []log.NodeID, response *KnownVersions) error {
+    *response = logEx.knownVersions(nodeIds)
+    return nil
+}
+
+// Used to catch up with a peer over one connection when S3 is down.
+func (server *p2pLogEx) GetEntriesSince(logEx *LogEx, caller log.NodeID, request EntriesSinceRequest, response *EntriesSince) error {
+    if request.WithValues && !logEx.limiter.allow(caller, time.Now()) {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: Too many requests from %v", caller)))
+    }
+    logEntries, more := logEx.theLog.GetEntriesSince(request.Since, entriesSincePage)
+    values := make(map[log.EncodedHash][]byte)
+    size, refused := 0, 0
+    for i, logEntry := range logEntries {
+        if !request.WithValues {
+            break
+        }
+        update, ok := logEntry.Message.(*log.Update)
+        if !ok || !subscriptions(request.Subscriptions).covers(update.Key) {
+            continue
+        }
+        if size >= entriesSinceValueBytes {
+            // The rest goes in the next page.
+            logEntries, more = logEntries[:i], true
+            break
+        }
+        if !logEx.theLog.CanRead(caller, logEntry) {
+            refused++
+            continue
+        }
+        value, err := logEx.theLog.GetValue(update.HashOfValue)
+        if err != nil {
+            // The caller fetches it elsewhere.
+            continue
+        }
+        values[update.HashOfValue] = value
+        size += len(value)
+    }
+    if refused > 0 {
+        p2pDebug.Debugf("Withheld %v values %v may not read", refused, caller)
+    }
+    *response = EntriesSince{logEntries, values, more}
+    return nil
+}
+
+// Used by peers to tell about entries they just committed.
+func (server *p2pLogEx) Notify(logEx *LogEx, caller log.NodeID, notification Notification, response *bool) error {
+    if _, ok := logEx.nodeBucketMap[notification.NodeId]; !ok || notification.NodeId == logEx.myNodeId {
+        return p2pDebug.Error(errors.New("Teapot: Notification from an unknown node"))
+    }
+    // Nodes only tell about their own entries.
+    if notification.NodeId != caller {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: %v may not notify for %v", caller, notification.NodeId)))
+    }
+    if !logEx.theLog.Observed(notification.NodeId, notification.Latest.AcceptStamp) {
+        logEx.gossip.markNews(notification.NodeId, time.Now())
+        logEx.announcements.add(notification)
+    }
+    *response = true
+    return nil
+}
+
+// Used by peers to find who else can give them the entries of a node.
+func (server *p2pLogEx) GetServableVersions(logEx *LogEx, nodeIds []log.NodeID, response *ServableVersions) error {
+    *response = logEx.servableVersions(nodeIds)
+    return nil
+}
+
+// Used by peers to find which ranges of entries we differ in.
+func (server *p2pLogEx) GetDigests(logEx *LogEx, floors map[log.NodeID]log.Timestamp, response *Digests) error {
+    *response = logEx.theLog.GetDigests(floors)
+    return nil
+}
+
+// Used by peers to descend into the ranges we differ in.
+func (server *p2pLogEx) GetChildDigests(logEx *LogEx, request ChildDigestsRequest, response *ChildDigests) error {
+    if len(request.Ranges) > digestDescent {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: Asked for digests below %v ranges", len(request.Ranges))))
+    }
+    children := make(ChildDigests, len(request.Ranges))
+    for i, entryRange := range request.Ranges {
+        children[i] = logEx.theLog.GetChildDigests(entryRange.NodeId, entryRange.Level, entryRange.Start, request.Floors[entryRange.NodeId])
+    }
+    *response = children
+    return nil
+}
+
+// Used by peers to fetch what they miss in the ranges we differ in.
+func (server *p2pLogEx) GetRanges(logEx *LogEx, caller log.NodeID, request RangesRequest, response *EntriesSince) error {
+    if !logEx.limiter.allow(caller, time.Now()) {
+        return p2pDebug.Error(errors.New(fmt.Sprintf("Teapot: Too many requests from %v", caller)))
+    }
+    *response = logEx.entriesInRanges(caller, request)
+    return nil
+}
+
+/*
+   What a peer is served over one connection. The caller is the node the
+   TLS handshake authenticated.
+*/
+type p2pSession struct {
+    logex  *LogEx
+    caller log.NodeID
+}
+
 // Used to get log entries when S3 is down
-func (server *LogEx) GetEntryByEncodedHash(key log.EncodedHash, logEntry *log.LogEntry) error {
-    return server.p2p.GetEntryByEncodedHash(server, key, logEntry)
+func (session *p2pSession) GetEntryByEncodedHash(key log.EncodedHash, logEntry *log.LogEntry) error {
+    return session.logex.p2p.GetEntryByEncodedHash(session.logex, key, logEntry)
 }
 
 // Used to check whether there is new update when S3 is down.
-func (server *LogEx) GetLastLogEntryInfoOfNode(nodeId log.NodeID, response *log.VersionInfo) error {
+func (session *p2pSession) GetLastLogEntryInfoOfNode(nodeId log.NodeID, response *log.VersionInfo) error {
     // Notice how to assign to the response.
-    return server.p2p.GetLastLogEntryInfoOfNode(server, nodeId, response)
+    return session.logex.p2p.GetLastLogEntryInfoOfNode(session.logex, nodeId, response)
 }
 
 // Get Value when S3 is down.
-func (server *LogEx) GetValue(key log.EncodedHash, object *[]byte) error {
-    return server.p2p.GetValue(server, key, object)
+func (session *p2pSession) GetValue(key log.EncodedHash, object *[]byte) error {
+    return session.logex.p2p.GetValue(session.logex, session.caller, key, object)
+}
+
+// Used by peers to check that buckets are not stale.
+func (session *p2pSession) GetKnownVersions(nodeIds []log.NodeID, response *KnownVersions) error {
+    return session.logex.p2p.GetKnownVersions(session.logex, nodeIds, response)
+}
+
+// Used to catch up with a peer over one connection when S3 is down.
+func (session *p2pSession) GetEntriesSince(request EntriesSinceRequest, response *EntriesSince) error {
+    return session.logex.p2p.GetEntriesSince(session.logex, session.caller, request, response)
+}
+
+// Used by peers to tell about entries they just committed.
+func (session *p2pSession) Notify(notification Notification, response *bool) error {
+    return session.logex.p2p.Notify(session.logex, session.caller, notification, response)
+}
+
+// Used by peers to find who else can give them the entries of a node.
+func (session *p2pSession) GetServableVersions(nodeIds []log.NodeID, response *ServableVersions) error {
+    return session.logex.p2p.GetServableVersions(session.logex, nodeIds, response)
+}
+
+// Used by peers to find which ranges of entries we differ in.
+func (session *p2pSession) GetDigests(floors map[log.NodeID]log.Timestamp, response *Digests) error {
+    return session.logex.p2p.GetDigests(session.logex, floors, response)
+}
+
+// Used by peers to descend into the ranges we differ in.
+func (session *p2pSession) GetChildDigests(request ChildDigestsRequest, response *ChildDigests) error {
+    return session.logex.p2p.GetChildDigests(session.logex, request, response)
+}
+
+// Used by peers to fetch what they miss in the ranges we differ in.
+func (session *p2pSession) GetRanges(request RangesRequest, response *EntriesSince) error {
+    return session.logex.p2p.GetRanges(session.logex, session.caller, request, response)
 }
 
 func (server *LogEx) startP2P(ipPort string) {
-    s := rpc.NewServer()
-    s.Register(server)
-    s.HandleHTTP("/"+string(server.myNodeId), "/"+string(server.myNodeId)+"_debug")
     parts := strings.Split(ipPort, ":")
     if len(parts) != 2 {
         p2pDebug.Panicf("Malformed ip port information, %v", ipPort)
     }
-    listener, err := net.Listen("tcp", ":"+parts[1])
+    listener, err := server.transport.listen(":" + parts[1])
     if err != nil {
         p2pDebug.Panicf("Unable to set up p2p server. %v", err)
     }
     server.listener = listener
-    go http.Serve(listener, nil)
+    go server.serveP2P(listener)
+}
+
+func (server *LogEx) serveP2P(listener net.Listener) {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        go server.serveConn(conn)
+    }
+}
+
+// Serve one peer with the calls of a session knowing who it is.
+func (server *LogEx) serveConn(conn net.Conn) {
+    caller, err := server.transport.accept(conn, server.myNodeId)
+    if err != nil {
+        p2pDebug.Debugf("Refused connection from %v: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+    s := rpc.NewServer()
+    if err := s.RegisterName("LogEx", &p2pSession{server, caller}); err != nil {
+        p2pDebug.Panicf("Unable to register p2p session. %v", err)
+    }
+    s.ServeConn(conn)
 }
 
 func (server *LogEx) stopP2P() {
@@ -1,11 +1,35 @@
 package logex
 
 import (
+    "fmt"
     . "launchpad.net/gocheck"
+    "teapot/adaptor"
     "teapot/conf"
     "teapot/log"
+    "teapot/utility"
+    "time"
 )
 
+/*
+   n nodes that each see their own bucket only, so that anything else
+   has to come over P2P. Stop them with stopNodes.
+*/
+func newIsolatedNodes(dir string, n int) []*LogEx {
+    configs := conf.LoadMultipleTest(dir, n)
+    logEx := make([]*LogEx, len(configs))
+    for i, config := range configs {
+        storage := adaptor.NewFSAdaptor(fmt.Sprintf("%v/storage%v", dir, i), config.MyBucketName)
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage), storage)
+    }
+    return logEx
+}
+
+func stopNodes(logEx []*LogEx) {
+    for _, node := range logEx {
+        node.stopP2P()
+    }
+}
+
 type P2PSuite struct {
     dir        string
     n          int
@@ -48,6 +72,7 @@ func (s *P2PSuite) TearDownTest(c *C) {
 
 func (s *P2PSuite) TestP2P(c *C) {
     for _, logEx := range s.logEx {
+        shareHello(c, logEx, s.logEx)
         update := logEx.theLog.NewUpdate(log.Key(string(logEx.myNodeId)+"/hello/0"), []byte("world"))
         logEntry := logEx.theLog.NewLogEntry(update)
         s.logEntries = append(s.logEntries, logEntry)
@@ -58,7 +83,7 @@ func (s *P2PSuite) TestP2P(c *C) {
         versionInfo, err := logEx.p2pAnyNewLogEntriesOfNode(s.logEx[nextIndex].myNodeId)
         c.Assert(err, IsNil)
         c.Assert(versionInfo, NotNil)
-        c.Assert(versionInfo.AcceptStamp, Equals, log.Timestamp(1))
+        c.Assert(versionInfo.AcceptStamp, Equals, log.Timestamp(2))
         c.Logf("%v", s.logEntries[nextIndex])
         c.Assert(versionInfo.HashOfUpdate, Equals, s.logEntries[nextIndex].EncodedHash())
         logEntry, err := logEx.p2pGetEntryByEncodedHash(s.logEx[nextIndex].myNodeId, versionInfo.HashOfUpdate)
@@ -73,3 +98,222 @@ func (s *P2PSuite) TestP2P(c *C) {
         //c.Assert(string(value), Equals, "world")
     }
 }
+
+type EntriesSinceSuite struct {
+    dir string
+}
+
+var _ = Suite(&EntriesSinceSuite{})
+
+func (s *EntriesSinceSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// Counts the calls served.
+type countingP2PLogEx struct {
+    p2pLogEx
+    entriesSince, entries, ranges, children int
+    // The ranges asked for by the last GetRanges.
+    leaves []EntryRange
+}
+
+func (cp2p *countingP2PLogEx) GetChildDigests(logEx *LogEx, request ChildDigestsRequest, response *ChildDigests) error {
+    cp2p.children++
+    return cp2p.p2pLogEx.GetChildDigests(logEx, request, response)
+}
+
+func (cp2p *countingP2PLogEx) GetRanges(logEx *LogEx, caller log.NodeID, request RangesRequest, response *EntriesSince) error {
+    cp2p.ranges++
+    cp2p.leaves = request.Ranges
+    return cp2p.p2pLogEx.GetRanges(logEx, caller, request, response)
+}
+
+func (cp2p *countingP2PLogEx) GetEntriesSince(logEx *LogEx, caller log.NodeID, request EntriesSinceRequest, response *EntriesSince) error {
+    cp2p.entriesSince++
+    return cp2p.p2pLogEx.GetEntriesSince(logEx, caller, request, response)
+}
+
+func (cp2p *countingP2PLogEx) GetEntryByEncodedHash(logEx *LogEx, key log.EncodedHash, logEntry *log.LogEntry) error {
+    cp2p.entries++
+    return cp2p.p2pLogEx.GetEntryByEncodedHash(logEx, key, logEntry)
+}
+
+// A node out of reach of the bucket catches up in pages, values included.
+func (s *EntriesSinceSuite) TestEntriesSince(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    counting := &countingP2PLogEx{}
+    logEx[0].p2p = counting
+    shareHello(c, logEx[0], logEx)
+    n := entriesSincePage + 44
+    for i := 0; i < n; i++ {
+        update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", logEx[0].myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(logEx[0].theLog.Commit(logEx[0].theLog.NewLogEntry(update)), IsNil)
+    }
+    versionInfo, err := logEx[1].anyNewLogEntriesOfNode(logEx[0].myNodeId)
+    c.Assert(err, IsNil)
+    c.Assert(versionInfo, NotNil)
+    c.Assert(logEx[1].antiEntropy(logEx[0].myNodeId, *versionInfo), IsNil)
+    c.Assert(counting.entriesSince, Equals, 2)
+    c.Assert(counting.entries, Equals, 0)
+    for i := 0; i < n; i++ {
+        logEntries, err := logEx[1].theLog.GetCheckpoint(log.Key(fmt.Sprintf("%v/hello/%v", logEx[0].myNodeId, i)))
+        c.Assert(err, IsNil)
+        c.Assert(len(logEntries), Equals, 1)
+        _, err = logEx[1].theLog.GetValue(logEntries[0].Message.(*log.Update).HashOfValue)
+        c.Assert(err, IsNil)
+    }
+    c.Assert(logEx[1].theLog.Observed(logEx[0].myNodeId, versionInfo.AcceptStamp), Equals, true)
+}
+
+type NotifySuite struct {
+    dir string
+}
+
+var _ = Suite(&NotifySuite{})
+
+func (s *NotifySuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// A peer told about a commit fetches it without waiting for the bucket.
+func (s *NotifySuite) TestNotify(c *C) {
+    logEx := newIsolatedNodes(s.dir, 3)
+    defer stopNodes(logEx)
+    update := logEx[0].theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/0", logEx[0].myNodeId)), []byte("world"))
+    logEntry := logEx[0].theLog.NewLogEntry(update)
+    c.Assert(logEx[0].theLog.Commit(logEntry), IsNil)
+    logEx[0].NotifyPeers()
+    select {
+    case <-logEx[1].Notified():
+    case <-time.After(5 * time.Second):
+        c.Fatalf("No notification received")
+    }
+    latest, ok := logEx[1].announcements.take(logEx[0].myNodeId)
+    c.Assert(ok, Equals, true)
+    c.Assert(latest, Equals, log.VersionInfo{logEntry.AcceptStamp, logEntry.EncodedHash()})
+    logEx[1].announcements.add(Notification{logEx[0].myNodeId, latest})
+    c.Assert(logEx[1].BackgroundGossip(), Equals, true)
+    c.Assert(logEx[1].theLog.HasLogEntry(logEx[0].myNodeId, logEntry.EncodedHash()), Equals, true)
+    // Only known nodes are listened to.
+    c.Assert(logEx[1].p2pNotify(logEx[0].myNodeId, Notification{"somebody_else", latest}), ErrorMatches, ".*unknown node")
+    // Nor told about others' entries.
+    c.Assert(logEx[2].p2pNotify(logEx[1].myNodeId, Notification{logEx[0].myNodeId, latest}), ErrorMatches, ".*may not notify.*")
+}
+
+// Commits made while a peer is being notified make one more notification.
+func (s *NotifySuite) TestCoalesce(c *C) {
+    n := newNotifier()
+    c.Assert(n.start("a"), Equals, true)
+    c.Assert(n.start("a"), Equals, false)
+    c.Assert(n.start("a"), Equals, false)
+    c.Assert(n.start("b"), Equals, true)
+    c.Assert(n.again("a"), Equals, true)
+    c.Assert(n.again("a"), Equals, false)
+    c.Assert(n.again("b"), Equals, false)
+    c.Assert(n.start("a"), Equals, true)
+}
+
+type ValueAccessSuite struct {
+    dir string
+}
+
+var _ = Suite(&ValueAccessSuite{})
+
+func (s *ValueAccessSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// Values are only given to readers and writers of their directory.
+func (s *ValueAccessSuite) TestValueAccess(c *C) {
+    logEx := newIsolatedNodes(s.dir, 3)
+    defer stopNodes(logEx)
+    owner, reader, other := logEx[0], logEx[1], logEx[2]
+    values := make([]log.EncodedHash, 0)
+    for i := 0; i < 2; i++ {
+        if i == 1 {
+            chmod := owner.theLog.NewChangeMode("hello", utility.KeyFromPassphrase("password"), []log.NodeID{reader.myNodeId}, []log.NodeID{})
+            c.Assert(owner.theLog.Commit(owner.theLog.NewLogEntry(chmod)), IsNil)
+        }
+        update := owner.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", owner.myNodeId, i)), []byte("world"))
+        c.Assert(owner.theLog.Commit(owner.theLog.NewLogEntry(update)), IsNil)
+        values = append(values, update.HashOfValue)
+    }
+    _, err := reader.p2pGetValue(owner.myNodeId, values[0])
+    c.Assert(err, ErrorMatches, ".*may not read.*")
+    _, err = reader.p2pGetValue(owner.myNodeId, values[1])
+    c.Assert(err, IsNil)
+    _, err = other.p2pGetValue(owner.myNodeId, values[1])
+    c.Assert(err, ErrorMatches, ".*may not read.*")
+    // Pages carry the values the caller may read only.
+    for _, caller := range []*LogEx{reader, other} {
+        client, err := caller.dialPeer(owner.myNodeId)
+        c.Assert(err, IsNil)
+        var page EntriesSince
+        c.Assert(client.Call("LogEx.GetEntriesSince", EntriesSinceRequest{map[log.NodeID]log.VersionInfo{}, true, nil}, &page), IsNil)
+        client.Close()
+        c.Assert(len(page.Entries), Equals, 3)
+        _, ok := page.Values[values[1]]
+        c.Assert(ok, Equals, caller == reader)
+        _, ok = page.Values[values[0]]
+        c.Assert(ok, Equals, false)
+    }
+    // The others get entries they may not read the values of all the same.
+    c.Assert(other.p2pAntiEntropy(owner.myNodeId), IsNil)
+    c.Assert(other.theLog.Observed(owner.myNodeId, 3), Equals, true)
+    // Each peer is held to its own rate.
+    owner.limiter = newRateLimiter(0, 1)
+    _, err = reader.p2pGetValue(owner.myNodeId, values[1])
+    c.Assert(err, IsNil)
+    _, err = reader.p2pGetValue(owner.myNodeId, values[1])
+    c.Assert(err, ErrorMatches, ".*Too many requests.*")
+    _, err = other.p2pGetValue(owner.myNodeId, values[1])
+    c.Assert(err, ErrorMatches, ".*may not read.*")
+}
+
+type RelaySuite struct {
+    dir string
+}
+
+var _ = Suite(&RelaySuite{})
+
+func (s *RelaySuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// The entries of a node out of reach are fetched from a peer holding them.
+func (s *RelaySuite) TestRelay(c *C) {
+    logEx := newIsolatedNodes(s.dir, 3)
+    defer stopNodes(logEx)
+    writer, relay, reader := logEx[0], logEx[1], logEx[2]
+    shareHello(c, writer, logEx)
+    values := make([]log.EncodedHash, 0)
+    for i := 0; i < 3; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(update)), IsNil)
+        values = append(values, update.HashOfValue)
+    }
+    latest := *writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    news, err := relay.gossipWith(writer.myNodeId)
+    c.Assert(err, IsNil)
+    c.Assert(news, Equals, true)
+    versions, err := reader.p2pGetServableVersions(relay.myNodeId, []log.NodeID{writer.myNodeId})
+    c.Assert(err, IsNil)
+    c.Assert(versions[writer.myNodeId], Equals, latest)
+    // The writer goes offline.
+    writer.stopP2P()
+    _, err = reader.p2pAnyNewLogEntriesOfNode(writer.myNodeId)
+    c.Assert(err, NotNil)
+    news, err = reader.gossipWith(writer.myNodeId)
+    c.Assert(err, IsNil)
+    c.Assert(news, Equals, true)
+    c.Assert(reader.theLog.Observed(writer.myNodeId, latest.AcceptStamp), Equals, true)
+    for _, value := range values {
+        _, err := reader.theLog.GetValue(value)
+        c.Assert(err, IsNil)
+    }
+    // Nothing more to learn, the writer is still reported out of reach.
+    news, err = reader.gossipWith(writer.myNodeId)
+    c.Assert(err, NotNil)
+    c.Assert(news, Equals, false)
+}
@@ -0,0 +1,119 @@
+package logex
+
+import (
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+)
+
+const packsDebug utility.Debug = true
+
+/*
+   Log entries of other nodes read from their packs. Reading a pack
+   brings in all of its entries, which then wait here to be committed
+   instead of being fetched one by one.
+*/
+type packCache struct {
+    lock *sync.Mutex
+    // The last index read, per node.
+    markers map[log.NodeID]string
+    // The pack of every listed entry we have not read yet.
+    located map[log.EncodedHash]string
+    entries map[log.EncodedHash]*log.LogEntry
+}
+
+func newPackCache() *packCache {
+    return &packCache{
+        new(sync.Mutex),
+        make(map[log.NodeID]string),
+        make(map[log.EncodedHash]string),
+        make(map[log.EncodedHash]*log.LogEntry),
+    }
+}
+
+/*
+   Find a log entry of nodeId in its packs, reading the indexes written
+   since the last look if the entry is not known yet. Returns nil if no
+   pack holds the entry, e.g. because it was synced before packs existed.
+*/
+func (logex *LogEx) getPackedEntry(nodeId log.NodeID, encodedHash log.EncodedHash) (*log.LogEntry, error) {
+    cache := logex.packs
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    if logEntry, ok := cache.entries[encodedHash]; ok {
+        return logEntry, nil
+    }
+    if _, ok := cache.located[encodedHash]; !ok {
+        if err := logex.readNewPackIndexes(nodeId); err != nil {
+            return nil, err
+        }
+    }
+    packKey, ok := cache.located[encodedHash]
+    if !ok {
+        return nil, nil
+    }
+    if err := logex.readPack(nodeId, packKey); err != nil {
+        return nil, err
+    }
+    return cache.entries[encodedHash], nil
+}
+
+// Locate the entries listed by the indexes written since the last look.
+func (logex *LogEx) readNewPackIndexes(nodeId log.NodeID) error {
+    cache := logex.packs
+    bucketName := logex.nodeBucketMap[nodeId]
+    for {
+        result, err := logex.theAdaptor.ListFrom(bucketName, log.PackIndexPrefix(nodeId), cache.markers[nodeId], 0)
+        if err != nil {
+            return packsDebug.Error(err)
+        }
+        for _, object := range result.Objects {
+            index, err := logex.theAdaptor.GetTextFrom(bucketName, object.Key)
+            if err != nil {
+                return packsDebug.Error(err)
+            }
+            packKey := log.PackKeyOfIndex(object.Key)
+            for _, encodedHash := range log.DecodePackIndex(index) {
+                if !logex.theLog.HasLogEntry(nodeId, encodedHash) {
+                    cache.located[encodedHash] = packKey
+                }
+            }
+            cache.markers[nodeId] = object.Key
+        }
+        if !result.Truncated || len(result.Objects) == 0 {
+            return nil
+        }
+    }
+}
+
+// Keep the entries of the pack we don't have yet.
+func (logex *LogEx) readPack(nodeId log.NodeID, packKey string) error {
+    cache := logex.packs
+    pack, err := logex.theAdaptor.GetBinaryFrom(logex.nodeBucketMap[nodeId], packKey)
+    if err != nil {
+        return packsDebug.Error(err)
+    }
+    logEntries, err := log.DecodePack(pack)
+    if err != nil {
+        return packsDebug.Error(err)
+    }
+    for _, logEntry := range logEntries {
+        encodedHash := logEntry.EncodedHash()
+        if cache.located[encodedHash] == packKey {
+            delete(cache.located, encodedHash)
+        }
+        if !logex.theLog.HasLogEntry(logEntry.NodeId, encodedHash) {
+            cache.entries[encodedHash] = logEntry
+        }
+    }
+    packsDebug.Debugf("Read %v log entries from %v", len(logEntries), packKey)
+    return nil
+}
+
+// Drop an entry once it is committed.
+func (cache *packCache) forget(encodedHash log.EncodedHash) {
+    cache.lock.Lock()
+    defer cache.lock.Unlock()
+    delete(cache.entries, encodedHash)
+    delete(cache.located, encodedHash)
+}
@@ -0,0 +1,54 @@
+package logex
+
+import (
+    "sync"
+    "teapot/log"
+    "time"
+)
+
+// Requests for values each peer may make per second, and in a burst.
+const valueRequestRate = 20
+const valueRequestBurst = 100
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+/*
+   A token bucket per peer, so that one peer asking too much does not
+   keep the others from being served.
+*/
+type rateLimiter struct {
+    lock    *sync.Mutex
+    rate    float64
+    burst   float64
+    buckets map[log.NodeID]*tokenBucket
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+    return &rateLimiter{new(sync.Mutex), rate, burst, make(map[log.NodeID]*tokenBucket)}
+}
+
+// Take a token of nodeId if it has one left.
+func (limiter *rateLimiter) allow(nodeId log.NodeID, now time.Time) bool {
+    limiter.lock.Lock()
+    defer limiter.lock.Unlock()
+    bucket, ok := limiter.buckets[nodeId]
+    if !ok {
+        bucket = &tokenBucket{limiter.burst, now}
+        limiter.buckets[nodeId] = bucket
+    }
+    if elapsed := now.Sub(bucket.last); elapsed > 0 {
+        bucket.tokens += elapsed.Seconds() * limiter.rate
+        if bucket.tokens > limiter.burst {
+            bucket.tokens = limiter.burst
+        }
+        bucket.last = now
+    }
+    if bucket.tokens < 1 {
+        return false
+    }
+    bucket.tokens--
+    return true
+}
@@ -0,0 +1,29 @@
+package logex
+
+import (
+    . "launchpad.net/gocheck"
+    "time"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = Suite(&RateLimiterSuite{})
+
+func (s *RateLimiterSuite) TestAllow(c *C) {
+    now := time.Now()
+    limiter := newRateLimiter(2, 3)
+    for i := 0; i < 3; i++ {
+        c.Assert(limiter.allow("a", now), Equals, true)
+    }
+    c.Assert(limiter.allow("a", now), Equals, false)
+    // Another peer has a bucket of its own.
+    c.Assert(limiter.allow("b", now), Equals, true)
+    // Tokens come back at the rate, up to the burst.
+    c.Assert(limiter.allow("a", now.Add(500*time.Millisecond)), Equals, true)
+    c.Assert(limiter.allow("a", now.Add(500*time.Millisecond)), Equals, false)
+    later := now.Add(time.Hour)
+    for i := 0; i < 3; i++ {
+        c.Assert(limiter.allow("a", later), Equals, true)
+    }
+    c.Assert(limiter.allow("a", later), Equals, false)
+}
@@ -0,0 +1,141 @@
+package logex
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "teapot/log"
+    "teapot/utility"
+)
+
+const relayDebug utility.Debug = true
+
+/*
+   The newest entry of each node a peer holds and can serve. Entries are
+   signed by their writers, so any peer can pass them on.
+*/
+type ServableVersions map[log.NodeID]log.VersionInfo
+
+// What we can serve of nodeIds, of every node if nodeIds is empty.
+func (logex *LogEx) servableVersions(nodeIds []log.NodeID) ServableVersions {
+    versions := make(ServableVersions)
+    for nodeId, versionInfo := range logex.theLog.GetVersionVector() {
+        versions[nodeId] = versionInfo
+    }
+    if len(nodeIds) == 0 {
+        return versions
+    }
+    wanted := make(ServableVersions)
+    for _, nodeId := range nodeIds {
+        if versionInfo, ok := versions[nodeId]; ok {
+            wanted[nodeId] = versionInfo
+        }
+    }
+    return wanted
+}
+
+// The peers other than nodeId to ask for its entries, in random order.
+func (logex *LogEx) relayCandidates(nodeId log.NodeID) []log.NodeID {
+    candidates := make([]log.NodeID, 0)
+    for peer := range logex.nodeIPMap {
+        if peer != logex.myNodeId && peer != nodeId && !logex.theLog.Blocked(peer) {
+            candidates = append(candidates, peer)
+        }
+    }
+    shuffled := make([]log.NodeID, len(candidates))
+    for i, j := range rand.Perm(len(candidates)) {
+        shuffled[i] = candidates[j]
+    }
+    return shuffled
+}
+
+/*
+   Ask the other peers what they hold of nodeId. Returns the peers
+   serving its entries up to at least acceptStamp, and the newest entry
+   of nodeId any of them holds.
+*/
+func (logex *LogEx) p2pFindRelays(nodeId log.NodeID, acceptStamp log.Timestamp) ([]log.NodeID, *log.VersionInfo) {
+    relays := make([]log.NodeID, 0)
+    var latest *log.VersionInfo
+    for _, peer := range logex.relayCandidates(nodeId) {
+        versions, err := logex.p2pGetServableVersions(peer, []log.NodeID{nodeId})
+        if err != nil {
+            relayDebug.Debugf("%v does not answer: %v", peer, err)
+            continue
+        }
+        versionInfo, ok := versions[nodeId]
+        if !ok || versionInfo.AcceptStamp < acceptStamp {
+            continue
+        }
+        relays = append(relays, peer)
+        if latest == nil || versionInfo.AcceptStamp > latest.AcceptStamp {
+            latest = &log.VersionInfo{versionInfo.AcceptStamp, versionInfo.HashOfUpdate}
+        }
+    }
+    return relays, latest
+}
+
+/*
+   Like p2pAnyNewLogEntriesOfNode, but other peers are asked what they
+   hold of nodeId if it is out of reach itself.
+*/
+func (logex *LogEx) p2pNewLogEntriesOfNode(nodeId log.NodeID) (*log.VersionInfo, error) {
+    versionInfo, err := logex.p2pAnyNewLogEntriesOfNode(nodeId)
+    if err == nil {
+        return versionInfo, nil
+    }
+    _, latest := logex.p2pFindRelays(nodeId, 0)
+    if latest == nil || logex.theLog.Observed(nodeId, latest.AcceptStamp) {
+        return nil, err
+    }
+    relayDebug.Debugf("%v is out of reach, peers hold its entries up to %v", nodeId, latest)
+    return latest, nil
+}
+
+/*
+   Fetch the entry of nodeId described by versionInfo, and what it depends
+   on, from the peers holding it. Commit checks their signatures.
+*/
+func (logex *LogEx) relayAntiEntropy(nodeId log.NodeID, versionInfo log.VersionInfo) error {
+    relays, _ := logex.p2pFindRelays(nodeId, versionInfo.AcceptStamp)
+    for _, relay := range relays {
+        if err := logex.p2pAntiEntropy(relay); err != nil {
+            relayDebug.Error(err)
+        }
+        if logex.theLog.HasLogEntry(nodeId, versionInfo.HashOfUpdate) {
+            return nil
+        }
+    }
+    return relayDebug.Error(errors.New(fmt.Sprintf("No peer could serve %v of %v.", versionInfo, nodeId)))
+}
+
+/*
+   Get a value written by nodeId from any peer holding it, nodeId first.
+   The caller checks it against its hash.
+*/
+func (logex *LogEx) p2pGetValueFromAny(nodeId log.NodeID, encodedHash log.EncodedHash) ([]byte, error) {
+    value, err := logex.p2pGetValue(nodeId, encodedHash)
+    if err == nil {
+        return value, nil
+    }
+    for _, peer := range logex.relayCandidates(nodeId) {
+        if value, relayErr := logex.p2pGetValue(peer, encodedHash); relayErr == nil {
+            return value, nil
+        }
+    }
+    return nil, err
+}
+
+// ask a peer which entries it can serve in p2p mode.
+func (logex *LogEx) p2pGetServableVersions(peer log.NodeID, nodeIds []log.NodeID) (ServableVersions, error) {
+    client, err := logex.dialPeer(peer)
+    if err != nil {
+        return nil, err
+    }
+    defer client.Close()
+    var response ServableVersions
+    if err := client.Call("LogEx.GetServableVersions", nodeIds, &response); err != nil {
+        return nil, err
+    }
+    return response, nil
+}
@@ -0,0 +1,208 @@
+package logex
+
+import (
+    "io/ioutil"
+    "os"
+    path_ "path"
+    "sync"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const sessionDebug utility.Debug = true
+
+// Sessions are saved every this many entries committed, see LogEx.antiEntropy.
+const sessionCheckpoint = 32
+
+/*
+   Catching up with the entry Target of a node. Fetched holds what was
+   fetched of it and its dependencies but is not committed yet, so that a
+   round cut off by a missing value or a restart resumes there.
+*/
+type AntiEntropySession struct {
+    Target    log.VersionInfo
+    Fetched   map[log.EncodedHash]*log.LogEntry
+    Committed int
+}
+
+// An entry that failed validation. It is not committed again.
+type QuarantinedEntry struct {
+    NodeId      log.NodeID
+    AcceptStamp log.Timestamp
+    Hash        log.EncodedHash
+    Reason      string
+    Since       time.Time
+}
+
+type sessionState struct {
+    Sessions map[log.NodeID]*AntiEntropySession
+    // By quarantineKey.
+    Quarantine map[log.EncodedHash]QuarantinedEntry
+}
+
+/*
+   The signature is not part of the hash of an entry, so a forged copy
+   must not get the genuine one quarantined.
+*/
+func quarantineKey(logEntry *log.LogEntry) log.EncodedHash {
+    buf := append([]byte(logEntry.EncodedHash()), logEntry.Sig...)
+    return log.EncodedHash(utility.GetHashOfBytesAndEncode(buf))
+}
+
+/*
+   The anti-entropy sessions and the quarantine, kept in a file next to
+   the journal.
+*/
+type sessionStore struct {
+    path  string
+    lock  *sync.Mutex
+    state sessionState
+}
+
+func newSessionStore(path string) *sessionStore {
+    store := &sessionStore{path, new(sync.Mutex), sessionState{make(map[log.NodeID]*AntiEntropySession), make(map[log.EncodedHash]QuarantinedEntry)}}
+    if buf, err := ioutil.ReadFile(path); err == nil {
+        var state sessionState
+        if err := utility.GobDecode(buf, &state); err != nil {
+            sessionDebug.Error(err)
+        } else {
+            if state.Sessions != nil {
+                store.state.Sessions = state.Sessions
+            }
+            if state.Quarantine != nil {
+                store.state.Quarantine = state.Quarantine
+            }
+        }
+    } else if !os.IsNotExist(err) {
+        sessionDebug.Error(err)
+    }
+    return store
+}
+
+/*
+   Start catching up with target of nodeId, or resume the session with it.
+   What was fetched for an older target is still of use.
+*/
+func (store *sessionStore) begin(nodeId log.NodeID, target log.VersionInfo) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    session, ok := store.state.Sessions[nodeId]
+    if !ok {
+        session = &AntiEntropySession{target, make(map[log.EncodedHash]*log.LogEntry), 0}
+        store.state.Sessions[nodeId] = session
+    } else if session.Target.AcceptStamp < target.AcceptStamp {
+        session.Target = target
+    } else {
+        sessionDebug.Debugf("Resuming anti-entropy with %v at %v: %v fetched, %v committed", nodeId, session.Target, len(session.Fetched), session.Committed)
+    }
+}
+
+// An entry fetched in any session, nil if there is none.
+func (store *sessionStore) fetchedEntry(encodedHash log.EncodedHash) *log.LogEntry {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    for _, session := range store.state.Sessions {
+        if logEntry, ok := session.Fetched[encodedHash]; ok {
+            return logEntry
+        }
+    }
+    return nil
+}
+
+func (store *sessionStore) fetched(nodeId log.NodeID, logEntry *log.LogEntry) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    if session, ok := store.state.Sessions[nodeId]; ok {
+        session.Fetched[logEntry.EncodedHash()] = logEntry
+    }
+}
+
+func (store *sessionStore) committed(nodeId log.NodeID, encodedHash log.EncodedHash) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    if session, ok := store.state.Sessions[nodeId]; ok {
+        delete(session.Fetched, encodedHash)
+        session.Committed++
+    }
+}
+
+// The session with nodeId reached its target.
+func (store *sessionStore) finish(nodeId log.NodeID) error {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    delete(store.state.Sessions, nodeId)
+    return store.doSave()
+}
+
+/*
+   Keep a round that stopped, to resume it. Entries committed since
+   by other means are dropped.
+*/
+func (store *sessionStore) suspend(theLog log.ILog) error {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    for _, session := range store.state.Sessions {
+        for encodedHash, logEntry := range session.Fetched {
+            if theLog.HasLogEntry(logEntry.NodeId, encodedHash) {
+                delete(session.Fetched, encodedHash)
+            }
+        }
+    }
+    return store.doSave()
+}
+
+// Record why the entry failed validation, and drop it from every session.
+func (store *sessionStore) quarantine(logEntry *log.LogEntry, reason string, now time.Time) error {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    encodedHash := logEntry.EncodedHash()
+    sessionDebug.Debugf("Quarantined %v of %v: %v", encodedHash, logEntry.NodeId, reason)
+    store.state.Quarantine[quarantineKey(logEntry)] = QuarantinedEntry{logEntry.NodeId, logEntry.AcceptStamp, encodedHash, reason, now}
+    for _, session := range store.state.Sessions {
+        delete(session.Fetched, encodedHash)
+    }
+    return store.doSave()
+}
+
+func (store *sessionStore) quarantined(logEntry *log.LogEntry) (QuarantinedEntry, bool) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    quarantined, ok := store.state.Quarantine[quarantineKey(logEntry)]
+    return quarantined, ok
+}
+
+func (store *sessionStore) session(nodeId log.NodeID) (AntiEntropySession, bool) {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    session, ok := store.state.Sessions[nodeId]
+    if !ok {
+        return AntiEntropySession{}, false
+    }
+    return *session, true
+}
+
+// Save the sessions as they are.
+func (store *sessionStore) save() error {
+    store.lock.Lock()
+    defer store.lock.Unlock()
+    return store.doSave()
+}
+
+func (store *sessionStore) doSave() error {
+    file, err := ioutil.TempFile(path_.Dir(store.path), path_.Base(store.path))
+    if err != nil {
+        return sessionDebug.Error(err)
+    }
+    if _, err := file.Write(utility.GobEncode(&store.state)); err != nil {
+        file.Close()
+        return sessionDebug.Error(err)
+    }
+    if err := file.Close(); err != nil {
+        return sessionDebug.Error(err)
+    }
+    if err := os.Rename(file.Name(), store.path); err != nil {
+        return sessionDebug.Error(err)
+    }
+    return nil
+}
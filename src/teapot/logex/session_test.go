@@ -0,0 +1,138 @@
+package logex
+
+import (
+    "fmt"
+    . "launchpad.net/gocheck"
+    "teapot/adaptor"
+    "teapot/conf"
+    "teapot/log"
+    "time"
+)
+
+type SessionSuite struct {
+    dir string
+}
+
+var _ = Suite(&SessionSuite{})
+
+func (s *SessionSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+// A round stopped by a missing value resumes with what it fetched.
+func (s *SessionSuite) TestResumeAntiEntropy(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    storage := make([]adaptor.Adaptor, len(configs))
+    for i, config := range configs {
+        storage[i] = adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage[i]), storage[i])
+    }
+    writer, reader := logEx[0], logEx[1]
+    shareHello(c, writer, logEx)
+    values := make([]log.EncodedHash, 0)
+    for i := 0; i < 5; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(update)), IsNil)
+        values = append(values, update.HashOfValue)
+    }
+    for i := 0; i < 500 && writer.theLog.SyncStatus().Pending != 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(writer.theLog.SyncStatus().Pending, Equals, 0)
+    // Nothing but the buckets to read from, and one value is missing.
+    writer.stopP2P()
+    defer reader.stopP2P()
+    value, err := storage[0].GetBinary(string(values[2]))
+    c.Assert(err, IsNil)
+    c.Assert(storage[0].Delete(string(values[2])), IsNil)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    c.Assert(reader.antiEntropy(writer.myNodeId, *latest), NotNil)
+    // The session survives a restart.
+    session, ok := newSessionStore(reader.sessions.path).session(writer.myNodeId)
+    c.Assert(ok, Equals, true)
+    c.Assert(session.Target, Equals, *latest)
+    // The chmod and the first two updates.
+    c.Assert(session.Committed, Equals, 3)
+    c.Assert(len(session.Fetched), Equals, 3)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, false)
+
+    c.Assert(storage[0].PutBinary(string(values[2]), value), IsNil)
+    c.Assert(reader.antiEntropy(writer.myNodeId, *latest), IsNil)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, true)
+    for _, value := range values {
+        c.Assert(reader.theLog.HasValue(value), Equals, true)
+    }
+    _, ok = newSessionStore(reader.sessions.path).session(writer.myNodeId)
+    c.Assert(ok, Equals, false)
+}
+
+// A round cut off before it could suspend still resumes from its last checkpoint.
+func (s *SessionSuite) TestCheckpoint(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    logEx := make([]*LogEx, len(configs))
+    storage := make([]adaptor.Adaptor, len(configs))
+    for i, config := range configs {
+        storage[i] = adaptor.NewFSAdaptor(s.dir+"/storage", config.MyBucketName)
+        logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage[i]), storage[i])
+    }
+    writer, reader := logEx[0], logEx[1]
+    shareHello(c, writer, logEx)
+    n := sessionCheckpoint + 8
+    values := make([]log.EncodedHash, 0)
+    for i := 0; i < n; i++ {
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/%v", writer.myNodeId, i)), []byte(fmt.Sprintf("world%v", i)))
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(update)), IsNil)
+        values = append(values, update.HashOfValue)
+    }
+    for i := 0; i < 500 && writer.theLog.SyncStatus().Pending != 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(writer.theLog.SyncStatus().Pending, Equals, 0)
+    writer.stopP2P()
+    defer reader.stopP2P()
+    c.Assert(storage[0].Delete(string(values[n-4])), IsNil)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    // As if the node went down before suspending the session.
+    reader.sessions.begin(writer.myNodeId, *latest)
+    c.Assert(reader.catchUp(writer.myNodeId, *latest), NotNil)
+    session, ok := newSessionStore(reader.sessions.path).session(writer.myNodeId)
+    c.Assert(ok, Equals, true)
+    c.Assert(session.Committed, Equals, sessionCheckpoint)
+    // What is left of the chmod and the updates.
+    c.Assert(len(session.Fetched), Equals, n+1-sessionCheckpoint)
+}
+
+// Entries failing validation are quarantined instead of crashing the node.
+func (s *SessionSuite) TestQuarantine(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    writer, reader := logEx[0], logEx[1]
+    update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/hello/0", writer.myNodeId)), []byte("world"))
+    logEntry := writer.theLog.NewLogEntry(update)
+    c.Assert(writer.theLog.Commit(logEntry), IsNil)
+    value, err := writer.theLog.GetValue(update.HashOfValue)
+    c.Assert(err, IsNil)
+    forged := *logEntry
+    forged.Sig = make([]byte, 10)
+    c.Assert(reader.commitRemoteEntry(&forged, value, false), ErrorMatches, ".*verification error.*")
+    quarantined, ok := newSessionStore(reader.sessions.path).quarantined(&forged)
+    c.Assert(ok, Equals, true)
+    c.Assert(quarantined.Hash, Equals, logEntry.EncodedHash())
+    c.Assert(quarantined.Reason, Matches, ".*verification error.*")
+    c.Assert(reader.commitRemoteEntry(&forged, value, false), ErrorMatches, ".* is quarantined: .*verification error.*")
+    // The genuine entry is still welcome.
+    _, ok = reader.sessions.quarantined(logEntry)
+    c.Assert(ok, Equals, false)
+    c.Assert(reader.commitRemoteEntry(logEntry, value, false), IsNil)
+
+    malformed := log.LogEntry{nil, nil, 1, writer.myNodeId, nil}
+    c.Assert(reader.commitRemoteEntry(&malformed, nil, false), ErrorMatches, "Log entry without a message.")
+    _, ok = reader.sessions.quarantined(&malformed)
+    c.Assert(ok, Equals, true)
+    stranger := *logEntry
+    stranger.NodeId = "stranger"
+    c.Assert(reader.commitRemoteEntry(&stranger, nil, false), ErrorMatches, "Log entry of an unknown node .*")
+    _, ok = reader.sessions.quarantined(&stranger)
+    c.Assert(ok, Equals, true)
+}
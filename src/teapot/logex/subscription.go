@@ -0,0 +1,32 @@
+package logex
+
+import (
+    "strings"
+    "teapot/log"
+)
+
+/*
+   The owner/directory prefixes whose values this node replicates, see
+   conf.Subscriptions. Entries are fetched whatever their key, causality
+   needs them all, while values of other directories stay remote.
+*/
+type subscriptions []string
+
+// Whether values under key are replicated. All are without subscriptions.
+func (subscribed subscriptions) covers(key log.Key) bool {
+    if len(subscribed) == 0 {
+        return true
+    }
+    for _, prefix := range subscribed {
+        if string(key) == prefix || strings.HasPrefix(string(key), prefix+"/") {
+            return true
+        }
+    }
+    return false
+}
+
+// Whether the value of logEntry, if it is an update, is replicated.
+func (subscribed subscriptions) wants(logEntry *log.LogEntry) bool {
+    update, ok := logEntry.Message.(*log.Update)
+    return ok && subscribed.covers(update.Key)
+}
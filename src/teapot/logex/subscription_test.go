@@ -0,0 +1,57 @@
+package logex
+
+import (
+    "fmt"
+    . "launchpad.net/gocheck"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+type SubscriptionSuite struct {
+    dir string
+}
+
+var _ = Suite(&SubscriptionSuite{})
+
+func (s *SubscriptionSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+}
+
+func (s *SubscriptionSuite) TestCovers(c *C) {
+    c.Assert(subscriptions(nil).covers("alice/docs/a"), Equals, true)
+    subscribed := subscriptions{"alice/docs", "bob"}
+    c.Assert(subscribed.covers("alice/docs/a"), Equals, true)
+    c.Assert(subscribed.covers("alice/docs2/a"), Equals, false)
+    c.Assert(subscribed.covers("alice/photos/a"), Equals, false)
+    c.Assert(subscribed.covers("bob/photos/a"), Equals, true)
+}
+
+// Every entry comes in, values only of the directories subscribed to.
+func (s *SubscriptionSuite) TestPartialReplication(c *C) {
+    logEx := newIsolatedNodes(s.dir, 2)
+    defer stopNodes(logEx)
+    writer, reader := logEx[0], logEx[1]
+    reader.subscriptions = subscriptions{fmt.Sprintf("%v/docs", writer.myNodeId)}
+    values := make(map[string]log.EncodedHash)
+    for _, dir := range []string{"docs", "photos"} {
+        chmod := writer.theLog.NewChangeMode(log.Dir(dir), utility.KeyFromPassphrase("password"), []log.NodeID{reader.myNodeId}, []log.NodeID{})
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(chmod)), IsNil)
+        update := writer.theLog.NewUpdate(log.Key(fmt.Sprintf("%v/%v/0", writer.myNodeId, dir)), []byte("world"))
+        c.Assert(writer.theLog.Commit(writer.theLog.NewLogEntry(update)), IsNil)
+        values[dir] = update.HashOfValue
+    }
+    c.Assert(reader.p2pAntiEntropy(writer.myNodeId), IsNil)
+    latest := writer.theLog.GetLastEntryInfoOfNode(writer.myNodeId)
+    c.Assert(reader.theLog.HasLogEntry(writer.myNodeId, latest.HashOfUpdate), Equals, true)
+    c.Assert(reader.theLog.HasValue(values["docs"]), Equals, true)
+    c.Assert(reader.theLog.HasValue(values["photos"]), Equals, false)
+    // Nor does the reader try to back up what it lacks.
+    for i := 0; i < 500 && reader.theLog.SyncStatus().Pending != 0; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.Assert(reader.theLog.SyncStatus().Pending, Equals, 0)
+    // Comparing summaries does not bring it either.
+    reader.digestAntiEntropy(writer.myNodeId)
+    c.Assert(reader.theLog.HasValue(values["photos"]), Equals, false)
+}
@@ -0,0 +1,181 @@
+package logex
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/http"
+    "net/rpc"
+    "teapot/conf"
+    "teapot/log"
+    "teapot/utility"
+    "time"
+)
+
+const transportDebug utility.Debug = true
+
+// What a net/rpc server answers to CONNECT, see rpc.DialHTTPPath.
+const rpcConnected = "200 Connected to Go RPC"
+
+// How long connecting to a peer, handshakes included, may take.
+const dialTimeout = 5 * time.Second
+
+/*
+   TLS between nodes, both ends authenticated by their node key. Every
+   node presents a certificate it signed itself for its node id, and the
+   other end only takes it if its key is the one in the configuration.
+*/
+type transport struct {
+    certificate tls.Certificate
+    publicKeys  map[string]*rsa.PublicKey
+    // Nodes whose requests are refused.
+    blocked func(nodeId log.NodeID) bool
+}
+
+func newTransport(config *conf.Config, blocked func(nodeId log.NodeID) bool) (*transport, error) {
+    certificate, err := selfSignedCertificate(config.MyNodeId, config.PrivateKey)
+    if err != nil {
+        return nil, transportDebug.Error(err)
+    }
+    return &transport{certificate, config.PublicKeys, blocked}, nil
+}
+
+func selfSignedCertificate(nodeId string, privateKey *rsa.PrivateKey) (tls.Certificate, error) {
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    template := &x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{CommonName: nodeId},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(100 * 365 * 24 * time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}, nil
+}
+
+/*
+   Check the certificate of the other end against the configured key of
+   the node it names, which must be expected unless expected is "".
+*/
+func (t *transport) verify(expected log.NodeID) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+    return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+        if len(rawCerts) == 0 {
+            return transportDebug.Error(errors.New("No certificate presented."))
+        }
+        certificate, err := x509.ParseCertificate(rawCerts[0])
+        if err != nil {
+            return transportDebug.Error(err)
+        }
+        nodeId := log.NodeID(certificate.Subject.CommonName)
+        if expected != "" && nodeId != expected {
+            return transportDebug.Error(errors.New(fmt.Sprintf("Expected %v, %v answered.", expected, nodeId)))
+        }
+        publicKey, ok := t.publicKeys[string(nodeId)]
+        if !ok {
+            return transportDebug.Error(errors.New(fmt.Sprintf("Unknown node %v.", nodeId)))
+        }
+        presented, ok := certificate.PublicKey.(*rsa.PublicKey)
+        if !ok || presented.N.Cmp(publicKey.N) != 0 || presented.E != publicKey.E {
+            return transportDebug.Error(errors.New(fmt.Sprintf("Certificate of %v does not match its key.", nodeId)))
+        }
+        if t.blocked(nodeId) {
+            return transportDebug.Error(errors.New(fmt.Sprintf("Node %v is blacklisted.", nodeId)))
+        }
+        return nil
+    }
+}
+
+func (t *transport) serverConfig() *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{t.certificate},
+        // Chains are not verified, keys are pinned by verify.
+        ClientAuth:            tls.RequireAnyClientCert,
+        VerifyPeerCertificate: t.verify(""),
+        MinVersion:            tls.VersionTLS12,
+    }
+}
+
+func (t *transport) clientConfig(peer log.NodeID) *tls.Config {
+    return &tls.Config{
+        Certificates: []tls.Certificate{t.certificate},
+        // Chains are not verified, keys are pinned by verify.
+        InsecureSkipVerify:    true,
+        VerifyPeerCertificate: t.verify(peer),
+        MinVersion:            tls.VersionTLS12,
+    }
+}
+
+func (t *transport) listen(address string) (net.Listener, error) {
+    return tls.Listen("tcp", address, t.serverConfig())
+}
+
+// Like rpc.DialHTTPPath, over TLS.
+func (t *transport) dial(peer log.NodeID, address string) (*rpc.Client, error) {
+    conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, t.clientConfig(peer))
+    if err != nil {
+        return nil, err
+    }
+    // A peer that takes the connection and never answers must not hold us.
+    conn.SetDeadline(time.Now().Add(dialTimeout))
+    path := "/" + string(peer)
+    io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+    response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+    if err == nil && response.Status == rpcConnected {
+        conn.SetDeadline(time.Time{})
+        return rpc.NewClient(conn), nil
+    }
+    if err == nil {
+        err = errors.New("unexpected HTTP response: " + response.Status)
+    }
+    conn.Close()
+    return nil, err
+}
+
+/*
+   The server side of dial: complete the handshake of conn and answer the
+   CONNECT to nodeId. Returns the node at the other end.
+*/
+func (t *transport) accept(conn net.Conn, nodeId log.NodeID) (log.NodeID, error) {
+    tlsConn, ok := conn.(*tls.Conn)
+    if !ok {
+        return "", errors.New("not a TLS connection")
+    }
+    // A peer that connects and never says anything must not hold us either.
+    conn.SetDeadline(time.Now().Add(dialTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        return "", err
+    }
+    // verify made sure there is one, and that it is a known node's.
+    caller := log.NodeID(tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+    request, err := http.ReadRequest(bufio.NewReader(conn))
+    if err != nil {
+        return "", err
+    }
+    if request.Method != "CONNECT" || request.URL.Path != "/"+string(nodeId) {
+        io.WriteString(conn, "HTTP/1.0 405 must CONNECT\n")
+        return "", errors.New("unexpected HTTP request: " + request.Method + " " + request.URL.Path)
+    }
+    io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+    conn.SetDeadline(time.Time{})
+    return caller, nil
+}
+
+// Connect to the P2P server of peer.
+func (logex *LogEx) dialPeer(peer log.NodeID) (*rpc.Client, error) {
+    return logex.transport.dial(peer, logex.nodeIPMap[peer])
+}
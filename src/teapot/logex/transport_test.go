@@ -0,0 +1,102 @@
+package logex
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/tls"
+    "fmt"
+    . "launchpad.net/gocheck"
+    "net"
+    "net/rpc"
+    "teapot/adaptor"
+    "teapot/conf"
+    "teapot/log"
+    "time"
+)
+
+type TransportSuite struct {
+    dir   string
+    logEx []*LogEx
+}
+
+var _ = Suite(&TransportSuite{})
+
+func (s *TransportSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    s.logEx = make([]*LogEx, len(configs))
+    for i, config := range configs {
+        storage := adaptor.NewFSAdaptor(fmt.Sprintf("%v/storage%v", s.dir, i), config.MyBucketName)
+        s.logEx[i] = NewLogExWithAdaptor(config, log.NewLogWithAdaptor(config, storage), storage)
+    }
+}
+
+func (s *TransportSuite) TearDownTest(c *C) {
+    for _, logEx := range s.logEx {
+        logEx.stopP2P()
+    }
+}
+
+func (s *TransportSuite) call(client *rpc.Client, err error) error {
+    if err != nil {
+        return err
+    }
+    defer client.Close()
+    var response KnownVersions
+    return client.Call("LogEx.GetKnownVersions", []log.NodeID{}, &response)
+}
+
+// A transport presenting nodeId with a key of its own.
+func (s *TransportSuite) impostor(c *C, nodeId log.NodeID) *transport {
+    privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    c.Assert(err, IsNil)
+    certificate, err := selfSignedCertificate(string(nodeId), privateKey)
+    c.Assert(err, IsNil)
+    return &transport{certificate, s.logEx[1].config.PublicKeys, func(log.NodeID) bool { return false }}
+}
+
+func (s *TransportSuite) TestMutualAuthentication(c *C) {
+    server, peer := s.logEx[0], s.logEx[1]
+    address := peer.nodeIPMap[server.myNodeId]
+    c.Assert(s.call(peer.dialPeer(server.myNodeId)), IsNil)
+    // Plain HTTP is not served.
+    c.Assert(s.call(rpc.DialHTTPPath("tcp", address, "/"+string(server.myNodeId))), NotNil)
+    // Nor is a node the server does not know, or one without its key.
+    c.Assert(s.call(s.impostor(c, "somebody_else").dial(server.myNodeId, address)), NotNil)
+    c.Assert(s.call(s.impostor(c, peer.myNodeId).dial(server.myNodeId, address)), NotNil)
+    // The server must be the node asked for.
+    c.Assert(s.call(peer.transport.dial(peer.myNodeId, address)), ErrorMatches, ".*answered.*")
+}
+
+func (s *TransportSuite) TestBlacklisted(c *C) {
+    server, peer := s.logEx[0], s.logEx[1]
+    server.transport.blocked = func(nodeId log.NodeID) bool { return nodeId == peer.myNodeId }
+    c.Assert(s.call(peer.dialPeer(server.myNodeId)), NotNil)
+    server.transport.blocked = server.theLog.Blocked
+    c.Assert(s.call(peer.dialPeer(server.myNodeId)), IsNil)
+}
+
+// Peers that connect and say nothing, before or after the handshake, are hung up on.
+func (s *TransportSuite) TestSilentPeer(c *C) {
+    server, peer := s.logEx[0], s.logEx[1]
+    address := peer.nodeIPMap[server.myNodeId]
+    hungUp := func(conn net.Conn) {
+        defer conn.Close()
+        conn.SetReadDeadline(time.Now().Add(2 * dialTimeout))
+        start := time.Now()
+        _, err := conn.Read(make([]byte, 1))
+        c.Assert(err, NotNil)
+        c.Assert(time.Since(start) < 2*dialTimeout, Equals, true)
+    }
+    conn, err := net.Dial("tcp", address)
+    c.Assert(err, IsNil)
+    hungUp(conn)
+    tlsConn, err := tls.Dial("tcp", address, peer.transport.clientConfig(server.myNodeId))
+    c.Assert(err, IsNil)
+    hungUp(tlsConn)
+    // Once connected, a quiet peer is not hung up on.
+    client, err := peer.dialPeer(server.myNodeId)
+    c.Assert(err, IsNil)
+    time.Sleep(dialTimeout + time.Second)
+    c.Assert(s.call(client, nil), IsNil)
+}
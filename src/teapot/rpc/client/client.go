@@ -4,6 +4,7 @@ import (
     "net/rpc"
     "teapot/conf"
     "teapot/log"
+    "teapot/logex"
     . "teapot/rpc"
     "teapot/utility"
 )
@@ -48,6 +49,34 @@ func (c *Client) LS() ([]log.Key, error) {
     return response.Keys, nil
 }
 
+func (c *Client) SyncStatus() (*log.SyncStatus, error) {
+    client, err := rpc.Dial("tcp", c.addr)
+    if err != nil {
+        return nil, clientDebug.Error(err)
+    }
+    defer client.Close()
+    request := SyncStatusRequest{}
+    var response SyncStatusResponse
+    if err := client.Call("TeapotServer.SyncStatus", request, &response); err != nil {
+        return nil, clientDebug.Error(err)
+    }
+    return &response.Status, nil
+}
+
+func (c *Client) Freshness() ([]logex.FreshnessViolation, error) {
+    client, err := rpc.Dial("tcp", c.addr)
+    if err != nil {
+        return nil, clientDebug.Error(err)
+    }
+    defer client.Close()
+    request := FreshnessRequest{}
+    var response FreshnessResponse
+    if err := client.Call("TeapotServer.Freshness", request, &response); err != nil {
+        return nil, clientDebug.Error(err)
+    }
+    return response.Violations, nil
+}
+
 func (c *Client) Put(key log.Key, value []byte) error {
     client, err := rpc.Dial("tcp", c.addr)
     if err != nil {
@@ -2,6 +2,7 @@ package rpc
 
 import (
     "teapot/log"
+    "teapot/logex"
 )
 
 type GetRequest struct {
@@ -47,6 +48,20 @@ type LSResponse struct {
     Keys []log.Key
 }
 
+type SyncStatusRequest struct {
+}
+
+type SyncStatusResponse struct {
+    Status log.SyncStatus
+}
+
+type FreshnessRequest struct {
+}
+
+type FreshnessResponse struct {
+    Violations []logex.FreshnessViolation
+}
+
 type ChangeModeRequest struct {
     Directory log.Dir
     SecretKey log.SecretKey
@@ -17,13 +17,16 @@ type TeapotServer struct {
     listener net.Listener
 }
 
-func NewTeapotServer(config *conf.Config) *TeapotServer {
-    t := teapot.NewTeapot(config)
+func NewTeapotServer(config *conf.Config) (*TeapotServer, error) {
+    t, err := teapot.NewTeapot(config)
+    if err != nil {
+        return nil, serverDebug.Error(err)
+    }
     return &TeapotServer{
         config.DaemonPort,
         t,
         nil,
-    }
+    }, nil
 }
 
 func StartServer(server *TeapotServer) {
@@ -70,6 +73,16 @@ func (s *TeapotServer) LS(request LSRequest, response *LSResponse) error {
     return nil
 }
 
+func (s *TeapotServer) SyncStatus(request SyncStatusRequest, response *SyncStatusResponse) error {
+    response.Status = s.teapot.SyncStatus()
+    return nil
+}
+
+func (s *TeapotServer) Freshness(request FreshnessRequest, response *FreshnessResponse) error {
+    response.Violations = s.teapot.Freshness()
+    return nil
+}
+
 func (s *TeapotServer) GetVersions(request VersionRequest, response *VersionResponse) error {
     versions, err := s.teapot.GetVersions()
     if err != nil {
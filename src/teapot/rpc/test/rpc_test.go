@@ -26,7 +26,8 @@ func (s *RPCSuite) SetUpSuite(c *C) {
 func (s *RPCSuite) TestRPC(c *C) {
     config := conf.LoadTest(s.dir, 0)
     cl := client.NewClient(config)
-    se := server.NewTeapotServer(config)
+    se, err := server.NewTeapotServer(config)
+    c.Assert(err, IsNil)
     server.AsyncStartServer(se)
     c.Assert(cl.Put(log.Key(config.MyNodeId+"/hello/0"), []byte("world")), IsNil)
     values, err := cl.Get(log.Key(config.MyNodeId + "/hello/0"))
@@ -42,6 +43,13 @@ func (s *RPCSuite) TestRPC(c *C) {
     // test GC
     now := time.Now().Unix()
     c.Assert(cl.GC(), IsNil)
+    // test SyncStatus
+    _, err = cl.SyncStatus()
+    c.Assert(err, IsNil)
+    // test Freshness
+    violations, err := cl.Freshness()
+    c.Assert(err, IsNil)
+    c.Assert(len(violations), Equals, 0)
     // test GetVersions
     versions, err := cl.GetVersions()
     c.Assert(err, IsNil)
@@ -12,6 +12,8 @@ package teapot
 
 import (
     "errors"
+    "fmt"
+    "teapot/adaptor"
     "teapot/conf"
     "teapot/log"
     "teapot/logex"
@@ -33,6 +35,8 @@ type ITeapot interface {
     ChangeMode(directory log.Dir, newKey log.SecretKey, readers []log.NodeID, writers []log.NodeID) error
     GC() error
     LS() []log.Key
+    SyncStatus() log.SyncStatus
+    Freshness() []logex.FreshnessViolation
 }
 
 type Teapot struct {
@@ -40,27 +44,42 @@ type Teapot struct {
     logEx logex.ILogEx
 }
 
+// Bounds, in seconds, of the interval between two gossip rounds with a quiet peer.
 var defaultLogExInterval int = 10
-var logExInterval int = defaultLogExInterval
 var logExUpperBound int = 64 * defaultLogExInterval
 
-func NewTeapot(config *conf.Config) *Teapot {
-    l := log.NewLog(config)
-    le := logex.NewLogEx(config, l)
+// Gossip with a due peer no sooner than this after the previous round.
+const minGossipWait = time.Second
 
+func NewTeapot(config *conf.Config) (*Teapot, error) {
+    // One adaptor per Teapot instance, shared by its log and log exchange.
+    theAdaptor, err := adaptor.New(config, config.MyBucketName)
+    if err != nil {
+        return nil, teapotDebug.Error(err)
+    }
+    l := log.NewLogWithAdaptor(config, theAdaptor)
+    if l == nil {
+        // The log tells why.
+        return nil, teapotDebug.Error(errors.New("Unable to rebuild the log."))
+    }
+    le := logex.NewLogExWithAdaptor(config, l, theAdaptor)
+
+    le.SetGossipIntervals(time.Duration(defaultLogExInterval)*time.Second, time.Duration(logExUpperBound)*time.Second)
     go func() {
         for {
-            if !le.BackgroundGossip() {
-                if logExInterval < logExUpperBound {
-                    logExInterval *= 2
-                }
-            } else {
-                logExInterval = defaultLogExInterval
+            le.BackgroundGossip()
+            wait := le.NextGossip().Sub(time.Now())
+            if wait < minGossipWait {
+                wait = minGossipWait
+            }
+            select {
+            case <-le.Notified():
+                // A peer committed something, go fetch it.
+            case <-time.After(wait):
             }
-            time.Sleep(time.Duration(logExInterval) * time.Second)
         }
     }()
-    return &Teapot{l, le}
+    return &Teapot{l, le}, nil
 }
 
 func (teapot *Teapot) GetVersions() ([]string, error) {
@@ -75,6 +94,15 @@ func (teapot *Teapot) GC() error {
     return teapot.log.GC()
 }
 
+func (teapot *Teapot) SyncStatus() log.SyncStatus {
+    return teapot.log.SyncStatus()
+}
+
+// Buckets of other nodes caught serving a stale or rolled back view.
+func (teapot *Teapot) Freshness() []logex.FreshnessViolation {
+    return teapot.logEx.Freshness()
+}
+
 func (teapot *Teapot) LS() []log.Key {
     return teapot.log.LS()
 }
@@ -97,6 +125,7 @@ func (teapot *Teapot) Put(key log.Key, object []byte) error {
     if err := teapot.log.AsyncHandle(logEntry); err != nil {
         return teapotDebug.Error(err)
     }
+    teapot.logEx.NotifyPeers()
     return nil
 }
 
@@ -138,18 +167,58 @@ func (teapot *Teapot) ChangeMode(directory log.Dir, newKey log.SecretKey, reader
     if err := teapot.log.AsyncHandle(logEntry); err != nil {
         return teapotDebug.Error(err)
     }
+    teapot.logEx.NotifyPeers()
     return nil
 }
 
+// A value missing locally that neither its writer's bucket nor peers could serve. Try again later.
+var ErrValueTemporarilyUnavailable = errors.New("Value temporarily unavailable.")
+
+/*
+   The value of Key written by NodeId could not be fetched, Err tells why.
+   It is ErrValueTemporarilyUnavailable for errors.Is.
+*/
+type ValueUnavailableError struct {
+    Key    log.Key
+    NodeId log.NodeID
+    Err    error
+}
+
+func (err *ValueUnavailableError) Error() string {
+    return fmt.Sprintf("Value temporarily unavailable. Neither the bucket of %v nor peers could serve %v: %v", err.NodeId, err.Key, err.Err)
+}
+
+func (err *ValueUnavailableError) Unwrap() error {
+    return err.Err
+}
+
+func (err *ValueUnavailableError) Is(target error) bool {
+    return target == ErrValueTemporarilyUnavailable
+}
+
+/*
+   Read the values of logEntries, fetching those missing locally. A value
+   that cannot be fetched or read is skipped; the error only tells why
+   none was read.
+*/
 func (teapot *Teapot) getValues(logEntries []*log.LogEntry) ([][]byte, error) {
     defer utility.RecordTime("Teapot getvalues latency: %v", time.Now().UnixNano())
     values := make([][]byte, 0)
+    var unavailable error
     for _, logEntry := range logEntries {
         update, ok := logEntry.Message.(*log.Update)
         if !ok {
             return nil, teapotDebug.Error(errors.New("Non-update in checkpoint"))
         }
         value, err := teapot.log.GetDecryptValue(update, logEntry.DVV)
+        if err == log.ErrValueNotAvailable {
+            // Not replicated here, or not fetched yet.
+            if fetchErr := teapot.logEx.FetchValue(logEntry.NodeId, update.HashOfValue); fetchErr != nil {
+                unavailable = teapotDebug.Error(&ValueUnavailableError{update.Key, logEntry.NodeId, fetchErr})
+                continue
+            }
+            value, err = teapot.log.GetDecryptValue(update, logEntry.DVV)
+        }
         if err == nil {
             teapotDebug.Debugf("Teapot get size: %v", len(value))
             values = append(values, value)
@@ -159,17 +228,12 @@ func (teapot *Teapot) getValues(logEntries []*log.LogEntry) ([][]byte, error) {
                 return nil, teapotDebug.Error(err)
             }
         }
-        // TODO read from remote.
-        /*value, err = teapot.logEx.GetValue(logEntry.NodeId, update.HashOfValue)
-          if err == nil {
-              values = append(values, value)
-              continue
-          } else {
-              teapotDebug.Error(err)
-          }*/
         teapotDebug.Debugf("The value is probably lost or you don't have access to this value.")
     }
     if len(values) == 0 {
+        if unavailable != nil {
+            return nil, unavailable
+        }
         teapotDebug.Debugf("Not any value read due to value missing from store or access denied.")
         return nil, errors.New("Read Access Denied.")
     }
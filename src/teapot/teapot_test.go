@@ -1,8 +1,11 @@
 package teapot
 
 import (
+    "errors"
     . "launchpad.net/gocheck"
+    "os"
     "strconv"
+    "teapot/adaptor"
     "teapot/conf"
     "teapot/log"
     "teapot/utility"
@@ -24,14 +27,14 @@ func (s *TeapotSuite) SetUpSuite(c *C) {
     s.n = 3
     s.dir = c.MkDir()
     defaultLogExInterval = 1
-    logExInterval = 1
     logExUpperBound = 4
 }
 
 func (s *TeapotSuite) TestTeapot(c *C) {
     config := conf.LoadTest(s.dir, 0)
-    teapot := NewTeapot(config)
-    err := teapot.Put(log.Key(config.MyNodeId+"/default/hello"), []byte("world"))
+    teapot, err := NewTeapot(config)
+    c.Assert(err, IsNil)
+    err = teapot.Put(log.Key(config.MyNodeId+"/default/hello"), []byte("world"))
     c.Assert(err, IsNil)
     data, err := teapot.Get(log.Key(config.MyNodeId + "/default/hello"))
     c.Assert(err, IsNil)
@@ -41,9 +44,19 @@ func (s *TeapotSuite) TestTeapot(c *C) {
     c.Assert(err, ErrorMatches, "The key doesn't exist.*")
 }
 
+// A storage backend that cannot be set up is reported.
+func (s *TeapotSuite) TestBadBackend(c *C) {
+    config := conf.LoadTest(s.dir, 0)
+    config.StorageBackend = "nowhere"
+    teapot, err := NewTeapot(config)
+    c.Assert(teapot, IsNil)
+    c.Assert(err, ErrorMatches, "Unknown storage backend: nowhere")
+}
+
 func (s *TeapotSuite) TestComplexTeapot(c *C) {
     config := conf.LoadTest(s.dir, 0)
-    teapot := NewTeapot(config)
+    teapot, err := NewTeapot(config)
+    c.Assert(err, IsNil)
     for i := 0; i < 5; i++ {
         err := teapot.Put(log.Key(config.MyNodeId+"/default/hello"), []byte("world"+strconv.Itoa(i)))
         c.Assert(err, IsNil)
@@ -70,8 +83,8 @@ func (s *TeapotSuite) TestMultipleClientTeapot(c *C) {
     configs := conf.LoadMultipleTest(s.dir, s.n)
     teapots := make([]*Teapot, 0)
     for _, config := range configs {
-        teapot := NewTeapot(config)
-        c.Assert(teapot, NotNil)
+        teapot, err := NewTeapot(config)
+        c.Assert(err, IsNil)
         teapots = append(teapots, teapot)
     }
     for i := 0; i < s.n; i++ {
@@ -151,3 +164,61 @@ func (s *TeapotSuite) TestMultipleClientTeapot(c *C) {
         }
     }
 }
+
+// Values of directories not subscribed to are fetched when read.
+func (s *TeapotSuite) TestLazyGet(c *C) {
+    configs := conf.LoadMultipleTest(s.dir, 2)
+    for _, config := range configs {
+        config.StorageBackend = conf.FSBackend
+        config.StorageDir = s.dir + "/lazystorage"
+    }
+    configs[1].Subscriptions = []string{configs[1].MyNodeId}
+    writer, err := NewTeapot(configs[0])
+    c.Assert(err, IsNil)
+    reader, err := NewTeapot(configs[1])
+    c.Assert(err, IsNil)
+    c.Assert(writer.ChangeMode("default", utility.KeyFromPassphrase("password"), []log.NodeID{log.NodeID(configs[1].MyNodeId)}, []log.NodeID{}), IsNil)
+    key := log.Key(configs[0].MyNodeId + "/default/hello")
+    waitFor := func(value string) *log.LogEntry {
+        c.Assert(writer.Put(key, []byte(value)), IsNil)
+        logEntries, err := writer.log.GetCheckpoint(key)
+        c.Assert(err, IsNil)
+        latest := logEntries[0]
+        for i := 0; i < 200 && !reader.log.HasLogEntry(latest.NodeId, latest.EncodedHash()); i++ {
+            time.Sleep(100 * time.Millisecond)
+        }
+        c.Assert(reader.log.HasLogEntry(latest.NodeId, latest.EncodedHash()), Equals, true)
+        for i := 0; i < 500 && writer.SyncStatus().Pending != 0; i++ {
+            time.Sleep(10 * time.Millisecond)
+        }
+        return latest
+    }
+    first := waitFor("world")
+    update := first.Message.(*log.Update)
+    c.Assert(reader.log.HasValue(update.HashOfValue), Equals, false)
+    data, err := reader.Get(key)
+    c.Assert(err, IsNil)
+    c.Assert(string(data[0]), Equals, "world")
+    c.Assert(reader.log.HasValue(update.HashOfValue), Equals, true)
+
+    // Gone from the bucket and from the writer.
+    second := waitFor("world2")
+    update = second.Message.(*log.Update)
+    storage, err := adaptor.New(configs[0], configs[0].MyBucketName)
+    c.Assert(err, IsNil)
+    c.Assert(storage.Delete(string(update.HashOfValue)), IsNil)
+    c.Assert(os.Remove(configs[0].ValueDir+"/"+string(update.HashOfValue)), IsNil)
+    _, err = reader.Get(key)
+    c.Assert(err, ErrorMatches, "Value temporarily unavailable.*")
+    c.Assert(errors.Is(err, ErrValueTemporarilyUnavailable), Equals, true)
+    c.Assert(errors.Is(err, log.ErrValueNotAvailable), Equals, false)
+    unavailable, ok := err.(*ValueUnavailableError)
+    c.Assert(ok, Equals, true)
+    c.Assert(unavailable.Key, Equals, key)
+    c.Assert(unavailable.Err, NotNil)
+    // Only the version that cannot be fetched is skipped.
+    data, err = reader.getValues([]*log.LogEntry{second, first})
+    c.Assert(err, IsNil)
+    c.Assert(len(data), Equals, 1)
+    c.Assert(string(data[0]), Equals, "world")
+}
@@ -0,0 +1,157 @@
+package utility
+
+import (
+    "math/rand"
+    "sync"
+    "time"
+)
+
+/*
+   Exponential backoff with jitter.
+   The n-th delay is drawn uniformly from [d/2, d], where
+   d = min(Initial * 2^n, Max), so that nodes failing at the same time
+   don't retry at the same time.
+*/
+type Backoff struct {
+    Initial time.Duration
+    Max     time.Duration
+    attempt uint
+}
+
+func NewBackoff(initial, max time.Duration) *Backoff {
+    return &Backoff{initial, max, 0}
+}
+
+// The delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+    d := b.Initial << b.attempt
+    if d > b.Max || d < b.Initial {
+        d = b.Max
+    } else {
+        b.attempt++
+    }
+    half := int64(d / 2)
+    if half <= 0 {
+        return d
+    }
+    return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Start over from Initial, e.g. after a success.
+func (b *Backoff) Reset() {
+    b.attempt = 0
+}
+
+type BreakerState int
+
+const (
+    // Requests go through.
+    BreakerClosed BreakerState = iota
+    // Requests are held back until the cool down is over.
+    BreakerOpen
+    // One trial request is let through.
+    BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+    switch state {
+    case BreakerClosed:
+        return "closed"
+    case BreakerOpen:
+        return "open"
+    case BreakerHalfOpen:
+        return "half open"
+    }
+    return "unknown"
+}
+
+/*
+   A circuit breaker.
+   It opens after threshold consecutive failures, or at once on Trip.
+   After cooldown it becomes half open and lets one request through,
+   which either closes it again or reopens it.
+*/
+type CircuitBreaker struct {
+    lock      *sync.Mutex
+    state     BreakerState
+    failures  int
+    threshold int
+    cooldown  time.Duration
+    openedAt  time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+    return &CircuitBreaker{
+        new(sync.Mutex),
+        BreakerClosed,
+        0,
+        threshold,
+        cooldown,
+        time.Time{},
+    }
+}
+
+// Whether a request may be sent now.
+func (cb *CircuitBreaker) Allow() bool {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.cooldown {
+        cb.state = BreakerHalfOpen
+    }
+    return cb.state != BreakerOpen
+}
+
+func (cb *CircuitBreaker) Success() {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    cb.state = BreakerClosed
+    cb.failures = 0
+}
+
+func (cb *CircuitBreaker) Failure() {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    cb.failures++
+    if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+        cb.open()
+    }
+}
+
+// Open the breaker regardless of the number of failures.
+func (cb *CircuitBreaker) Trip() {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    cb.failures++
+    cb.open()
+}
+
+func (cb *CircuitBreaker) open() {
+    cb.state = BreakerOpen
+    cb.openedAt = time.Now()
+}
+
+// Time left until the breaker lets a trial request through.
+func (cb *CircuitBreaker) RetryIn() time.Duration {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    if cb.state != BreakerOpen {
+        return 0
+    }
+    if left := cb.cooldown - time.Since(cb.openedAt); left > 0 {
+        return left
+    }
+    return 0
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    return cb.state
+}
+
+// Consecutive failures since the last success.
+func (cb *CircuitBreaker) Failures() int {
+    cb.lock.Lock()
+    defer cb.lock.Unlock()
+    return cb.failures
+}
@@ -0,0 +1,40 @@
+package utility
+
+import (
+    . "launchpad.net/gocheck"
+    "time"
+)
+
+func (s *S) TestBackoff(c *C) {
+    b := NewBackoff(10*time.Millisecond, 100*time.Millisecond)
+    for _, expected := range []time.Duration{10, 20, 40, 80, 100, 100} {
+        d := b.Next()
+        c.Assert(d >= expected*time.Millisecond/2, Equals, true)
+        c.Assert(d <= expected*time.Millisecond, Equals, true)
+    }
+    b.Reset()
+    c.Assert(b.Next() <= 10*time.Millisecond, Equals, true)
+}
+
+func (s *S) TestCircuitBreaker(c *C) {
+    cb := NewCircuitBreaker(2, 20*time.Millisecond)
+    c.Assert(cb.Allow(), Equals, true)
+    cb.Failure()
+    c.Assert(cb.State(), Equals, BreakerClosed)
+    cb.Failure()
+    c.Assert(cb.State(), Equals, BreakerOpen)
+    c.Assert(cb.Allow(), Equals, false)
+    time.Sleep(cb.RetryIn())
+    c.Assert(cb.Allow(), Equals, true)
+    c.Assert(cb.State(), Equals, BreakerHalfOpen)
+    // A failed trial opens it again.
+    cb.Failure()
+    c.Assert(cb.State(), Equals, BreakerOpen)
+    time.Sleep(cb.RetryIn())
+    c.Assert(cb.Allow(), Equals, true)
+    cb.Success()
+    c.Assert(cb.State(), Equals, BreakerClosed)
+    c.Assert(cb.Failures(), Equals, 0)
+    cb.Trip()
+    c.Assert(cb.State(), Equals, BreakerOpen)
+}
@@ -5,25 +5,15 @@ import (
     "crypto/sha256"
     "encoding/base64"
     "errors"
-    "hash"
 )
 
 const hashDebug Debug = true
 
-var shaHasher hash.Hash
-
-func init() {
-    shaHasher = sha256.New()
-}
-
 // Get the hash of a binary chunk. The binary is usually the encoding of an object.
+// Safe for concurrent use, replicated storage verifies objects in parallel.
 func GetHashOfBytes(buf []byte) []byte {
-    shaHasher.Reset()
-    _, err := shaHasher.Write(buf)
-    if err != nil {
-        hashDebug.Panicf("Computer hash error: %v", err.Error())
-    }
-    return shaHasher.Sum(nil)
+    hash := sha256.Sum256(buf)
+    return hash[:]
 }
 
 // Get the hash of a binary chunk and encode the binary hash into base64 encoded String.
@@ -0,0 +1,8 @@
+package utility
+
+/*
+   What node ids and directories in keys are made of, see
+   log.ValidateKey. Anything naming them, subscriptions for instance,
+   must take the same.
+*/
+const KeyNamePattern = "[[:alnum:]_]+"
@@ -0,0 +1,270 @@
+package utility
+
+import (
+    "errors"
+)
+
+const reedSolomonDebug Debug = true
+
+/*
+   Arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+   gfExp is doubled so that gfExp[log a + log b] needs no modulo.
+*/
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+    x := 1
+    for i := 0; i < 255; i++ {
+        gfExp[i] = byte(x)
+        gfExp[i+255] = byte(x)
+        gfLog[x] = i
+        x <<= 1
+        if x&0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+}
+
+func gfMul(a, b byte) byte {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+    return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+    result := byte(1)
+    for i := 0; i < n; i++ {
+        result = gfMul(result, a)
+    }
+    return result
+}
+
+// dst += c * src
+func gfMulAdd(dst, src []byte, c byte) {
+    if c == 0 {
+        return
+    }
+    logC := gfLog[c]
+    for i, b := range src {
+        if b != 0 {
+            dst[i] ^= gfExp[logC+gfLog[b]]
+        }
+    }
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+    m := make(gfMatrix, rows)
+    for r := range m {
+        m[r] = make([]byte, cols)
+    }
+    return m
+}
+
+func (m gfMatrix) multiply(other gfMatrix) gfMatrix {
+    result := newGFMatrix(len(m), len(other[0]))
+    for r := range m {
+        for c := range other[0] {
+            var v byte
+            for i := range other {
+                v ^= gfMul(m[r][i], other[i][c])
+            }
+            result[r][c] = v
+        }
+    }
+    return result
+}
+
+// Gauss-Jordan elimination of a square matrix.
+func (m gfMatrix) invert() (gfMatrix, error) {
+    n := len(m)
+    work := newGFMatrix(n, 2*n)
+    for r := 0; r < n; r++ {
+        copy(work[r], m[r])
+        work[r][n+r] = 1
+    }
+    for c := 0; c < n; c++ {
+        pivot := c
+        for pivot < n && work[pivot][c] == 0 {
+            pivot++
+        }
+        if pivot == n {
+            return nil, errors.New("Singular matrix.")
+        }
+        work[c], work[pivot] = work[pivot], work[c]
+        inv := gfInv(work[c][c])
+        for i := range work[c] {
+            work[c][i] = gfMul(work[c][i], inv)
+        }
+        for r := 0; r < n; r++ {
+            if r != c && work[r][c] != 0 {
+                gfMulAdd(work[r], work[c], work[r][c])
+            }
+        }
+    }
+    result := newGFMatrix(n, n)
+    for r := 0; r < n; r++ {
+        copy(result[r], work[r][n:])
+    }
+    return result, nil
+}
+
+/*
+   A systematic Reed-Solomon code: data is cut into dataShards shards and
+   parityShards more are computed, so that any dataShards of them
+   rebuild the data.
+*/
+type ReedSolomon struct {
+    dataShards   int
+    parityShards int
+    // The first dataShards rows are the identity.
+    matrix gfMatrix
+}
+
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+    if dataShards < 1 || parityShards < 0 || dataShards+parityShards > 256 {
+        return nil, reedSolomonDebug.Error(errors.New("Invalid number of shards."))
+    }
+    n := dataShards + parityShards
+    // Any dataShards rows of a Vandermonde matrix are independent,
+    // and so are they after turning its top into the identity.
+    vandermonde := newGFMatrix(n, dataShards)
+    for r := 0; r < n; r++ {
+        for c := 0; c < dataShards; c++ {
+            vandermonde[r][c] = gfPow(byte(r), c)
+        }
+    }
+    top, err := vandermonde[:dataShards].invert()
+    if err != nil {
+        return nil, reedSolomonDebug.Error(err)
+    }
+    return &ReedSolomon{dataShards, parityShards, vandermonde.multiply(top)}, nil
+}
+
+func (rs *ReedSolomon) DataShards() int {
+    return rs.dataShards
+}
+
+func (rs *ReedSolomon) TotalShards() int {
+    return rs.dataShards + rs.parityShards
+}
+
+/*
+   Cut data into equally sized data shards, the last one padded with
+   zeros, and allocate the parity shards. Encode fills the parity.
+*/
+func (rs *ReedSolomon) Split(data []byte) [][]byte {
+    shardSize := (len(data) + rs.dataShards - 1) / rs.dataShards
+    if shardSize == 0 {
+        shardSize = 1
+    }
+    shards := make([][]byte, rs.TotalShards())
+    for i := range shards {
+        shards[i] = make([]byte, shardSize)
+        if i < rs.dataShards && i*shardSize < len(data) {
+            copy(shards[i], data[i*shardSize:])
+        }
+    }
+    return shards
+}
+
+// Compute the parity shards from the data shards.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+    if len(shards) != rs.TotalShards() {
+        return reedSolomonDebug.Error(errors.New("Wrong number of shards."))
+    }
+    shardSize := len(shards[0])
+    for _, shard := range shards {
+        if len(shard) != shardSize {
+            return reedSolomonDebug.Error(errors.New("Shards differ in size."))
+        }
+    }
+    for p := rs.dataShards; p < rs.TotalShards(); p++ {
+        for i := range shards[p] {
+            shards[p][i] = 0
+        }
+        for c := 0; c < rs.dataShards; c++ {
+            gfMulAdd(shards[p], shards[c], rs.matrix[p][c])
+        }
+    }
+    return nil
+}
+
+/*
+   Rebuild the missing shards, which are nil, in place.
+   Needs at least dataShards shards of the same size.
+*/
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+    if len(shards) != rs.TotalShards() {
+        return reedSolomonDebug.Error(errors.New("Wrong number of shards."))
+    }
+    present := make([]int, 0, rs.dataShards)
+    shardSize := -1
+    for i, shard := range shards {
+        if shard == nil {
+            continue
+        }
+        if shardSize == -1 {
+            shardSize = len(shard)
+        } else if len(shard) != shardSize {
+            return reedSolomonDebug.Error(errors.New("Shards differ in size."))
+        }
+        if len(present) < rs.dataShards {
+            present = append(present, i)
+        }
+    }
+    if len(present) < rs.dataShards {
+        return reedSolomonDebug.Error(errors.New("Too few shards to reconstruct."))
+    }
+    sub := newGFMatrix(rs.dataShards, rs.dataShards)
+    for r, i := range present {
+        copy(sub[r], rs.matrix[i])
+    }
+    decode, err := sub.invert()
+    if err != nil {
+        return reedSolomonDebug.Error(err)
+    }
+    for d := 0; d < rs.dataShards; d++ {
+        if shards[d] != nil {
+            continue
+        }
+        shard := make([]byte, shardSize)
+        for r, i := range present {
+            gfMulAdd(shard, shards[i], decode[d][r])
+        }
+        shards[d] = shard
+    }
+    for p := rs.dataShards; p < rs.TotalShards(); p++ {
+        if shards[p] != nil {
+            continue
+        }
+        shard := make([]byte, shardSize)
+        for c := 0; c < rs.dataShards; c++ {
+            gfMulAdd(shard, shards[c], rs.matrix[p][c])
+        }
+        shards[p] = shard
+    }
+    return nil
+}
+
+// Concatenate the data shards and cut the padding off.
+func (rs *ReedSolomon) Join(shards [][]byte, size int) ([]byte, error) {
+    data := make([]byte, 0, size)
+    for i := 0; i < rs.dataShards && len(data) < size; i++ {
+        if shards[i] == nil {
+            return nil, reedSolomonDebug.Error(errors.New("Missing data shard."))
+        }
+        data = append(data, shards[i]...)
+    }
+    if len(data) < size {
+        return nil, reedSolomonDebug.Error(errors.New("Shards are too short."))
+    }
+    return data[:size], nil
+}
@@ -0,0 +1,40 @@
+package utility
+
+import (
+    "bytes"
+    . "launchpad.net/gocheck"
+    "math/rand"
+)
+
+func (s *S) TestReedSolomon(c *C) {
+    rs, err := NewReedSolomon(4, 2)
+    c.Assert(err, IsNil)
+    data := make([]byte, 1001)
+    rand.Read(data)
+    shards := rs.Split(data)
+    c.Assert(len(shards), Equals, 6)
+    c.Assert(rs.Encode(shards), IsNil)
+    original := make([][]byte, len(shards))
+    for i := range shards {
+        original[i] = append([]byte(nil), shards[i]...)
+    }
+    // Any two shards may go missing.
+    for i := 0; i < 6; i++ {
+        for j := i + 1; j < 6; j++ {
+            damaged := make([][]byte, len(original))
+            copy(damaged, original)
+            damaged[i], damaged[j] = nil, nil
+            c.Assert(rs.Reconstruct(damaged), IsNil)
+            for k := range damaged {
+                c.Assert(bytes.Equal(damaged[k], original[k]), Equals, true)
+            }
+            joined, err := rs.Join(damaged, len(data))
+            c.Assert(err, IsNil)
+            c.Assert(joined, DeepEquals, data)
+        }
+    }
+    damaged := [][]byte{nil, nil, nil, original[3], original[4], original[5]}
+    c.Assert(rs.Reconstruct(damaged), ErrorMatches, "Too few shards.*")
+    _, err = NewReedSolomon(0, 2)
+    c.Assert(err, NotNil)
+}